@@ -1,6 +1,10 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"os"
 	"time"
@@ -20,21 +24,113 @@ func getJWTSecret() []byte {
 	return []byte(secret)
 }
 
-// generateJWT creates a signed JWT token with the user's ID.
-func generateJWT(userID int64) (string, error) {
+// AccessTokenTTL is how long an access token is valid; clients renew it with their refresh token.
+const AccessTokenTTL = 15 * time.Minute
+
+// RefreshTokenTTL is how long a session stays valid without being refreshed.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// StreamTicketTTL is how long a ticket from POST /api/auth/stream-ticket can open an event stream.
+const StreamTicketTTL = 30 * time.Second
+
+// VerificationTokenTTL is how long an email verification link stays valid.
+const VerificationTokenTTL = 48 * time.Hour
+
+// PasswordResetIPLimit is how many password resets one client IP may request per PasswordResetIPWindow.
+const PasswordResetIPLimit = 10
+
+// PasswordResetIPWindow is the window over which PasswordResetIPLimit applies.
+const PasswordResetIPWindow = time.Hour
+
+// MinPasswordLength is the minimum length of a password.
+const MinPasswordLength = 6
+
+// generateJWT creates a signed, short-lived access token with the user's ID and session ID.
+func generateJWT(userID, sessionID int64) (string, error) {
 	now := time.Now()
 	claims := jwt.MapClaims{
 		"user_id": userID,
+		"sid":     sessionID,
 		"iat":     now.Unix(),
-		"exp":     now.Add(24 * time.Hour).Unix(),
+		"exp":     now.Add(AccessTokenTTL).Unix(),
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(getJWTSecret())
 }
 
-// validateJWT parses and validates a JWT token string and returns the user ID.
-func validateJWT(tokenString string) (int64, error) {
+// validateJWT parses and validates a JWT token string and returns the user ID and session ID.
+// It does not check that the session is still active; jwtMiddleware does.
+func validateJWT(tokenString string) (int64, int64, error) {
+	claims, err := parseJWT(tokenString)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	userIDFloat, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, 0, ErrInvalidToken
+	}
+	sessionIDFloat, ok := claims["sid"].(float64)
+	if !ok {
+		return 0, 0, ErrInvalidToken
+	}
+
+	return int64(userIDFloat), int64(sessionIDFloat), nil
+}
+
+// accessTokenExpiry validates an access token and returns when it expires.
+func accessTokenExpiry(tokenString string) (time.Time, error) {
+	claims, err := parseJWT(tokenString)
+	if err != nil {
+		return time.Time{}, err
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return time.Time{}, ErrInvalidToken
+	}
+	return exp.Time, nil
+}
+
+// generateVerificationToken creates the signed token of an email verification link, proving that
+// its holder received mail at the user's email. It has no sid, so it is not an access token.
+func generateVerificationToken(userID int64, email string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"purpose": "verify_email",
+		"user_id": userID,
+		"email":   email,
+		"iat":     now.Unix(),
+		"exp":     now.Add(VerificationTokenTTL).Unix(),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(getJWTSecret())
+}
+
+// validateVerificationToken parses a token made by generateVerificationToken and returns its user
+// ID and email.
+func validateVerificationToken(tokenString string) (int64, string, error) {
+	claims, err := parseJWT(tokenString)
+	if err != nil {
+		return 0, "", err
+	}
+	if purpose, _ := claims["purpose"].(string); purpose != "verify_email" {
+		return 0, "", ErrInvalidToken
+	}
+	userIDFloat, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, "", ErrInvalidToken
+	}
+	email, ok := claims["email"].(string)
+	if !ok {
+		return 0, "", ErrInvalidToken
+	}
+	return int64(userIDFloat), email, nil
+}
+
+// parseJWT checks the signature and expiry of a token signed with the JWT secret and returns its claims.
+func parseJWT(tokenString string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, ErrInvalidToken
@@ -42,18 +138,28 @@ func validateJWT(tokenString string) (int64, error) {
 		return getJWTSecret(), nil
 	})
 	if err != nil {
-		return 0, ErrInvalidToken
+		return nil, ErrInvalidToken
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok || !token.Valid {
-		return 0, ErrInvalidToken
+		return nil, ErrInvalidToken
 	}
+	return claims, nil
+}
 
-	userIDFloat, ok := claims["user_id"].(float64)
-	if !ok {
-		return 0, ErrInvalidToken
+// generateOpaqueToken returns a random URL-safe token, such as a refresh or password reset token.
+// Only its hashToken is stored.
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
 
-	return int64(userIDFloat), nil
+// hashToken returns the hex SHA-256 of an opaque token, the form it is stored and looked up in.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -2,8 +2,15 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
@@ -11,6 +18,42 @@ import (
 const MaxTitleLength = 255
 const MaxListNameLength = 50
 
+// MaxNotesLength is the maximum size in bytes of a todo's Markdown notes.
+const MaxNotesLength = 64 * 1024
+
+// DefaultTimezone is assigned to users who have not chosen a timezone.
+const DefaultTimezone = "UTC"
+
+// dbTimeLayout matches SQLite's datetime('now') so stored timestamps compare lexically.
+const dbTimeLayout = "2006-01-02 15:04:05"
+
+// Due filters accepted by GetTodosDue.
+const (
+	DueOverdue  = "overdue"
+	DueToday    = "today"
+	DueUpcoming = "upcoming"
+)
+
+// PriorityLevels are the valid todo priorities, indexed by their stored rank (0 = none).
+var PriorityLevels = []string{"none", "low", "medium", "high", "urgent"}
+
+// TodoSort names an ordering accepted by the todo listing functions.
+type TodoSort string
+
+// Todo orderings. SortPosition (the manual order, newest first until reordered) is the default.
+const (
+	SortPosition TodoSort = "position"
+	SortCreated  TodoSort = "created"
+	SortPriority TodoSort = "priority"
+	SortDue      TodoSort = "due"
+)
+
+// todoColumns is the column list for every query that returns a Todo (aliased as t).
+// Notes are excluded; they are only loaded by GetTodoByID. Checklist progress is computed.
+const todoColumns = "t.id, t.title, t.completed, t.created_at, t.user_id, t.due_at, t.start_at, t.priority, t.recurrence, t.version, t.updated_at, " +
+	"(SELECT COUNT(*) FROM todo_items i WHERE i.todo_id = t.id AND i.completed = 1), " +
+	"(SELECT COUNT(*) FROM todo_items i WHERE i.todo_id = t.id)"
+
 // DefaultListColor is used when migrating tags or when color is invalid.
 const DefaultListColor = "#BBDEFB"
 
@@ -32,6 +75,18 @@ var (
 	ErrDuplicateList   = errors.New("list with this name already exists")
 	ErrListNotFound    = errors.New("list not found")
 	ErrInvalidColor    = errors.New("color must be a valid pastel hex from the palette")
+	ErrStartAfterDue   = errors.New("start date must not be after due date")
+	ErrInvalidTimezone = errors.New("invalid timezone")
+	ErrInvalidDue      = errors.New("due filter must be overdue, today or upcoming")
+	ErrInvalidDate     = errors.New("date must be RFC 3339 or YYYY-MM-DD")
+	ErrInvalidPriority = errors.New("priority must be none, low, medium, high or urgent")
+	ErrInvalidSort     = errors.New("sort must be position, created, priority or due")
+	ErrNotesTooLong    = errors.New("notes exceed maximum length")
+	ErrItemNotFound    = errors.New("checklist item not found")
+	ErrInvalidOrder    = errors.New("order must list every item exactly once")
+	ErrInvalidPosition = errors.New("after_id must reference another todo in the same view")
+	ErrEmptyQuery      = errors.New("search query cannot be empty")
+	ErrVersionMismatch = errors.New("version does not match")
 )
 
 // InitDB opens (or creates) a SQLite database at dbPath, enables WAL mode,
@@ -61,7 +116,8 @@ func InitDB(dbPath string) (*sql.DB, error) {
 			id            INTEGER PRIMARY KEY AUTOINCREMENT,
 			email         TEXT    NOT NULL UNIQUE,
 			password_hash TEXT    NOT NULL,
-			created_at    TEXT    NOT NULL DEFAULT (datetime('now'))
+			created_at    TEXT    NOT NULL DEFAULT (datetime('now')),
+			timezone      TEXT    NOT NULL DEFAULT '` + DefaultTimezone + `'
 		);
 	`
 	if _, err := db.Exec(createUsersTable); err != nil {
@@ -69,6 +125,12 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Migration: add timezone, email_verified_at and verification_sent_at columns for existing databases
+	db.Exec(`ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT '` + DefaultTimezone + `'`)
+	db.Exec(`ALTER TABLE users ADD COLUMN email_verified_at TEXT NULL`)
+	db.Exec(`ALTER TABLE users ADD COLUMN verification_sent_at TEXT NULL`)
+	// Ignore errors — columns may already exist
+
 	createTodosTable := `
 		CREATE TABLE IF NOT EXISTS todos (
 			id         INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -76,7 +138,15 @@ func InitDB(dbPath string) (*sql.DB, error) {
 			completed  BOOLEAN NOT NULL DEFAULT 0,
 			created_at TEXT    NOT NULL DEFAULT (datetime('now')),
 			user_id    INTEGER NOT NULL REFERENCES users(id),
-			deleted_at TEXT    NULL
+			deleted_at TEXT    NULL,
+			due_at     TEXT    NULL,
+			start_at   TEXT    NULL,
+			priority   INTEGER NOT NULL DEFAULT 0,
+			notes      TEXT    NOT NULL DEFAULT '',
+			recurrence TEXT    NULL,
+			position   TEXT    NULL,
+			version    INTEGER NOT NULL DEFAULT 1,
+			updated_at TEXT    NULL
 		);
 	`
 	if _, err := db.Exec(createTodosTable); err != nil {
@@ -84,9 +154,18 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, err
 	}
 
-	// Migration: add deleted_at column for existing databases
+	// Migration: add deleted_at, due_at, start_at, priority, notes, recurrence, position, version and updated_at columns for existing databases
 	db.Exec(`ALTER TABLE todos ADD COLUMN deleted_at TEXT NULL`)
-	// Ignore error — column may already exist
+	db.Exec(`ALTER TABLE todos ADD COLUMN due_at TEXT NULL`)
+	db.Exec(`ALTER TABLE todos ADD COLUMN start_at TEXT NULL`)
+	db.Exec(`ALTER TABLE todos ADD COLUMN priority INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE todos ADD COLUMN notes TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE todos ADD COLUMN recurrence TEXT NULL`)
+	db.Exec(`ALTER TABLE todos ADD COLUMN position TEXT NULL`)
+	db.Exec(`ALTER TABLE todos ADD COLUMN version INTEGER NOT NULL DEFAULT 1`)
+	db.Exec(`ALTER TABLE todos ADD COLUMN updated_at TEXT NULL`)
+	// Ignore errors — columns may already exist
+	db.Exec(`UPDATE todos SET updated_at = created_at WHERE updated_at IS NULL`)
 
 	createTagsTable := `
 		CREATE TABLE IF NOT EXISTS tags (
@@ -122,6 +201,10 @@ func InitDB(dbPath string) (*sql.DB, error) {
 			color      TEXT    NOT NULL DEFAULT '` + DefaultListColor + `',
 			created_at TEXT    NOT NULL DEFAULT (datetime('now')),
 			user_id    INTEGER NOT NULL REFERENCES users(id),
+			position   INTEGER NOT NULL DEFAULT 0,
+			pinned     BOOLEAN NOT NULL DEFAULT 0,
+			version    INTEGER NOT NULL DEFAULT 1,
+			updated_at TEXT    NULL,
 			UNIQUE(user_id, name)
 		);
 	`
@@ -130,10 +213,20 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Migration: add position, pinned, version and updated_at columns for existing databases.
+	// Existing lists share position 0 and keep their newest-first order until reordered.
+	db.Exec(`ALTER TABLE lists ADD COLUMN position INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE lists ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE lists ADD COLUMN version INTEGER NOT NULL DEFAULT 1`)
+	db.Exec(`ALTER TABLE lists ADD COLUMN updated_at TEXT NULL`)
+	// Ignore errors — columns may already exist
+	db.Exec(`UPDATE lists SET updated_at = created_at WHERE updated_at IS NULL`)
+
 	createTodoListsTable := `
 		CREATE TABLE IF NOT EXISTS todo_lists (
-			todo_id INTEGER NOT NULL REFERENCES todos(id),
-			list_id INTEGER NOT NULL REFERENCES lists(id),
+			todo_id  INTEGER NOT NULL REFERENCES todos(id),
+			list_id  INTEGER NOT NULL REFERENCES lists(id),
+			position TEXT    NULL,
 			PRIMARY KEY (todo_id, list_id)
 		);
 	`
@@ -142,15 +235,295 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Migration: add position column for existing databases
+	db.Exec(`ALTER TABLE todo_lists ADD COLUMN position TEXT NULL`)
+	// Ignore error — column may already exist
+
+	createPositionIndexes := `
+		CREATE INDEX IF NOT EXISTS idx_todos_user_position ON todos(user_id, position);
+		CREATE INDEX IF NOT EXISTS idx_todo_lists_list_position ON todo_lists(list_id, position);
+	`
+	if _, err := db.Exec(createPositionIndexes); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	createTodoItemsTable := `
+		CREATE TABLE IF NOT EXISTS todo_items (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			todo_id    INTEGER NOT NULL REFERENCES todos(id),
+			title      TEXT    NOT NULL,
+			completed  BOOLEAN NOT NULL DEFAULT 0,
+			position   INTEGER NOT NULL,
+			created_at TEXT    NOT NULL DEFAULT (datetime('now'))
+		);
+		CREATE INDEX IF NOT EXISTS idx_todo_items_todo ON todo_items(todo_id, position);
+	`
+	if _, err := db.Exec(createTodoItemsTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	createSmartListsTable := `
+		CREATE TABLE IF NOT EXISTS smart_lists (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			name       TEXT    NOT NULL,
+			filter     TEXT    NOT NULL DEFAULT '',
+			created_at TEXT    NOT NULL DEFAULT (datetime('now')),
+			user_id    INTEGER NOT NULL REFERENCES users(id),
+			UNIQUE(user_id, name)
+		);
+	`
+	if _, err := db.Exec(createSmartListsTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Saved responses of POST requests sent with an Idempotency-Key; status 0 marks a request in progress.
+	createIdempotencyKeysTable := `
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			user_id      INTEGER NOT NULL REFERENCES users(id),
+			key          TEXT    NOT NULL,
+			request_hash TEXT    NOT NULL,
+			status       INTEGER NOT NULL DEFAULT 0,
+			headers      TEXT    NOT NULL DEFAULT '{}',
+			body         BLOB    NULL,
+			created_at   TEXT    NOT NULL DEFAULT (datetime('now')),
+			PRIMARY KEY (user_id, key)
+		);
+		CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at);
+	`
+	if _, err := db.Exec(createIdempotencyKeysTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Login sessions. Each holds the hash of its current refresh token; the tokens it rotated out
+	// are kept in session_tokens so that replaying one is detected as reuse.
+	createSessionsTable := `
+		CREATE TABLE IF NOT EXISTS sessions (
+			id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id            INTEGER NOT NULL REFERENCES users(id),
+			refresh_token_hash TEXT    NOT NULL UNIQUE,
+			created_at         TEXT    NOT NULL,
+			last_used_at       TEXT    NOT NULL,
+			expires_at         TEXT    NOT NULL,
+			revoked_at         TEXT    NULL,
+			user_agent         TEXT    NOT NULL DEFAULT '',
+			ip                 TEXT    NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+		CREATE TABLE IF NOT EXISTS session_tokens (
+			token_hash TEXT    PRIMARY KEY,
+			session_id INTEGER NOT NULL REFERENCES sessions(id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_session_tokens_session ON session_tokens(session_id);
+	`
+	if _, err := db.Exec(createSessionsTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Pending password resets; a token is single-use (used_at) and expires after PasswordResetTTL.
+	createPasswordResetsTable := `
+		CREATE TABLE IF NOT EXISTS password_resets (
+			token_hash TEXT    PRIMARY KEY,
+			user_id    INTEGER NOT NULL REFERENCES users(id),
+			created_at TEXT    NOT NULL,
+			expires_at TEXT    NOT NULL,
+			used_at    TEXT    NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_password_resets_user ON password_resets(user_id);
+	`
+	if _, err := db.Exec(createPasswordResetsTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Tickets opening an event stream in place of an access token; single-use, expire after StreamTicketTTL.
+	createStreamTicketsTable := `
+		CREATE TABLE IF NOT EXISTS stream_tickets (
+			ticket_hash TEXT    PRIMARY KEY,
+			user_id     INTEGER NOT NULL REFERENCES users(id),
+			session_id  INTEGER NOT NULL REFERENCES sessions(id),
+			expires_at  TEXT    NOT NULL
+		);
+	`
+	if _, err := db.Exec(createStreamTicketsTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Change log for delta sync: the latest change of each todo, list and todo_lists row, with a
+	// tombstone (deleted = 1) once it is hard-deleted. Every change takes a new, higher seq.
+	createSyncChangesTable := `
+		CREATE TABLE IF NOT EXISTS sync_changes (
+			seq       INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id   INTEGER NOT NULL REFERENCES users(id),
+			entity    TEXT    NOT NULL,
+			entity_id INTEGER NOT NULL,
+			list_id   INTEGER NOT NULL DEFAULT 0,
+			deleted   BOOLEAN NOT NULL DEFAULT 0,
+			UNIQUE(entity, entity_id, list_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_sync_changes_user_seq ON sync_changes(user_id, seq);
+	`
+	if _, err := db.Exec(createSyncChangesTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	// Migrate tags → lists and todo_tags → todo_lists (idempotent)
 	if err := migrateTagsToLists(db); err != nil {
 		db.Close()
 		return nil, err
 	}
 
+	// Assign manual-order ranks to rows created before positions existed (idempotent)
+	if err := backfillPositions(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := initSearchIndex(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := initVersionTriggers(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := initSyncTriggers(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
 
+// initVersionTriggers creates the triggers bumping the version of a todo or list whenever its
+// representation changes, which is what ETags and If-Match preconditions compare. A todo's version
+// also covers its list memberships and checklist progress. Manual ordering of todos is not part of
+// the todo itself and leaves the version alone.
+func initVersionTriggers(db *sql.DB) error {
+	createVersionTriggers := `
+		CREATE TRIGGER IF NOT EXISTS todos_version AFTER UPDATE OF title, completed, deleted_at, due_at, start_at, priority, notes, recurrence ON todos BEGIN
+			UPDATE todos SET version = version + 1 WHERE id = new.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS todo_lists_version_insert AFTER INSERT ON todo_lists BEGIN
+			UPDATE todos SET version = version + 1 WHERE id = new.todo_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS todo_lists_version_delete AFTER DELETE ON todo_lists BEGIN
+			UPDATE todos SET version = version + 1 WHERE id = old.todo_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS todo_items_version_insert AFTER INSERT ON todo_items BEGIN
+			UPDATE todos SET version = version + 1 WHERE id = new.todo_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS todo_items_version_update AFTER UPDATE OF completed ON todo_items BEGIN
+			UPDATE todos SET version = version + 1 WHERE id = new.todo_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS todo_items_version_delete AFTER DELETE ON todo_items BEGIN
+			UPDATE todos SET version = version + 1 WHERE id = old.todo_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS lists_version AFTER UPDATE OF name, color, position, pinned ON lists BEGIN
+			UPDATE lists SET version = version + 1 WHERE id = new.id;
+		END;
+	`
+	_, err := db.Exec(createVersionTriggers)
+	return err
+}
+
+// initSyncTriggers creates the triggers stamping updated_at on todos and lists and recording every
+// insert, update and delete of todos, lists and todo_lists rows in sync_changes. A todo_lists row is
+// attributed to its todo's owner, or to its list's owner once the todo is gone.
+func initSyncTriggers(db *sql.DB) error {
+	createSyncTriggers := `
+		CREATE TRIGGER IF NOT EXISTS todos_sync_insert AFTER INSERT ON todos BEGIN
+			UPDATE todos SET updated_at = new.created_at WHERE id = new.id AND updated_at IS NULL;
+			INSERT OR REPLACE INTO sync_changes (user_id, entity, entity_id) VALUES (new.user_id, 'todo', new.id);
+		END;
+		CREATE TRIGGER IF NOT EXISTS todos_sync_update AFTER UPDATE ON todos BEGIN
+			UPDATE todos SET updated_at = datetime('now') WHERE id = new.id;
+			INSERT OR REPLACE INTO sync_changes (user_id, entity, entity_id) VALUES (new.user_id, 'todo', new.id);
+		END;
+		CREATE TRIGGER IF NOT EXISTS todos_sync_delete AFTER DELETE ON todos BEGIN
+			INSERT OR REPLACE INTO sync_changes (user_id, entity, entity_id, deleted) VALUES (old.user_id, 'todo', old.id, 1);
+		END;
+		CREATE TRIGGER IF NOT EXISTS lists_sync_insert AFTER INSERT ON lists BEGIN
+			UPDATE lists SET updated_at = new.created_at WHERE id = new.id AND updated_at IS NULL;
+			INSERT OR REPLACE INTO sync_changes (user_id, entity, entity_id) VALUES (new.user_id, 'list', new.id);
+		END;
+		CREATE TRIGGER IF NOT EXISTS lists_sync_update AFTER UPDATE ON lists BEGIN
+			UPDATE lists SET updated_at = datetime('now') WHERE id = new.id;
+			INSERT OR REPLACE INTO sync_changes (user_id, entity, entity_id) VALUES (new.user_id, 'list', new.id);
+		END;
+		CREATE TRIGGER IF NOT EXISTS lists_sync_delete AFTER DELETE ON lists BEGIN
+			INSERT OR REPLACE INTO sync_changes (user_id, entity, entity_id, deleted) VALUES (old.user_id, 'list', old.id, 1);
+		END;
+		CREATE TRIGGER IF NOT EXISTS todo_lists_sync_insert AFTER INSERT ON todo_lists BEGIN
+			INSERT OR REPLACE INTO sync_changes (user_id, entity, entity_id, list_id)
+				SELECT user_id, 'todo_list', new.todo_id, new.list_id FROM todos WHERE id = new.todo_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS todo_lists_sync_delete AFTER DELETE ON todo_lists BEGIN
+			INSERT OR REPLACE INTO sync_changes (user_id, entity, entity_id, list_id, deleted)
+				SELECT user_id, 'todo_list', old.todo_id, old.list_id, 1 FROM (
+					SELECT user_id FROM todos WHERE id = old.todo_id
+					UNION ALL
+					SELECT user_id FROM lists WHERE id = old.list_id
+					LIMIT 1
+				);
+		END;
+	`
+	_, err := db.Exec(createSyncTriggers)
+	return err
+}
+
+// initSearchIndex creates the FTS5 index over todo titles and notes and the triggers keeping it in
+// sync with the todos table. The index stores no text of its own (content='todos'); it is rebuilt
+// from existing rows only when first created.
+func initSearchIndex(db *sql.DB) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'todos_fts')").Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	createSearchIndex := `
+		CREATE VIRTUAL TABLE IF NOT EXISTS todos_fts USING fts5(
+			title, notes,
+			content='todos', content_rowid='id',
+			tokenize='unicode61 remove_diacritics 2'
+		);
+		CREATE TRIGGER IF NOT EXISTS todos_fts_insert AFTER INSERT ON todos BEGIN
+			INSERT INTO todos_fts(rowid, title, notes) VALUES (new.id, new.title, new.notes);
+		END;
+		CREATE TRIGGER IF NOT EXISTS todos_fts_delete AFTER DELETE ON todos BEGIN
+			INSERT INTO todos_fts(todos_fts, rowid, title, notes) VALUES ('delete', old.id, old.title, old.notes);
+		END;
+		CREATE TRIGGER IF NOT EXISTS todos_fts_update AFTER UPDATE OF title, notes ON todos BEGIN
+			INSERT INTO todos_fts(todos_fts, rowid, title, notes) VALUES ('delete', old.id, old.title, old.notes);
+			INSERT INTO todos_fts(rowid, title, notes) VALUES (new.id, new.title, new.notes);
+		END;
+	`
+	if _, err := db.Exec(createSearchIndex); err != nil {
+		return err
+	}
+
+	// Titles saved before control characters were stripped may contain the snippet delimiters;
+	// the update trigger reindexes the rows changed here.
+	_, err = db.Exec("UPDATE todos SET title = replace(replace(title, char(2), ''), char(3), '') WHERE instr(title, char(2)) > 0 OR instr(title, char(3)) > 0")
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		_, err = db.Exec("INSERT INTO todos_fts(todos_fts) VALUES ('rebuild')")
+	}
+	return err
+}
+
 // migrateTagsToLists copies data from tags/todo_tags to lists/todo_lists.
 // Idempotent: safe to run multiple times; uses INSERT OR IGNORE.
 func migrateTagsToLists(db *sql.DB) error {
@@ -238,6 +611,76 @@ func migrateTagsToLists(db *sql.DB) error {
 	return nil
 }
 
+// backfillPositions gives todos and todo_lists rows without a rank one that preserves the
+// previous newest-first order, appended after any already-ranked rows of the same user or list.
+// Idempotent: only rows with a NULL position are touched.
+func backfillPositions(db *sql.DB) error {
+	type unranked struct {
+		group int64
+		key   []any
+	}
+	backfill := func(selectQuery, lastQuery, updateQuery string, keyCols int) error {
+		// Read rows into memory first (avoids holding rows open while Exec with MaxOpenConns=1)
+		rows, err := db.Query(selectQuery)
+		if err != nil {
+			return err
+		}
+		var pending []unranked
+		for rows.Next() {
+			var u unranked
+			dest := []any{&u.group}
+			ids := make([]int64, keyCols)
+			for i := range ids {
+				dest = append(dest, &ids[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return err
+			}
+			for _, id := range ids {
+				u.key = append(u.key, id)
+			}
+			pending = append(pending, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		last := make(map[int64]string)
+		for _, u := range pending {
+			prev, ok := last[u.group]
+			if !ok {
+				var max sql.NullString
+				if err := db.QueryRow(lastQuery, u.group).Scan(&max); err != nil {
+					return err
+				}
+				prev = max.String
+			}
+			rank := rankBetween(prev, "")
+			if _, err := db.Exec(updateQuery, append([]any{rank}, u.key...)...); err != nil {
+				return err
+			}
+			last[u.group] = rank
+		}
+		return nil
+	}
+
+	err := backfill(
+		"SELECT user_id, id FROM todos WHERE position IS NULL ORDER BY user_id, created_at DESC, id DESC",
+		"SELECT MAX(position) FROM todos WHERE user_id = ?",
+		"UPDATE todos SET position = ? WHERE id = ?", 1)
+	if err != nil {
+		return err
+	}
+	return backfill(`
+		SELECT tl.list_id, tl.todo_id, tl.list_id FROM todo_lists tl
+		INNER JOIN todos t ON t.id = tl.todo_id
+		WHERE tl.position IS NULL ORDER BY tl.list_id, t.created_at DESC, t.id DESC`,
+		"SELECT MAX(position) FROM todo_lists WHERE list_id = ?",
+		"UPDATE todo_lists SET position = ? WHERE todo_id = ? AND list_id = ?", 2)
+}
+
 // CreateUser inserts a new user with the given email and password hash.
 // Returns ErrDuplicateEmail if the email is already registered.
 func CreateUser(db *sql.DB, email, passwordHash string) (User, error) {
@@ -255,8 +698,8 @@ func CreateUser(db *sql.DB, email, passwordHash string) (User, error) {
 	}
 
 	var user User
-	err = db.QueryRow("SELECT id, email, password_hash, created_at FROM users WHERE id = ?", id).
-		Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt)
+	err = db.QueryRow("SELECT id, email, password_hash, created_at, timezone, email_verified_at FROM users WHERE id = ?", id).
+		Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt, &user.Timezone, &user.EmailVerifiedAt)
 	if err != nil {
 		return User{}, err
 	}
@@ -268,8 +711,8 @@ func CreateUser(db *sql.DB, email, passwordHash string) (User, error) {
 // Returns ErrUserNotFound if no user with that email exists.
 func GetUserByEmail(db *sql.DB, email string) (User, error) {
 	var user User
-	err := db.QueryRow("SELECT id, email, password_hash, created_at FROM users WHERE email = ?", email).
-		Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt)
+	err := db.QueryRow("SELECT id, email, password_hash, created_at, timezone, email_verified_at FROM users WHERE email = ?", email).
+		Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt, &user.Timezone, &user.EmailVerifiedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, ErrUserNotFound
@@ -279,521 +722,3634 @@ func GetUserByEmail(db *sql.DB, email string) (User, error) {
 	return user, nil
 }
 
-// GetAllTodos returns all non-deleted todos for a given user ordered by created_at DESC.
-func GetAllTodos(db *sql.DB, userID int64) ([]Todo, error) {
-	rows, err := db.Query("SELECT id, title, completed, created_at, user_id FROM todos WHERE user_id = ? AND deleted_at IS NULL ORDER BY created_at DESC", userID)
+// GetUserByID retrieves a user by ID.
+// Returns ErrUserNotFound if no user with that ID exists.
+func GetUserByID(db *sql.DB, id int64) (User, error) {
+	var user User
+	err := db.QueryRow("SELECT id, email, password_hash, created_at, timezone, email_verified_at FROM users WHERE id = ?", id).
+		Scan(&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt, &user.Timezone, &user.EmailVerifiedAt)
 	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	todos := []Todo{}
-	for rows.Next() {
-		var t Todo
-		if err := rows.Scan(&t.ID, &t.Title, &t.Completed, &t.CreatedAt, &t.UserID); err != nil {
-			return nil, err
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, ErrUserNotFound
 		}
-		todos = append(todos, t)
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
+		return User{}, err
 	}
-
-	return todos, nil
+	return user, nil
 }
 
-// CreateTodo inserts a new todo with the given title for the given user and returns the created Todo.
-// Returns ErrEmptyTitle if the title is empty or whitespace-only.
-func CreateTodo(db *sql.DB, title string, userID int64) (Todo, error) {
-	trimmed := strings.TrimSpace(title)
-	if trimmed == "" {
-		return Todo{}, ErrEmptyTitle
+// UpdateUserTimezone sets the IANA timezone used to interpret the user's dates.
+// Returns ErrInvalidTimezone if the name is not a known location and ErrUserNotFound if the user does not exist.
+func UpdateUserTimezone(db *sql.DB, userID int64, timezone string) error {
+	name := strings.TrimSpace(timezone)
+	if name == "" {
+		return ErrInvalidTimezone
 	}
-	if len(trimmed) > MaxTitleLength {
-		return Todo{}, ErrTitleTooLong
+	if _, err := time.LoadLocation(name); err != nil {
+		return ErrInvalidTimezone
 	}
 
-	result, err := db.Exec("INSERT INTO todos (title, user_id) VALUES (?, ?)", trimmed, userID)
+	result, err := db.Exec("UPDATE users SET timezone = ? WHERE id = ?", name, userID)
 	if err != nil {
-		return Todo{}, err
+		return err
 	}
 
-	id, err := result.LastInsertId()
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return Todo{}, err
+		return err
 	}
 
-	var todo Todo
-	err = db.QueryRow("SELECT id, title, completed, created_at, user_id FROM todos WHERE id = ?", id).
-		Scan(&todo.ID, &todo.Title, &todo.Completed, &todo.CreatedAt, &todo.UserID)
-	if err != nil {
-		return Todo{}, err
+	if rowsAffected == 0 {
+		return ErrUserNotFound
 	}
 
-	return todo, nil
+	return nil
 }
 
-// UpdateTodoStatus updates the completed status of a todo by ID, scoped to the given user.
-// Returns ErrNotFound if the ID does not exist, does not belong to the user, or is deleted.
-func UpdateTodoStatus(db *sql.DB, id int64, completed bool, userID int64) error {
-	result, err := db.Exec("UPDATE todos SET completed = ? WHERE id = ? AND user_id = ? AND deleted_at IS NULL", completed, id, userID)
+// VerificationResendInterval is the minimum time between two verification emails to the same user.
+const VerificationResendInterval = time.Minute
+
+var (
+	ErrEmailAlreadyVerified = errors.New("email already verified")
+	ErrVerificationTooSoon  = errors.New("a verification email was sent too recently")
+)
+
+// ReserveVerificationEmail records that a verification email is being sent to the user at now.
+// Returns ErrEmailAlreadyVerified if there is nothing to verify, ErrVerificationTooSoon if the
+// previous one was sent less than VerificationResendInterval ago and ErrUserNotFound if the user
+// does not exist.
+func ReserveVerificationEmail(db *sql.DB, userID int64, now time.Time) error {
+	result, err := db.Exec(`
+		UPDATE users SET verification_sent_at = ?
+		WHERE id = ? AND email_verified_at IS NULL AND (verification_sent_at IS NULL OR verification_sent_at <= ?)`,
+		now.UTC().Format(dbTimeLayout), userID, now.Add(-VerificationResendInterval).UTC().Format(dbTimeLayout))
 	if err != nil {
 		return err
 	}
-
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
-
-	if rowsAffected == 0 {
-		return ErrNotFound
+	if rowsAffected > 0 {
+		return nil
 	}
 
-	return nil
-}
-
-// UpdateTodoTitle updates only the title of a todo by ID, scoped to the given user.
-// Returns ErrEmptyTitle if the title is empty, ErrTitleTooLong if it exceeds max length,
-// and ErrNotFound if the todo does not exist, does not belong to the user, or is deleted.
-func UpdateTodoTitle(db *sql.DB, id int64, title string, userID int64) error {
-	trimmed := strings.TrimSpace(title)
-	if trimmed == "" {
-		return ErrEmptyTitle
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		return err
 	}
-	if len(trimmed) > MaxTitleLength {
-		return ErrTitleTooLong
+	if user.EmailVerifiedAt != nil {
+		return ErrEmailAlreadyVerified
 	}
+	return ErrVerificationTooSoon
+}
 
-	result, err := db.Exec(
-		"UPDATE todos SET title = ? WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
-		trimmed, id, userID,
-	)
+// MarkEmailVerified records that the user owns email, keeping the first verification time if it
+// was already verified. Returns ErrUserNotFound if no user with that ID has that email (any more).
+func MarkEmailVerified(db *sql.DB, userID int64, email string, now time.Time) error {
+	result, err := db.Exec("UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ? AND email = ?",
+		now.UTC().Format(dbTimeLayout), userID, email)
 	if err != nil {
 		return err
 	}
-
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
-
 	if rowsAffected == 0 {
-		return ErrNotFound
+		return ErrUserNotFound
 	}
-
 	return nil
 }
 
-// DeleteTodo performs a soft delete by setting deleted_at to the current timestamp.
-// Returns ErrNotFound if the ID does not exist, does not belong to the user, or is already deleted.
-func DeleteTodo(db *sql.DB, id int64, userID int64) error {
-	result, err := db.Exec(
-		"UPDATE todos SET deleted_at = datetime('now') WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
-		id, userID,
-	)
+// GetUserLocation returns the time.Location for the user's timezone.
+// Falls back to UTC if the stored timezone can no longer be loaded.
+func GetUserLocation(db *sql.DB, userID int64) (*time.Location, error) {
+	user, err := GetUserByID(db, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	rowsAffected, err := result.RowsAffected()
+	loc, err := time.LoadLocation(user.Timezone)
 	if err != nil {
-		return err
+		return time.UTC, nil
 	}
+	return loc, nil
+}
 
-	if rowsAffected == 0 {
-		return ErrNotFound
-	}
+// --- Todo Functions ---
 
-	return nil
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
 }
 
-// --- List CRUD Functions ---
-
-// ListLists returns all lists for a given user ordered by created_at DESC.
-func ListLists(db *sql.DB, userID int64) ([]List, error) {
-	rows, err := db.Query("SELECT id, name, color, created_at, user_id FROM lists WHERE user_id = ? ORDER BY created_at DESC", userID)
+// scanTodo reads a row selected with todoColumns into a Todo.
+// Extra destinations receive any columns selected after todoColumns.
+func scanTodo(s rowScanner, extra ...any) (Todo, error) {
+	var t Todo
+	var priority int
+	dest := []any{&t.ID, &t.Title, &t.Completed, &t.CreatedAt, &t.UserID, &t.DueAt, &t.StartAt, &priority,
+		&t.Recurrence, &t.Version, &t.UpdatedAt, &t.Progress.Done, &t.Progress.Total}
+	err := s.Scan(append(dest, extra...)...)
 	if err != nil {
-		return nil, err
+		return Todo{}, err
 	}
-	defer rows.Close()
+	t.Priority = PriorityLevels[0]
+	if priority > 0 && priority < len(PriorityLevels) {
+		t.Priority = PriorityLevels[priority]
+	}
+	return t, nil
+}
 
-	lists := []List{}
+// scanTodos drains rows selected with todoColumns into a non-nil slice.
+func scanTodos(rows *sql.Rows) ([]Todo, error) {
+	todos := []Todo{}
 	for rows.Next() {
-		var l List
-		if err := rows.Scan(&l.ID, &l.Name, &l.Color, &l.CreatedAt, &l.UserID); err != nil {
+		t, err := scanTodo(rows)
+		if err != nil {
 			return nil, err
 		}
-		lists = append(lists, l)
+		todos = append(todos, t)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return lists, nil
+	return todos, nil
 }
 
-// GetListByID returns a list by ID, scoped to the given user.
-func GetListByID(db *sql.DB, listID int64, userID int64) (List, error) {
-	var l List
-	err := db.QueryRow("SELECT id, name, color, created_at, user_id FROM lists WHERE id = ? AND user_id = ?", listID, userID).
-		Scan(&l.ID, &l.Name, &l.Color, &l.CreatedAt, &l.UserID)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return List{}, ErrListNotFound
-		}
-		return List{}, err
+// rowQuerier is implemented by *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// getTodo returns a todo by ID without ownership checks; callers must scope by user beforehand.
+func getTodo(q rowQuerier, id int64) (Todo, error) {
+	return scanTodo(q.QueryRow("SELECT "+todoColumns+" FROM todos t WHERE t.id = ?", id))
+}
+
+// formatDBTime converts t to UTC in the storage layout; nil stays nil (SQL NULL).
+func formatDBTime(t *time.Time) *string {
+	if t == nil {
+		return nil
 	}
-	return l, nil
+	s := t.UTC().Format(dbTimeLayout)
+	return &s
 }
 
-// CreateList inserts a new list with the given name and color for the given user.
-// Returns ErrEmptyListName if the name is empty, ErrListNameTooLong if too long,
-// ErrDuplicateList if a list with the same name exists, ErrInvalidColor if color is not in the palette.
-func CreateList(db *sql.DB, name string, color string, userID int64) (List, error) {
-	trimmed := strings.TrimSpace(name)
-	if trimmed == "" {
-		return List{}, ErrEmptyListName
+// ParseTodoTime parses a due/start input. RFC 3339 values keep their offset; values without
+// an offset ("YYYY-MM-DDTHH:MM" or "YYYY-MM-DD") are interpreted in loc. A date-only value
+// means the end of that day when endOfDay is set (due dates) and its beginning otherwise.
+// Returns ErrInvalidDate if the value matches none of the layouts.
+func ParseTodoTime(value string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	v := strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
 	}
-	if len(trimmed) > MaxListNameLength {
-		return List{}, ErrListNameTooLong
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", dbTimeLayout} {
+		if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+			return t, nil
+		}
 	}
-
-	hexColor, err := validateColor(color)
+	t, err := time.ParseInLocation("2006-01-02", v, loc)
 	if err != nil {
-		return List{}, err
+		return time.Time{}, ErrInvalidDate
 	}
-
-	result, err := db.Exec("INSERT INTO lists (name, color, user_id) VALUES (?, ?, ?)", trimmed, hexColor, userID)
-	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			return List{}, ErrDuplicateList
-		}
-		return List{}, err
-	}
-
-	id, err := result.LastInsertId()
-	if err != nil {
-		return List{}, err
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
 	}
+	return t, nil
+}
 
-	var list List
-	err = db.QueryRow("SELECT id, name, color, created_at, user_id FROM lists WHERE id = ?", id).
-		Scan(&list.ID, &list.Name, &list.Color, &list.CreatedAt, &list.UserID)
-	if err != nil {
-		return List{}, err
+// validateSchedule returns ErrStartAfterDue if both dates are set and start is after due.
+func validateSchedule(dueAt, startAt *time.Time) error {
+	if dueAt != nil && startAt != nil && startAt.After(*dueAt) {
+		return ErrStartAfterDue
 	}
-
-	return list, nil
+	return nil
 }
 
-// validateColor returns the hex if it's in the pastel palette, or ErrInvalidColor.
-func validateColor(color string) (string, error) {
-	c := strings.TrimSpace(color)
-	if c == "" {
-		return DefaultListColor, nil
-	}
-	if len(c) == 6 && !strings.HasPrefix(c, "#") {
-		c = "#" + c
+// validatePriority returns the stored rank for a priority name; empty means "none".
+// Returns ErrInvalidPriority for unknown names.
+func validatePriority(priority string) (int, error) {
+	p := strings.ToLower(strings.TrimSpace(priority))
+	if p == "" {
+		return 0, nil
 	}
-	if PastelColors[c] {
-		return c, nil
+	for rank, name := range PriorityLevels {
+		if name == p {
+			return rank, nil
+		}
 	}
-	return "", ErrInvalidColor
+	return 0, ErrInvalidPriority
 }
 
-// normalizeColor returns a valid pastel hex or DefaultListColor if invalid (for UpdateList).
-func normalizeColor(color string) string {
-	c := strings.TrimSpace(color)
-	if c == "" {
-		return DefaultListColor
-	}
-	if len(c) == 6 && !strings.HasPrefix(c, "#") {
-		c = "#" + c
+// todoSortKeys returns the ORDER BY keys for a sort; empty means SortPosition, read from
+// positionColumn (t.position for the unfiltered view, tl.position inside a list).
+// Undated todos sort after dated ones. Every ordering ends in created_at, id so it is total,
+// which keeps cursor pagination stable. Returns ErrInvalidSort for unknown sorts.
+func todoSortKeys(sort TodoSort, positionColumn string) ([]sortKey, error) {
+	created := []sortKey{{"t.created_at", true}, {"t.id", true}}
+	undatedLast := []sortKey{{"t.due_at IS NULL", false}, {"COALESCE(t.due_at, '')", false}}
+	switch sort {
+	case "", SortPosition:
+		return append([]sortKey{{positionColumn, false}}, created...), nil
+	case SortCreated:
+		return created, nil
+	case SortPriority:
+		keys := append([]sortKey{{"t.priority", true}}, undatedLast...)
+		return append(keys, created...), nil
+	case SortDue:
+		keys := append(undatedLast, sortKey{"t.priority", true})
+		return append(keys, created...), nil
+	default:
+		return nil, ErrInvalidSort
 	}
-	if PastelColors[c] {
-		return c
-	}
-	return DefaultListColor
 }
 
-// UpdateList updates the name and/or color of a list by ID, scoped to the given user.
-func UpdateList(db *sql.DB, listID int64, name string, color string, userID int64) error {
-	trimmed := strings.TrimSpace(name)
-	if trimmed == "" {
-		return ErrEmptyListName
-	}
-	if len(trimmed) > MaxListNameLength {
-		return ErrListNameTooLong
+// todoOrderBy returns the ORDER BY expression for a sort; see todoSortKeys.
+func todoOrderBy(sort TodoSort, positionColumn string) (string, error) {
+	keys, err := todoSortKeys(sort, positionColumn)
+	if err != nil {
+		return "", err
 	}
+	return orderByClause(keys), nil
+}
 
-	hexColor := normalizeColor(color)
+// todoCursorOrder names the ordering a todo cursor belongs to, so a cursor cannot be replayed
+// against a different view or sort.
+func todoCursorOrder(view string, sort TodoSort) string {
+	if sort == "" {
+		sort = SortPosition
+	}
+	return view + ":" + string(sort)
+}
 
-	result, err := db.Exec(
-		"UPDATE lists SET name = ?, color = ? WHERE id = ? AND user_id = ?",
-		trimmed, hexColor, listID, userID,
-	)
-	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			return ErrDuplicateList
+// scanTodoPage scans todos selected with todoColumns followed by their sort key expressions,
+// returning each row's key values alongside for nextCursor.
+func scanTodoPage(rows *sql.Rows, keys int) ([]Todo, [][]any, error) {
+	todos := []Todo{}
+	var keyValues [][]any
+	for rows.Next() {
+		values := make([]any, keys)
+		dest := make([]any, keys)
+		for i := range values {
+			dest[i] = &values[i]
 		}
-		return err
+		t, err := scanTodo(rows, dest...)
+		if err != nil {
+			return nil, nil, err
+		}
+		todos = append(todos, t)
+		keyValues = append(keyValues, values)
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
 	}
 
-	if rowsAffected == 0 {
-		return ErrListNotFound
-	}
+	return todos, keyValues, nil
+}
 
-	return nil
+// topTodoRank returns a rank placing a todo before all of the user's todos.
+func topTodoRank(q rowQuerier, userID int64) (string, error) {
+	var min sql.NullString
+	if err := q.QueryRow("SELECT MIN(position) FROM todos WHERE user_id = ?", userID).Scan(&min); err != nil {
+		return "", err
+	}
+	return rankBetween("", min.String), nil
 }
 
-// DeleteList removes a list by ID, scoped to the given user.
-func DeleteList(db *sql.DB, listID int64, userID int64) error {
-	result, err := db.Exec("DELETE FROM lists WHERE id = ? AND user_id = ?", listID, userID)
-	if err != nil {
-		return err
+// topListRank returns a rank placing a todo before all todos in the list.
+func topListRank(q rowQuerier, listID int64) (string, error) {
+	var min sql.NullString
+	if err := q.QueryRow("SELECT MIN(position) FROM todo_lists WHERE list_id = ?", listID).Scan(&min); err != nil {
+		return "", err
 	}
+	return rankBetween("", min.String), nil
+}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
+// validateNotes sanitizes Markdown notes and checks them against ErrNotesTooLong.
+func validateNotes(notes string) (string, error) {
+	clean := sanitizeNotes(notes)
+	if len(clean) > MaxNotesLength {
+		return "", ErrNotesTooLong
 	}
+	return clean, nil
+}
 
-	if rowsAffected == 0 {
-		return ErrListNotFound
+// validateTitle drops control characters (tabs and line breaks become spaces), trims the title and
+// checks it against ErrEmptyTitle / ErrTitleTooLong.
+func validateTitle(title string) (string, error) {
+	trimmed := strings.TrimSpace(strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			return ' '
+		case r < 0x20 || r == 0x7f:
+			return -1
+		}
+		return r
+	}, title))
+	if trimmed == "" {
+		return "", ErrEmptyTitle
+	}
+	if len(trimmed) > MaxTitleLength {
+		return "", ErrTitleTooLong
 	}
+	return trimmed, nil
+}
 
-	return nil
+// GetAllTodos returns all non-deleted todos for a given user in manual order (newest first until reordered).
+func GetAllTodos(db *sql.DB, userID int64) ([]Todo, error) {
+	return GetAllTodosSorted(db, userID, SortPosition)
 }
 
-// --- Todo-List Relationship Functions ---
+// GetAllTodosSorted returns all non-deleted todos for a given user in the given order.
+// Returns ErrInvalidSort for unknown sorts.
+func GetAllTodosSorted(db *sql.DB, userID int64, sort TodoSort) ([]Todo, error) {
+	todos, _, err := GetAllTodosPage(db, userID, sort, Page{})
+	return todos, err
+}
 
-// AddListToTodo associates a list with a todo.
-// Returns ErrNotFound if the todo does not exist or is deleted, ErrListNotFound if the list does not exist.
-// Idempotent: returns nil if the association already exists.
-func AddListToTodo(db *sql.DB, todoID int64, listID int64, userID int64) error {
-	var todoExists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL)", todoID, userID).Scan(&todoExists)
+// GetAllTodosPage returns one page of the user's non-deleted todos in the given order, plus the
+// cursor of the next page ("" on the last page). A zero Page returns every todo.
+// Returns ErrInvalidSort, ErrInvalidLimit or ErrInvalidCursor for bad parameters.
+func GetAllTodosPage(db *sql.DB, userID int64, sort TodoSort, page Page) ([]Todo, string, error) {
+	keys, err := todoSortKeys(sort, "t.position")
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-	if !todoExists {
-		return ErrNotFound
+	order := todoCursorOrder("todos", sort)
+	cond, condArgs, limit, err := paginate(keys, order, page)
+	if err != nil {
+		return nil, "", err
 	}
 
-	var listExists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM lists WHERE id = ? AND user_id = ?)", listID, userID).Scan(&listExists)
-	if err != nil {
-		return err
+	query := "SELECT " + todoColumns + ", " + keyExprs(keys) + " FROM todos t WHERE t.user_id = ? AND t.deleted_at IS NULL"
+	args := []any{userID}
+	if cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
 	}
-	if !listExists {
-		return ErrListNotFound
+	query += " ORDER BY " + orderByClause(keys)
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
 	}
 
-	_, err = db.Exec("INSERT OR IGNORE INTO todo_lists (todo_id, list_id) VALUES (?, ?)", todoID, listID)
-	return err
-}
-
-// RemoveListFromTodo removes the association between a list and a todo.
-func RemoveListFromTodo(db *sql.DB, todoID int64, listID int64, userID int64) error {
-	var todoExists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL)", todoID, userID).Scan(&todoExists)
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return err
-	}
-	if !todoExists {
-		return ErrNotFound
+		return nil, "", err
 	}
+	defer rows.Close()
 
-	var listExists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM lists WHERE id = ? AND user_id = ?)", listID, userID).Scan(&listExists)
+	todos, keyValues, err := scanTodoPage(rows, len(keys))
 	if err != nil {
-		return err
-	}
-	if !listExists {
-		return ErrListNotFound
+		return nil, "", err
 	}
+	n, next := nextCursor(order, limit, keyValues)
+	return todos[:n], next, nil
+}
 
-	result, err := db.Exec("DELETE FROM todo_lists WHERE todo_id = ? AND list_id = ?", todoID, listID)
-	if err != nil {
-		return err
+// TodoFilter selects and orders todos for QueryTodos; see ParseTodoFilter for its query syntax.
+// Zero fields do not filter. Time bounds are inclusive.
+type TodoFilter struct {
+	Completed     *bool
+	ListIDs       []int64
+	AllLists      bool // todos must be in every list of ListIDs rather than any
+	CreatedFrom   *time.Time
+	CreatedTo     *time.Time
+	DueFrom       *time.Time
+	DueTo         *time.Time
+	TitleContains string
+	Sort          string
+}
+
+// likeEscaper escapes LIKE wildcards for use with ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// requireLists returns ErrListNotFound unless every (distinct) list ID belongs to the user.
+func requireLists(db *sql.DB, listIDs []int64, userID int64) error {
+	args := []any{userID}
+	for _, id := range listIDs {
+		args = append(args, id)
 	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(listIDs)), ", ")
 
-	rowsAffected, err := result.RowsAffected()
+	var owned int
+	err := db.QueryRow("SELECT COUNT(*) FROM lists WHERE user_id = ? AND id IN ("+placeholders+")", args...).Scan(&owned)
 	if err != nil {
 		return err
 	}
-
-	if rowsAffected == 0 {
-		return ErrNotFound
+	if owned != len(listIDs) {
+		return ErrListNotFound
 	}
-
 	return nil
 }
 
-// ListTodosByList returns all todos associated with a specific list, scoped to the given user.
-// Returns ErrListNotFound if the list does not exist or does not belong to the user.
-func ListTodosByList(db *sql.DB, listID int64, userID int64) ([]Todo, error) {
-	_, err := GetListByID(db, listID, userID)
-	if err != nil {
-		return nil, err
+// QueryTodos returns one page of the user's non-deleted todos matching filter, in filter.Sort order,
+// plus the cursor of the next page ("" on the last page). The filter is compiled into a single
+// parameterized query. With exactly one list, the position sort follows that list's manual order.
+// Returns ErrListNotFound if a filtered list is not one of the user's, ErrInvalidFilter for a bad
+// sort expression, and ErrInvalidLimit or ErrInvalidCursor for bad page parameters.
+func QueryTodos(db *sql.DB, filter TodoFilter, userID int64, page Page) ([]Todo, string, error) {
+	from := "todos t"
+	var fromArgs []any
+	positionColumn := "t.position"
+	if len(filter.ListIDs) == 1 {
+		from += " INNER JOIN todo_lists tl ON tl.todo_id = t.id AND tl.list_id = ?"
+		fromArgs = append(fromArgs, filter.ListIDs[0])
+		positionColumn = "tl.position"
 	}
 
-	rows, err := db.Query(`
-		SELECT t.id, t.title, t.completed, t.created_at, t.user_id
-		FROM todos t
-		INNER JOIN todo_lists tl ON t.id = tl.todo_id
-		WHERE tl.list_id = ? AND t.user_id = ? AND t.deleted_at IS NULL
-		ORDER BY t.created_at DESC
-	`, listID, userID)
+	keys, err := todoFilterSortKeys(filter.Sort, positionColumn)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	defer rows.Close()
-
-	todos := []Todo{}
-	for rows.Next() {
-		var t Todo
-		if err := rows.Scan(&t.ID, &t.Title, &t.Completed, &t.CreatedAt, &t.UserID); err != nil {
-			return nil, err
-		}
-		todos = append(todos, t)
+	order := "query:" + filter.Sort
+	cond, condArgs, limit, err := paginate(keys, order, page)
+	if err != nil {
+		return nil, "", err
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
+	where := []string{"t.user_id = ?", "t.deleted_at IS NULL"}
+	args := append(fromArgs, userID)
 
-	// Populate lists for each todo
-	for i := range todos {
-		lists, err := ListTodoLists(db, todos[i].ID, userID)
-		if err != nil {
-			todos[i].Lists = nil
-		} else {
-			todos[i].Lists = lists
+	if len(filter.ListIDs) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(filter.ListIDs)), ", ")
+		listArgs := make([]any, len(filter.ListIDs))
+		for i, id := range filter.ListIDs {
+			listArgs[i] = id
 		}
-	}
 
-	return todos, nil
-}
+		if err := requireLists(db, filter.ListIDs, userID); err != nil {
+			return nil, "", err
+		}
 
-// ListTodoLists returns all lists associated with a specific todo, scoped to the given user.
-func ListTodoLists(db *sql.DB, todoID int64, userID int64) ([]List, error) {
-	var todoExists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL)", todoID, userID).Scan(&todoExists)
-	if err != nil {
-		return nil, err
+		switch {
+		case len(filter.ListIDs) == 1:
+			// Already joined above.
+		case filter.AllLists:
+			where = append(where, "(SELECT COUNT(*) FROM todo_lists x WHERE x.todo_id = t.id AND x.list_id IN ("+placeholders+")) = ?")
+			args = append(append(args, listArgs...), len(filter.ListIDs))
+		default:
+			where = append(where, "EXISTS(SELECT 1 FROM todo_lists x WHERE x.todo_id = t.id AND x.list_id IN ("+placeholders+"))")
+			args = append(args, listArgs...)
+		}
 	}
-	if !todoExists {
-		return nil, ErrNotFound
+	if filter.Completed != nil {
+		where = append(where, "t.completed = ?")
+		args = append(args, *filter.Completed)
+	}
+	if filter.CreatedFrom != nil {
+		where = append(where, "t.created_at >= ?")
+		args = append(args, formatDBTime(filter.CreatedFrom))
+	}
+	if filter.CreatedTo != nil {
+		where = append(where, "t.created_at <= ?")
+		args = append(args, formatDBTime(filter.CreatedTo))
+	}
+	if filter.DueFrom != nil {
+		where = append(where, "t.due_at >= ?")
+		args = append(args, formatDBTime(filter.DueFrom))
+	}
+	if filter.DueTo != nil {
+		where = append(where, "t.due_at <= ?")
+		args = append(args, formatDBTime(filter.DueTo))
+	}
+	if filter.TitleContains != "" {
+		where = append(where, `t.title LIKE '%' || ? || '%' ESCAPE '\'`)
+		args = append(args, likeEscaper.Replace(filter.TitleContains))
+	}
+	if cond != "" {
+		where = append(where, cond)
+		args = append(args, condArgs...)
 	}
 
-	rows, err := db.Query(`
-		SELECT l.id, l.name, l.color, l.created_at, l.user_id
-		FROM lists l
-		INNER JOIN todo_lists tl ON l.id = tl.list_id
-		WHERE tl.todo_id = ? AND l.user_id = ?
-		ORDER BY l.created_at DESC
-	`, todoID, userID)
+	query := "SELECT " + todoColumns + ", " + keyExprs(keys) + " FROM " + from +
+		" WHERE " + strings.Join(where, " AND ") + " ORDER BY " + orderByClause(keys)
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
-	lists := []List{}
-	for rows.Next() {
-		var l List
-		if err := rows.Scan(&l.ID, &l.Name, &l.Color, &l.CreatedAt, &l.UserID); err != nil {
-			return nil, err
-		}
-		lists = append(lists, l)
+	todos, keyValues, err := scanTodoPage(rows, len(keys))
+	if err != nil {
+		return nil, "", err
 	}
+	n, next := nextCursor(order, limit, keyValues)
+	return todos[:n], next, nil
+}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
+// TodoDetails holds the optional attributes of a todo beyond its title.
+// Nil fields are stored as NULL.
+type TodoDetails struct {
+	DueAt      *time.Time
+	StartAt    *time.Time
+	Priority   string
+	Notes      string
+	Recurrence string
+}
 
-	return lists, nil
+// CreateTodo inserts a new todo with the given title for the given user and returns the created Todo.
+// Returns ErrEmptyTitle if the title is empty or whitespace-only.
+func CreateTodo(db *sql.DB, title string, userID int64) (Todo, error) {
+	return CreateTodoWithDetails(db, title, TodoDetails{}, userID)
 }
 
-// CreateTodoInList creates a todo and atomically associates it with the given list.
-// Returns ErrListNotFound if the list does not exist or does not belong to the user.
-// Returns ErrEmptyTitle / ErrTitleTooLong for invalid titles.
-// Uses a transaction: if any step fails, the todo is not created.
-func CreateTodoInList(db *sql.DB, title string, listID int64, userID int64) (Todo, error) {
-	trimmed := strings.TrimSpace(title)
-	if trimmed == "" {
-		return Todo{}, ErrEmptyTitle
+// CreateTodoWithDetails inserts a new todo with the given title and optional details for the given user.
+// Returns ErrEmptyTitle / ErrTitleTooLong for invalid titles, ErrStartAfterDue for an inverted schedule,
+// ErrInvalidPriority for an unknown priority, ErrNotesTooLong for oversized notes and
+// ErrInvalidRecurrence for an unsupported RRULE.
+func CreateTodoWithDetails(db *sql.DB, title string, details TodoDetails, userID int64) (Todo, error) {
+	trimmed, err := validateTitle(title)
+	if err != nil {
+		return Todo{}, err
 	}
-	if len(trimmed) > MaxTitleLength {
-		return Todo{}, ErrTitleTooLong
+	if err := validateSchedule(details.DueAt, details.StartAt); err != nil {
+		return Todo{}, err
 	}
-
-	tx, err := db.Begin()
+	priority, err := validatePriority(details.Priority)
 	if err != nil {
 		return Todo{}, err
 	}
-	var txDone bool
-	defer func() {
-		if !txDone {
-			tx.Rollback()
-		}
-	}()
-
-	// 1. Verify the list exists and belongs to the user
-	var listExists bool
-	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM lists WHERE id = ? AND user_id = ?)", listID, userID).Scan(&listExists)
+	notes, err := validateNotes(details.Notes)
 	if err != nil {
 		return Todo{}, err
 	}
-	if !listExists {
-		err = ErrListNotFound
+	recurrence, err := normalizeRecurrence(details.Recurrence)
+	if err != nil {
 		return Todo{}, err
 	}
 
-	// 2. Insert the todo
-	result, err := tx.Exec("INSERT INTO todos (title, user_id) VALUES (?, ?)", trimmed, userID)
+	position, err := topTodoRank(db, userID)
 	if err != nil {
 		return Todo{}, err
 	}
 
-	todoID, err := result.LastInsertId()
+	result, err := db.Exec("INSERT INTO todos (title, user_id, due_at, start_at, priority, notes, recurrence, position) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		trimmed, userID, formatDBTime(details.DueAt), formatDBTime(details.StartAt), priority, notes, recurrence, position)
 	if err != nil {
 		return Todo{}, err
 	}
 
-	// 3. Associate the todo with the list
-	_, err = tx.Exec("INSERT INTO todo_lists (todo_id, list_id) VALUES (?, ?)", todoID, listID)
+	id, err := result.LastInsertId()
 	if err != nil {
 		return Todo{}, err
 	}
 
-	if err = tx.Commit(); err != nil {
-		return Todo{}, err
+	return getTodo(db, id)
+}
+
+// UpdateTodoStatus updates the completed status of a todo by ID, scoped to the given user.
+// Returns ErrNotFound if the ID does not exist, does not belong to the user, or is deleted.
+// Completing a recurring todo spawns its next occurrence in the same transaction; see spawnNextOccurrence.
+func UpdateTodoStatus(db *sql.DB, id int64, completed bool, userID int64) error {
+	_, err := PatchTodo(db, id, TodoPatch{Completed: &completed}, userID)
+	return err
+}
+
+// spawnNextOccurrence creates the next todo of a recurring series inside tx.
+// The new todo copies the title, priority, notes, lists and (reset) checklist of the completed one,
+// with due/start dates shifted to the next occurrence in loc; an undated todo is scheduled from now.
+// The recurrence moves to the new todo, so completing the old one again does not spawn a duplicate.
+// Nothing is spawned once the series has ended (COUNT exhausted or past UNTIL).
+func spawnNextOccurrence(tx *sql.Tx, id int64, rule string, dueAt, startAt *string, loc *time.Location, now time.Time) error {
+	if _, err := tx.Exec("UPDATE todos SET recurrence = NULL WHERE id = ?", id); err != nil {
+		return err
 	}
-	txDone = true
 
-	// 4. Return the created todo with its list populated
-	var todo Todo
-	err = db.QueryRow("SELECT id, title, completed, created_at, user_id FROM todos WHERE id = ?", todoID).
-		Scan(&todo.ID, &todo.Title, &todo.Completed, &todo.CreatedAt, &todo.UserID)
+	r, err := ParseRecurrence(rule)
 	if err != nil {
-		return Todo{}, err
+		// A rule stored before validation tightened ends the series rather than failing the update.
+		return nil
 	}
 
-	lists, err := ListTodoLists(db, todo.ID, userID)
-	if err != nil {
-		todo.Lists = nil
-	} else {
-		todo.Lists = lists
+	anchor := now
+	if dueAt != nil {
+		if parsed, err := time.Parse(dbTimeLayout, *dueAt); err == nil {
+			anchor = parsed
+		}
+	}
+	nextDue, ok := r.Next(anchor, loc)
+	if !ok {
+		return nil
 	}
 
-	return todo, nil
+	var nextStart *time.Time
+	if startAt != nil {
+		if parsed, err := time.Parse(dbTimeLayout, *startAt); err == nil {
+			shifted := parsed.Add(nextDue.Sub(anchor))
+			nextStart = &shifted
+		}
+	}
+
+	var userID int64
+	if err := tx.QueryRow("SELECT user_id FROM todos WHERE id = ?", id).Scan(&userID); err != nil {
+		return err
+	}
+	position, err := topTodoRank(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	successor := r.Successor().String()
+	result, err := tx.Exec(`
+		INSERT INTO todos (title, user_id, due_at, start_at, priority, notes, recurrence, position)
+		SELECT title, user_id, ?, ?, priority, notes, ?, ? FROM todos WHERE id = ?
+	`, formatDBTime(&nextDue), formatDBTime(nextStart), successor, position, id)
+	if err != nil {
+		return err
+	}
+
+	nextID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	// The next occurrence joins the top of each of the original's lists.
+	rows, err := tx.Query("SELECT list_id FROM todo_lists WHERE todo_id = ?", id)
+	if err != nil {
+		return err
+	}
+	var listIDs []int64
+	for rows.Next() {
+		var listID int64
+		if err := rows.Scan(&listID); err != nil {
+			rows.Close()
+			return err
+		}
+		listIDs = append(listIDs, listID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, listID := range listIDs {
+		listPosition, err := topListRank(tx, listID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO todo_lists (todo_id, list_id, position) VALUES (?, ?, ?)", nextID, listID, listPosition); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO todo_items (todo_id, title, position) SELECT ?, title, position FROM todo_items WHERE todo_id = ?", nextID, id)
+	return err
+}
+
+// UpdateTodoRecurrence sets or clears (empty rule) the RRULE of a todo by ID, scoped to the given user.
+// Returns ErrInvalidRecurrence for unsupported rules and ErrNotFound if the todo does not exist,
+// does not belong to the user, or is deleted.
+func UpdateTodoRecurrence(db *sql.DB, id int64, rule string, userID int64) error {
+	_, err := PatchTodo(db, id, TodoPatch{Recurrence: &rule}, userID)
+	return err
+}
+
+// UpdateTodoTitle updates only the title of a todo by ID, scoped to the given user.
+// Returns ErrEmptyTitle if the title is empty, ErrTitleTooLong if it exceeds max length,
+// and ErrNotFound if the todo does not exist, does not belong to the user, or is deleted.
+func UpdateTodoTitle(db *sql.DB, id int64, title string, userID int64) error {
+	_, err := PatchTodo(db, id, TodoPatch{Title: &title}, userID)
+	return err
+}
+
+// GetTodoByID returns a todo with its notes and lists, scoped to the given user.
+// Returns ErrNotFound if the todo does not exist, does not belong to the user, or is deleted.
+func GetTodoByID(db *sql.DB, id int64, userID int64) (Todo, error) {
+	var notes string
+	row := db.QueryRow("SELECT "+todoColumns+", t.notes FROM todos t WHERE t.id = ? AND t.user_id = ? AND t.deleted_at IS NULL", id, userID)
+	todo, err := scanTodo(row, &notes)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Todo{}, ErrNotFound
+		}
+		return Todo{}, err
+	}
+	todo.Notes = &notes
+
+	lists, err := ListTodoLists(db, todo.ID, userID)
+	if err != nil {
+		return Todo{}, err
+	}
+	todo.Lists = lists
+
+	return todo, nil
+}
+
+// UpdateTodoNotes replaces the Markdown notes of a todo by ID, scoped to the given user.
+// Notes are sanitized before storage; an empty value clears them.
+// Returns ErrNotesTooLong if they exceed MaxNotesLength and ErrNotFound if the todo does not exist,
+// does not belong to the user, or is deleted.
+func UpdateTodoNotes(db *sql.DB, id int64, notes string, userID int64) error {
+	_, err := PatchTodo(db, id, TodoPatch{Notes: &notes}, userID)
+	return err
+}
+
+// UpdateTodoSchedule replaces the due and start dates of a todo by ID, scoped to the given user.
+// A nil date clears the stored value.
+// Returns ErrStartAfterDue for an inverted schedule and ErrNotFound if the todo does not exist,
+// does not belong to the user, or is deleted.
+func UpdateTodoSchedule(db *sql.DB, id int64, dueAt, startAt *time.Time, userID int64) error {
+	patch := TodoPatch{DueAt: dueAt, ClearDueAt: dueAt == nil, StartAt: startAt, ClearStartAt: startAt == nil}
+	_, err := PatchTodo(db, id, patch, userID)
+	return err
+}
+
+// UpdateTodoPriority sets the priority of a todo by ID, scoped to the given user.
+// Returns ErrInvalidPriority for unknown priorities and ErrNotFound if the todo does not exist,
+// does not belong to the user, or is deleted.
+func UpdateTodoPriority(db *sql.DB, id int64, priority string, userID int64) error {
+	_, err := PatchTodo(db, id, TodoPatch{Priority: &priority}, userID)
+	return err
+}
+
+// TodoPatch holds a partial todo update; nil fields are left untouched. A nil DueAt or StartAt
+// with its Clear flag set removes the date. Empty Priority, Notes and Recurrence reset them.
+// A non-zero Version makes the update conditional on the todo still being at that version.
+type TodoPatch struct {
+	Title        *string
+	Completed    *bool
+	DueAt        *time.Time
+	ClearDueAt   bool
+	StartAt      *time.Time
+	ClearStartAt bool
+	Priority     *string
+	Notes        *string
+	Recurrence   *string
+	Version      int64
+}
+
+// PatchTodo applies a partial update to a todo by ID, scoped to the given user, in one transaction,
+// and returns the updated todo with its notes and lists. The schedule is validated after merging
+// the patch into the stored dates. Completing a recurring todo spawns its next occurrence, as in
+// UpdateTodoStatus, using the patched recurrence and dates.
+// Returns the validation errors of CreateTodoWithDetails, ErrNotFound if the todo does not exist,
+// does not belong to the user, or is deleted, and ErrVersionMismatch if patch.Version is stale.
+func PatchTodo(db *sql.DB, id int64, patch TodoPatch, userID int64) (Todo, error) {
+	// Resolve the timezone before the transaction: with one connection, db cannot be used inside it.
+	loc, err := GetUserLocation(db, userID)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			return Todo{}, err
+		}
+		loc = time.UTC
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Todo{}, err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	if err := patchTodo(tx, id, patch, loc, userID); err != nil {
+		return Todo{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Todo{}, err
+	}
+	txDone = true
+
+	return GetTodoByID(db, id, userID)
+}
+
+// patchTodo applies a TodoPatch inside tx; loc is the user's timezone, used to schedule the next
+// occurrence of a completed recurring todo. See PatchTodo.
+func patchTodo(tx *sql.Tx, id int64, patch TodoPatch, loc *time.Location, userID int64) error {
+	var sets []string
+	var args []any
+	if patch.Title != nil {
+		trimmed, err := validateTitle(*patch.Title)
+		if err != nil {
+			return err
+		}
+		sets, args = append(sets, "title = ?"), append(args, trimmed)
+	}
+	if patch.Priority != nil {
+		rank, err := validatePriority(*patch.Priority)
+		if err != nil {
+			return err
+		}
+		sets, args = append(sets, "priority = ?"), append(args, rank)
+	}
+	if patch.Notes != nil {
+		clean, err := validateNotes(*patch.Notes)
+		if err != nil {
+			return err
+		}
+		sets, args = append(sets, "notes = ?"), append(args, clean)
+	}
+	var recurrence *string
+	if patch.Recurrence != nil {
+		var err error
+		if recurrence, err = normalizeRecurrence(*patch.Recurrence); err != nil {
+			return err
+		}
+		sets, args = append(sets, "recurrence = ?"), append(args, recurrence)
+	}
+
+	var wasCompleted bool
+	var storedRecurrence, dueAt, startAt *string
+	var version int64
+	err := tx.QueryRow("SELECT completed, recurrence, due_at, start_at, version FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL", id, userID).
+		Scan(&wasCompleted, &storedRecurrence, &dueAt, &startAt, &version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if patch.Version != 0 && patch.Version != version {
+		return ErrVersionMismatch
+	}
+	if patch.Recurrence == nil {
+		recurrence = storedRecurrence
+	}
+
+	if patch.DueAt != nil || patch.ClearDueAt || patch.StartAt != nil || patch.ClearStartAt {
+		if patch.DueAt != nil || patch.ClearDueAt {
+			dueAt = formatDBTime(patch.DueAt)
+			sets, args = append(sets, "due_at = ?"), append(args, dueAt)
+		}
+		if patch.StartAt != nil || patch.ClearStartAt {
+			startAt = formatDBTime(patch.StartAt)
+			sets, args = append(sets, "start_at = ?"), append(args, startAt)
+		}
+		// Both columns use dbTimeLayout, so comparing the strings compares the instants.
+		if dueAt != nil && startAt != nil && *startAt > *dueAt {
+			return ErrStartAfterDue
+		}
+	}
+	if patch.Completed != nil {
+		sets, args = append(sets, "completed = ?"), append(args, *patch.Completed)
+	}
+
+	if len(sets) > 0 {
+		if _, err := tx.Exec("UPDATE todos SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, id)...); err != nil {
+			return err
+		}
+	}
+
+	if patch.Completed != nil && *patch.Completed && !wasCompleted && recurrence != nil {
+		if err := spawnNextOccurrence(tx, id, *recurrence, dueAt, startAt, loc, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dueWindow returns the [from, to) UTC bounds for a due filter evaluated at now in loc.
+// An empty bound is open-ended. Returns ErrInvalidDue for unknown filters.
+func dueWindow(filter string, loc *time.Location, now time.Time) (from, to string, err error) {
+	local := now.In(loc)
+	startOfToday := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	startOfTomorrow := startOfToday.AddDate(0, 0, 1)
+
+	switch filter {
+	case DueOverdue:
+		return "", now.UTC().Format(dbTimeLayout), nil
+	case DueToday:
+		return startOfToday.UTC().Format(dbTimeLayout), startOfTomorrow.UTC().Format(dbTimeLayout), nil
+	case DueUpcoming:
+		return startOfTomorrow.UTC().Format(dbTimeLayout), "", nil
+	default:
+		return "", "", ErrInvalidDue
+	}
+}
+
+// GetTodosDue returns the user's non-deleted todos matching a due filter, in the given order
+// (SortDue when empty). "today" and "upcoming" use calendar days in loc; "overdue" only returns
+// incomplete todos. Returns ErrInvalidDue for unknown filters and ErrInvalidSort for unknown sorts.
+func GetTodosDue(db *sql.DB, userID int64, filter string, sort TodoSort, loc *time.Location, now time.Time) ([]Todo, error) {
+	from, to, err := dueWindow(filter, loc, now)
+	if err != nil {
+		return nil, err
+	}
+	if sort == "" {
+		sort = SortDue
+	}
+	orderBy, err := todoOrderBy(sort, "t.position")
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + todoColumns + " FROM todos t WHERE t.user_id = ? AND t.deleted_at IS NULL AND t.due_at IS NOT NULL"
+	args := []any{userID}
+	if from != "" {
+		query += " AND t.due_at >= ?"
+		args = append(args, from)
+	}
+	if to != "" {
+		query += " AND t.due_at < ?"
+		args = append(args, to)
+	}
+	if filter == DueOverdue {
+		query += " AND t.completed = 0"
+	}
+	query += " ORDER BY " + orderBy
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTodos(rows)
+}
+
+// DeleteTodo performs a soft delete by setting deleted_at to the current timestamp.
+// Returns ErrNotFound if the ID does not exist, does not belong to the user, or is already deleted.
+func DeleteTodo(db *sql.DB, id int64, userID int64) error {
+	return DeleteTodoIfMatch(db, id, 0, userID)
+}
+
+// DeleteTodoIfMatch soft-deletes a todo like DeleteTodo, provided it is still at the given version
+// (0 skips the check). Returns ErrVersionMismatch if the todo has changed since.
+func DeleteTodoIfMatch(db *sql.DB, id int64, version int64, userID int64) error {
+	result, err := db.Exec(
+		"UPDATE todos SET deleted_at = datetime('now') WHERE id = ? AND user_id = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)",
+		id, userID, version, version,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return versionMismatch(db, ErrNotFound, "SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL)", id, userID)
+	}
+
+	return nil
+}
+
+// versionMismatch explains a conditional write that matched no row: ErrVersionMismatch if the row
+// still exists according to the SELECT EXISTS query, notFound otherwise.
+func versionMismatch(db *sql.DB, notFound error, exists string, args ...any) error {
+	var found bool
+	if err := db.QueryRow(exists, args...).Scan(&found); err != nil {
+		return err
+	}
+	if found {
+		return ErrVersionMismatch
+	}
+	return notFound
+}
+
+// --- Trash Functions ---
+
+// ListTrash returns the user's soft-deleted todos, most recently deleted first, with DeletedAt populated.
+func ListTrash(db *sql.DB, userID int64) ([]Todo, error) {
+	rows, err := db.Query("SELECT "+todoColumns+", t.deleted_at FROM todos t WHERE t.user_id = ? AND t.deleted_at IS NOT NULL ORDER BY t.deleted_at DESC, t.id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	todos := []Todo{}
+	for rows.Next() {
+		var deletedAt string
+		t, err := scanTodo(rows, &deletedAt)
+		if err != nil {
+			return nil, err
+		}
+		t.DeletedAt = &deletedAt
+		todos = append(todos, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return todos, nil
+}
+
+// RestoreTodo moves a soft-deleted todo back out of the trash, scoped to the given user.
+// Returns ErrNotFound if the todo does not exist, does not belong to the user, or is not deleted.
+func RestoreTodo(db *sql.DB, id int64, userID int64) error {
+	result, err := db.Exec(
+		"UPDATE todos SET deleted_at = NULL WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL",
+		id, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// PurgeTodo permanently deletes a trashed todo with its list associations and checklist items.
+// Returns ErrNotFound if the todo does not exist, does not belong to the user, or is not in the trash.
+func PurgeTodo(db *sql.DB, id int64, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	var inTrash bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL)", id, userID).Scan(&inTrash)
+	if err != nil {
+		return err
+	}
+	if !inTrash {
+		return ErrNotFound
+	}
+
+	if err := hardDeleteTodos(tx, "id = ?", id); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	txDone = true
+
+	return nil
+}
+
+// PurgeTrash permanently deletes every user's todos that were trashed before cutoff,
+// with their list associations and checklist items. Returns the number of todos removed.
+func PurgeTrash(db *sql.DB, cutoff time.Time) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	var count int64
+	before := cutoff.UTC().Format(dbTimeLayout)
+	err = tx.QueryRow("SELECT COUNT(*) FROM todos WHERE deleted_at IS NOT NULL AND deleted_at < ?", before).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		if err := hardDeleteTodos(tx, "deleted_at IS NOT NULL AND deleted_at < ?", before); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	txDone = true
+
+	return count, nil
+}
+
+// hardDeleteTodos removes the todos matching where (a condition on the todos table) together with
+// their todo_lists, todo_items and legacy todo_tags rows.
+func hardDeleteTodos(tx *sql.Tx, where string, args ...any) error {
+	for _, child := range []string{"todo_lists", "todo_items", "todo_tags"} {
+		if _, err := tx.Exec("DELETE FROM "+child+" WHERE todo_id IN (SELECT id FROM todos WHERE "+where+")", args...); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("DELETE FROM todos WHERE "+where, args...)
+	return err
+}
+
+// --- Search Functions ---
+
+// MaxSearchResults caps the number of todos returned by SearchTodos.
+const MaxSearchResults = 50
+
+// snippetStart and snippetEnd delimit matches in raw FTS snippets. validateTitle and sanitizeNotes
+// strip control characters on write, so these cannot occur in the indexed text, and they survive
+// HTML escaping before being swapped for <mark> tags.
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+// SearchFilter narrows SearchTodos results. Nil fields do not filter.
+type SearchFilter struct {
+	ListID    *int64
+	Completed *bool
+}
+
+// ftsQuery turns free text into an FTS5 query matching every word as a prefix ("buy mil" → "buy"* "mil"*).
+// Words are quoted so FTS5 operators and punctuation in user input are matched literally.
+func ftsQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		word = strings.ReplaceAll(word, `"`, "")
+		if word == "" {
+			continue
+		}
+		terms = append(terms, `"`+word+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// SearchTodos runs a full-text search over the user's non-deleted todos (titles and notes), best
+// matches first with title hits weighted above notes. Each result carries an HTML-escaped snippet
+// with the matched words wrapped in <mark>. Returns ErrEmptyQuery if text has no words and
+// ErrListNotFound if filter.ListID is not one of the user's lists.
+func SearchTodos(db *sql.DB, text string, filter SearchFilter, userID int64) ([]SearchResult, error) {
+	match := ftsQuery(text)
+	if match == "" {
+		return nil, ErrEmptyQuery
+	}
+
+	query := "SELECT " + todoColumns + ", snippet(todos_fts, -1, ?, ?, '…', 12) " +
+		"FROM todos_fts INNER JOIN todos t ON t.id = todos_fts.rowid " +
+		"WHERE todos_fts MATCH ? AND t.user_id = ? AND t.deleted_at IS NULL"
+	args := []any{snippetStart, snippetEnd, match, userID}
+
+	if filter.ListID != nil {
+		if _, err := GetListByID(db, *filter.ListID, userID); err != nil {
+			return nil, err
+		}
+		query += " AND EXISTS(SELECT 1 FROM todo_lists tl WHERE tl.todo_id = t.id AND tl.list_id = ?)"
+		args = append(args, *filter.ListID)
+	}
+	if filter.Completed != nil {
+		query += " AND t.completed = ?"
+		args = append(args, *filter.Completed)
+	}
+	query += " ORDER BY bm25(todos_fts, 10.0, 1.0), t.created_at DESC, t.id DESC LIMIT ?"
+	args = append(args, MaxSearchResults)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var snippet string
+		t, err := scanTodo(rows, &snippet)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, SearchResult{Todo: t, Snippet: highlightSnippet(snippet)})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// highlightSnippet HTML-escapes a raw FTS snippet and replaces the match delimiters with <mark> tags.
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	return strings.NewReplacer(snippetStart, "<mark>", snippetEnd, "</mark>").Replace(escaped)
+}
+
+// --- List CRUD Functions ---
+
+// listColumns is the SELECT list scanned by scanList; queries must alias lists as l.
+const listColumns = "l.id, l.name, l.color, l.created_at, l.user_id, l.position, l.pinned, l.version, l.updated_at"
+
+// listSortKeys is the user's manual list order: pinned lists first, then by position (newest first on ties).
+var listSortKeys = []sortKey{{"l.pinned", true}, {"l.position", false}, {"l.created_at", true}, {"l.id", true}}
+
+// listOrderBy is listSortKeys as an ORDER BY expression.
+var listOrderBy = orderByClause(listSortKeys)
+
+// scanList scans a row selected with listColumns, followed by any extra columns.
+func scanList(s rowScanner, extra ...any) (List, error) {
+	var l List
+	dest := []any{&l.ID, &l.Name, &l.Color, &l.CreatedAt, &l.UserID, &l.Position, &l.Pinned, &l.Version, &l.UpdatedAt}
+	err := s.Scan(append(dest, extra...)...)
+	return l, err
+}
+
+// ListLists returns all lists for a given user in manual order (pinned first, then by position).
+func ListLists(db *sql.DB, userID int64) ([]List, error) {
+	lists, _, err := ListListsPage(db, userID, Page{})
+	return lists, err
+}
+
+// ListListsPage returns one page of the user's lists in manual order, plus the cursor of the next
+// page ("" on the last page). A zero Page returns every list.
+// Returns ErrInvalidLimit or ErrInvalidCursor for bad parameters.
+func ListListsPage(db *sql.DB, userID int64, page Page) ([]List, string, error) {
+	cond, condArgs, limit, err := paginate(listSortKeys, "lists", page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	query := "SELECT " + listColumns + ", " + keyExprs(listSortKeys) + " FROM lists l WHERE l.user_id = ?"
+	args := []any{userID}
+	if cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	query += " ORDER BY " + listOrderBy
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	lists := []List{}
+	var keyValues [][]any
+	for rows.Next() {
+		values := make([]any, len(listSortKeys))
+		dest := make([]any, len(values))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		l, err := scanList(rows, dest...)
+		if err != nil {
+			return nil, "", err
+		}
+		lists = append(lists, l)
+		keyValues = append(keyValues, values)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	n, next := nextCursor("lists", limit, keyValues)
+	return lists[:n], next, nil
+}
+
+// GetListByID returns a list by ID, scoped to the given user.
+func GetListByID(db *sql.DB, listID int64, userID int64) (List, error) {
+	l, err := scanList(db.QueryRow("SELECT "+listColumns+" FROM lists l WHERE l.id = ? AND l.user_id = ?", listID, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return List{}, ErrListNotFound
+		}
+		return List{}, err
+	}
+	return l, nil
+}
+
+// CreateList inserts a new list with the given name and color for the given user.
+// Returns ErrEmptyListName if the name is empty, ErrListNameTooLong if too long,
+// ErrDuplicateList if a list with the same name exists, ErrInvalidColor if color is not in the palette.
+func CreateList(db *sql.DB, name string, color string, userID int64) (List, error) {
+	trimmed := strings.TrimSpace(name)
+	if trimmed == "" {
+		return List{}, ErrEmptyListName
+	}
+	if len(trimmed) > MaxListNameLength {
+		return List{}, ErrListNameTooLong
+	}
+
+	hexColor, err := validateColor(color)
+	if err != nil {
+		return List{}, err
+	}
+
+	// New lists go to the top of the unpinned lists.
+	result, err := db.Exec(`
+		INSERT INTO lists (name, color, user_id, position)
+		VALUES (?, ?, ?, (SELECT COALESCE(MIN(position), 1) - 1 FROM lists WHERE user_id = ?))
+	`, trimmed, hexColor, userID, userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return List{}, ErrDuplicateList
+		}
+		return List{}, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return List{}, err
+	}
+
+	list, err := scanList(db.QueryRow("SELECT "+listColumns+" FROM lists l WHERE l.id = ?", id))
+	if err != nil {
+		return List{}, err
+	}
+
+	return list, nil
+}
+
+// validateColor returns the hex if it's in the pastel palette, or ErrInvalidColor.
+func validateColor(color string) (string, error) {
+	c := strings.TrimSpace(color)
+	if c == "" {
+		return DefaultListColor, nil
+	}
+	if len(c) == 6 && !strings.HasPrefix(c, "#") {
+		c = "#" + c
+	}
+	if PastelColors[c] {
+		return c, nil
+	}
+	return "", ErrInvalidColor
+}
+
+// normalizeColor returns a valid pastel hex or DefaultListColor if invalid (for UpdateList).
+func normalizeColor(color string) string {
+	c := strings.TrimSpace(color)
+	if c == "" {
+		return DefaultListColor
+	}
+	if len(c) == 6 && !strings.HasPrefix(c, "#") {
+		c = "#" + c
+	}
+	if PastelColors[c] {
+		return c
+	}
+	return DefaultListColor
+}
+
+// UpdateList updates the name and/or color of a list by ID, scoped to the given user.
+func UpdateList(db *sql.DB, listID int64, name string, color string, userID int64) error {
+	return UpdateListIfMatch(db, listID, name, color, nil, 0, userID)
+}
+
+// UpdateListIfMatch updates a list's name and color like UpdateList, and its pinned flag when pinned
+// is non-nil, in one statement, provided the list is still at the given version (0 skips the check).
+// Returns ErrVersionMismatch if the list has changed since.
+func UpdateListIfMatch(db *sql.DB, listID int64, name string, color string, pinned *bool, version int64, userID int64) error {
+	trimmed := strings.TrimSpace(name)
+	if trimmed == "" {
+		return ErrEmptyListName
+	}
+	if len(trimmed) > MaxListNameLength {
+		return ErrListNameTooLong
+	}
+
+	hexColor := normalizeColor(color)
+
+	result, err := db.Exec(
+		"UPDATE lists SET name = ?, color = ?, pinned = COALESCE(?, pinned) WHERE id = ? AND user_id = ? AND (? = 0 OR version = ?)",
+		trimmed, hexColor, pinned, listID, userID, version, version,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrDuplicateList
+		}
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return versionMismatch(db, ErrListNotFound, "SELECT EXISTS(SELECT 1 FROM lists WHERE id = ? AND user_id = ?)", listID, userID)
+	}
+
+	return nil
+}
+
+// UpdateListPinned pins or unpins a list, scoped to the given user. Pinned lists sort before the others.
+// Returns ErrListNotFound if the list does not exist or does not belong to the user.
+func UpdateListPinned(db *sql.DB, listID int64, pinned bool, userID int64) error {
+	result, err := db.Exec("UPDATE lists SET pinned = ? WHERE id = ? AND user_id = ?", pinned, listID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrListNotFound
+	}
+
+	return nil
+}
+
+// ReorderLists sets the manual order of the user's lists from the full ordered list of IDs, in one transaction.
+// Pinned lists still sort first, keeping their relative order. Returns ErrInvalidOrder unless listIDs
+// names every list of the user exactly once.
+func ReorderLists(db *sql.DB, listIDs []int64, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM lists WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return err
+	}
+	if count != len(listIDs) {
+		return ErrInvalidOrder
+	}
+
+	seen := make(map[int64]bool, len(listIDs))
+	for i, listID := range listIDs {
+		if seen[listID] {
+			return ErrInvalidOrder
+		}
+		seen[listID] = true
+
+		result, err := tx.Exec("UPDATE lists SET position = ? WHERE id = ? AND user_id = ?", i+1, listID, userID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrInvalidOrder
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	txDone = true
+
+	return nil
+}
+
+// DeleteList removes a list by ID, scoped to the given user.
+func DeleteList(db *sql.DB, listID int64, userID int64) error {
+	return DeleteListIfMatch(db, listID, 0, userID)
+}
+
+// DeleteListIfMatch deletes a list like DeleteList, provided it is still at the given version
+// (0 skips the check), together with its todo memberships. Returns ErrVersionMismatch if the list
+// has changed since.
+func DeleteListIfMatch(db *sql.DB, listID int64, version int64, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	result, err := tx.Exec("DELETE FROM lists WHERE id = ? AND user_id = ? AND (? = 0 OR version = ?)", listID, userID, version, version)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		tx.Rollback()
+		txDone = true
+		return versionMismatch(db, ErrListNotFound, "SELECT EXISTS(SELECT 1 FROM lists WHERE id = ? AND user_id = ?)", listID, userID)
+	}
+
+	if _, err := tx.Exec("DELETE FROM todo_lists WHERE list_id = ?", listID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	txDone = true
+
+	return nil
+}
+
+// --- Todo-List Relationship Functions ---
+
+// AddListToTodo associates a list with a todo.
+// Returns ErrNotFound if the todo does not exist or is deleted, ErrListNotFound if the list does not exist.
+// Idempotent: returns nil if the association already exists.
+func AddListToTodo(db *sql.DB, todoID int64, listID int64, userID int64) error {
+	var todoExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL)", todoID, userID).Scan(&todoExists)
+	if err != nil {
+		return err
+	}
+	if !todoExists {
+		return ErrNotFound
+	}
+
+	var listExists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM lists WHERE id = ? AND user_id = ?)", listID, userID).Scan(&listExists)
+	if err != nil {
+		return err
+	}
+	if !listExists {
+		return ErrListNotFound
+	}
+
+	position, err := topListRank(db, listID)
+	if err != nil {
+		return err
+	}
+
+	// New members go to the top of the list; re-adding keeps the existing position.
+	_, err = db.Exec("INSERT OR IGNORE INTO todo_lists (todo_id, list_id, position) VALUES (?, ?, ?)", todoID, listID, position)
+	return err
+}
+
+// RemoveListFromTodo removes the association between a list and a todo.
+func RemoveListFromTodo(db *sql.DB, todoID int64, listID int64, userID int64) error {
+	var todoExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL)", todoID, userID).Scan(&todoExists)
+	if err != nil {
+		return err
+	}
+	if !todoExists {
+		return ErrNotFound
+	}
+
+	var listExists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM lists WHERE id = ? AND user_id = ?)", listID, userID).Scan(&listExists)
+	if err != nil {
+		return err
+	}
+	if !listExists {
+		return ErrListNotFound
+	}
+
+	result, err := db.Exec("DELETE FROM todo_lists WHERE todo_id = ? AND list_id = ?", todoID, listID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// ListTodosByList returns all todos associated with a specific list in the list's manual order,
+// scoped to the given user. Returns ErrListNotFound if the list does not exist or does not belong to the user.
+func ListTodosByList(db *sql.DB, listID int64, userID int64) ([]Todo, error) {
+	return ListTodosByListSorted(db, listID, userID, SortPosition)
+}
+
+// ListTodosByListSorted is ListTodosByList in the given order.
+// Returns ErrInvalidSort for unknown sorts.
+func ListTodosByListSorted(db *sql.DB, listID int64, userID int64, sort TodoSort) ([]Todo, error) {
+	todos, _, err := ListTodosByListPage(db, listID, userID, sort, Page{})
+	return todos, err
+}
+
+// ListTodosByListPage returns one page of a list's todos in the given order, with lists populated,
+// plus the cursor of the next page ("" on the last page). A zero Page returns every todo.
+// Returns ErrListNotFound, ErrInvalidSort, ErrInvalidLimit or ErrInvalidCursor.
+func ListTodosByListPage(db *sql.DB, listID int64, userID int64, sort TodoSort, page Page) ([]Todo, string, error) {
+	keys, err := todoSortKeys(sort, "tl.position")
+	if err != nil {
+		return nil, "", err
+	}
+	order := todoCursorOrder("list", sort)
+	cond, condArgs, limit, err := paginate(keys, order, page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = GetListByID(db, listID, userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	query := `
+		SELECT ` + todoColumns + `, ` + keyExprs(keys) + `
+		FROM todos t
+		INNER JOIN todo_lists tl ON t.id = tl.todo_id
+		WHERE tl.list_id = ? AND t.user_id = ? AND t.deleted_at IS NULL`
+	args := []any{listID, userID}
+	if cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	query += " ORDER BY " + orderByClause(keys)
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	todos, keyValues, err := scanTodoPage(rows, len(keys))
+	if err != nil {
+		return nil, "", err
+	}
+	rows.Close()
+	n, next := nextCursor(order, limit, keyValues)
+	todos = todos[:n]
+
+	// Populate lists for all todos of the page at once
+	if err := attachTodoLists(db, todos, userID); err != nil {
+		return nil, "", err
+	}
+
+	return todos, next, nil
+}
+
+// MoveTodo moves a todo to directly after afterID in the user's manual order, or to the top when
+// afterID is nil. Only the moved todo's rank changes. Returns ErrNotFound if the todo does not exist,
+// does not belong to the user, or is deleted, and ErrInvalidPosition if afterID is not another of
+// the user's active todos.
+func MoveTodo(db *sql.DB, todoID int64, afterID *int64, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	if err := requireTodo(tx, todoID, userID); err != nil {
+		return err
+	}
+
+	lower, err := rankAfter(tx, "SELECT position FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL", todoID, afterID, userID)
+	if err != nil {
+		return err
+	}
+	var upper sql.NullString
+	err = tx.QueryRow("SELECT MIN(position) FROM todos WHERE user_id = ? AND id != ? AND position > ?", userID, todoID, lower).Scan(&upper)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE todos SET position = ? WHERE id = ?", rankBetween(lower, upper.String), todoID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	txDone = true
+
+	return nil
+}
+
+// MoveTodoInList moves a todo to directly after afterID within a list, or to the top when afterID
+// is nil. Only the moved todo's rank changes. Returns ErrListNotFound if the list does not exist or
+// does not belong to the user, ErrNotFound if the todo is not an active member of the list, and
+// ErrInvalidPosition if afterID is not another active todo in the list.
+func MoveTodoInList(db *sql.DB, listID int64, todoID int64, afterID *int64, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	var listExists bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM lists WHERE id = ? AND user_id = ?)", listID, userID).Scan(&listExists)
+	if err != nil {
+		return err
+	}
+	if !listExists {
+		return ErrListNotFound
+	}
+
+	memberQuery := `
+		SELECT tl.position FROM todo_lists tl
+		INNER JOIN todos t ON t.id = tl.todo_id
+		WHERE tl.todo_id = ? AND tl.list_id = ? AND t.deleted_at IS NULL`
+	var current sql.NullString
+	if err := tx.QueryRow(memberQuery, todoID, listID).Scan(&current); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	lower, err := rankAfter(tx, memberQuery, todoID, afterID, listID)
+	if err != nil {
+		return err
+	}
+	var upper sql.NullString
+	err = tx.QueryRow("SELECT MIN(position) FROM todo_lists WHERE list_id = ? AND todo_id != ? AND position > ?", listID, todoID, lower).Scan(&upper)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE todo_lists SET position = ? WHERE todo_id = ? AND list_id = ?", rankBetween(lower, upper.String), todoID, listID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	txDone = true
+
+	return nil
+}
+
+// rankAfter returns the rank of the todo a moved todo should follow ("" for the top). query selects
+// that todo's position by (afterID, scopeID); no row, or afterID == todoID, yields ErrInvalidPosition.
+func rankAfter(q rowQuerier, query string, todoID int64, afterID *int64, scopeID int64) (string, error) {
+	if afterID == nil {
+		return "", nil
+	}
+	if *afterID == todoID {
+		return "", ErrInvalidPosition
+	}
+	var position sql.NullString
+	if err := q.QueryRow(query, *afterID, scopeID).Scan(&position); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrInvalidPosition
+		}
+		return "", err
+	}
+	return position.String, nil
+}
+
+// attachBatchSize bounds the number of todo IDs bound into one IN (...) query by attachTodoLists,
+// well under SQLite's host parameter limit.
+const attachBatchSize = 500
+
+// attachTodoLists populates Lists on each todo with set-based queries: one join per attachBatchSize
+// todos instead of a lookup per todo. Lists are ordered like ListLists; todos without lists get an empty slice.
+func attachTodoLists(db *sql.DB, todos []Todo, userID int64) error {
+	index := make(map[int64][]int, len(todos))
+	for i := range todos {
+		todos[i].Lists = []List{}
+		index[todos[i].ID] = append(index[todos[i].ID], i)
+	}
+
+	for start := 0; start < len(todos); start += attachBatchSize {
+		end := min(start+attachBatchSize, len(todos))
+		args := []any{userID}
+		for _, t := range todos[start:end] {
+			args = append(args, t.ID)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", end-start), ", ")
+
+		// CROSS JOIN keeps todo_lists as the outer loop, so SQLite probes the batch's todo IDs
+		// instead of every (list, todo) pair of the user.
+		rows, err := db.Query(`
+			SELECT `+listColumns+`, tl.todo_id
+			FROM todo_lists tl
+			CROSS JOIN lists l ON l.id = tl.list_id
+			WHERE l.user_id = ? AND tl.todo_id IN (`+placeholders+`)
+			ORDER BY `+listOrderBy, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var todoID int64
+			l, err := scanList(rows, &todoID)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			for _, i := range index[todoID] {
+				todos[i].Lists = append(todos[i].Lists, l)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListTodoLists returns all lists associated with a specific todo, scoped to the given user.
+func ListTodoLists(db *sql.DB, todoID int64, userID int64) ([]List, error) {
+	var todoExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL)", todoID, userID).Scan(&todoExists)
+	if err != nil {
+		return nil, err
+	}
+	if !todoExists {
+		return nil, ErrNotFound
+	}
+
+	rows, err := db.Query(`
+		SELECT `+listColumns+`
+		FROM lists l
+		INNER JOIN todo_lists tl ON l.id = tl.list_id
+		WHERE tl.todo_id = ? AND l.user_id = ?
+		ORDER BY `+listOrderBy, todoID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []List{}
+	for rows.Next() {
+		l, err := scanList(rows)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lists, nil
+}
+
+// CreateTodoInList creates a todo and atomically associates it with the given list.
+// Returns ErrListNotFound if the list does not exist or does not belong to the user.
+// Returns ErrEmptyTitle / ErrTitleTooLong for invalid titles.
+// Uses a transaction: if any step fails, the todo is not created.
+func CreateTodoInList(db *sql.DB, title string, listID int64, userID int64) (Todo, error) {
+	return CreateTodoInListWithDetails(db, title, TodoDetails{}, listID, userID)
+}
+
+// CreateTodoInListWithDetails is CreateTodoInList with optional todo details.
+// Returns ErrStartAfterDue / ErrInvalidPriority / ErrNotesTooLong / ErrInvalidRecurrence for invalid
+// details in addition to CreateTodoInList's errors.
+func CreateTodoInListWithDetails(db *sql.DB, title string, details TodoDetails, listID int64, userID int64) (Todo, error) {
+	trimmed, err := validateTitle(title)
+	if err != nil {
+		return Todo{}, err
+	}
+	if err := validateSchedule(details.DueAt, details.StartAt); err != nil {
+		return Todo{}, err
+	}
+	priority, err := validatePriority(details.Priority)
+	if err != nil {
+		return Todo{}, err
+	}
+	notes, err := validateNotes(details.Notes)
+	if err != nil {
+		return Todo{}, err
+	}
+	recurrence, err := normalizeRecurrence(details.Recurrence)
+	if err != nil {
+		return Todo{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Todo{}, err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	// 1. Verify the list exists and belongs to the user
+	var listExists bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM lists WHERE id = ? AND user_id = ?)", listID, userID).Scan(&listExists)
+	if err != nil {
+		return Todo{}, err
+	}
+	if !listExists {
+		err = ErrListNotFound
+		return Todo{}, err
+	}
+
+	// 2. Insert the todo at the top of the user's todos
+	position, err := topTodoRank(tx, userID)
+	if err != nil {
+		return Todo{}, err
+	}
+	result, err := tx.Exec("INSERT INTO todos (title, user_id, due_at, start_at, priority, notes, recurrence, position) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		trimmed, userID, formatDBTime(details.DueAt), formatDBTime(details.StartAt), priority, notes, recurrence, position)
+	if err != nil {
+		return Todo{}, err
+	}
+
+	todoID, err := result.LastInsertId()
+	if err != nil {
+		return Todo{}, err
+	}
+
+	// 3. Associate the todo with the list, at the top of the list
+	listPosition, err := topListRank(tx, listID)
+	if err != nil {
+		return Todo{}, err
+	}
+	_, err = tx.Exec("INSERT INTO todo_lists (todo_id, list_id, position) VALUES (?, ?, ?)", todoID, listID, listPosition)
+	if err != nil {
+		return Todo{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Todo{}, err
+	}
+	txDone = true
+
+	// 4. Return the created todo with its list populated
+	todo, err := getTodo(db, todoID)
+	if err != nil {
+		return Todo{}, err
+	}
+
+	lists, err := ListTodoLists(db, todo.ID, userID)
+	if err != nil {
+		todo.Lists = nil
+	} else {
+		todo.Lists = lists
+	}
+
+	return todo, nil
+}
+
+// --- Checklist Item Functions ---
+
+// todoItemColumns is the column list for every query that returns a TodoItem.
+const todoItemColumns = "id, todo_id, title, completed, position, created_at"
+
+// scanTodoItem reads a row selected with todoItemColumns into a TodoItem.
+func scanTodoItem(s rowScanner) (TodoItem, error) {
+	var item TodoItem
+	err := s.Scan(&item.ID, &item.TodoID, &item.Title, &item.Completed, &item.Position, &item.CreatedAt)
+	return item, err
+}
+
+// requireTodo returns ErrNotFound unless the todo exists, belongs to the user and is not deleted.
+func requireTodo(q rowQuerier, todoID int64, userID int64) error {
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL)", todoID, userID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListTodoItems returns the checklist items of a todo ordered by position, scoped to the given user.
+// Returns ErrNotFound if the todo does not exist, does not belong to the user, or is deleted.
+func ListTodoItems(db *sql.DB, todoID int64, userID int64) ([]TodoItem, error) {
+	if err := requireTodo(db, todoID, userID); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT "+todoItemColumns+" FROM todo_items WHERE todo_id = ? ORDER BY position ASC, id ASC", todoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []TodoItem{}
+	for rows.Next() {
+		item, err := scanTodoItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// CreateTodoItem appends a checklist item to a todo, scoped to the given user.
+// Returns ErrEmptyTitle / ErrTitleTooLong for invalid titles and ErrNotFound if the todo
+// does not exist, does not belong to the user, or is deleted.
+func CreateTodoItem(db *sql.DB, todoID int64, title string, userID int64) (TodoItem, error) {
+	trimmed, err := validateTitle(title)
+	if err != nil {
+		return TodoItem{}, err
+	}
+	if err := requireTodo(db, todoID, userID); err != nil {
+		return TodoItem{}, err
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO todo_items (todo_id, title, position) VALUES (?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM todo_items WHERE todo_id = ?))",
+		todoID, trimmed, todoID,
+	)
+	if err != nil {
+		return TodoItem{}, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return TodoItem{}, err
+	}
+
+	return scanTodoItem(db.QueryRow("SELECT "+todoItemColumns+" FROM todo_items WHERE id = ?", id))
+}
+
+// UpdateTodoItem changes the title and/or completion of a checklist item; nil fields are left untouched.
+// Returns ErrEmptyTitle / ErrTitleTooLong for invalid titles, ErrNotFound if the todo is not accessible
+// and ErrItemNotFound if the item does not belong to the todo.
+func UpdateTodoItem(db *sql.DB, todoID int64, itemID int64, title *string, completed *bool, userID int64) (TodoItem, error) {
+	var trimmed *string
+	if title != nil {
+		t, err := validateTitle(*title)
+		if err != nil {
+			return TodoItem{}, err
+		}
+		trimmed = &t
+	}
+	if err := requireTodo(db, todoID, userID); err != nil {
+		return TodoItem{}, err
+	}
+
+	result, err := db.Exec(
+		"UPDATE todo_items SET title = COALESCE(?, title), completed = COALESCE(?, completed) WHERE id = ? AND todo_id = ?",
+		trimmed, completed, itemID, todoID,
+	)
+	if err != nil {
+		return TodoItem{}, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return TodoItem{}, err
+	}
+
+	if rowsAffected == 0 {
+		return TodoItem{}, ErrItemNotFound
+	}
+
+	return scanTodoItem(db.QueryRow("SELECT "+todoItemColumns+" FROM todo_items WHERE id = ?", itemID))
+}
+
+// DeleteTodoItem permanently removes a checklist item from a todo, scoped to the given user.
+// Returns ErrNotFound if the todo is not accessible and ErrItemNotFound if the item does not belong to it.
+func DeleteTodoItem(db *sql.DB, todoID int64, itemID int64, userID int64) error {
+	if err := requireTodo(db, todoID, userID); err != nil {
+		return err
+	}
+
+	result, err := db.Exec("DELETE FROM todo_items WHERE id = ? AND todo_id = ?", itemID, todoID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrItemNotFound
+	}
+
+	return nil
+}
+
+// ReorderTodoItems sets the checklist order of a todo to itemIDs, which must contain every item exactly once.
+// Returns ErrNotFound if the todo is not accessible and ErrInvalidOrder for an incomplete or foreign ID set.
+// Uses a transaction: either every position is updated or none is.
+func ReorderTodoItems(db *sql.DB, todoID int64, itemIDs []int64, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	if err := requireTodo(tx, todoID, userID); err != nil {
+		return err
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM todo_items WHERE todo_id = ?", todoID).Scan(&count); err != nil {
+		return err
+	}
+	if count != len(itemIDs) {
+		return ErrInvalidOrder
+	}
+
+	seen := make(map[int64]bool, len(itemIDs))
+	for i, itemID := range itemIDs {
+		if seen[itemID] {
+			return ErrInvalidOrder
+		}
+		seen[itemID] = true
+
+		result, err := tx.Exec("UPDATE todo_items SET position = ? WHERE id = ? AND todo_id = ?", i+1, itemID, todoID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrInvalidOrder
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	txDone = true
+
+	return nil
+}
+
+// --- Smart List Functions ---
+
+var (
+	ErrSmartListNotFound  = errors.New("smart list not found")
+	ErrDuplicateSmartList = errors.New("smart list with this name already exists")
+)
+
+// smartListColumns is the SELECT list scanned by scanSmartList.
+const smartListColumns = "id, name, filter, created_at, user_id"
+
+// scanSmartList scans a row selected with smartListColumns.
+func scanSmartList(s rowScanner) (SmartList, error) {
+	var sl SmartList
+	err := s.Scan(&sl.ID, &sl.Name, &sl.Filter, &sl.CreatedAt, &sl.UserID)
+	return sl, err
+}
+
+// validateSmartList trims and checks a smart list name and normalizes its filter (a ParseTodoFilter
+// query string) to canonical form. Filters are rejected when they would fail later: unknown
+// parameters, values ParseTodoFilter refuses (ErrInvalidFilter) or lists the user does not own
+// (ErrListNotFound). Returns ErrEmptyListName or ErrListNameTooLong for bad names.
+func validateSmartList(db *sql.DB, name, filter string, userID int64) (string, string, error) {
+	trimmed := strings.TrimSpace(name)
+	if trimmed == "" {
+		return "", "", ErrEmptyListName
+	}
+	if len(trimmed) > MaxListNameLength {
+		return "", "", ErrListNameTooLong
+	}
+
+	values, err := url.ParseQuery(strings.TrimPrefix(strings.TrimSpace(filter), "?"))
+	if err != nil {
+		return "", "", fmt.Errorf("%w: filter must be a query string", ErrInvalidFilter)
+	}
+	for param := range values {
+		if !slices.Contains(todoFilterParams, param) {
+			return "", "", fmt.Errorf("%w: unknown filter parameter %q", ErrInvalidFilter, param)
+		}
+	}
+	parsed, err := ParseTodoFilter(values, time.UTC, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	if len(parsed.ListIDs) > 0 {
+		if err := requireLists(db, parsed.ListIDs, userID); err != nil {
+			return "", "", err
+		}
+	}
+
+	return trimmed, values.Encode(), nil
+}
+
+// ListSmartLists returns all smart lists of the user, alphabetically.
+func ListSmartLists(db *sql.DB, userID int64) ([]SmartList, error) {
+	rows, err := db.Query("SELECT "+smartListColumns+" FROM smart_lists WHERE user_id = ? ORDER BY name COLLATE NOCASE, id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	smartLists := []SmartList{}
+	for rows.Next() {
+		sl, err := scanSmartList(rows)
+		if err != nil {
+			return nil, err
+		}
+		smartLists = append(smartLists, sl)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return smartLists, nil
+}
+
+// GetSmartList returns a smart list by ID, scoped to the given user.
+// Returns ErrSmartListNotFound if it does not exist or does not belong to the user.
+func GetSmartList(db *sql.DB, id int64, userID int64) (SmartList, error) {
+	sl, err := scanSmartList(db.QueryRow("SELECT "+smartListColumns+" FROM smart_lists WHERE id = ? AND user_id = ?", id, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return SmartList{}, ErrSmartListNotFound
+		}
+		return SmartList{}, err
+	}
+	return sl, nil
+}
+
+// CreateSmartList saves a named filter for the user; see validateSmartList for the checks applied.
+// Returns ErrDuplicateSmartList if the user already has a smart list with that name.
+func CreateSmartList(db *sql.DB, name string, filter string, userID int64) (SmartList, error) {
+	trimmed, canonical, err := validateSmartList(db, name, filter, userID)
+	if err != nil {
+		return SmartList{}, err
+	}
+
+	result, err := db.Exec("INSERT INTO smart_lists (name, filter, user_id) VALUES (?, ?, ?)", trimmed, canonical, userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return SmartList{}, ErrDuplicateSmartList
+		}
+		return SmartList{}, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return SmartList{}, err
+	}
+
+	return GetSmartList(db, id, userID)
+}
+
+// UpdateSmartList replaces the name and filter of a smart list, scoped to the given user, with the
+// same validation as CreateSmartList. Returns ErrSmartListNotFound if it does not exist or does not
+// belong to the user.
+func UpdateSmartList(db *sql.DB, id int64, name string, filter string, userID int64) error {
+	trimmed, canonical, err := validateSmartList(db, name, filter, userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec("UPDATE smart_lists SET name = ?, filter = ? WHERE id = ? AND user_id = ?", trimmed, canonical, id, userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrDuplicateSmartList
+		}
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrSmartListNotFound
+	}
+
+	return nil
+}
+
+// DeleteSmartList removes a smart list by ID, scoped to the given user. The todos it matched are untouched.
+// Returns ErrSmartListNotFound if it does not exist or does not belong to the user.
+func DeleteSmartList(db *sql.DB, id int64, userID int64) error {
+	result, err := db.Exec("DELETE FROM smart_lists WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrSmartListNotFound
+	}
+
+	return nil
+}
+
+// QuerySmartListTodos evaluates a smart list's filter now, in the user's timezone, returning one page
+// of matching todos and the next cursor. Returns ErrSmartListNotFound if the smart list does not exist
+// or does not belong to the user, and ErrListNotFound if the filter references a list deleted since.
+func QuerySmartListTodos(db *sql.DB, id int64, userID int64, page Page) ([]Todo, string, error) {
+	sl, err := GetSmartList(db, id, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	loc, err := GetUserLocation(db, userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	values, err := url.ParseQuery(sl.Filter)
+	if err != nil {
+		return nil, "", err
+	}
+	filter, err := ParseTodoFilter(values, loc, time.Now())
+	if err != nil {
+		return nil, "", err
+	}
+
+	return QueryTodos(db, filter, userID, page)
+}
+
+// --- Bulk Functions ---
+
+// BulkAction is an operation BulkUpdateTodos applies to each selected todo.
+type BulkAction string
+
+const (
+	BulkComplete       BulkAction = "complete"
+	BulkUncomplete     BulkAction = "uncomplete"
+	BulkDelete         BulkAction = "delete"
+	BulkRestore        BulkAction = "restore"
+	BulkAddToList      BulkAction = "add_to_list"
+	BulkRemoveFromList BulkAction = "remove_from_list"
+	BulkMoveToList     BulkAction = "move_to_list"
+)
+
+// MaxBulkTodos caps the number of todos in one bulk request.
+const MaxBulkTodos = 500
+
+var (
+	ErrInvalidBulkAction = errors.New("action must be complete, uncomplete, delete, restore, add_to_list, remove_from_list or move_to_list")
+	ErrInvalidBulkSize   = errors.New("ids must hold between 1 and 500 todo IDs")
+)
+
+// isListAction reports whether a bulk action targets a list.
+func (a BulkAction) isListAction() bool {
+	return a == BulkAddToList || a == BulkRemoveFromList || a == BulkMoveToList
+}
+
+// BulkUpdateTodos applies action to every todo in ids in one transaction and returns one error per ID,
+// in order: nil when applied, or ErrNotFound when the todo does not exist, belongs to another user or
+// is not in the state the action applies to (in the trash for restore, out of it otherwise). Failed
+// items change nothing; the others are committed together. A repeated ID shares its first result.
+// List actions need one of the user's lists: add_to_list is idempotent, remove_from_list succeeds for
+// non-members, and move_to_list makes the list the todo's only one.
+// Returns ErrInvalidBulkAction, ErrInvalidBulkSize or ErrListNotFound for the request as a whole.
+func BulkUpdateTodos(db *sql.DB, action BulkAction, ids []int64, listID int64, userID int64) ([]error, error) {
+	switch action {
+	case BulkComplete, BulkUncomplete, BulkDelete, BulkRestore, BulkAddToList, BulkRemoveFromList, BulkMoveToList:
+	default:
+		return nil, ErrInvalidBulkAction
+	}
+	if len(ids) == 0 || len(ids) > MaxBulkTodos {
+		return nil, ErrInvalidBulkSize
+	}
+	if action.isListAction() {
+		if err := requireLists(db, []int64{listID}, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Resolve the timezone before the transaction: with one connection, db cannot be used inside it.
+	loc, err := GetUserLocation(db, userID)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			return nil, err
+		}
+		loc = time.UTC
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	results := make([]error, len(ids))
+	first := make(map[int64]int, len(ids))
+	for i, id := range ids {
+		if j, ok := first[id]; ok {
+			results[i] = results[j]
+			continue
+		}
+		first[id] = i
+
+		err := bulkApply(tx, action, id, listID, loc, userID)
+		if errors.Is(err, ErrNotFound) {
+			results[i] = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	txDone = true
+
+	return results, nil
+}
+
+// bulkApply applies one bulk action to one todo inside tx. It returns ErrNotFound before writing
+// anything when the todo does not qualify, so a failed item never leaves partial changes.
+func bulkApply(tx *sql.Tx, action BulkAction, id int64, listID int64, loc *time.Location, userID int64) error {
+	switch action {
+	case BulkComplete, BulkUncomplete:
+		completed := action == BulkComplete
+		return patchTodo(tx, id, TodoPatch{Completed: &completed}, loc, userID)
+	case BulkRestore:
+		result, err := tx.Exec("UPDATE todos SET deleted_at = NULL WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL", id, userID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	}
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NULL)", id, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	switch action {
+	case BulkDelete:
+		_, err := tx.Exec("UPDATE todos SET deleted_at = datetime('now') WHERE id = ?", id)
+		return err
+	case BulkRemoveFromList:
+		_, err := tx.Exec("DELETE FROM todo_lists WHERE todo_id = ? AND list_id = ?", id, listID)
+		return err
+	case BulkMoveToList:
+		if _, err := tx.Exec("DELETE FROM todo_lists WHERE todo_id = ? AND list_id != ?", id, listID); err != nil {
+			return err
+		}
+	}
+
+	// add_to_list and move_to_list: new members go to the top of the list, existing ones stay put.
+	position, err := topListRank(tx, listID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO todo_lists (todo_id, list_id, position) VALUES (?, ?, ?)", id, listID, position)
+	return err
+}
+
+// --- Idempotency Functions ---
+
+// IdempotencyKeyTTL is how long a saved response can be replayed.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+var (
+	ErrIdempotencyKeyReused     = errors.New("idempotency key was used with a different request")
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is in progress")
+)
+
+// IdempotentResponse is a response saved under an idempotency key for replay.
+type IdempotentResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    []byte
+}
+
+// ReserveIdempotencyKey claims key for a request of the user whose method, path and body hash to
+// requestHash. It returns nil when the request should run (the key is new or its previous use has
+// expired), or the saved response when it is a retry of a completed request.
+// Returns ErrIdempotencyKeyReused if the key was used for a different request and
+// ErrIdempotencyKeyInProgress while the first request with the key has not finished.
+func ReserveIdempotencyKey(db *sql.DB, userID int64, key string, requestHash string, now time.Time) (*IdempotentResponse, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	expired := now.Add(-IdempotencyKeyTTL).UTC().Format(dbTimeLayout)
+	if _, err := tx.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND created_at < ?", userID, key, expired); err != nil {
+		return nil, err
+	}
+
+	var storedHash, headers string
+	var saved IdempotentResponse
+	err = tx.QueryRow("SELECT request_hash, status, headers, body FROM idempotency_keys WHERE user_id = ? AND key = ?", userID, key).
+		Scan(&storedHash, &saved.Status, &headers, &saved.Body)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.Exec("INSERT INTO idempotency_keys (user_id, key, request_hash, created_at) VALUES (?, ?, ?, ?)",
+			userID, key, requestHash, now.UTC().Format(dbTimeLayout))
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		txDone = true
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case storedHash != requestHash:
+		return nil, ErrIdempotencyKeyReused
+	case saved.Status == 0:
+		return nil, ErrIdempotencyKeyInProgress
+	}
+
+	if err := json.Unmarshal([]byte(headers), &saved.Headers); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// SaveIdempotentResponse stores the response of a request that reserved key, for later replay.
+func SaveIdempotentResponse(db *sql.DB, userID int64, key string, resp IdempotentResponse) error {
+	headers, err := json.Marshal(resp.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE idempotency_keys SET status = ?, headers = ?, body = ? WHERE user_id = ? AND key = ?",
+		resp.Status, string(headers), resp.Body, userID, key)
+	return err
+}
+
+// ReleaseIdempotencyKey drops the reservation of key, so a retry runs the request again.
+func ReleaseIdempotencyKey(db *sql.DB, userID int64, key string) error {
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?", userID, key)
+	return err
+}
+
+// PurgeIdempotencyKeys deletes every idempotency key created before cutoff and returns how many were removed.
+func PurgeIdempotencyKeys(db *sql.DB, cutoff time.Time) (int64, error) {
+	result, err := db.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", cutoff.UTC().Format(dbTimeLayout))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// --- Session Functions ---
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// SessionTouchInterval is how stale a session's last_used_at may get before a request updates it,
+// sparing a write on every request.
+const SessionTouchInterval = time.Minute
+
+// MaxUserAgentLength caps the User-Agent stored with a session.
+const MaxUserAgentLength = 512
+
+// sessionColumns selects a session row for scanSession.
+const sessionColumns = "id, user_id, created_at, last_used_at, expires_at, revoked_at, user_agent, ip"
+
+// scanSession reads a row selected with sessionColumns into a Session.
+func scanSession(s rowScanner) (Session, error) {
+	var session Session
+	err := s.Scan(&session.ID, &session.UserID, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &session.RevokedAt,
+		&session.UserAgent, &session.IP)
+	return session, err
+}
+
+// CreateSession starts a session for the user whose refresh token hashes to refreshHash, logged in
+// from userAgent and ip; it expires after RefreshTokenTTL unless refreshed.
+func CreateSession(db *sql.DB, userID int64, refreshHash string, userAgent, ip string, now time.Time) (Session, error) {
+	if len(userAgent) > MaxUserAgentLength {
+		userAgent = userAgent[:MaxUserAgentLength]
+	}
+	created := now.UTC().Format(dbTimeLayout)
+	result, err := db.Exec(
+		"INSERT INTO sessions (user_id, refresh_token_hash, created_at, last_used_at, expires_at, user_agent, ip) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userID, refreshHash, created, created, now.Add(RefreshTokenTTL).UTC().Format(dbTimeLayout), userAgent, ip)
+	if err != nil {
+		return Session{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Session{}, err
+	}
+	return scanSession(db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+}
+
+// RotateSession exchanges the refresh token hashing to oldHash for the one hashing to newHash, sent
+// from ip, and extends the session by RefreshTokenTTL. Returns ErrInvalidRefreshToken if the token is unknown or
+// its session is revoked or expired. A token that was already rotated out is a sign that it was
+// stolen: its session is revoked, ending the whole token family, and ErrRefreshTokenReused returned.
+func RotateSession(db *sql.DB, oldHash, newHash string, ip string, now time.Time) (Session, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Session{}, err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	stamp := now.UTC().Format(dbTimeLayout)
+	session, err := scanSession(tx.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE refresh_token_hash = ?", oldHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		var sessionID int64
+		err := tx.QueryRow("SELECT session_id FROM session_tokens WHERE token_hash = ?", oldHash).Scan(&sessionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return Session{}, ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return Session{}, err
+		}
+		if _, err := tx.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", stamp, sessionID); err != nil {
+			return Session{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return Session{}, err
+		}
+		txDone = true
+		return Session{}, ErrRefreshTokenReused
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if session.RevokedAt != nil || session.ExpiresAt <= stamp {
+		return Session{}, ErrInvalidRefreshToken
+	}
+
+	if _, err := tx.Exec("INSERT INTO session_tokens (token_hash, session_id) VALUES (?, ?)", oldHash, session.ID); err != nil {
+		return Session{}, err
+	}
+	session.LastUsedAt = stamp
+	session.ExpiresAt = now.Add(RefreshTokenTTL).UTC().Format(dbTimeLayout)
+	session.IP = ip
+	_, err = tx.Exec("UPDATE sessions SET refresh_token_hash = ?, last_used_at = ?, expires_at = ?, ip = ? WHERE id = ?",
+		newHash, session.LastUsedAt, session.ExpiresAt, session.IP, session.ID)
+	if err != nil {
+		return Session{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Session{}, err
+	}
+	txDone = true
+	return session, nil
+}
+
+// RevokeSessionByRefreshToken ends the session whose current refresh token hashes to refreshHash.
+// Returns ErrInvalidRefreshToken if there is no such session or it has already ended.
+func RevokeSessionByRefreshToken(db *sql.DB, refreshHash string, now time.Time) error {
+	result, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE refresh_token_hash = ? AND revoked_at IS NULL",
+		now.UTC().Format(dbTimeLayout), refreshHash)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrInvalidRefreshToken
+	}
+	return nil
+}
+
+// TouchSession checks that the user's session is active, i.e. neither revoked nor expired, and
+// records it as used at now, at most once per SessionTouchInterval.
+// Returns ErrSessionNotFound if the session does not exist, belongs to another user or has ended.
+func TouchSession(db *sql.DB, userID, sessionID int64, now time.Time) error {
+	var lastUsed, expires string
+	var revoked *string
+	err := db.QueryRow("SELECT last_used_at, expires_at, revoked_at FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID).
+		Scan(&lastUsed, &expires, &revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	stamp := now.UTC().Format(dbTimeLayout)
+	if revoked != nil || expires <= stamp {
+		return ErrSessionNotFound
+	}
+
+	if lastUsed < now.Add(-SessionTouchInterval).UTC().Format(dbTimeLayout) {
+		if _, err := db.Exec("UPDATE sessions SET last_used_at = ? WHERE id = ?", stamp, sessionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListSessions returns the user's active sessions, most recently used first.
+func ListSessions(db *sql.DB, userID int64, now time.Time) ([]Session, error) {
+	rows, err := db.Query("SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY last_used_at DESC, id DESC",
+		userID, now.UTC().Format(dbTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession logs out one of the user's sessions: its refresh token stops working and so do its
+// access tokens. Returns ErrSessionNotFound if the user has no such active session.
+func RevokeSession(db *sql.DB, userID, sessionID int64, now time.Time) error {
+	stamp := now.UTC().Format(dbTimeLayout)
+	result, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?",
+		stamp, sessionID, userID, stamp)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAllSessions logs out every active session of the user and returns how many there were.
+func RevokeAllSessions(db *sql.DB, userID int64, now time.Time) (int64, error) {
+	stamp := now.UTC().Format(dbTimeLayout)
+	result, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?",
+		stamp, userID, stamp)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PurgeSessions deletes sessions that expired before cutoff, with their rotated tokens, and returns
+// how many were deleted. Revoked sessions are kept until they expire so reuse is still detected.
+func PurgeSessions(db *sql.DB, cutoff time.Time) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	stamp := cutoff.UTC().Format(dbTimeLayout)
+	_, err = tx.Exec("DELETE FROM session_tokens WHERE session_id IN (SELECT id FROM sessions WHERE expires_at < ?)", stamp)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM sessions WHERE expires_at < ?", stamp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	txDone = true
+	return n, nil
+}
+
+// --- Password Functions ---
+
+// PasswordResetTTL is how long a password reset link stays valid.
+const PasswordResetTTL = time.Hour
+
+// PasswordResetInterval is the minimum time between two reset emails to the same user.
+const PasswordResetInterval = time.Minute
+
+var (
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+	ErrResetTooSoon      = errors.New("a password reset was requested too recently")
+)
+
+// CreatePasswordReset records a reset token, hashing to tokenHash, for the user; it replaces any
+// earlier one, so only the latest link works. Returns ErrResetTooSoon if the previous one was
+// created less than PasswordResetInterval ago.
+func CreatePasswordReset(db *sql.DB, userID int64, tokenHash string, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	var recent int
+	err = tx.QueryRow("SELECT COUNT(*) FROM password_resets WHERE user_id = ? AND created_at > ?",
+		userID, now.Add(-PasswordResetInterval).UTC().Format(dbTimeLayout)).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if recent > 0 {
+		return ErrResetTooSoon
+	}
+
+	if _, err := tx.Exec("DELETE FROM password_resets WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO password_resets (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		tokenHash, userID, now.UTC().Format(dbTimeLayout), now.Add(PasswordResetTTL).UTC().Format(dbTimeLayout))
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	txDone = true
+	return nil
+}
+
+// ResetPassword sets the password hash of the user whose reset token hashes to tokenHash, uses up the
+// token and logs out all of the user's sessions. Returns ErrInvalidResetToken if the token is
+// unknown, used or expired.
+func ResetPassword(db *sql.DB, tokenHash, passwordHash string, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	stamp := now.UTC().Format(dbTimeLayout)
+	var userID int64
+	err = tx.QueryRow("SELECT user_id FROM password_resets WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, stamp).
+		Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = ? WHERE token_hash = ?", stamp, tokenHash); err != nil {
+		return err
+	}
+	if err := setPassword(tx, userID, passwordHash, 0, now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	txDone = true
+	return nil
+}
+
+// ChangePassword sets the user's password hash and logs out every session but keepSessionID, the one
+// that made the change. Pending reset links stop working.
+// Returns ErrUserNotFound if the user does not exist.
+func ChangePassword(db *sql.DB, userID int64, passwordHash string, keepSessionID int64, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	if err := setPassword(tx, userID, passwordHash, keepSessionID, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM password_resets WHERE user_id = ? AND used_at IS NULL", userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	txDone = true
+	return nil
+}
+
+// setPassword updates the user's password hash and revokes their sessions except keepSessionID.
+func setPassword(tx *sql.Tx, userID int64, passwordHash string, keepSessionID int64, now time.Time) error {
+	result, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	_, err = tx.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id != ? AND revoked_at IS NULL",
+		now.UTC().Format(dbTimeLayout), userID, keepSessionID)
+	return err
+}
+
+// PurgePasswordResets deletes reset tokens that expired before cutoff and returns how many were deleted.
+func PurgePasswordResets(db *sql.DB, cutoff time.Time) (int64, error) {
+	result, err := db.Exec("DELETE FROM password_resets WHERE expires_at < ?", cutoff.UTC().Format(dbTimeLayout))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// --- Stream Ticket Functions ---
+
+// ErrInvalidStreamTicket is returned for a stream ticket that is unknown, used or expired.
+var ErrInvalidStreamTicket = errors.New("invalid or expired stream ticket")
+
+// CreateStreamTicket records a stream ticket, hashing to ticketHash, for the user's session. It
+// expires after StreamTicketTTL.
+func CreateStreamTicket(db *sql.DB, userID, sessionID int64, ticketHash string, now time.Time) error {
+	_, err := db.Exec("INSERT INTO stream_tickets (ticket_hash, user_id, session_id, expires_at) VALUES (?, ?, ?, ?)",
+		ticketHash, userID, sessionID, now.Add(StreamTicketTTL).UTC().Format(dbTimeLayout))
+	return err
+}
+
+// RedeemStreamTicket uses up the stream ticket hashing to ticketHash and returns the user and
+// session it was issued to. It does not check that the session is still active.
+// Returns ErrInvalidStreamTicket if the ticket is unknown, used or expired.
+func RedeemStreamTicket(db *sql.DB, ticketHash string, now time.Time) (int64, int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	var userID, sessionID int64
+	err = tx.QueryRow("SELECT user_id, session_id FROM stream_tickets WHERE ticket_hash = ? AND expires_at > ?",
+		ticketHash, now.UTC().Format(dbTimeLayout)).Scan(&userID, &sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, ErrInvalidStreamTicket
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM stream_tickets WHERE ticket_hash = ?", ticketHash); err != nil {
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	txDone = true
+	return userID, sessionID, nil
+}
+
+// PurgeStreamTickets deletes stream tickets that expired before cutoff and returns how many were deleted.
+func PurgeStreamTickets(db *sql.DB, cutoff time.Time) (int64, error) {
+	result, err := db.Exec("DELETE FROM stream_tickets WHERE expires_at < ?", cutoff.UTC().Format(dbTimeLayout))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// --- Sync Functions ---
+
+// ErrInvalidSyncToken is returned for a sync token that was not issued to the user.
+var ErrInvalidSyncToken = errors.New("invalid sync token")
+
+// syncTodoColumns selects a todo as it is synced: with its trash date and notes, without its lists.
+const syncTodoColumns = todoColumns + ", t.deleted_at, t.notes"
+
+// scanSyncTodo reads a row selected with syncTodoColumns into a Todo.
+func scanSyncTodo(s rowScanner) (Todo, error) {
+	var deletedAt *string
+	var notes string
+	todo, err := scanTodo(s, &deletedAt, &notes)
+	if err != nil {
+		return Todo{}, err
+	}
+	todo.DeletedAt = deletedAt
+	todo.Notes = &notes
+	return todo, nil
+}
+
+// GetSyncChanges returns the user's todos, lists and todo-list memberships changed after the change
+// token since, with tombstones for those hard-deleted since, and the token to pass next time.
+// A nil since returns a full snapshot (no tombstones). Trashed todos are changes too: they carry
+// DeletedAt until restored or purged. Synced todos include their notes but not their lists, which
+// are in TodoLists. Returns ErrInvalidSyncToken if since is ahead of the user's latest change.
+func GetSyncChanges(db *sql.DB, since *int64, userID int64) (SyncChanges, error) {
+	changes := SyncChanges{
+		Todos:     []Todo{},
+		Lists:     []List{},
+		TodoLists: []TodoListLink{},
+		Deleted:   SyncTombstones{Todos: []int64{}, Lists: []int64{}, TodoLists: []TodoListLink{}},
+	}
+
+	// Read everything from one transaction so the token matches the snapshot.
+	tx, err := db.Begin()
+	if err != nil {
+		return changes, err
+	}
+	defer tx.Rollback()
+
+	var latest int64
+	if err := tx.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM sync_changes WHERE user_id = ?", userID).Scan(&latest); err != nil {
+		return changes, err
+	}
+	changes.Token = strconv.FormatInt(latest, 10)
+	if since != nil && (*since < 0 || *since > latest) {
+		return changes, ErrInvalidSyncToken
+	}
+
+	todoWhere, listWhere := "t.user_id = ?", "l.user_id = ?"
+	todoArgs, listArgs := []any{userID}, []any{userID}
+	linkQuery := "SELECT tl.todo_id, tl.list_id FROM todo_lists tl JOIN todos t ON t.id = tl.todo_id JOIN lists l ON l.id = tl.list_id " +
+		"WHERE t.user_id = ? AND l.user_id = t.user_id ORDER BY tl.todo_id, tl.list_id"
+	linkArgs := []any{userID}
+	if since != nil {
+		changed := " AND %s IN (SELECT entity_id FROM sync_changes WHERE user_id = ? AND entity = ? AND deleted = 0 AND seq > ?)"
+		todoWhere += fmt.Sprintf(changed, "t.id")
+		todoArgs = append(todoArgs, userID, "todo", *since)
+		listWhere += fmt.Sprintf(changed, "l.id")
+		listArgs = append(listArgs, userID, "list", *since)
+		linkQuery = "SELECT c.entity_id, c.list_id FROM sync_changes c JOIN todo_lists tl ON tl.todo_id = c.entity_id AND tl.list_id = c.list_id " +
+			"WHERE c.user_id = ? AND c.entity = 'todo_list' AND c.deleted = 0 AND c.seq > ? ORDER BY c.entity_id, c.list_id"
+		linkArgs = append(linkArgs, *since)
+	}
+
+	rows, err := tx.Query("SELECT "+syncTodoColumns+" FROM todos t WHERE "+todoWhere+" ORDER BY t.id", todoArgs...)
+	if err != nil {
+		return changes, err
+	}
+	for rows.Next() {
+		todo, err := scanSyncTodo(rows)
+		if err != nil {
+			rows.Close()
+			return changes, err
+		}
+		changes.Todos = append(changes.Todos, todo)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return changes, err
+	}
+
+	rows, err = tx.Query("SELECT "+listColumns+" FROM lists l WHERE "+listWhere+" ORDER BY l.id", listArgs...)
+	if err != nil {
+		return changes, err
+	}
+	for rows.Next() {
+		l, err := scanList(rows)
+		if err != nil {
+			rows.Close()
+			return changes, err
+		}
+		changes.Lists = append(changes.Lists, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return changes, err
+	}
+
+	if changes.TodoLists, err = querySyncLinks(tx, linkQuery, linkArgs...); err != nil {
+		return changes, err
+	}
+
+	if since == nil {
+		return changes, nil
+	}
+
+	tombstones := "SELECT entity_id FROM sync_changes WHERE user_id = ? AND entity = ? AND deleted = 1 AND seq > ? ORDER BY entity_id"
+	if changes.Deleted.Todos, err = querySyncIDs(tx, tombstones, userID, "todo", *since); err != nil {
+		return changes, err
+	}
+	if changes.Deleted.Lists, err = querySyncIDs(tx, tombstones, userID, "list", *since); err != nil {
+		return changes, err
+	}
+	changes.Deleted.TodoLists, err = querySyncLinks(tx,
+		"SELECT entity_id, list_id FROM sync_changes WHERE user_id = ? AND entity = 'todo_list' AND deleted = 1 AND seq > ? ORDER BY entity_id, list_id",
+		userID, *since)
+	if err != nil {
+		return changes, err
+	}
+
+	return changes, nil
+}
+
+// querySyncIDs returns the IDs selected by query as a non-nil slice.
+func querySyncIDs(tx *sql.Tx, query string, args ...any) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// querySyncLinks returns the (todo ID, list ID) pairs selected by query as a non-nil slice.
+func querySyncLinks(tx *sql.Tx, query string, args ...any) ([]TodoListLink, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []TodoListLink{}
+	for rows.Next() {
+		var link TodoListLink
+		if err := rows.Scan(&link.TodoID, &link.ListID); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// SyncOpKind is the kind of an offline operation replayed by PushSyncOps.
+type SyncOpKind string
+
+const (
+	SyncCreateTodo     SyncOpKind = "create_todo"
+	SyncUpdateTodo     SyncOpKind = "update_todo"
+	SyncDeleteTodo     SyncOpKind = "delete_todo"
+	SyncAddToList      SyncOpKind = "add_to_list"
+	SyncRemoveFromList SyncOpKind = "remove_from_list"
+)
+
+// MaxSyncOps caps the number of operations in one push.
+const MaxSyncOps = 500
+
+var (
+	ErrInvalidSyncOp     = errors.New("op must be create_todo, update_todo, delete_todo, add_to_list or remove_from_list")
+	ErrInvalidSyncBatch  = errors.New("operations must hold between 1 and 500 operations")
+	ErrUnknownClientID   = errors.New("client_id does not match a todo created earlier in the batch")
+	ErrDuplicateClientID = errors.New("client_id is already used in the batch")
+	ErrTodoInTrash       = errors.New("todo is in the trash")
+)
+
+// SyncOp is an operation recorded by a client while offline. The target todo is TodoID, or the todo
+// created earlier in the same batch under ClientID; create_todo records its new todo under ClientID.
+// Patch holds the fields of create_todo (Title is required) and update_todo. A non-zero Version
+// makes update_todo and delete_todo conditional on the todo still being at that version.
+type SyncOp struct {
+	Kind     SyncOpKind
+	TodoID   int64
+	ClientID string
+	Version  int64
+	Patch    TodoPatch
+	ListID   int64
+}
+
+// SyncOpResult is the outcome of one SyncOp: the todo it targeted, that todo's state once the whole
+// batch is applied (nil if it no longer exists), and nil or the error that made the operation fail.
+type SyncOpResult struct {
+	TodoID int64
+	Todo   *Todo
+	Err    error
+}
+
+// PushSyncOps applies ops in order in one transaction and returns one result per operation. Failed
+// operations change nothing and do not stop the others. The server wins conflicts: a stale Version
+// fails with ErrVersionMismatch and an operation on a trashed todo (other than deleting it again) with
+// ErrTodoInTrash, both reporting the server's state. Other per-operation errors are ErrNotFound,
+// ErrListNotFound, ErrUnknownClientID, ErrDuplicateClientID and the validation errors of
+// CreateTodoWithDetails. Returns ErrInvalidSyncBatch or ErrInvalidSyncOp for the request as a whole.
+func PushSyncOps(db *sql.DB, ops []SyncOp, userID int64) ([]SyncOpResult, error) {
+	if len(ops) == 0 || len(ops) > MaxSyncOps {
+		return nil, ErrInvalidSyncBatch
+	}
+	for _, op := range ops {
+		switch op.Kind {
+		case SyncCreateTodo, SyncUpdateTodo, SyncDeleteTodo, SyncAddToList, SyncRemoveFromList:
+		default:
+			return nil, ErrInvalidSyncOp
+		}
+	}
+
+	// Resolve the timezone before the transaction: with one connection, db cannot be used inside it.
+	loc, err := GetUserLocation(db, userID)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			return nil, err
+		}
+		loc = time.UTC
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var txDone bool
+	defer func() {
+		if !txDone {
+			tx.Rollback()
+		}
+	}()
+
+	results := make([]SyncOpResult, len(ops))
+	created := make(map[string]int64)
+	for i, op := range ops {
+		// Each operation runs in a savepoint so that a failed one leaves no partial writes.
+		if _, err := tx.Exec("SAVEPOINT sync_op"); err != nil {
+			return nil, err
+		}
+		id, err := syncApply(tx, op, created, loc, userID)
+		results[i] = SyncOpResult{TodoID: id, Err: err}
+		if err != nil {
+			if !isSyncOpError(err) {
+				return nil, err
+			}
+			if _, err := tx.Exec("ROLLBACK TO sync_op"); err != nil {
+				return nil, err
+			}
+		} else if op.Kind == SyncCreateTodo && op.ClientID != "" {
+			created[op.ClientID] = id
+		}
+		if _, err := tx.Exec("RELEASE sync_op"); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range results {
+		if results[i].TodoID == 0 {
+			continue
+		}
+		todo, err := scanSyncTodo(tx.QueryRow("SELECT "+syncTodoColumns+" FROM todos t WHERE t.id = ? AND t.user_id = ?", results[i].TodoID, userID))
+		if err == nil {
+			results[i].Todo = &todo
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	txDone = true
+
+	return results, nil
+}
+
+// syncApply applies one SyncOp inside tx and returns the ID of the todo it targeted (0 if unresolved).
+// created maps the client IDs of the batch's todos so far to their IDs.
+func syncApply(tx *sql.Tx, op SyncOp, created map[string]int64, loc *time.Location, userID int64) (int64, error) {
+	if op.Kind == SyncCreateTodo {
+		if _, ok := created[op.ClientID]; ok {
+			return 0, ErrDuplicateClientID
+		}
+		return syncCreateTodo(tx, op.Patch, loc, userID)
+	}
+
+	id := op.TodoID
+	if id == 0 {
+		var ok bool
+		if id, ok = created[op.ClientID]; !ok {
+			return 0, ErrUnknownClientID
+		}
+	}
+
+	var err error
+	switch op.Kind {
+	case SyncUpdateTodo:
+		patch := op.Patch
+		patch.Version = op.Version
+		err = patchTodo(tx, id, patch, loc, userID)
+	case SyncDeleteTodo:
+		err = syncDeleteTodo(tx, id, op.Version, userID)
+	case SyncAddToList, SyncRemoveFromList:
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM lists WHERE id = ? AND user_id = ?)", op.ListID, userID).Scan(&exists); err != nil {
+			return id, err
+		}
+		if !exists {
+			return id, ErrListNotFound
+		}
+		action := BulkAddToList
+		if op.Kind == SyncRemoveFromList {
+			action = BulkRemoveFromList
+		}
+		err = bulkApply(tx, action, id, op.ListID, loc, userID)
+	}
+
+	if errors.Is(err, ErrNotFound) {
+		var trashed bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM todos WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL)", id, userID).Scan(&trashed); err != nil {
+			return id, err
+		}
+		if trashed {
+			return id, ErrTodoInTrash
+		}
+	}
+	return id, err
+}
+
+// syncCreateTodo inserts a todo at the top of the user's manual order and applies the rest of patch
+// to it, returning its ID.
+func syncCreateTodo(tx *sql.Tx, patch TodoPatch, loc *time.Location, userID int64) (int64, error) {
+	if patch.Title == nil {
+		return 0, ErrEmptyTitle
+	}
+	title, err := validateTitle(*patch.Title)
+	if err != nil {
+		return 0, err
+	}
+	position, err := topTodoRank(tx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO todos (title, user_id, position) VALUES (?, ?, ?)", title, userID, position)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	patch.Title, patch.Version = nil, 0
+	return id, patchTodo(tx, id, patch, loc, userID)
+}
+
+// syncDeleteTodo moves a todo to the trash unless it is already there, checking version (0 skips
+// the check) first.
+func syncDeleteTodo(tx *sql.Tx, id int64, version int64, userID int64) error {
+	var current int64
+	var trashed bool
+	err := tx.QueryRow("SELECT version, deleted_at IS NOT NULL FROM todos WHERE id = ? AND user_id = ?", id, userID).Scan(&current, &trashed)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if trashed {
+		return nil
+	}
+	if version != 0 && version != current {
+		return ErrVersionMismatch
+	}
+	_, err = tx.Exec("UPDATE todos SET deleted_at = datetime('now') WHERE id = ?", id)
+	return err
+}
+
+// isSyncOpError reports whether err fails a single SyncOp rather than the whole push.
+func isSyncOpError(err error) bool {
+	for _, target := range []error{
+		ErrNotFound, ErrListNotFound, ErrVersionMismatch, ErrTodoInTrash, ErrUnknownClientID, ErrDuplicateClientID,
+		ErrEmptyTitle, ErrTitleTooLong, ErrStartAfterDue, ErrInvalidPriority, ErrNotesTooLong, ErrInvalidRecurrence,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// --- Event Functions ---
+
+// idPlaceholders returns n comma-separated placeholders for an IN (...) list.
+func idPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// syncTodosByID loads the todos with the given IDs in their sync form, keyed by ID, with one query
+// per attachBatchSize IDs. Missing IDs are left out.
+func syncTodosByID(db *sql.DB, ids []int64) (map[int64]Todo, error) {
+	todos := make(map[int64]Todo, len(ids))
+	for start := 0; start < len(ids); start += attachBatchSize {
+		batch := ids[start:min(start+attachBatchSize, len(ids))]
+		args := make([]any, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		rows, err := db.Query("SELECT "+syncTodoColumns+" FROM todos t WHERE t.id IN ("+idPlaceholders(len(batch))+")", args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			todo, err := scanSyncTodo(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			todos[todo.ID] = todo
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return todos, nil
+}
+
+// listsByID loads the lists with the given IDs, keyed by ID, with one query per attachBatchSize IDs.
+// Missing IDs are left out.
+func listsByID(db *sql.DB, ids []int64) (map[int64]List, error) {
+	lists := make(map[int64]List, len(ids))
+	for start := 0; start < len(ids); start += attachBatchSize {
+		batch := ids[start:min(start+attachBatchSize, len(ids))]
+		args := make([]any, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		rows, err := db.Query("SELECT "+listColumns+" FROM lists l WHERE l.id IN ("+idPlaceholders(len(batch))+")", args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			l, err := scanList(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			lists[l.ID] = l
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
+
+// GetChangeEvents returns the changes recorded after the sync token after as events, oldest first, for
+// one user or, with userID 0, for every user; at most limit of them (0 for no limit). Each entity
+// appears once, with its latest change and current state; one deleted after its change was
+// selected is skipped, as its deletion follows. Returns ErrInvalidSyncToken if after is ahead of
+// the user's latest change.
+func GetChangeEvents(db *sql.DB, after int64, userID int64, limit int) ([]Event, error) {
+	type change struct {
+		seq, userID, entityID, listID int64
+		entity                        string
+		deleted                       bool
+	}
+
+	query := "SELECT seq, user_id, entity, entity_id, list_id, deleted FROM sync_changes WHERE seq > ?"
+	args := []any{after}
+	if userID != 0 {
+		var latest int64
+		if err := db.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM sync_changes WHERE user_id = ?", userID).Scan(&latest); err != nil {
+			return nil, err
+		}
+		if after < 0 || after > latest {
+			return nil, ErrInvalidSyncToken
+		}
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	query += " ORDER BY seq"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var changes []change
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&c.seq, &c.userID, &c.entity, &c.entityID, &c.listID, &c.deleted); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var todoIDs, listIDs []int64
+	for _, c := range changes {
+		switch {
+		case c.entity == "todo" && !c.deleted:
+			todoIDs = append(todoIDs, c.entityID)
+		case c.entity == "list" && !c.deleted:
+			listIDs = append(listIDs, c.entityID)
+		}
+	}
+	todos, err := syncTodosByID(db, todoIDs)
+	if err != nil {
+		return nil, err
+	}
+	lists, err := listsByID(db, listIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	type deletedEntity struct {
+		ID int64 `json:"id"`
+	}
+	events := make([]Event, 0, len(changes))
+	for _, c := range changes {
+		e := Event{ID: c.seq, UserID: c.userID}
+		switch {
+		case c.entity == "todo" && c.deleted:
+			e.Type, e.Data = EventTodoDeleted, deletedEntity{c.entityID}
+		case c.entity == "todo":
+			todo, ok := todos[c.entityID]
+			if !ok {
+				continue
+			}
+			e.Type, e.Data = EventTodoChanged, todo
+		case c.entity == "list" && c.deleted:
+			e.Type, e.Data = EventListDeleted, deletedEntity{c.entityID}
+		case c.entity == "list":
+			list, ok := lists[c.entityID]
+			if !ok {
+				continue
+			}
+			e.Type, e.Data = EventListChanged, list
+		case c.entity == "todo_list" && c.deleted:
+			e.Type, e.Data = EventTodoListRemoved, TodoListLink{c.entityID, c.listID}
+		default:
+			e.Type, e.Data = EventTodoListAdded, TodoListLink{c.entityID, c.listID}
+		}
+		events = append(events, e)
+	}
+	return events, nil
 }
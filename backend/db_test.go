@@ -3,12 +3,15 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // setupTestDB creates a fresh in-memory SQLite database for testing.
-func setupTestDB(t *testing.T) *sql.DB {
+func setupTestDB(t testing.TB) *sql.DB {
 	t.Helper()
 	db, err := InitDB(":memory:")
 	if err != nil {
@@ -19,7 +22,7 @@ func setupTestDB(t *testing.T) *sql.DB {
 }
 
 // createTestUser is a helper that creates a user and returns the user.
-func createTestUser(t *testing.T, db *sql.DB, email, passwordHash string) User {
+func createTestUser(t testing.TB, db *sql.DB, email, passwordHash string) User {
 	t.Helper()
 	user, err := CreateUser(db, email, passwordHash)
 	if err != nil {
@@ -229,6 +232,22 @@ func TestCreateTodo_TitleAtMaxLength(t *testing.T) {
 	}
 }
 
+func TestCreateTodo_TitleControlCharacters(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	todo, err := CreateTodo(db, "Buy\x02 milk\x03\tnow\n", user.ID)
+	if err != nil {
+		t.Fatalf("CreateTodo failed: %v", err)
+	}
+	if todo.Title != "Buy milk now" {
+		t.Errorf("expected control characters stripped, got %q", todo.Title)
+	}
+	if _, err := CreateTodo(db, "\x02\x03", user.ID); !errors.Is(err, ErrEmptyTitle) {
+		t.Errorf("expected ErrEmptyTitle for control characters only, got: %v", err)
+	}
+}
+
 func TestGetAllTodos_Empty(t *testing.T) {
 	db := setupTestDB(t)
 	user := createTestUser(t, db, "user@test.com", "hash")
@@ -690,7 +709,6 @@ func TestInitDB_CreatesTagsTables(t *testing.T) {
 	}
 }
 
-
 // --- List Tests ---
 
 func TestInitDB_CreatesListsTables(t *testing.T) {
@@ -1166,4 +1184,2445 @@ func TestCreateTodoInList_TitleTooLong(t *testing.T) {
 		t.Errorf("expected ErrTitleTooLong, got: %v", err)
 	}
 }
-
+
+// --- Due/Start Date Tests ---
+
+func mustParseTodoTime(t *testing.T, value string, loc *time.Location, endOfDay bool) *time.Time {
+	t.Helper()
+	parsed, err := ParseTodoTime(value, loc, endOfDay)
+	if err != nil {
+		t.Fatalf("ParseTodoTime(%q) failed: %v", value, err)
+	}
+	return &parsed
+}
+
+func TestParseTodoTime(t *testing.T) {
+	loc, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Fatalf("LoadLocation failed: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		value    string
+		endOfDay bool
+		want     string
+	}{
+		{"rfc3339 keeps offset", "2026-03-10T09:00:00Z", false, "2026-03-10 09:00:00"},
+		{"local time uses location", "2026-03-10T09:00", false, "2026-03-10 12:00:00"},
+		{"date-only start is beginning of day", "2026-03-10", false, "2026-03-10 03:00:00"},
+		{"date-only due is end of day", "2026-03-10", true, "2026-03-11 02:59:59"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mustParseTodoTime(t, tc.value, loc, tc.endOfDay)
+			if s := *formatDBTime(got); s != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, s)
+			}
+		})
+	}
+
+	if _, err := ParseTodoTime("next tuesday", loc, true); !errors.Is(err, ErrInvalidDate) {
+		t.Errorf("expected ErrInvalidDate, got: %v", err)
+	}
+}
+
+func TestCreateTodoWithDetails_Schedule(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	due := mustParseTodoTime(t, "2026-03-10T18:00:00Z", time.UTC, false)
+	start := mustParseTodoTime(t, "2026-03-09T08:00:00Z", time.UTC, false)
+	todo, err := CreateTodoWithDetails(db, "Plan trip", TodoDetails{DueAt: due, StartAt: start}, user.ID)
+	if err != nil {
+		t.Fatalf("CreateTodoWithDetails failed: %v", err)
+	}
+
+	if todo.DueAt == nil || *todo.DueAt != "2026-03-10 18:00:00" {
+		t.Errorf("expected due_at '2026-03-10 18:00:00', got %v", todo.DueAt)
+	}
+	if todo.StartAt == nil || *todo.StartAt != "2026-03-09 08:00:00" {
+		t.Errorf("expected start_at '2026-03-09 08:00:00', got %v", todo.StartAt)
+	}
+
+	plain, err := CreateTodo(db, "No dates", user.ID)
+	if err != nil {
+		t.Fatalf("CreateTodo failed: %v", err)
+	}
+	if plain.DueAt != nil || plain.StartAt != nil {
+		t.Errorf("expected nil dates, got due=%v start=%v", plain.DueAt, plain.StartAt)
+	}
+}
+
+func TestCreateTodoWithDetails_StartAfterDue(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	due := mustParseTodoTime(t, "2026-03-09T08:00:00Z", time.UTC, false)
+	start := mustParseTodoTime(t, "2026-03-10T08:00:00Z", time.UTC, false)
+	_, err := CreateTodoWithDetails(db, "Backwards", TodoDetails{DueAt: due, StartAt: start}, user.ID)
+	if !errors.Is(err, ErrStartAfterDue) {
+		t.Errorf("expected ErrStartAfterDue, got: %v", err)
+	}
+}
+
+func TestUpdateTodoSchedule_SetAndClear(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Task", user.ID)
+
+	due := mustParseTodoTime(t, "2026-03-10T18:00:00Z", time.UTC, false)
+	if err := UpdateTodoSchedule(db, todo.ID, due, nil, user.ID); err != nil {
+		t.Fatalf("UpdateTodoSchedule failed: %v", err)
+	}
+	got, _ := getTodo(db, todo.ID)
+	if got.DueAt == nil || *got.DueAt != "2026-03-10 18:00:00" {
+		t.Errorf("expected due_at to be set, got %v", got.DueAt)
+	}
+
+	if err := UpdateTodoSchedule(db, todo.ID, nil, nil, user.ID); err != nil {
+		t.Fatalf("UpdateTodoSchedule (clear) failed: %v", err)
+	}
+	got, _ = getTodo(db, todo.ID)
+	if got.DueAt != nil {
+		t.Errorf("expected due_at to be cleared, got %v", *got.DueAt)
+	}
+
+	other := createTestUser(t, db, "other@test.com", "hash")
+	if err := UpdateTodoSchedule(db, todo.ID, due, nil, other.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for wrong user, got: %v", err)
+	}
+}
+
+func TestGetTodosDue_Filters(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	loc, _ := time.LoadLocation("America/Sao_Paulo")
+	// 2026-03-10 22:00 in São Paulo is already 2026-03-11 in UTC.
+	now := time.Date(2026, 3, 10, 22, 0, 0, 0, loc)
+
+	create := func(title, due string) Todo {
+		todo, err := CreateTodoWithDetails(db, title, TodoDetails{DueAt: mustParseTodoTime(t, due, loc, true)}, user.ID)
+		if err != nil {
+			t.Fatalf("CreateTodoWithDetails(%q) failed: %v", title, err)
+		}
+		return todo
+	}
+	create("Yesterday", "2026-03-09")
+	done := create("Yesterday done", "2026-03-09")
+	UpdateTodoStatus(db, done.ID, true, user.ID)
+	create("Today", "2026-03-10")
+	create("Tomorrow", "2026-03-11")
+	CreateTodo(db, "Undated", user.ID)
+
+	testCases := []struct {
+		filter string
+		want   []string
+	}{
+		{DueOverdue, []string{"Yesterday"}},
+		{DueToday, []string{"Today"}},
+		{DueUpcoming, []string{"Tomorrow"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.filter, func(t *testing.T) {
+			todos, err := GetTodosDue(db, user.ID, tc.filter, "", loc, now)
+			if err != nil {
+				t.Fatalf("GetTodosDue failed: %v", err)
+			}
+			var titles []string
+			for _, todo := range todos {
+				titles = append(titles, todo.Title)
+			}
+			if strings.Join(titles, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("expected %v, got %v", tc.want, titles)
+			}
+		})
+	}
+
+	if _, err := GetTodosDue(db, user.ID, "someday", "", loc, now); !errors.Is(err, ErrInvalidDue) {
+		t.Errorf("expected ErrInvalidDue, got: %v", err)
+	}
+}
+
+func TestUpdateUserTimezone(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	if user.Timezone != DefaultTimezone {
+		t.Errorf("expected default timezone %q, got %q", DefaultTimezone, user.Timezone)
+	}
+
+	if err := UpdateUserTimezone(db, user.ID, "Europe/Lisbon"); err != nil {
+		t.Fatalf("UpdateUserTimezone failed: %v", err)
+	}
+	loc, err := GetUserLocation(db, user.ID)
+	if err != nil {
+		t.Fatalf("GetUserLocation failed: %v", err)
+	}
+	if loc.String() != "Europe/Lisbon" {
+		t.Errorf("expected Europe/Lisbon, got %s", loc)
+	}
+
+	if err := UpdateUserTimezone(db, user.ID, "Mars/Olympus"); !errors.Is(err, ErrInvalidTimezone) {
+		t.Errorf("expected ErrInvalidTimezone, got: %v", err)
+	}
+}
+
+// --- Priority Tests ---
+
+func TestCreateTodoWithDetails_Priority(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	todo, err := CreateTodoWithDetails(db, "Fix prod", TodoDetails{Priority: "Urgent"}, user.ID)
+	if err != nil {
+		t.Fatalf("CreateTodoWithDetails failed: %v", err)
+	}
+	if todo.Priority != "urgent" {
+		t.Errorf("expected priority 'urgent', got '%s'", todo.Priority)
+	}
+
+	plain, _ := CreateTodo(db, "Whenever", user.ID)
+	if plain.Priority != "none" {
+		t.Errorf("expected default priority 'none', got '%s'", plain.Priority)
+	}
+
+	_, err = CreateTodoWithDetails(db, "Bad", TodoDetails{Priority: "critical"}, user.ID)
+	if !errors.Is(err, ErrInvalidPriority) {
+		t.Errorf("expected ErrInvalidPriority, got: %v", err)
+	}
+}
+
+func TestUpdateTodoPriority(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Task", user.ID)
+
+	if err := UpdateTodoPriority(db, todo.ID, "high", user.ID); err != nil {
+		t.Fatalf("UpdateTodoPriority failed: %v", err)
+	}
+	got, _ := getTodo(db, todo.ID)
+	if got.Priority != "high" {
+		t.Errorf("expected priority 'high', got '%s'", got.Priority)
+	}
+
+	if err := UpdateTodoPriority(db, todo.ID, "extreme", user.ID); !errors.Is(err, ErrInvalidPriority) {
+		t.Errorf("expected ErrInvalidPriority, got: %v", err)
+	}
+	if err := UpdateTodoPriority(db, 999, "low", user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got: %v", err)
+	}
+}
+
+func TestGetAllTodosSorted_Priority(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	soon := mustParseTodoTime(t, "2026-03-01", time.UTC, true)
+	later := mustParseTodoTime(t, "2026-04-01", time.UTC, true)
+	CreateTodoWithDetails(db, "low", TodoDetails{Priority: "low"}, user.ID)
+	CreateTodoWithDetails(db, "high undated", TodoDetails{Priority: "high"}, user.ID)
+	CreateTodoWithDetails(db, "high later", TodoDetails{Priority: "high", DueAt: later}, user.ID)
+	CreateTodoWithDetails(db, "high soon", TodoDetails{Priority: "high", DueAt: soon}, user.ID)
+
+	todos, err := GetAllTodosSorted(db, user.ID, SortPriority)
+	if err != nil {
+		t.Fatalf("GetAllTodosSorted failed: %v", err)
+	}
+	var titles []string
+	for _, todo := range todos {
+		titles = append(titles, todo.Title)
+	}
+	want := "high soon,high later,high undated,low"
+	if strings.Join(titles, ",") != want {
+		t.Errorf("expected order %s, got %v", want, titles)
+	}
+
+	if _, err := GetAllTodosSorted(db, user.ID, "title"); !errors.Is(err, ErrInvalidSort) {
+		t.Errorf("expected ErrInvalidSort, got: %v", err)
+	}
+}
+
+// --- Notes Tests ---
+
+func TestSanitizeNotes(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain markdown kept", "# Plan\n\n- [ ] step *one*\n> quote", "# Plan\n\n- [ ] step *one*\n> quote"},
+		{"script tag stripped", "hi <script>alert(1)</script>there", "hi alert(1)there"},
+		{"event handler stripped", `<img src=x onerror="alert(1)">ok`, "ok"},
+		{"comment stripped", "a<!-- hidden -->b", "ab"},
+		{"javascript link neutralized", "[click](javascript:alert(1))", "[click](#)"},
+		{"data link neutralized", "[x]( DATA:text/html;base64,AAAA)", "[x](#)"},
+		{"safe autolink kept", "see <https://example.com>", "see <https://example.com>"},
+		{"unsafe autolink removed", "see <javascript:alert(1)>", "see"},
+		{"crlf normalized", "a\r\nb\x00c", "a\nbc"},
+		{"tag split by a nested tag stripped", "<img<b> src=x onerror=alert(1)>ok", "ok"},
+		{"script split by a nested script stripped", "<scr<script>ipt>alert(1)", "alert(1)"},
+		{"unclosed tag escaped", "<img src=x onerror=alert(1)//", "&lt;img src=x onerror=alert(1)//"},
+		{"stray angle bracket escaped", "a < b and <b", "a &lt; b and &lt;b"},
+		{"reference definition neutralized", "[x][1]\n\n[1]: javascript:alert(1)", "[x][1]\n\n[1]: #"},
+		{"reference definition on next line neutralized", "[x][1]\n\n[1]:\n  javascript:alert(1) \"t\"", "[x][1]\n\n[1]:\n  # \"t\""},
+		{"angle reference definition dropped", "[x][1]\n\n[1]: <javascript:alert(1)>", "[x][1]\n\n[1]:"},
+		{"entity-encoded scheme neutralized", "[x](java&#115;cript:alert(1))", "[x](#)"},
+		{"named entity colon neutralized", "[x](javascript&colon;alert(1))", "[x](#)"},
+		{"tab inside scheme neutralized", "[x](java&#9;script:alert(1))", "[x](#)"},
+		{"angle destination dropped", "![x](<vbscript:msgbox(1)>)", "![x]()"},
+		{"angle destination with entities neutralized", "![x](<java&#115;cript:alert(1)>)", "![x](#)"},
+		{"safe links kept", "[a](https://example.com/a_(b)) [b](/path:x) [c]: mailto:me@example.com", "[a](https://example.com/a_(b)) [b](/path:x) [c]: mailto:me@example.com"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sanitizeNotes(tc.input); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGetTodoByID_WithNotes(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "work", "#F8BBD9", user.ID)
+	todo, _ := CreateTodoInListWithDetails(db, "Write report", TodoDetails{Notes: "**draft** <b>now</b>"}, list.ID, user.ID)
+
+	got, err := GetTodoByID(db, todo.ID, user.ID)
+	if err != nil {
+		t.Fatalf("GetTodoByID failed: %v", err)
+	}
+	if got.Notes == nil || *got.Notes != "**draft** now" {
+		t.Errorf("expected sanitized notes '**draft** now', got %v", got.Notes)
+	}
+	if len(got.Lists) != 1 || got.Lists[0].Name != "work" {
+		t.Errorf("expected list 'work', got %v", got.Lists)
+	}
+
+	other := createTestUser(t, db, "other@test.com", "hash")
+	if _, err := GetTodoByID(db, todo.ID, other.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for wrong user, got: %v", err)
+	}
+
+	all, _ := GetAllTodos(db, user.ID)
+	if len(all) != 1 || all[0].Notes != nil {
+		t.Errorf("expected notes to be omitted from GetAllTodos, got %v", all)
+	}
+}
+
+func TestUpdateTodoNotes(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Task", user.ID)
+
+	if err := UpdateTodoNotes(db, todo.ID, "[docs](https://go.dev)", user.ID); err != nil {
+		t.Fatalf("UpdateTodoNotes failed: %v", err)
+	}
+	got, _ := GetTodoByID(db, todo.ID, user.ID)
+	if *got.Notes != "[docs](https://go.dev)" {
+		t.Errorf("expected notes to be stored, got %q", *got.Notes)
+	}
+
+	tooLong := strings.Repeat("a", MaxNotesLength+1)
+	if err := UpdateTodoNotes(db, todo.ID, tooLong, user.ID); !errors.Is(err, ErrNotesTooLong) {
+		t.Errorf("expected ErrNotesTooLong, got: %v", err)
+	}
+	if err := UpdateTodoNotes(db, 999, "x", user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got: %v", err)
+	}
+}
+
+// --- Checklist Item Tests ---
+
+func TestTodoItems_CRUDAndProgress(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "home", "#BBDEFB", user.ID)
+	todo, _ := CreateTodoInList(db, "Move house", list.ID, user.ID)
+
+	first, err := CreateTodoItem(db, todo.ID, "Pack books", user.ID)
+	if err != nil {
+		t.Fatalf("CreateTodoItem failed: %v", err)
+	}
+	second, _ := CreateTodoItem(db, todo.ID, "Book truck", user.ID)
+	if first.Position != 1 || second.Position != 2 {
+		t.Errorf("expected positions 1 and 2, got %d and %d", first.Position, second.Position)
+	}
+
+	done := true
+	updated, err := UpdateTodoItem(db, todo.ID, first.ID, nil, &done, user.ID)
+	if err != nil {
+		t.Fatalf("UpdateTodoItem failed: %v", err)
+	}
+	if !updated.Completed || updated.Title != "Pack books" {
+		t.Errorf("expected completed item with unchanged title, got %+v", updated)
+	}
+
+	all, _ := GetAllTodos(db, user.ID)
+	if all[0].Progress != (Progress{Done: 1, Total: 2}) {
+		t.Errorf("expected progress 1/2 from GetAllTodos, got %+v", all[0].Progress)
+	}
+	inList, _ := ListTodosByList(db, list.ID, user.ID)
+	if inList[0].Progress != (Progress{Done: 1, Total: 2}) {
+		t.Errorf("expected progress 1/2 from ListTodosByList, got %+v", inList[0].Progress)
+	}
+
+	if err := DeleteTodoItem(db, todo.ID, second.ID, user.ID); err != nil {
+		t.Fatalf("DeleteTodoItem failed: %v", err)
+	}
+	if err := DeleteTodoItem(db, todo.ID, second.ID, user.ID); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("expected ErrItemNotFound, got: %v", err)
+	}
+	items, _ := ListTodoItems(db, todo.ID, user.ID)
+	if len(items) != 1 {
+		t.Errorf("expected 1 item, got %d", len(items))
+	}
+}
+
+func TestTodoItems_WrongUser(t *testing.T) {
+	db := setupTestDB(t)
+	owner := createTestUser(t, db, "owner@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	todo, _ := CreateTodo(db, "Private", owner.ID)
+	item, _ := CreateTodoItem(db, todo.ID, "Secret step", owner.ID)
+
+	if _, err := ListTodoItems(db, todo.ID, other.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound listing, got: %v", err)
+	}
+	if _, err := CreateTodoItem(db, todo.ID, "Intrusion", other.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound creating, got: %v", err)
+	}
+	title := "Hijacked"
+	if _, err := UpdateTodoItem(db, todo.ID, item.ID, &title, nil, other.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound updating, got: %v", err)
+	}
+
+	otherTodo, _ := CreateTodo(db, "Mine", other.ID)
+	if _, err := UpdateTodoItem(db, otherTodo.ID, item.ID, &title, nil, other.ID); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("expected ErrItemNotFound for item of another todo, got: %v", err)
+	}
+}
+
+func TestReorderTodoItems(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Trip", user.ID)
+	a, _ := CreateTodoItem(db, todo.ID, "a", user.ID)
+	b, _ := CreateTodoItem(db, todo.ID, "b", user.ID)
+	c, _ := CreateTodoItem(db, todo.ID, "c", user.ID)
+
+	if err := ReorderTodoItems(db, todo.ID, []int64{c.ID, a.ID, b.ID}, user.ID); err != nil {
+		t.Fatalf("ReorderTodoItems failed: %v", err)
+	}
+	items, _ := ListTodoItems(db, todo.ID, user.ID)
+	var titles []string
+	for _, item := range items {
+		titles = append(titles, item.Title)
+	}
+	if strings.Join(titles, "") != "cab" {
+		t.Errorf("expected order cab, got %v", titles)
+	}
+
+	for _, ids := range [][]int64{{a.ID, b.ID}, {a.ID, a.ID, b.ID}, {a.ID, b.ID, 999}} {
+		if err := ReorderTodoItems(db, todo.ID, ids, user.ID); !errors.Is(err, ErrInvalidOrder) {
+			t.Errorf("ids %v: expected ErrInvalidOrder, got: %v", ids, err)
+		}
+	}
+	items, _ = ListTodoItems(db, todo.ID, user.ID)
+	if items[0].Title != "c" {
+		t.Errorf("expected failed reorder to be rolled back, got first item %q", items[0].Title)
+	}
+}
+
+// --- Recurrence Tests ---
+
+func TestParseRecurrence(t *testing.T) {
+	testCases := []struct {
+		rule string
+		want string
+	}{
+		{"weekly", "FREQ=WEEKLY"},
+		{"RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE", "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE"},
+		{"freq=monthly;byday=-1fr", "FREQ=MONTHLY;BYDAY=-1FR"},
+		{"FREQ=MONTHLY;BYMONTHDAY=1,15;COUNT=5", "FREQ=MONTHLY;BYMONTHDAY=1,15;COUNT=5"},
+		{"FREQ=DAILY;UNTIL=20261231", "FREQ=DAILY;UNTIL=20261231T235959Z"},
+	}
+	for _, tc := range testCases {
+		r, err := ParseRecurrence(tc.rule)
+		if err != nil {
+			t.Errorf("ParseRecurrence(%q) failed: %v", tc.rule, err)
+			continue
+		}
+		if r.String() != tc.want {
+			t.Errorf("ParseRecurrence(%q): expected %q, got %q", tc.rule, tc.want, r.String())
+		}
+	}
+
+	for _, rule := range []string{"", "hourly", "FREQ=HOURLY", "FREQ=DAILY;BYDAY=MO", "FREQ=WEEKLY;BYDAY=2MO",
+		"FREQ=WEEKLY;BYMONTHDAY=3", "FREQ=DAILY;COUNT=2;UNTIL=20261231", "FREQ=DAILY;INTERVAL=0", "FREQ=DAILY;BYHOUR=9"} {
+		if _, err := ParseRecurrence(rule); !errors.Is(err, ErrInvalidRecurrence) {
+			t.Errorf("ParseRecurrence(%q): expected ErrInvalidRecurrence, got: %v", rule, err)
+		}
+	}
+}
+
+func TestRecurrenceNext(t *testing.T) {
+	loc, _ := time.LoadLocation("America/New_York")
+	// Thursday 2026-01-29 09:00 local
+	base := time.Date(2026, 1, 29, 9, 0, 0, 0, loc)
+
+	testCases := []struct {
+		rule string
+		from time.Time
+		want time.Time
+	}{
+		{"FREQ=DAILY;INTERVAL=3", base, time.Date(2026, 2, 1, 9, 0, 0, 0, loc)},
+		{"FREQ=WEEKLY", base, time.Date(2026, 2, 5, 9, 0, 0, 0, loc)},
+		{"FREQ=WEEKLY;BYDAY=MO,FR", base, time.Date(2026, 1, 30, 9, 0, 0, 0, loc)},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO", base, time.Date(2026, 2, 9, 9, 0, 0, 0, loc)},
+		{"FREQ=MONTHLY", base, time.Date(2026, 3, 29, 9, 0, 0, 0, loc)}, // February has no 29th
+		{"FREQ=MONTHLY;BYMONTHDAY=-1", base, time.Date(2026, 1, 31, 9, 0, 0, 0, loc)},
+		{"FREQ=MONTHLY;BYDAY=-1FR", base, time.Date(2026, 1, 30, 9, 0, 0, 0, loc)},
+		{"FREQ=MONTHLY;BYDAY=2TU", base, time.Date(2026, 2, 10, 9, 0, 0, 0, loc)},
+		{"FREQ=YEARLY", time.Date(2028, 2, 29, 9, 0, 0, 0, loc), time.Date(2032, 2, 29, 9, 0, 0, 0, loc)},
+		// Wall-clock time is kept across the March DST change.
+		{"FREQ=WEEKLY", time.Date(2026, 3, 5, 9, 0, 0, 0, loc), time.Date(2026, 3, 12, 9, 0, 0, 0, loc)},
+	}
+	for _, tc := range testCases {
+		r, err := ParseRecurrence(tc.rule)
+		if err != nil {
+			t.Fatalf("ParseRecurrence(%q) failed: %v", tc.rule, err)
+		}
+		got, ok := r.Next(tc.from, loc)
+		if !ok || !got.Equal(tc.want) {
+			t.Errorf("%s from %s: expected %s, got %s (ok=%v)", tc.rule, tc.from, tc.want, got, ok)
+		}
+	}
+
+	ended, _ := ParseRecurrence("FREQ=DAILY;COUNT=1")
+	if _, ok := ended.Next(base, loc); ok {
+		t.Error("expected COUNT=1 to end the series")
+	}
+	bounded, _ := ParseRecurrence("FREQ=WEEKLY;UNTIL=20260201")
+	if _, ok := bounded.Next(base, loc); ok {
+		t.Error("expected UNTIL to end the series")
+	}
+}
+
+func TestUpdateTodoStatus_SpawnsNextOccurrence(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "chores", "#FFF9C4", user.ID)
+
+	due := mustParseTodoTime(t, "2026-01-29T14:00:00Z", time.UTC, false)
+	start := mustParseTodoTime(t, "2026-01-29T12:00:00Z", time.UTC, false)
+	todo, err := CreateTodoInListWithDetails(db, "Take out trash",
+		TodoDetails{DueAt: due, StartAt: start, Priority: "high", Recurrence: "FREQ=WEEKLY;COUNT=2"}, list.ID, user.ID)
+	if err != nil {
+		t.Fatalf("CreateTodoInListWithDetails failed: %v", err)
+	}
+	CreateTodoItem(db, todo.ID, "Recycling too", user.ID)
+
+	if err := UpdateTodoStatus(db, todo.ID, true, user.ID); err != nil {
+		t.Fatalf("UpdateTodoStatus failed: %v", err)
+	}
+
+	todos, _ := ListTodosByList(db, list.ID, user.ID)
+	if len(todos) != 2 {
+		t.Fatalf("expected the next occurrence in the same list, got %d todos", len(todos))
+	}
+	var next Todo
+	for _, td := range todos {
+		if td.ID != todo.ID {
+			next = td
+		}
+	}
+	if next.Completed || next.Title != "Take out trash" || next.Priority != "high" {
+		t.Errorf("expected an open copy of the todo, got %+v", next)
+	}
+	if next.DueAt == nil || *next.DueAt != "2026-02-05 14:00:00" {
+		t.Errorf("expected due_at shifted one week, got %v", next.DueAt)
+	}
+	if next.StartAt == nil || *next.StartAt != "2026-02-05 12:00:00" {
+		t.Errorf("expected start_at shifted one week, got %v", next.StartAt)
+	}
+	if next.Recurrence == nil || *next.Recurrence != "FREQ=WEEKLY;COUNT=1" {
+		t.Errorf("expected COUNT to be decremented, got %v", next.Recurrence)
+	}
+	if next.Progress != (Progress{Done: 0, Total: 1}) {
+		t.Errorf("expected checklist to be copied and reset, got %+v", next.Progress)
+	}
+
+	// Re-completing the original does not spawn again, and the last occurrence ends the series.
+	UpdateTodoStatus(db, todo.ID, false, user.ID)
+	UpdateTodoStatus(db, todo.ID, true, user.ID)
+	UpdateTodoStatus(db, next.ID, true, user.ID)
+	all, _ := GetAllTodos(db, user.ID)
+	if len(all) != 2 {
+		t.Errorf("expected no further occurrences, got %d todos", len(all))
+	}
+}
+
+func TestUpdateTodoRecurrence(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Water plants", user.ID)
+
+	if err := UpdateTodoRecurrence(db, todo.ID, "daily", user.ID); err != nil {
+		t.Fatalf("UpdateTodoRecurrence failed: %v", err)
+	}
+	got, _ := getTodo(db, todo.ID)
+	if got.Recurrence == nil || *got.Recurrence != "FREQ=DAILY" {
+		t.Errorf("expected recurrence 'FREQ=DAILY', got %v", got.Recurrence)
+	}
+
+	if err := UpdateTodoRecurrence(db, todo.ID, "FREQ=SECONDLY", user.ID); !errors.Is(err, ErrInvalidRecurrence) {
+		t.Errorf("expected ErrInvalidRecurrence, got: %v", err)
+	}
+
+	if err := UpdateTodoRecurrence(db, todo.ID, "", user.ID); err != nil {
+		t.Fatalf("UpdateTodoRecurrence (clear) failed: %v", err)
+	}
+	got, _ = getTodo(db, todo.ID)
+	if got.Recurrence != nil {
+		t.Errorf("expected recurrence to be cleared, got %v", *got.Recurrence)
+	}
+}
+
+// --- Trash Tests ---
+
+func TestTrash_ListAndRestore(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	kept, _ := CreateTodo(db, "Kept", user.ID)
+	trashed, _ := CreateTodo(db, "Trashed", user.ID)
+	DeleteTodo(db, trashed.ID, user.ID)
+
+	trash, err := ListTrash(db, user.ID)
+	if err != nil {
+		t.Fatalf("ListTrash failed: %v", err)
+	}
+	if len(trash) != 1 || trash[0].ID != trashed.ID || trash[0].DeletedAt == nil {
+		t.Fatalf("expected only the trashed todo with deleted_at, got %+v", trash)
+	}
+	if otherTrash, _ := ListTrash(db, other.ID); len(otherTrash) != 0 {
+		t.Errorf("expected other user's trash to be empty, got %d", len(otherTrash))
+	}
+
+	if err := RestoreTodo(db, trashed.ID, other.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound restoring as another user, got: %v", err)
+	}
+	if err := RestoreTodo(db, kept.ID, user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound restoring a live todo, got: %v", err)
+	}
+	if err := RestoreTodo(db, trashed.ID, user.ID); err != nil {
+		t.Fatalf("RestoreTodo failed: %v", err)
+	}
+	todos, _ := GetAllTodos(db, user.ID)
+	if len(todos) != 2 {
+		t.Errorf("expected 2 todos after restore, got %d", len(todos))
+	}
+}
+
+func TestPurgeTodo_RemovesAssociations(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "work", "#F8BBD9", user.ID)
+	todo, _ := CreateTodoInList(db, "Old", list.ID, user.ID)
+	CreateTodoItem(db, todo.ID, "step", user.ID)
+
+	if err := PurgeTodo(db, todo.ID, user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound purging a todo not in trash, got: %v", err)
+	}
+
+	DeleteTodo(db, todo.ID, user.ID)
+	if err := PurgeTodo(db, todo.ID, user.ID); err != nil {
+		t.Fatalf("PurgeTodo failed: %v", err)
+	}
+
+	for _, table := range []string{"todos WHERE id = ?", "todo_lists WHERE todo_id = ?", "todo_items WHERE todo_id = ?"} {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM "+table, todo.ID).Scan(&count)
+		if count != 0 {
+			t.Errorf("expected no rows in %s, got %d", table, count)
+		}
+	}
+}
+
+func TestPurgeTrash_RespectsCutoff(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	old, _ := CreateTodo(db, "Old", user.ID)
+	recent, _ := CreateTodo(db, "Recent", user.ID)
+	CreateTodo(db, "Live", user.ID)
+	DeleteTodo(db, old.ID, user.ID)
+	DeleteTodo(db, recent.ID, user.ID)
+	db.Exec("UPDATE todos SET deleted_at = datetime('now', '-40 days') WHERE id = ?", old.ID)
+
+	n, err := PurgeTrash(db, time.Now().Add(-DefaultTrashRetention))
+	if err != nil {
+		t.Fatalf("PurgeTrash failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 purged todo, got %d", n)
+	}
+	trash, _ := ListTrash(db, user.ID)
+	if len(trash) != 1 || trash[0].ID != recent.ID {
+		t.Errorf("expected only the recent todo to remain in trash, got %+v", trash)
+	}
+}
+
+// --- Manual Ordering Tests ---
+
+func TestRankBetween(t *testing.T) {
+	maxInteger := "z" + strings.Repeat("z", 26)
+	cases := [][2]string{{"", ""}, {"", "a0"}, {"a0", ""}, {"a0", "a1"}, {"a0", "a0V"}, {"Zz", "a0"},
+		{"a0V", "a1"}, {"a0001", "a001"}, {"b00", "b01"}, {maxInteger, ""}, {"", "Zz"}, {"Zz", "Zz1"}}
+	for _, c := range cases {
+		got := rankBetween(c[0], c[1])
+		if got <= c[0] || (c[1] != "" && got >= c[1]) {
+			t.Errorf("rankBetween(%q, %q) = %q, not strictly between", c[0], c[1], got)
+		}
+	}
+
+	// Repeatedly inserting at the same spot must keep producing ordered ranks.
+	lower, upper := "", ""
+	for i := 0; i < 200; i++ {
+		mid := rankBetween(lower, upper)
+		if mid <= lower || (upper != "" && mid >= upper) {
+			t.Fatalf("step %d: %q not between %q and %q", i, mid, lower, upper)
+		}
+		if i%2 == 0 {
+			upper = mid
+		} else {
+			lower = mid
+		}
+	}
+	// Every new todo goes to the top, so prepends (and appends) must keep ranks short.
+	top, bottom := "", ""
+	for i := 0; i < 10000; i++ {
+		next := rankBetween("", top)
+		if top != "" && next >= top {
+			t.Fatalf("prepend %d: %q not before %q", i, next, top)
+		}
+		top = next
+		next = rankBetween(bottom, "")
+		if next <= bottom {
+			t.Fatalf("append %d: %q not after %q", i, next, bottom)
+		}
+		bottom = next
+	}
+	if len(top) > 4 || len(bottom) > 4 {
+		t.Errorf("expected short ranks after 10000 prepends/appends, got %q and %q", top, bottom)
+	}
+}
+
+func todoTitles(todos []Todo) []string {
+	titles := make([]string, len(todos))
+	for i, td := range todos {
+		titles[i] = td.Title
+	}
+	return titles
+}
+
+func TestMoveTodo(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	a, _ := CreateTodo(db, "A", user.ID)
+	b, _ := CreateTodo(db, "B", user.ID)
+	c, _ := CreateTodo(db, "C", user.ID)
+
+	todos, _ := GetAllTodos(db, user.ID)
+	if got := strings.Join(todoTitles(todos), ""); got != "CBA" {
+		t.Fatalf("expected newest first, got %s", got)
+	}
+
+	if err := MoveTodo(db, c.ID, &a.ID, user.ID); err != nil {
+		t.Fatalf("MoveTodo failed: %v", err)
+	}
+	if err := MoveTodo(db, a.ID, nil, user.ID); err != nil {
+		t.Fatalf("MoveTodo to top failed: %v", err)
+	}
+	todos, _ = GetAllTodos(db, user.ID)
+	if got := strings.Join(todoTitles(todos), ""); got != "ABC" {
+		t.Errorf("expected ABC, got %s", got)
+	}
+
+	// New todos still go to the top of the manual order.
+	CreateTodo(db, "D", user.ID)
+	todos, _ = GetAllTodos(db, user.ID)
+	if got := strings.Join(todoTitles(todos), ""); got != "DABC" {
+		t.Errorf("expected DABC, got %s", got)
+	}
+
+	if err := MoveTodo(db, b.ID, &b.ID, user.ID); !errors.Is(err, ErrInvalidPosition) {
+		t.Errorf("expected ErrInvalidPosition moving after itself, got %v", err)
+	}
+	other := createTestUser(t, db, "other@test.com", "hash")
+	foreign, _ := CreateTodo(db, "Foreign", other.ID)
+	if err := MoveTodo(db, b.ID, &foreign.ID, user.ID); !errors.Is(err, ErrInvalidPosition) {
+		t.Errorf("expected ErrInvalidPosition for another user's todo, got %v", err)
+	}
+	if err := MoveTodo(db, foreign.ID, nil, user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMoveTodoInList(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	a, _ := CreateTodoInList(db, "A", list.ID, user.ID)
+	b, _ := CreateTodoInList(db, "B", list.ID, user.ID)
+	c, _ := CreateTodo(db, "C", user.ID)
+	AddListToTodo(db, c.ID, list.ID, user.ID)
+
+	if err := MoveTodoInList(db, list.ID, c.ID, &a.ID, user.ID); err != nil {
+		t.Fatalf("MoveTodoInList failed: %v", err)
+	}
+	if err := MoveTodoInList(db, list.ID, b.ID, &c.ID, user.ID); err != nil {
+		t.Fatalf("MoveTodoInList failed: %v", err)
+	}
+	todos, _ := ListTodosByList(db, list.ID, user.ID)
+	if got := strings.Join(todoTitles(todos), ""); got != "ACB" {
+		t.Errorf("expected ACB, got %s", got)
+	}
+
+	// The list order is independent of the global order.
+	all, _ := GetAllTodos(db, user.ID)
+	if got := strings.Join(todoTitles(all), ""); got != "CBA" {
+		t.Errorf("expected global order CBA, got %s", got)
+	}
+
+	outside, _ := CreateTodo(db, "Outside", user.ID)
+	if err := MoveTodoInList(db, list.ID, outside.ID, nil, user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a todo outside the list, got %v", err)
+	}
+	if err := MoveTodoInList(db, list.ID, a.ID, &outside.ID, user.ID); !errors.Is(err, ErrInvalidPosition) {
+		t.Errorf("expected ErrInvalidPosition, got %v", err)
+	}
+	if err := MoveTodoInList(db, 9999, a.ID, nil, user.ID); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("expected ErrListNotFound, got %v", err)
+	}
+}
+
+func TestBackfillPositions(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	CreateTodoInList(db, "A", list.ID, user.ID)
+	CreateTodoInList(db, "B", list.ID, user.ID)
+	CreateTodoInList(db, "C", list.ID, user.ID)
+	db.Exec("UPDATE todos SET position = NULL")
+	db.Exec("UPDATE todo_lists SET position = NULL")
+
+	if err := backfillPositions(db); err != nil {
+		t.Fatalf("backfillPositions failed: %v", err)
+	}
+
+	var missing int
+	db.QueryRow("SELECT (SELECT COUNT(*) FROM todos WHERE position IS NULL) + (SELECT COUNT(*) FROM todo_lists WHERE position IS NULL)").Scan(&missing)
+	if missing != 0 {
+		t.Fatalf("expected every row ranked, %d left", missing)
+	}
+	todos, _ := ListTodosByList(db, list.ID, user.ID)
+	if got := strings.Join(todoTitles(todos), ""); got != "CBA" {
+		t.Errorf("expected backfill to keep newest first, got %s", got)
+	}
+}
+
+func listNames(lists []List) string {
+	names := make([]string, len(lists))
+	for i, l := range lists {
+		names[i] = l.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestReorderLists(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	a, _ := CreateList(db, "A", "", user.ID)
+	b, _ := CreateList(db, "B", "", user.ID)
+	c, _ := CreateList(db, "C", "", user.ID)
+
+	lists, _ := ListLists(db, user.ID)
+	if got := listNames(lists); got != "C,B,A" {
+		t.Fatalf("expected newest first, got %s", got)
+	}
+
+	if err := ReorderLists(db, []int64{a.ID, c.ID, b.ID}, user.ID); err != nil {
+		t.Fatalf("ReorderLists failed: %v", err)
+	}
+	lists, _ = ListLists(db, user.ID)
+	if got := listNames(lists); got != "A,C,B" {
+		t.Errorf("expected A,C,B, got %s", got)
+	}
+
+	if err := UpdateListPinned(db, b.ID, true, user.ID); err != nil {
+		t.Fatalf("UpdateListPinned failed: %v", err)
+	}
+	CreateList(db, "D", "", user.ID)
+	lists, _ = ListLists(db, user.ID)
+	if got := listNames(lists); got != "B,D,A,C" {
+		t.Errorf("expected pinned first and new lists on top of the rest, got %s", got)
+	}
+	if !lists[0].Pinned {
+		t.Error("expected pinned flag to be returned")
+	}
+
+	// Partial, duplicated and foreign orders are rejected without changes.
+	other := createTestUser(t, db, "other@test.com", "hash")
+	foreign, _ := CreateList(db, "X", "", other.ID)
+	for _, ids := range [][]int64{{a.ID}, {a.ID, a.ID, b.ID, c.ID}, {a.ID, b.ID, c.ID, foreign.ID}} {
+		if err := ReorderLists(db, ids, user.ID); !errors.Is(err, ErrInvalidOrder) {
+			t.Errorf("ReorderLists(%v): expected ErrInvalidOrder, got %v", ids, err)
+		}
+	}
+	lists, _ = ListLists(db, user.ID)
+	if got := listNames(lists); got != "B,D,A,C" {
+		t.Errorf("expected order unchanged after rejected reorder, got %s", got)
+	}
+
+	if err := UpdateListPinned(db, foreign.ID, true, user.ID); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("expected ErrListNotFound, got %v", err)
+	}
+}
+
+// --- Search Tests ---
+
+func TestSearchTodos(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	milk, _ := CreateTodo(db, "Buy milk", user.ID)
+	notesOnly, _ := CreateTodoWithDetails(db, "Groceries", TodoDetails{Notes: "milk, eggs and <b>bread</b>"}, user.ID)
+	CreateTodo(db, "Call mom", user.ID)
+	other := createTestUser(t, db, "other@test.com", "hash")
+	CreateTodo(db, "Buy milk too", other.ID)
+
+	results, err := SearchTodos(db, "mil", SearchFilter{}, user.ID)
+	if err != nil {
+		t.Fatalf("SearchTodos failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 prefix matches, got %d", len(results))
+	}
+	if results[0].ID != milk.ID || results[1].ID != notesOnly.ID {
+		t.Errorf("expected title match ranked first, got %d then %d", results[0].ID, results[1].ID)
+	}
+	if results[0].Snippet != "Buy <mark>milk</mark>" {
+		t.Errorf("unexpected title snippet %q", results[0].Snippet)
+	}
+
+	// Snippets are HTML-escaped; notes are sanitized on save, so the tags are already gone.
+	results, _ = SearchTodos(db, "eggs", SearchFilter{}, user.ID)
+	if len(results) != 1 || strings.Contains(results[0].Snippet, "<b>") || !strings.Contains(results[0].Snippet, "<mark>eggs</mark>") {
+		t.Errorf("unexpected notes snippet %+v", results)
+	}
+
+	// The index follows title updates and soft deletes.
+	UpdateTodoTitle(db, milk.ID, "Buy oat drink", user.ID)
+	if results, _ = SearchTodos(db, "oat", SearchFilter{}, user.ID); len(results) != 1 {
+		t.Errorf("expected renamed todo to be found, got %d", len(results))
+	}
+	DeleteTodo(db, notesOnly.ID, user.ID)
+	if results, _ = SearchTodos(db, "milk", SearchFilter{}, user.ID); len(results) != 0 {
+		t.Errorf("expected deleted and renamed todos to be excluded, got %d", len(results))
+	}
+
+	// Operator characters are matched literally rather than breaking the query.
+	if _, err := SearchTodos(db, `"mom" OR (`, SearchFilter{}, user.ID); err != nil {
+		t.Errorf("expected punctuation to be tolerated, got %v", err)
+	}
+	if _, err := SearchTodos(db, `  "" `, SearchFilter{}, user.ID); !errors.Is(err, ErrEmptyQuery) {
+		t.Errorf("expected ErrEmptyQuery, got %v", err)
+	}
+}
+
+func TestSearchTodos_SnippetDelimitersInStoredTitle(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Buy milk", user.ID)
+	// Rows written before titles were validated for control characters.
+	if _, err := db.Exec("UPDATE todos SET title = ? WHERE id = ?", "Buy \x02<script>\x03 milk", todo.ID); err != nil {
+		t.Fatalf("update title: %v", err)
+	}
+
+	if err := initSearchIndex(db); err != nil {
+		t.Fatalf("initSearchIndex failed: %v", err)
+	}
+	results, err := SearchTodos(db, "milk", SearchFilter{}, user.ID)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d (%v)", len(results), err)
+	}
+	if results[0].Snippet != "Buy &lt;script&gt; <mark>milk</mark>" {
+		t.Errorf("unexpected snippet %q", results[0].Snippet)
+	}
+}
+
+func TestSearchTodos_Filters(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	inList, _ := CreateTodoInList(db, "Report draft", list.ID, user.ID)
+	done, _ := CreateTodo(db, "Report final", user.ID)
+	UpdateTodoStatus(db, done.ID, true, user.ID)
+
+	results, _ := SearchTodos(db, "report", SearchFilter{ListID: &list.ID}, user.ID)
+	if len(results) != 1 || results[0].ID != inList.ID {
+		t.Errorf("expected only the list's todo, got %+v", results)
+	}
+	completed := true
+	results, _ = SearchTodos(db, "report", SearchFilter{Completed: &completed}, user.ID)
+	if len(results) != 1 || results[0].ID != done.ID {
+		t.Errorf("expected only the completed todo, got %+v", results)
+	}
+	missing := int64(9999)
+	if _, err := SearchTodos(db, "report", SearchFilter{ListID: &missing}, user.ID); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("expected ErrListNotFound, got %v", err)
+	}
+}
+
+func TestInitSearchIndex_RebuildsExistingTodos(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	CreateTodo(db, "Água mineral", user.ID)
+	if _, err := db.Exec("DROP TABLE todos_fts"); err != nil {
+		t.Fatalf("drop index: %v", err)
+	}
+
+	if err := initSearchIndex(db); err != nil {
+		t.Fatalf("initSearchIndex failed: %v", err)
+	}
+	results, err := SearchTodos(db, "agua", SearchFilter{}, user.ID)
+	if err != nil || len(results) != 1 {
+		t.Errorf("expected rebuilt index to match without diacritics, got %d (%v)", len(results), err)
+	}
+}
+
+// --- Pagination Tests ---
+
+func TestGetAllTodosPage_MatchesUnpaginatedOrder(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	loc := time.UTC
+	priorities := []string{"none", "high", "low", "high", "urgent"}
+	for i := 0; i < 23; i++ {
+		details := TodoDetails{Priority: priorities[i%len(priorities)]}
+		if i%3 != 0 {
+			// Several todos share a due date so ties fall through to created_at, id.
+			details.DueAt = mustParseTodoTime(t, "2030-01-0"+strconv.Itoa(1+i%4), loc, true)
+		}
+		CreateTodoWithDetails(db, "Todo "+strconv.Itoa(i), details, user.ID)
+	}
+	all, _ := GetAllTodos(db, user.ID)
+	MoveTodo(db, all[5].ID, nil, user.ID)
+	MoveTodo(db, all[0].ID, &all[10].ID, user.ID)
+
+	for _, sort := range []TodoSort{SortPosition, SortCreated, SortPriority, SortDue} {
+		want, _ := GetAllTodosSorted(db, user.ID, sort)
+		var got []Todo
+		page := Page{Limit: 5}
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatalf("sort %s: pagination did not terminate", sort)
+			}
+			todos, next, err := GetAllTodosPage(db, user.ID, sort, page)
+			if err != nil {
+				t.Fatalf("sort %s: GetAllTodosPage failed: %v", sort, err)
+			}
+			if len(todos) > 5 {
+				t.Fatalf("sort %s: page of %d exceeds limit", sort, len(todos))
+			}
+			got = append(got, todos...)
+			if next == "" {
+				break
+			}
+			page.Cursor = next
+		}
+		if len(got) != len(want) {
+			t.Fatalf("sort %s: expected %d todos across pages, got %d", sort, len(want), len(got))
+		}
+		for i := range want {
+			if got[i].ID != want[i].ID {
+				t.Errorf("sort %s: position %d: expected todo %d, got %d", sort, i, want[i].ID, got[i].ID)
+				break
+			}
+		}
+	}
+}
+
+func TestPagination_InvalidParameters(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	for i := 0; i < 3; i++ {
+		CreateTodoInList(db, "Todo", list.ID, user.ID)
+	}
+
+	_, next, err := GetAllTodosPage(db, user.ID, SortCreated, Page{Limit: 2})
+	if err != nil || next == "" {
+		t.Fatalf("expected a next cursor, got %q (%v)", next, err)
+	}
+	if _, _, err := GetAllTodosPage(db, user.ID, SortDue, Page{Limit: 2, Cursor: next}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor for a cursor of another sort, got %v", err)
+	}
+	if _, _, err := ListTodosByListPage(db, list.ID, user.ID, SortCreated, Page{Limit: 2, Cursor: next}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor for a cursor of another view, got %v", err)
+	}
+	if _, _, err := GetAllTodosPage(db, user.ID, SortCreated, Page{Cursor: "not-a-cursor"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+	if _, _, err := GetAllTodosPage(db, user.ID, SortCreated, Page{Limit: MaxPageSize + 1}); !errors.Is(err, ErrInvalidLimit) {
+		t.Errorf("expected ErrInvalidLimit, got %v", err)
+	}
+
+	todos, next, _ := ListTodosByListPage(db, list.ID, user.ID, "", Page{Limit: 3})
+	if len(todos) != 3 || next != "" {
+		t.Errorf("expected a single full page without cursor, got %d todos and %q", len(todos), next)
+	}
+}
+
+func TestListListsPage(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	for _, name := range []string{"A", "B", "C", "D", "E"} {
+		CreateList(db, name, "", user.ID)
+	}
+	lists, _ := ListLists(db, user.ID)
+	UpdateListPinned(db, lists[3].ID, true, user.ID)
+	want, _ := ListLists(db, user.ID)
+
+	first, next, err := ListListsPage(db, user.ID, Page{Limit: 3})
+	if err != nil || len(first) != 3 || next == "" {
+		t.Fatalf("expected first page of 3 with cursor, got %d, %q (%v)", len(first), next, err)
+	}
+	rest, next, err := ListListsPage(db, user.ID, Page{Limit: 3, Cursor: next})
+	if err != nil || len(rest) != 2 || next != "" {
+		t.Fatalf("expected last page of 2 without cursor, got %d, %q (%v)", len(rest), next, err)
+	}
+	if got := listNames(append(first, rest...)); got != listNames(want) {
+		t.Errorf("expected %s across pages, got %s", listNames(want), got)
+	}
+}
+
+// --- Read Path Tests and Benchmarks ---
+
+func TestAttachTodoLists_Batched(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	seedTodos(t, db, user.ID, attachBatchSize+7, 3)
+
+	todos, _ := GetAllTodos(db, user.ID)
+	if err := attachTodoLists(db, todos, user.ID); err != nil {
+		t.Fatalf("attachTodoLists failed: %v", err)
+	}
+	for _, td := range todos {
+		want, _ := ListTodoLists(db, td.ID, user.ID)
+		if len(td.Lists) != len(want) {
+			t.Fatalf("todo %d: expected %d lists, got %d", td.ID, len(want), len(td.Lists))
+		}
+		for i := range want {
+			if td.Lists[i].ID != want[i].ID {
+				t.Fatalf("todo %d: expected lists %+v, got %+v", td.ID, want, td.Lists)
+			}
+		}
+	}
+}
+
+// seedTodos inserts n todos for the user directly in one transaction, spread over the given number
+// of lists (every todo joins one list, every third a second one), ranked newest first.
+func seedTodos(tb testing.TB, db *sql.DB, userID int64, n int, lists int) {
+	tb.Helper()
+	var listIDs []int64
+	for i := 0; i < lists; i++ {
+		l, err := CreateList(db, "List "+strconv.Itoa(i), "", userID)
+		if err != nil {
+			tb.Fatalf("CreateList failed: %v", err)
+		}
+		listIDs = append(listIDs, l.ID)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatalf("begin: %v", err)
+	}
+	position := ""
+	for i := 0; i < n; i++ {
+		position = rankBetween("", position)
+		result, err := tx.Exec("INSERT INTO todos (title, user_id, position) VALUES (?, ?, ?)", "Todo "+strconv.Itoa(i), userID, position)
+		if err != nil {
+			tb.Fatalf("insert todo: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		memberships := []int64{listIDs[i%lists]}
+		if i%3 == 0 && lists > 1 {
+			memberships = append(memberships, listIDs[(i+1)%lists])
+		}
+		for _, listID := range memberships {
+			if _, err := tx.Exec("INSERT INTO todo_lists (todo_id, list_id, position) VALUES (?, ?, ?)", id, listID, position); err != nil {
+				tb.Fatalf("insert todo_list: %v", err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tb.Fatalf("commit: %v", err)
+	}
+}
+
+// BenchmarkListTodosWithLists measures the GET /api/todos read path (todos plus their lists).
+// Time per op should grow linearly with the number of todos, not with todos × lookups.
+func BenchmarkListTodosWithLists(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			db := setupTestDB(b)
+			user := createTestUser(b, db, "user@test.com", "hash")
+			seedTodos(b, db, user.ID, n, 20)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				todos, err := GetAllTodos(db, user.ID)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := attachTodoLists(db, todos, user.ID); err != nil {
+					b.Fatal(err)
+				}
+				if len(todos) != n {
+					b.Fatalf("expected %d todos, got %d", n, len(todos))
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkListTodosByList measures GET /api/lists/{id}/todos on a list holding ~1/20 of the todos.
+func BenchmarkListTodosByList(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			db := setupTestDB(b)
+			user := createTestUser(b, db, "user@test.com", "hash")
+			seedTodos(b, db, user.ID, n, 20)
+			lists, _ := ListLists(db, user.ID)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := ListTodosByList(db, lists[0].ID, user.ID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkListTodosPage measures fetching a 50-todo page deep into 10k todos, lists included.
+func BenchmarkListTodosPage(b *testing.B) {
+	db := setupTestDB(b)
+	user := createTestUser(b, db, "user@test.com", "hash")
+	seedTodos(b, db, user.ID, 10000, 20)
+	_, cursor, err := GetAllTodosPage(db, user.ID, "", Page{Limit: MaxPageSize})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		todos, _, err := GetAllTodosPage(db, user.ID, "", Page{Limit: 50, Cursor: cursor})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := attachTodoLists(db, todos, user.ID); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// --- Filter Tests ---
+
+func TestParseTodoFilter(t *testing.T) {
+	valid := []string{
+		"",
+		"completed=true",
+		"list_id=1&list_id=2,3&list_match=all",
+		"created_from=2030-01-01&created_to=2030-01-31",
+		"due_from=2030-01-01T09:00:00Z",
+		"title=milk",
+		"sort=due",
+		"sort=due:asc,priority:desc",
+		"sort=title,completed:desc,created:asc",
+	}
+	for _, q := range valid {
+		values, _ := url.ParseQuery(q)
+		if _, err := ParseTodoFilter(values, time.UTC, time.Now()); err != nil {
+			t.Errorf("%q: unexpected error %v", q, err)
+		}
+	}
+
+	invalid := []string{
+		"completed=maybe",
+		"list_id=abc",
+		"list_id=0",
+		"list_match=some",
+		"created_from=yesterday",
+		"due_from=2030-02-01&due_to=2030-01-01",
+		"sort=color",
+		"sort=due:up",
+		"sort=due,due:desc",
+		"sort=title,due,priority,completed,created",
+		"title=" + strings.Repeat("x", MaxTitleLength+1),
+	}
+	for _, q := range invalid {
+		values, _ := url.ParseQuery(q)
+		if _, err := ParseTodoFilter(values, time.UTC, time.Now()); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%q: expected ErrInvalidFilter, got %v", q, err)
+		}
+	}
+
+	values, _ := url.ParseQuery("list_id=2,1&list_id=2&due_to=2030-01-31")
+	f, _ := ParseTodoFilter(values, time.UTC, time.Now())
+	if len(f.ListIDs) != 2 || f.ListIDs[0] != 2 || f.ListIDs[1] != 1 {
+		t.Errorf("expected deduplicated list IDs [2 1], got %v", f.ListIDs)
+	}
+	if f.DueTo == nil || f.DueTo.Format(time.RFC3339) != "2030-01-31T23:59:59Z" {
+		t.Errorf("expected date-only due_to to cover the whole day, got %v", f.DueTo)
+	}
+}
+
+func queryTodoTitles(t *testing.T, db *sql.DB, userID int64, query string) string {
+	t.Helper()
+	values, _ := url.ParseQuery(query)
+	f, err := ParseTodoFilter(values, time.UTC, time.Now())
+	if err != nil {
+		t.Fatalf("%q: ParseTodoFilter failed: %v", query, err)
+	}
+	todos, _, err := QueryTodos(db, f, userID, Page{})
+	if err != nil {
+		t.Fatalf("%q: QueryTodos failed: %v", query, err)
+	}
+	return strings.Join(todoTitles(todos), ",")
+}
+
+func TestQueryTodos(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	work, _ := CreateList(db, "Work", "", user.ID)
+	home, _ := CreateList(db, "Home", "", user.ID)
+
+	a, _ := CreateTodoWithDetails(db, "alpha 100%", TodoDetails{Priority: "high", DueAt: mustParseTodoTime(t, "2030-01-10", time.UTC, true)}, user.ID)
+	b, _ := CreateTodoWithDetails(db, "Beta", TodoDetails{Priority: "low", DueAt: mustParseTodoTime(t, "2030-01-05", time.UTC, true)}, user.ID)
+	c, _ := CreateTodoWithDetails(db, "gamma", TodoDetails{Priority: "high"}, user.ID)
+	AddListToTodo(db, a.ID, work.ID, user.ID)
+	AddListToTodo(db, a.ID, home.ID, user.ID)
+	AddListToTodo(db, b.ID, work.ID, user.ID)
+	AddListToTodo(db, c.ID, home.ID, user.ID)
+	UpdateTodoStatus(db, b.ID, true, user.ID)
+	db.Exec("UPDATE todos SET created_at = '2020-12-01 10:00:00' WHERE id = ?", c.ID)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"completed=false", "gamma,alpha 100%"},
+		{"list_id=" + strconv.FormatInt(work.ID, 10), "Beta,alpha 100%"},
+		{"list_id=" + strconv.FormatInt(work.ID, 10) + "," + strconv.FormatInt(home.ID, 10), "gamma,Beta,alpha 100%"},
+		{"list_id=" + strconv.FormatInt(work.ID, 10) + "," + strconv.FormatInt(home.ID, 10) + "&list_match=all", "alpha 100%"},
+		{"created_to=2020-12-31", "gamma"},
+		{"created_from=2020-12-02", "Beta,alpha 100%"},
+		{"due_from=2030-01-06", "alpha 100%"},
+		{"due_to=2030-01-31&sort=due:desc", "alpha 100%,Beta"},
+		{"title=ET", "Beta"},
+		{"title=%25", "alpha 100%"},
+		{"sort=title:desc", "gamma,Beta,alpha 100%"},
+		{"sort=priority:desc,due:asc", "alpha 100%,gamma,Beta"},
+		{"sort=due:desc", "alpha 100%,Beta,gamma"},
+		{"sort=completed:desc,title", "Beta,alpha 100%,gamma"},
+	}
+	for _, tc := range tests {
+		if got := queryTodoTitles(t, db, user.ID, tc.query); got != tc.want {
+			t.Errorf("%q: expected %s, got %s", tc.query, tc.want, got)
+		}
+	}
+
+	other := createTestUser(t, db, "other@test.com", "hash")
+	foreign, _ := CreateList(db, "Foreign", "", other.ID)
+	f := TodoFilter{ListIDs: []int64{work.ID, foreign.ID}}
+	if _, _, err := QueryTodos(db, f, user.ID, Page{}); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("expected ErrListNotFound for another user's list, got %v", err)
+	}
+}
+
+func TestQueryTodos_PaginatesCustomSort(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	for i := 0; i < 12; i++ {
+		CreateTodoWithDetails(db, "Todo "+strconv.Itoa(i%4), TodoDetails{Priority: PriorityLevels[i%3]}, user.ID)
+	}
+	f := TodoFilter{Sort: "title:asc,priority:desc"}
+	want, _, _ := QueryTodos(db, f, user.ID, Page{})
+
+	var got []Todo
+	page := Page{Limit: 5}
+	for {
+		todos, next, err := QueryTodos(db, f, user.ID, page)
+		if err != nil {
+			t.Fatalf("QueryTodos failed: %v", err)
+		}
+		got = append(got, todos...)
+		if next == "" {
+			break
+		}
+		page.Cursor = next
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d todos across pages, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID {
+			t.Fatalf("position %d: expected todo %d, got %d", i, want[i].ID, got[i].ID)
+		}
+	}
+}
+
+func TestParseTodoFilter_RelativeDates(t *testing.T) {
+	// Wednesday 2030-01-09, 22:00 in UTC is already Thursday in Tokyo.
+	now := time.Date(2030, 1, 9, 22, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query string
+		loc   string
+		from  string
+		to    string
+	}{
+		{"due_from=today&due_to=today", "UTC", "2030-01-09T00:00:00Z", "2030-01-09T23:59:59Z"},
+		{"due_from=week_start&due_to=week_end", "UTC", "2030-01-07T00:00:00Z", "2030-01-13T23:59:59Z"},
+		{"due_from=-2d&due_to=%2B1w", "UTC", "2030-01-07T00:00:00Z", "2030-01-16T23:59:59Z"},
+		{"due_from=today&due_to=%2B0d", "Asia/Tokyo", "2030-01-10T00:00:00+09:00", "2030-01-10T23:59:59+09:00"},
+	}
+	for _, tc := range tests {
+		loc, _ := time.LoadLocation(tc.loc)
+		values, _ := url.ParseQuery(tc.query)
+		f, err := ParseTodoFilter(values, loc, now)
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", tc.query, err)
+		}
+		if got := f.DueFrom.In(loc).Format(time.RFC3339); got != tc.from {
+			t.Errorf("%q: expected due_from %s, got %s", tc.query, tc.from, got)
+		}
+		if got := f.DueTo.In(loc).Format(time.RFC3339); got != tc.to {
+			t.Errorf("%q: expected due_to %s, got %s", tc.query, tc.to, got)
+		}
+	}
+
+	for _, q := range []string{"due_from=%2Bd", "due_from=%2B1m", "due_from=--1d", "due_to=week"} {
+		values, _ := url.ParseQuery(q)
+		if _, err := ParseTodoFilter(values, time.UTC, now); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%q: expected ErrInvalidFilter, got %v", q, err)
+		}
+	}
+}
+
+// --- Smart List Tests ---
+
+func TestSmartList_CRUD(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	work, _ := CreateList(db, "Work", "", user.ID)
+
+	sl, err := CreateSmartList(db, "  Open work ", "sort=due&completed=false&list_id="+strconv.FormatInt(work.ID, 10), user.ID)
+	if err != nil {
+		t.Fatalf("CreateSmartList failed: %v", err)
+	}
+	if sl.Name != "Open work" {
+		t.Errorf("expected trimmed name, got %q", sl.Name)
+	}
+	if want := "completed=false&list_id=" + strconv.FormatInt(work.ID, 10) + "&sort=due"; sl.Filter != want {
+		t.Errorf("expected canonical filter %q, got %q", want, sl.Filter)
+	}
+
+	if _, err := CreateSmartList(db, "Open work", "", user.ID); !errors.Is(err, ErrDuplicateSmartList) {
+		t.Errorf("expected ErrDuplicateSmartList, got %v", err)
+	}
+	if err := UpdateSmartList(db, sl.ID, "Everything", "", user.ID); err != nil {
+		t.Fatalf("UpdateSmartList failed: %v", err)
+	}
+	got, _ := GetSmartList(db, sl.ID, user.ID)
+	if got.Name != "Everything" || got.Filter != "" {
+		t.Errorf("expected updated smart list, got %+v", got)
+	}
+
+	other := createTestUser(t, db, "other@test.com", "hash")
+	if _, err := GetSmartList(db, sl.ID, other.ID); !errors.Is(err, ErrSmartListNotFound) {
+		t.Errorf("expected ErrSmartListNotFound for another user, got %v", err)
+	}
+	if err := DeleteSmartList(db, sl.ID, other.ID); !errors.Is(err, ErrSmartListNotFound) {
+		t.Errorf("expected ErrSmartListNotFound deleting another user's smart list, got %v", err)
+	}
+	if err := DeleteSmartList(db, sl.ID, user.ID); err != nil {
+		t.Fatalf("DeleteSmartList failed: %v", err)
+	}
+	if all, _ := ListSmartLists(db, user.ID); len(all) != 0 {
+		t.Errorf("expected no smart lists after delete, got %d", len(all))
+	}
+}
+
+func TestSmartList_RejectsBrokenFilters(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	foreign, _ := CreateList(db, "Foreign", "", other.ID)
+
+	tests := []struct {
+		name   string
+		filter string
+		want   error
+	}{
+		{"", "", ErrEmptyListName},
+		{strings.Repeat("x", 51), "", ErrListNameTooLong},
+		{"Bad sort", "sort=color", ErrInvalidFilter},
+		{"Bad date", "due_to=someday", ErrInvalidFilter},
+		{"Unknown", "colour=red", ErrInvalidFilter},
+		{"Paginated", "limit=10", ErrInvalidFilter},
+		{"Malformed", "title=%zz", ErrInvalidFilter},
+		{"Foreign", "list_id=" + strconv.FormatInt(foreign.ID, 10), ErrListNotFound},
+	}
+	for _, tc := range tests {
+		if _, err := CreateSmartList(db, tc.name, tc.filter, user.ID); !errors.Is(err, tc.want) {
+			t.Errorf("%q/%q: expected %v, got %v", tc.name, tc.filter, tc.want, err)
+		}
+	}
+}
+
+func TestQuerySmartListTodos(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	work, _ := CreateList(db, "Work", "", user.ID)
+
+	now := time.Now().UTC()
+	thisWeek, _ := CreateTodoWithDetails(db, "This week", TodoDetails{DueAt: &now}, user.ID)
+	later := now.AddDate(0, 0, 30)
+	CreateTodoWithDetails(db, "Later", TodoDetails{DueAt: &later}, user.ID)
+	CreateTodo(db, "Undated", user.ID)
+	AddListToTodo(db, thisWeek.ID, work.ID, user.ID)
+
+	sl, err := CreateSmartList(db, "Due this week", "due_from=week_start&due_to=week_end", user.ID)
+	if err != nil {
+		t.Fatalf("CreateSmartList failed: %v", err)
+	}
+	todos, _, err := QuerySmartListTodos(db, sl.ID, user.ID, Page{})
+	if err != nil {
+		t.Fatalf("QuerySmartListTodos failed: %v", err)
+	}
+	if got := strings.Join(todoTitles(todos), ","); got != "This week" {
+		t.Errorf("expected only the todo due this week, got %s", got)
+	}
+
+	byList, _ := CreateSmartList(db, "Work", "list_id="+strconv.FormatInt(work.ID, 10), user.ID)
+	DeleteList(db, work.ID, user.ID)
+	if _, _, err := QuerySmartListTodos(db, byList.ID, user.ID, Page{}); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("expected ErrListNotFound once the list is deleted, got %v", err)
+	}
+}
+
+// --- Partial Update Tests ---
+
+func TestPatchTodo(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodoWithDetails(db, "Original", TodoDetails{
+		Priority: "high",
+		Notes:    "keep me",
+		DueAt:    mustParseTodoTime(t, "2030-01-10", time.UTC, true),
+	}, user.ID)
+
+	title, completed := "Renamed", true
+	patched, err := PatchTodo(db, todo.ID, TodoPatch{Title: &title, Completed: &completed}, user.ID)
+	if err != nil {
+		t.Fatalf("PatchTodo failed: %v", err)
+	}
+	if patched.Title != "Renamed" || !patched.Completed {
+		t.Errorf("expected title and status updated, got %+v", patched)
+	}
+	if patched.Priority != "high" || patched.Notes == nil || *patched.Notes != "keep me" || patched.DueAt == nil {
+		t.Errorf("expected absent fields untouched, got %+v", patched)
+	}
+
+	// The start date is checked against the stored due date.
+	if _, err := PatchTodo(db, todo.ID, TodoPatch{StartAt: mustParseTodoTime(t, "2030-01-11", time.UTC, false)}, user.ID); !errors.Is(err, ErrStartAfterDue) {
+		t.Errorf("expected ErrStartAfterDue, got %v", err)
+	}
+	patched, err = PatchTodo(db, todo.ID, TodoPatch{ClearDueAt: true, StartAt: mustParseTodoTime(t, "2030-01-11", time.UTC, false)}, user.ID)
+	if err != nil {
+		t.Fatalf("PatchTodo failed: %v", err)
+	}
+	if patched.DueAt != nil || patched.StartAt == nil {
+		t.Errorf("expected due date cleared and start date set, got %+v", patched)
+	}
+
+	// A failing field leaves the others untouched.
+	bad, other := "extreme", "Not applied"
+	if _, err := PatchTodo(db, todo.ID, TodoPatch{Title: &other, Priority: &bad}, user.ID); !errors.Is(err, ErrInvalidPriority) {
+		t.Errorf("expected ErrInvalidPriority, got %v", err)
+	}
+	if got, _ := GetTodoByID(db, todo.ID, user.ID); got.Title != "Renamed" {
+		t.Errorf("expected title unchanged after a failed patch, got %q", got.Title)
+	}
+
+	if _, err := PatchTodo(db, 9999, TodoPatch{Title: &title}, user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	other2 := createTestUser(t, db, "other@test.com", "hash")
+	if _, err := PatchTodo(db, todo.ID, TodoPatch{}, other2.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for another user's todo, got %v", err)
+	}
+}
+
+func TestPatchTodo_CompletingWithNewRecurrence(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodoWithDetails(db, "Water plants", TodoDetails{DueAt: mustParseTodoTime(t, "2030-01-10", time.UTC, true)}, user.ID)
+
+	rule, completed := "FREQ=WEEKLY", true
+	if _, err := PatchTodo(db, todo.ID, TodoPatch{Recurrence: &rule, Completed: &completed}, user.ID); err != nil {
+		t.Fatalf("PatchTodo failed: %v", err)
+	}
+	todos, _ := GetAllTodos(db, user.ID)
+	if len(todos) != 2 {
+		t.Fatalf("expected the next occurrence to be spawned, got %d todos", len(todos))
+	}
+	next := todos[0]
+	if next.Completed || next.DueAt == nil || *next.DueAt != "2030-01-17 23:59:59" {
+		t.Errorf("expected an open occurrence due a week later, got %+v", next)
+	}
+}
+
+// --- Version Tests ---
+
+func TestTodoVersion_BumpsOnChange(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	todo, _ := CreateTodo(db, "Task", user.ID)
+	other, _ := CreateTodo(db, "Other", user.ID)
+	if todo.Version != 1 {
+		t.Fatalf("expected a new todo at version 1, got %d", todo.Version)
+	}
+
+	version := func() int64 {
+		t.Helper()
+		got, err := GetTodoByID(db, todo.ID, user.ID)
+		if err != nil {
+			t.Fatalf("GetTodoByID failed: %v", err)
+		}
+		return got.Version
+	}
+
+	steps := []struct {
+		name   string
+		change func()
+		bumped bool
+	}{
+		{"title", func() { UpdateTodoTitle(db, todo.ID, "Renamed", user.ID) }, true},
+		{"list added", func() { AddListToTodo(db, todo.ID, list.ID, user.ID) }, true},
+		{"checklist item", func() { CreateTodoItem(db, todo.ID, "Step", user.ID) }, true},
+		{"moved", func() { MoveTodo(db, todo.ID, &other.ID, user.ID) }, false},
+		{"list removed", func() { RemoveListFromTodo(db, todo.ID, list.ID, user.ID) }, true},
+	}
+	for _, step := range steps {
+		before := version()
+		step.change()
+		if after := version(); (after > before) != step.bumped {
+			t.Errorf("%s: version went from %d to %d", step.name, before, after)
+		}
+	}
+
+	before, _ := GetListByID(db, list.ID, user.ID)
+	UpdateListPinned(db, list.ID, true, user.ID)
+	if after, _ := GetListByID(db, list.ID, user.ID); after.Version <= before.Version {
+		t.Errorf("expected pinning to bump the list version, got %d then %d", before.Version, after.Version)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Task", user.ID)
+
+	title := "From tab A"
+	patched, err := PatchTodo(db, todo.ID, TodoPatch{Title: &title, Version: todo.Version}, user.ID)
+	if err != nil {
+		t.Fatalf("PatchTodo with the current version failed: %v", err)
+	}
+	stale := "From tab B"
+	if _, err := PatchTodo(db, todo.ID, TodoPatch{Title: &stale, Version: todo.Version}, user.ID); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch for a stale version, got %v", err)
+	}
+	if got, _ := GetTodoByID(db, todo.ID, user.ID); got.Title != "From tab A" {
+		t.Errorf("expected the stale write to be rejected, got title %q", got.Title)
+	}
+
+	if err := DeleteTodoIfMatch(db, todo.ID, todo.Version, user.ID); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch deleting with a stale version, got %v", err)
+	}
+	if err := DeleteTodoIfMatch(db, todo.ID, patched.Version, user.ID); err != nil {
+		t.Fatalf("DeleteTodoIfMatch failed: %v", err)
+	}
+	if err := DeleteTodoIfMatch(db, todo.ID, patched.Version, user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a deleted todo, got %v", err)
+	}
+
+	list, _ := CreateList(db, "Work", "", user.ID)
+	pinned := true
+	if err := UpdateListIfMatch(db, list.ID, "Office", list.Color, &pinned, list.Version, user.ID); err != nil {
+		t.Fatalf("UpdateListIfMatch failed: %v", err)
+	}
+	updated, _ := GetListByID(db, list.ID, user.ID)
+	if updated.Name != "Office" || !updated.Pinned {
+		t.Errorf("expected name and pinned updated together, got %+v", updated)
+	}
+	if err := UpdateListIfMatch(db, list.ID, "Home", list.Color, nil, list.Version, user.ID); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch for a stale list version, got %v", err)
+	}
+	if err := DeleteListIfMatch(db, list.ID, list.Version, user.ID); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch deleting a stale list, got %v", err)
+	}
+	if err := DeleteListIfMatch(db, list.ID, updated.Version, user.ID); err != nil {
+		t.Fatalf("DeleteListIfMatch failed: %v", err)
+	}
+	if err := DeleteListIfMatch(db, list.ID, 0, user.ID); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("expected ErrListNotFound, got %v", err)
+	}
+}
+
+// --- Bulk Tests ---
+
+func TestBulkUpdateTodos(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	work, _ := CreateList(db, "Work", "", user.ID)
+	home, _ := CreateList(db, "Home", "", user.ID)
+	a, _ := CreateTodo(db, "A", user.ID)
+	b, _ := CreateTodo(db, "B", user.ID)
+	foreign, _ := CreateTodo(db, "Foreign", other.ID)
+	AddListToTodo(db, b.ID, home.ID, user.ID)
+
+	errs, err := BulkUpdateTodos(db, BulkComplete, []int64{a.ID, foreign.ID, b.ID, a.ID, 9999}, 0, user.ID)
+	if err != nil {
+		t.Fatalf("BulkUpdateTodos failed: %v", err)
+	}
+	for i, want := range []error{nil, ErrNotFound, nil, nil, ErrNotFound} {
+		if !errors.Is(errs[i], want) {
+			t.Errorf("item %d: expected %v, got %v", i, want, errs[i])
+		}
+	}
+	if got, _ := GetTodoByID(db, foreign.ID, other.ID); got.Completed {
+		t.Error("expected another user's todo to be left alone")
+	}
+	todos, _ := GetAllTodos(db, user.ID)
+	for _, todo := range todos {
+		if !todo.Completed {
+			t.Errorf("expected %q to be completed", todo.Title)
+		}
+	}
+
+	if _, err := BulkUpdateTodos(db, BulkMoveToList, []int64{a.ID, b.ID}, work.ID, user.ID); err != nil {
+		t.Fatalf("move_to_list failed: %v", err)
+	}
+	for _, id := range []int64{a.ID, b.ID} {
+		lists, _ := ListTodoLists(db, id, user.ID)
+		if len(lists) != 1 || lists[0].ID != work.ID {
+			t.Errorf("todo %d: expected only the Work list, got %v", id, listNames(lists))
+		}
+	}
+	if _, err := BulkUpdateTodos(db, BulkRemoveFromList, []int64{a.ID}, work.ID, user.ID); err != nil {
+		t.Fatalf("remove_from_list failed: %v", err)
+	}
+	if lists, _ := ListTodoLists(db, a.ID, user.ID); len(lists) != 0 {
+		t.Errorf("expected todo A to have no lists, got %v", listNames(lists))
+	}
+
+	errs, _ = BulkUpdateTodos(db, BulkDelete, []int64{a.ID, b.ID}, 0, user.ID)
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("delete failed: %v", errs)
+	}
+	errs, _ = BulkUpdateTodos(db, BulkRestore, []int64{a.ID, foreign.ID}, 0, user.ID)
+	if errs[0] != nil || !errors.Is(errs[1], ErrNotFound) {
+		t.Errorf("expected A restored and the foreign todo rejected, got %v", errs)
+	}
+	if trash, _ := ListTrash(db, user.ID); len(trash) != 1 || trash[0].ID != b.ID {
+		t.Errorf("expected only B left in the trash, got %v", todoTitles(trash))
+	}
+}
+
+func TestBulkUpdateTodos_InvalidRequests(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	foreignList, _ := CreateList(db, "Foreign", "", other.ID)
+	todo, _ := CreateTodo(db, "A", user.ID)
+
+	if _, err := BulkUpdateTodos(db, "archive", []int64{todo.ID}, 0, user.ID); !errors.Is(err, ErrInvalidBulkAction) {
+		t.Errorf("expected ErrInvalidBulkAction, got %v", err)
+	}
+	if _, err := BulkUpdateTodos(db, BulkDelete, nil, 0, user.ID); !errors.Is(err, ErrInvalidBulkSize) {
+		t.Errorf("expected ErrInvalidBulkSize for no IDs, got %v", err)
+	}
+	if _, err := BulkUpdateTodos(db, BulkDelete, make([]int64, MaxBulkTodos+1), 0, user.ID); !errors.Is(err, ErrInvalidBulkSize) {
+		t.Errorf("expected ErrInvalidBulkSize for too many IDs, got %v", err)
+	}
+	if _, err := BulkUpdateTodos(db, BulkAddToList, []int64{todo.ID}, foreignList.ID, user.ID); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("expected ErrListNotFound for another user's list, got %v", err)
+	}
+}
+
+// --- Idempotency Tests ---
+
+func TestReserveIdempotencyKey(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	now := time.Now()
+
+	saved, err := ReserveIdempotencyKey(db, user.ID, "k1", "hash-a", now)
+	if err != nil || saved != nil {
+		t.Fatalf("expected a fresh reservation, got %+v, %v", saved, err)
+	}
+	if _, err := ReserveIdempotencyKey(db, user.ID, "k1", "hash-a", now); !errors.Is(err, ErrIdempotencyKeyInProgress) {
+		t.Errorf("expected ErrIdempotencyKeyInProgress, got %v", err)
+	}
+	if saved, err := ReserveIdempotencyKey(db, other.ID, "k1", "hash-b", now); err != nil || saved != nil {
+		t.Errorf("expected keys to be scoped per user, got %+v, %v", saved, err)
+	}
+
+	resp := IdempotentResponse{Status: 201, Headers: map[string]string{"Content-Type": "application/json"}, Body: []byte(`{"id":1}`)}
+	if err := SaveIdempotentResponse(db, user.ID, "k1", resp); err != nil {
+		t.Fatalf("SaveIdempotentResponse failed: %v", err)
+	}
+	saved, err = ReserveIdempotencyKey(db, user.ID, "k1", "hash-a", now)
+	if err != nil || saved == nil {
+		t.Fatalf("expected the saved response, got %+v, %v", saved, err)
+	}
+	if saved.Status != 201 || string(saved.Body) != `{"id":1}` || saved.Headers["Content-Type"] != "application/json" {
+		t.Errorf("unexpected saved response %+v", saved)
+	}
+	if _, err := ReserveIdempotencyKey(db, user.ID, "k1", "hash-c", now); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("expected ErrIdempotencyKeyReused, got %v", err)
+	}
+
+	// An expired key is reserved anew, even for a different request.
+	later := now.Add(IdempotencyKeyTTL + time.Minute)
+	if saved, err := ReserveIdempotencyKey(db, user.ID, "k1", "hash-c", later); err != nil || saved != nil {
+		t.Errorf("expected an expired key to be reserved again, got %+v, %v", saved, err)
+	}
+
+	if err := ReleaseIdempotencyKey(db, user.ID, "k1"); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey failed: %v", err)
+	}
+	if saved, err := ReserveIdempotencyKey(db, user.ID, "k1", "hash-a", now); err != nil || saved != nil {
+		t.Errorf("expected a released key to be reserved again, got %+v, %v", saved, err)
+	}
+}
+
+func TestPurgeIdempotencyKeys(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	now := time.Now()
+
+	ReserveIdempotencyKey(db, user.ID, "old", "h", now.Add(-2*IdempotencyKeyTTL))
+	ReserveIdempotencyKey(db, user.ID, "new", "h", now)
+
+	n, err := PurgeIdempotencyKeys(db, now.Add(-IdempotencyKeyTTL))
+	if err != nil {
+		t.Fatalf("PurgeIdempotencyKeys failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 purged key, got %d", n)
+	}
+	if _, err := ReserveIdempotencyKey(db, user.ID, "new", "h", now); !errors.Is(err, ErrIdempotencyKeyInProgress) {
+		t.Errorf("expected the recent key to be kept, got %v", err)
+	}
+}
+
+// --- Session Tests ---
+
+func TestRotateSession(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	now := time.Now()
+
+	session, err := CreateSession(db, user.ID, "h1", "agent", "10.0.0.1", now)
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	later := now.Add(time.Hour)
+	rotated, err := RotateSession(db, "h1", "h2", "10.0.0.2", later)
+	if err != nil {
+		t.Fatalf("RotateSession failed: %v", err)
+	}
+	if rotated.ID != session.ID || rotated.UserID != user.ID {
+		t.Errorf("expected the same session, got %+v", rotated)
+	}
+	if want := later.Add(RefreshTokenTTL).UTC().Format(dbTimeLayout); rotated.ExpiresAt != want {
+		t.Errorf("expected expiry extended to %s, got %s", want, rotated.ExpiresAt)
+	}
+
+	if _, err := RotateSession(db, "unknown", "h3", "10.0.0.2", later); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected ErrInvalidRefreshToken for an unknown token, got %v", err)
+	}
+
+	// Replaying the rotated-out token revokes the session, so its current token stops working too.
+	if _, err := RotateSession(db, "h1", "h3", "10.0.0.2", later); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	if _, err := RotateSession(db, "h2", "h3", "10.0.0.2", later); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected the revoked session's token to be rejected, got %v", err)
+	}
+}
+
+func TestRotateSession_Expired(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	now := time.Now()
+	CreateSession(db, user.ID, "h1", "agent", "10.0.0.1", now)
+
+	if _, err := RotateSession(db, "h1", "h2", "10.0.0.2", now.Add(RefreshTokenTTL+time.Second)); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected ErrInvalidRefreshToken for an expired session, got %v", err)
+	}
+}
+
+func TestRevokeSessionByRefreshToken(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	now := time.Now()
+	CreateSession(db, user.ID, "h1", "agent", "10.0.0.1", now)
+
+	if err := RevokeSessionByRefreshToken(db, "h1", now); err != nil {
+		t.Fatalf("RevokeSessionByRefreshToken failed: %v", err)
+	}
+	if err := RevokeSessionByRefreshToken(db, "h1", now); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected ErrInvalidRefreshToken on a second logout, got %v", err)
+	}
+	if _, err := RotateSession(db, "h1", "h2", "10.0.0.2", now); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected a logged-out session not to refresh, got %v", err)
+	}
+}
+
+func TestTouchSession(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	now := time.Now()
+	session, _ := CreateSession(db, user.ID, "h1", "agent", "10.0.0.1", now)
+
+	lastUsed := func() string {
+		var s string
+		db.QueryRow("SELECT last_used_at FROM sessions WHERE id = ?", session.ID).Scan(&s)
+		return s
+	}
+
+	if err := TouchSession(db, user.ID, session.ID, now.Add(time.Second)); err != nil {
+		t.Fatalf("TouchSession failed: %v", err)
+	}
+	if got := lastUsed(); got != session.LastUsedAt {
+		t.Errorf("expected last_used_at unchanged within SessionTouchInterval, got %s", got)
+	}
+	later := now.Add(2 * SessionTouchInterval)
+	TouchSession(db, user.ID, session.ID, later)
+	if got, want := lastUsed(), later.UTC().Format(dbTimeLayout); got != want {
+		t.Errorf("expected last_used_at %s, got %s", want, got)
+	}
+
+	if err := TouchSession(db, other.ID, session.ID, now); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound for another user, got %v", err)
+	}
+	if err := TouchSession(db, user.ID, session.ID, now.Add(RefreshTokenTTL+time.Minute)); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound for an expired session, got %v", err)
+	}
+	RevokeSession(db, user.ID, session.ID, now)
+	if err := TouchSession(db, user.ID, session.ID, now); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound for a revoked session, got %v", err)
+	}
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	now := time.Now()
+	laptop, _ := CreateSession(db, user.ID, "h1", "Laptop", "10.0.0.1", now.Add(-time.Hour))
+	phone, _ := CreateSession(db, user.ID, "h2", strings.Repeat("x", MaxUserAgentLength+1), "10.0.0.2", now)
+	foreign, _ := CreateSession(db, other.ID, "h3", "Other", "10.0.0.3", now)
+
+	sessions, err := ListSessions(db, user.ID, now)
+	if err != nil {
+		t.Fatalf("ListSessions failed: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != phone.ID || sessions[1].ID != laptop.ID {
+		t.Fatalf("expected the user's sessions, most recently used first, got %+v", sessions)
+	}
+	if len(sessions[0].UserAgent) != MaxUserAgentLength || sessions[1].UserAgent != "Laptop" || sessions[1].IP != "10.0.0.1" {
+		t.Errorf("unexpected user agents or IPs: %+v", sessions)
+	}
+
+	if err := RevokeSession(db, user.ID, foreign.ID, now); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound revoking another user's session, got %v", err)
+	}
+	if err := RevokeSession(db, user.ID, laptop.ID, now); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+	if sessions, _ := ListSessions(db, user.ID, now); len(sessions) != 1 || sessions[0].ID != phone.ID {
+		t.Errorf("expected only the phone session left, got %+v", sessions)
+	}
+
+	n, err := RevokeAllSessions(db, user.ID, now)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 session revoked, got %d, %v", n, err)
+	}
+	if sessions, _ := ListSessions(db, user.ID, now); len(sessions) != 0 {
+		t.Errorf("expected no sessions left, got %+v", sessions)
+	}
+	if sessions, _ := ListSessions(db, other.ID, now); len(sessions) != 1 {
+		t.Errorf("expected the other user's session to be kept, got %+v", sessions)
+	}
+}
+
+func TestPurgeSessions(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	now := time.Now()
+
+	CreateSession(db, user.ID, "old", "agent", "10.0.0.1", now.Add(-2*RefreshTokenTTL))
+	RotateSession(db, "old", "old2", "10.0.0.2", now.Add(-2*RefreshTokenTTL))
+	CreateSession(db, user.ID, "new", "agent", "10.0.0.1", now)
+
+	n, err := PurgeSessions(db, now)
+	if err != nil {
+		t.Fatalf("PurgeSessions failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 purged session, got %d", n)
+	}
+	var tokens int
+	db.QueryRow("SELECT COUNT(*) FROM session_tokens").Scan(&tokens)
+	if tokens != 0 {
+		t.Errorf("expected the purged session's rotated tokens to be deleted, got %d", tokens)
+	}
+	if _, err := RotateSession(db, "new", "new2", "10.0.0.2", now); err != nil {
+		t.Errorf("expected the live session to be kept, got %v", err)
+	}
+}
+
+// --- Email Verification Tests ---
+
+func TestReserveVerificationEmail(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	now := time.Now()
+
+	if err := ReserveVerificationEmail(db, user.ID, now); err != nil {
+		t.Fatalf("ReserveVerificationEmail failed: %v", err)
+	}
+	if err := ReserveVerificationEmail(db, user.ID, now.Add(time.Second)); !errors.Is(err, ErrVerificationTooSoon) {
+		t.Errorf("expected ErrVerificationTooSoon, got %v", err)
+	}
+	if err := ReserveVerificationEmail(db, user.ID, now.Add(VerificationResendInterval)); err != nil {
+		t.Errorf("expected a resend after the interval to be allowed, got %v", err)
+	}
+
+	MarkEmailVerified(db, user.ID, user.Email, now)
+	if err := ReserveVerificationEmail(db, user.ID, now.Add(time.Hour)); !errors.Is(err, ErrEmailAlreadyVerified) {
+		t.Errorf("expected ErrEmailAlreadyVerified, got %v", err)
+	}
+	if err := ReserveVerificationEmail(db, 999, now); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestMarkEmailVerified(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	if user.EmailVerifiedAt != nil {
+		t.Fatalf("expected a new user to be unverified, got %v", *user.EmailVerifiedAt)
+	}
+	now := time.Now()
+
+	if err := MarkEmailVerified(db, user.ID, "other@test.com", now); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound for another address, got %v", err)
+	}
+	if err := MarkEmailVerified(db, user.ID, user.Email, now); err != nil {
+		t.Fatalf("MarkEmailVerified failed: %v", err)
+	}
+	MarkEmailVerified(db, user.ID, user.Email, now.Add(time.Hour))
+
+	got, _ := GetUserByID(db, user.ID)
+	if want := now.UTC().Format(dbTimeLayout); got.EmailVerifiedAt == nil || *got.EmailVerifiedAt != want {
+		t.Errorf("expected email_verified_at %s, kept from the first verification, got %v", want, got.EmailVerifiedAt)
+	}
+}
+
+// --- Password Tests ---
+
+func TestResetPassword(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "old-hash")
+	now := time.Now()
+	CreateSession(db, user.ID, "s1", "agent", "10.0.0.1", now)
+
+	if err := CreatePasswordReset(db, user.ID, "r1", now.Add(-2*PasswordResetInterval)); err != nil {
+		t.Fatalf("CreatePasswordReset failed: %v", err)
+	}
+	if err := CreatePasswordReset(db, user.ID, "r2", now); err != nil {
+		t.Fatalf("CreatePasswordReset failed: %v", err)
+	}
+	if err := CreatePasswordReset(db, user.ID, "r3", now); !errors.Is(err, ErrResetTooSoon) {
+		t.Errorf("expected ErrResetTooSoon, got %v", err)
+	}
+
+	if err := ResetPassword(db, "r1", "new-hash", now); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("expected a replaced token to be invalid, got %v", err)
+	}
+	if err := ResetPassword(db, "r2", "new-hash", now.Add(PasswordResetTTL+time.Second)); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("expected an expired token to be invalid, got %v", err)
+	}
+	if err := ResetPassword(db, "r2", "new-hash", now); err != nil {
+		t.Fatalf("ResetPassword failed: %v", err)
+	}
+	if err := ResetPassword(db, "r2", "other-hash", now); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("expected a used token to be invalid, got %v", err)
+	}
+
+	got, _ := GetUserByID(db, user.ID)
+	if got.PasswordHash != "new-hash" {
+		t.Errorf("expected the new password hash, got %q", got.PasswordHash)
+	}
+	if sessions, _ := ListSessions(db, user.ID, now); len(sessions) != 0 {
+		t.Errorf("expected every session to be logged out, got %+v", sessions)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "old-hash")
+	now := time.Now()
+	current, _ := CreateSession(db, user.ID, "s1", "agent", "10.0.0.1", now)
+	CreateSession(db, user.ID, "s2", "agent", "10.0.0.2", now)
+	CreatePasswordReset(db, user.ID, "r1", now)
+
+	if err := ChangePassword(db, user.ID, "new-hash", current.ID, now); err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+	got, _ := GetUserByID(db, user.ID)
+	if got.PasswordHash != "new-hash" {
+		t.Errorf("expected the new password hash, got %q", got.PasswordHash)
+	}
+	if sessions, _ := ListSessions(db, user.ID, now); len(sessions) != 1 || sessions[0].ID != current.ID {
+		t.Errorf("expected only the current session to be kept, got %+v", sessions)
+	}
+	if err := ResetPassword(db, "r1", "reset-hash", now); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("expected pending reset links to stop working, got %v", err)
+	}
+	if err := ChangePassword(db, 999, "hash", 0, now); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+// --- Stream Ticket Tests ---
+
+func TestRedeemStreamTicket(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	now := time.Now()
+	session, _ := CreateSession(db, user.ID, "s1", "agent", "10.0.0.1", now)
+
+	for _, ticket := range []string{"t1", "t2"} {
+		if err := CreateStreamTicket(db, user.ID, session.ID, ticket, now); err != nil {
+			t.Fatalf("CreateStreamTicket failed: %v", err)
+		}
+	}
+
+	if _, _, err := RedeemStreamTicket(db, "t1", now.Add(StreamTicketTTL+time.Second)); !errors.Is(err, ErrInvalidStreamTicket) {
+		t.Errorf("expected an expired ticket to be invalid, got %v", err)
+	}
+	userID, sessionID, err := RedeemStreamTicket(db, "t1", now)
+	if err != nil {
+		t.Fatalf("RedeemStreamTicket failed: %v", err)
+	}
+	if userID != user.ID || sessionID != session.ID {
+		t.Errorf("expected the ticket's user and session, got %d %d", userID, sessionID)
+	}
+	if _, _, err := RedeemStreamTicket(db, "t1", now); !errors.Is(err, ErrInvalidStreamTicket) {
+		t.Errorf("expected a used ticket to be invalid, got %v", err)
+	}
+
+	if n, err := PurgeStreamTickets(db, now.Add(StreamTicketTTL+time.Second)); err != nil || n != 1 {
+		t.Errorf("expected the expired ticket to be purged, got %d %v", n, err)
+	}
+}
+
+// --- Sync Tests ---
+
+func TestGetSyncChanges(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	work, _ := CreateList(db, "Work", "", user.ID)
+	home, _ := CreateList(db, "Home", "", user.ID)
+	a, _ := CreateTodo(db, "A", user.ID)
+	b, _ := CreateTodo(db, "B", user.ID)
+	CreateTodo(db, "Foreign", other.ID)
+	AddListToTodo(db, a.ID, work.ID, user.ID)
+	AddListToTodo(db, b.ID, home.ID, user.ID)
+
+	full, err := GetSyncChanges(db, nil, user.ID)
+	if err != nil {
+		t.Fatalf("GetSyncChanges failed: %v", err)
+	}
+	if len(full.Todos) != 2 || len(full.Lists) != 2 || len(full.TodoLists) != 2 {
+		t.Fatalf("expected a snapshot of 2 todos, 2 lists and 2 links, got %d, %d, %d", len(full.Todos), len(full.Lists), len(full.TodoLists))
+	}
+	if full.Todos[0].UpdatedAt == "" || full.Todos[0].Notes == nil || full.Lists[0].UpdatedAt == "" {
+		t.Errorf("expected synced rows to carry updated_at and notes, got %+v", full.Todos[0])
+	}
+
+	since, _ := strconv.ParseInt(full.Token, 10, 64)
+	empty, err := GetSyncChanges(db, &since, user.ID)
+	if err != nil {
+		t.Fatalf("GetSyncChanges(since) failed: %v", err)
+	}
+	if len(empty.Todos)+len(empty.Lists)+len(empty.TodoLists) != 0 || empty.Token != full.Token {
+		t.Errorf("expected no changes and the same token, got %+v", empty)
+	}
+
+	UpdateTodoTitle(db, a.ID, "A2", user.ID)
+	DeleteTodo(db, b.ID, user.ID)
+	RemoveListFromTodo(db, a.ID, work.ID, user.ID)
+	AddListToTodo(db, a.ID, home.ID, user.ID)
+	DeleteList(db, work.ID, user.ID)
+	UpdateList(db, home.ID, "House", home.Color, user.ID)
+	PurgeTodo(db, b.ID, user.ID)
+
+	delta, err := GetSyncChanges(db, &since, user.ID)
+	if err != nil {
+		t.Fatalf("GetSyncChanges(since) failed: %v", err)
+	}
+	if len(delta.Todos) != 1 || delta.Todos[0].Title != "A2" {
+		t.Errorf("expected only the renamed todo, got %+v", delta.Todos)
+	}
+	if len(delta.Lists) != 1 || delta.Lists[0].Name != "House" {
+		t.Errorf("expected only the renamed list, got %+v", delta.Lists)
+	}
+	if len(delta.TodoLists) != 1 || delta.TodoLists[0] != (TodoListLink{a.ID, home.ID}) {
+		t.Errorf("expected the new membership, got %+v", delta.TodoLists)
+	}
+	if len(delta.Deleted.Todos) != 1 || delta.Deleted.Todos[0] != b.ID {
+		t.Errorf("expected a tombstone for the purged todo, got %+v", delta.Deleted.Todos)
+	}
+	if len(delta.Deleted.Lists) != 1 || delta.Deleted.Lists[0] != work.ID {
+		t.Errorf("expected a tombstone for the deleted list, got %+v", delta.Deleted.Lists)
+	}
+	wantLinks := []TodoListLink{{a.ID, work.ID}, {b.ID, home.ID}}
+	if len(delta.Deleted.TodoLists) != 2 || delta.Deleted.TodoLists[0] != wantLinks[0] || delta.Deleted.TodoLists[1] != wantLinks[1] {
+		t.Errorf("expected tombstones %+v, got %+v", wantLinks, delta.Deleted.TodoLists)
+	}
+
+	ahead := since + 1000
+	if _, err := GetSyncChanges(db, &ahead, user.ID); !errors.Is(err, ErrInvalidSyncToken) {
+		t.Errorf("expected ErrInvalidSyncToken, got %v", err)
+	}
+}
+
+func TestGetSyncChanges_TrashedTodo(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "A", user.ID)
+	full, _ := GetSyncChanges(db, nil, user.ID)
+	since, _ := strconv.ParseInt(full.Token, 10, 64)
+
+	DeleteTodo(db, todo.ID, user.ID)
+	delta, err := GetSyncChanges(db, &since, user.ID)
+	if err != nil {
+		t.Fatalf("GetSyncChanges failed: %v", err)
+	}
+	if len(delta.Todos) != 1 || delta.Todos[0].DeletedAt == nil || len(delta.Deleted.Todos) != 0 {
+		t.Errorf("expected the trashed todo with deleted_at and no tombstone, got %+v", delta)
+	}
+}
+
+func TestPushSyncOps(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	stale, _ := CreateTodo(db, "Stale", user.ID)
+	trashed, _ := CreateTodo(db, "Trashed", user.ID)
+	UpdateTodoTitle(db, stale.ID, "Changed on server", user.ID)
+	DeleteTodo(db, trashed.ID, user.ID)
+
+	title, empty, renamed, high := "Offline", "", "Renamed", "high"
+	ops := []SyncOp{
+		{Kind: SyncCreateTodo, ClientID: "c1", Patch: TodoPatch{Title: &title, Priority: &high}},
+		{Kind: SyncUpdateTodo, ClientID: "c1", Patch: TodoPatch{Title: &renamed}},
+		{Kind: SyncAddToList, ClientID: "c1", ListID: list.ID},
+		{Kind: SyncCreateTodo, ClientID: "c2", Patch: TodoPatch{Title: &empty}},
+		{Kind: SyncDeleteTodo, ClientID: "c2"},
+		{Kind: SyncUpdateTodo, TodoID: stale.ID, Version: stale.Version, Patch: TodoPatch{Title: &renamed}},
+		{Kind: SyncUpdateTodo, TodoID: trashed.ID, Patch: TodoPatch{Title: &renamed}},
+		{Kind: SyncDeleteTodo, TodoID: trashed.ID},
+		{Kind: SyncAddToList, TodoID: stale.ID, ListID: 9999},
+		{Kind: SyncDeleteTodo, TodoID: 9999},
+	}
+	results, err := PushSyncOps(db, ops, user.ID)
+	if err != nil {
+		t.Fatalf("PushSyncOps failed: %v", err)
+	}
+	want := []error{nil, nil, nil, ErrEmptyTitle, ErrUnknownClientID, ErrVersionMismatch, ErrTodoInTrash, nil, ErrListNotFound, ErrNotFound}
+	for i, w := range want {
+		if !errors.Is(results[i].Err, w) {
+			t.Errorf("op %d: expected %v, got %v", i, w, results[i].Err)
+		}
+	}
+
+	created := results[0].Todo
+	if created == nil || created.Title != "Renamed" || created.Priority != "high" || results[1].TodoID != results[0].TodoID {
+		t.Errorf("expected the created todo renamed by the later op, got %+v", created)
+	}
+	if lists, _ := ListTodoLists(db, results[0].TodoID, user.ID); len(lists) != 1 {
+		t.Errorf("expected the created todo in the list, got %d lists", len(lists))
+	}
+	if results[3].TodoID != 0 {
+		t.Error("expected a failed create to leave no todo behind")
+	}
+	if todos, _ := GetAllTodos(db, user.ID); len(todos) != 2 {
+		t.Errorf("expected 2 active todos, got %d", len(todos))
+	}
+	if server := results[5].Todo; server == nil || server.Title != "Changed on server" {
+		t.Errorf("expected the server state to win the conflict, got %+v", server)
+	}
+	if server := results[6].Todo; server == nil || server.DeletedAt == nil {
+		t.Errorf("expected the trashed server state, got %+v", server)
+	}
+	if results[9].Todo != nil {
+		t.Errorf("expected no state for a missing todo, got %+v", results[9].Todo)
+	}
+
+	if _, err := PushSyncOps(db, nil, user.ID); !errors.Is(err, ErrInvalidSyncBatch) {
+		t.Errorf("expected ErrInvalidSyncBatch, got %v", err)
+	}
+	if _, err := PushSyncOps(db, []SyncOp{{Kind: "archive", TodoID: stale.ID}}, user.ID); !errors.Is(err, ErrInvalidSyncOp) {
+		t.Errorf("expected ErrInvalidSyncOp, got %v", err)
+	}
+}
+
+// --- Event Tests ---
+
+func TestGetChangeEvents(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	full, _ := GetSyncChanges(db, nil, user.ID)
+	since, _ := strconv.ParseInt(full.Token, 10, 64)
+
+	list, _ := CreateList(db, "Work", "", user.ID)
+	todo, _ := CreateTodo(db, "A", user.ID)
+	AddListToTodo(db, todo.ID, list.ID, user.ID)
+	DeleteList(db, list.ID, user.ID)
+	CreateTodo(db, "Foreign", other.ID)
+
+	events, err := GetChangeEvents(db, since, user.ID, 0)
+	if err != nil {
+		t.Fatalf("GetChangeEvents failed: %v", err)
+	}
+	// Each entity appears once, at its latest change: deleting the list removed the membership,
+	// which changed the todo.
+	want := []string{EventListDeleted, EventTodoListRemoved, EventTodoChanged}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), events)
+	}
+	for i, e := range events {
+		if e.Type != want[i] || e.UserID != user.ID {
+			t.Errorf("event %d: expected %s, got %+v", i, want[i], e)
+		}
+		if i > 0 && e.ID <= events[i-1].ID {
+			t.Errorf("expected increasing event IDs, got %d after %d", e.ID, events[i-1].ID)
+		}
+	}
+	if got, ok := events[2].Data.(Todo); !ok || got.ID != todo.ID {
+		t.Errorf("expected the todo as event data, got %+v", events[2].Data)
+	}
+
+	all, _ := GetChangeEvents(db, since, 0, 0)
+	if len(all) != len(want)+1 {
+		t.Errorf("expected events of every user without a user ID, got %d", len(all))
+	}
+	if limited, _ := GetChangeEvents(db, since, user.ID, 2); len(limited) != 2 {
+		t.Errorf("expected the limit to apply, got %d events", len(limited))
+	}
+	if _, err := GetChangeEvents(db, events[2].ID+1000, user.ID, 0); !errors.Is(err, ErrInvalidSyncToken) {
+		t.Errorf("expected ErrInvalidSyncToken, got %v", err)
+	}
+}
+
+func TestPublishChanges(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	CreateTodo(db, "Before subscribing", user.ID)
+	bus := newEventBus(db)
+
+	events, unsubscribe, err := bus.Subscribe(user.ID)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer unsubscribe()
+
+	CreateTodo(db, "Foreign", other.ID)
+	todo, _ := CreateTodo(db, "A", user.ID)
+	bus.Notify()
+	bus.Notify()
+	select {
+	case e := <-events:
+		if e.Type != EventTodoChanged || e.Data.(Todo).ID != todo.ID {
+			t.Errorf("expected a todo.changed event for the new todo, got %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected an event after creating a todo")
+	}
+	select {
+	case e := <-events:
+		t.Errorf("expected no other event, got %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	bus.Close()
+	if _, ok := <-events; ok {
+		t.Error("expected the stream to be closed")
+	}
+	if _, _, err := bus.Subscribe(user.ID); !errors.Is(err, ErrEventBusClosed) {
+		t.Errorf("expected ErrEventBusClosed, got %v", err)
+	}
+}
+
+func TestPublishChanges_PollsWithoutNotify(t *testing.T) {
+	defer func(interval time.Duration) { eventPollInterval = interval }(eventPollInterval)
+	eventPollInterval = 10 * time.Millisecond
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	bus := newEventBus(db)
+	defer bus.Close()
+
+	events, unsubscribe, err := bus.Subscribe(user.ID)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer unsubscribe()
+
+	list, _ := CreateList(db, "Work", "", user.ID)
+	select {
+	case e := <-events:
+		if e.Type != EventListChanged || e.Data.(List).ID != list.ID {
+			t.Errorf("expected a list.changed event for the new list, got %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the bus to publish a change nobody notified it of")
+	}
+}
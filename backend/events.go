@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Event types pushed to clients. Todos and lists are sent whole on every change (todos in the
+// GET /api/sync form, so trashing a todo is a todo.changed with deleted_at); deletions carry the ID.
+const (
+	EventTodoChanged     = "todo.changed"
+	EventTodoDeleted     = "todo.deleted"
+	EventListChanged     = "list.changed"
+	EventListDeleted     = "list.deleted"
+	EventTodoListAdded   = "todo_list.added"
+	EventTodoListRemoved = "todo_list.removed"
+	// EventReset tells a resuming client that the changes it missed cannot be replayed and it
+	// should resync with GET /api/sync.
+	EventReset = "reset"
+)
+
+// Event is a change to one of a user's todos, lists or list memberships. ID is the change's sync
+// token: events are ordered by ID, and a client can resume after (or sync from) the last one it saw.
+type Event struct {
+	ID     int64
+	UserID int64
+	Type   string
+	Data   any
+}
+
+// ErrEventBusClosed is returned when subscribing to a closed event bus.
+var ErrEventBusClosed = errors.New("event bus closed")
+
+// MaxReplayEvents caps the missed events replayed to a resuming stream; past it the stream gets an
+// EventReset instead.
+const MaxReplayEvents = 500
+
+// eventHeartbeatInterval is how often an idle stream sends a comment to keep proxies from closing it.
+var eventHeartbeatInterval = 25 * time.Second
+
+// eventRetry is the reconnection delay suggested to EventSource clients.
+const eventRetry = 3 * time.Second
+
+// eventSubscriberBuffer is how many events a subscriber may fall behind before it is dropped.
+// A dropped stream ends, and its client reconnects and resumes with Last-Event-ID.
+const eventSubscriberBuffer = 64
+
+// eventPollInterval is how often the bus checks for changes nobody notified it of, such as those
+// made by background jobs like the trash purge.
+var eventPollInterval = 5 * time.Second
+
+// eventBus fans out the changes committed to a database to the subscribed streams of their user.
+// The server opens one with newEventBus, calls Notify after each mutation and closes it on
+// shutdown. A single goroutine publishes, so changes are loaded once however many requests
+// notify it. cursor is the last change published; it is only tracked while someone is subscribed.
+type eventBus struct {
+	db          *sql.DB
+	wake        chan struct{}
+	stop        chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+	mu          sync.Mutex
+	closed      bool
+	cursor      int64
+	subscribers map[int64]map[chan Event]bool
+}
+
+// newEventBus opens an event bus for db and starts its publisher. Close must be called when the
+// bus is no longer needed.
+func newEventBus(db *sql.DB) *eventBus {
+	b := &eventBus{
+		db:          db,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		subscribers: make(map[int64]map[chan Event]bool),
+	}
+	go b.run()
+	return b
+}
+
+// Notify tells the bus that changes may have been committed. It never blocks: notifications that
+// arrive while a publish is pending are merged into it.
+func (b *eventBus) Notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the publisher and ends every subscribed stream; new subscriptions fail. Closing
+// twice is a no-op.
+func (b *eventBus) Close() {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+		<-b.done
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.closed = true
+		for userID, chans := range b.subscribers {
+			for ch := range chans {
+				b.remove(userID, ch)
+			}
+		}
+	})
+}
+
+// Subscribe registers a stream for the user's events. The returned channel receives every change
+// committed after the call and is closed if the stream falls too far behind or the bus is closed;
+// unsubscribe must be called when the stream ends.
+func (b *eventBus) Subscribe(userID int64) (<-chan Event, func(), error) {
+	var latest int64
+	if err := b.db.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM sync_changes").Scan(&latest); err != nil {
+		return nil, nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, nil, ErrEventBusClosed
+	}
+	if b.subscriberCount() == 0 {
+		b.cursor = max(b.cursor, latest)
+	}
+
+	ch := make(chan Event, eventSubscriberBuffer)
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan Event]bool)
+	}
+	b.subscribers[userID][ch] = true
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(userID, ch)
+	}
+	return ch, unsubscribe, nil
+}
+
+// run publishes whenever the bus is notified, and every eventPollInterval in case it was not,
+// until the bus is closed.
+func (b *eventBus) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-b.wake:
+		case <-ticker.C:
+		}
+		b.publish()
+	}
+}
+
+// publish loads the changes after the cursor and delivers them; it does nothing while no stream is
+// subscribed. Only run calls it, and the query runs without holding b.mu so subscribing is never
+// blocked on the database.
+func (b *eventBus) publish() {
+	b.mu.Lock()
+	cursor, idle := b.cursor, b.subscriberCount() == 0
+	b.mu.Unlock()
+	if idle {
+		return
+	}
+
+	events, err := GetChangeEvents(b.db, cursor, 0, 0)
+	if err != nil {
+		slog.Error("failed to load change events", "error", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range events {
+		if e.ID <= b.cursor {
+			continue
+		}
+		b.cursor = e.ID
+		for ch := range b.subscribers[e.UserID] {
+			select {
+			case ch <- e:
+			default:
+				b.remove(e.UserID, ch)
+			}
+		}
+	}
+}
+
+// remove unsubscribes ch and closes it; removing it twice is a no-op. b.mu must be held.
+func (b *eventBus) remove(userID int64, ch chan Event) {
+	if !b.subscribers[userID][ch] {
+		return
+	}
+	delete(b.subscribers[userID], ch)
+	if len(b.subscribers[userID]) == 0 {
+		delete(b.subscribers, userID)
+	}
+	close(ch)
+}
+
+// subscriberCount returns the number of open streams. b.mu must be held.
+func (b *eventBus) subscriberCount() int {
+	n := 0
+	for _, chans := range b.subscribers {
+		n += len(chans)
+	}
+	return n
+}
+
+// writeEvent writes e in the Server-Sent Events format; a zero ID is left out.
+func writeEvent(w io.Writer, e Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	if e.ID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", e.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidFilter is wrapped by every ParseTodoFilter validation error; the wrapping message
+// names the offending parameter.
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// MaxSortFields caps the number of fields in a sort expression.
+const MaxSortFields = 4
+
+// todoSortFields maps the fields of a sort expression to their default direction (true = descending).
+var todoSortFields = map[string]bool{
+	"position":  false,
+	"created":   true,
+	"due":       false,
+	"priority":  true,
+	"title":     false,
+	"completed": false,
+}
+
+// todoFilterParams are the query parameters read by ParseTodoFilter.
+var todoFilterParams = []string{
+	"completed", "list_id", "list_match", "created_from", "created_to", "due_from", "due_to", "title", "sort",
+}
+
+// ParseTodoFilter reads a todo filter from query parameters:
+//
+//	completed=true|false              completion state
+//	list_id=1&list_id=2 (or 1,2)      list membership
+//	list_match=any|all                whether a todo must be in any (default) or all of the lists
+//	created_from, created_to          inclusive creation range
+//	due_from, due_to                  inclusive due range (undated todos never match)
+//	title=text                        case-insensitive title substring
+//	sort=due:asc,priority:desc        fields position, created, due, priority, title, completed
+//
+// Dates are RFC 3339, local date/time in loc, or relative to now in loc: today, +3d, -2w,
+// week_start or week_end (weeks start on Monday; '+' must be sent as %2B). A day-level *_to bound covers the whole day,
+// so saved filters such as due_from=week_start&due_to=week_end stay current.
+// A bare preset sort (position, created, priority or due) keeps its predefined tie-breakers.
+// Errors wrap ErrInvalidFilter.
+func ParseTodoFilter(values url.Values, loc *time.Location, now time.Time) (TodoFilter, error) {
+	var f TodoFilter
+
+	if v := values.Get("completed"); v != "" {
+		completed, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("%w: completed must be true or false", ErrInvalidFilter)
+		}
+		f.Completed = &completed
+	}
+
+	seen := make(map[int64]bool)
+	for _, v := range values["list_id"] {
+		for _, part := range strings.Split(v, ",") {
+			listID, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+			if err != nil || listID <= 0 {
+				return f, fmt.Errorf("%w: list_id must be a list ID", ErrInvalidFilter)
+			}
+			if !seen[listID] {
+				seen[listID] = true
+				f.ListIDs = append(f.ListIDs, listID)
+			}
+		}
+	}
+
+	switch values.Get("list_match") {
+	case "", "any":
+	case "all":
+		f.AllLists = true
+	default:
+		return f, fmt.Errorf("%w: list_match must be any or all", ErrInvalidFilter)
+	}
+
+	var err error
+	if f.CreatedFrom, f.CreatedTo, err = parseFilterRange(values, "created", loc, now); err != nil {
+		return f, err
+	}
+	if f.DueFrom, f.DueTo, err = parseFilterRange(values, "due", loc, now); err != nil {
+		return f, err
+	}
+
+	f.TitleContains = strings.TrimSpace(values.Get("title"))
+	if len(f.TitleContains) > MaxTitleLength {
+		return f, fmt.Errorf("%w: title exceeds maximum length", ErrInvalidFilter)
+	}
+
+	f.Sort = strings.TrimSpace(values.Get("sort"))
+	if _, err := todoFilterSortKeys(f.Sort, "t.position"); err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+// HasTodoFilter reports whether values carry any parameter read by ParseTodoFilter.
+func HasTodoFilter(values url.Values) bool {
+	for _, param := range todoFilterParams {
+		if values.Has(param) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFilterRange reads the <name>_from and <name>_to bounds, rejecting inverted ranges.
+func parseFilterRange(values url.Values, name string, loc *time.Location, now time.Time) (*time.Time, *time.Time, error) {
+	var bounds [2]*time.Time
+	for i, suffix := range []string{"_from", "_to"} {
+		v := values.Get(name + suffix)
+		if v == "" {
+			continue
+		}
+		endOfDay := suffix == "_to"
+		t, ok := parseRelativeDay(v, loc, now, endOfDay)
+		if !ok {
+			var err error
+			if t, err = ParseTodoTime(v, loc, endOfDay); err != nil {
+				return nil, nil, fmt.Errorf("%w: %s%s must be RFC 3339, YYYY-MM-DD or a relative day", ErrInvalidFilter, name, suffix)
+			}
+		}
+		bounds[i] = &t
+	}
+	if bounds[0] != nil && bounds[1] != nil && bounds[0].After(*bounds[1]) {
+		return nil, nil, fmt.Errorf("%w: %s_from must not be after %s_to", ErrInvalidFilter, name, name)
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// parseRelativeDay resolves a relative day (today, ±Nd, ±Nw, week_start, week_end) against now in loc,
+// returning the start of that day, or its end when endOfDay is set. It returns false for other values.
+func parseRelativeDay(value string, loc *time.Location, now time.Time, endOfDay bool) (time.Time, bool) {
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	var day time.Time
+	switch v := strings.TrimSpace(value); {
+	case v == "today":
+		day = today
+	case v == "week_start" || v == "week_end":
+		// Monday-based weeks: Sunday is the last day.
+		offset := (int(today.Weekday()) + 6) % 7
+		day = today.AddDate(0, 0, -offset)
+		if v == "week_end" {
+			day = day.AddDate(0, 0, 6)
+		}
+	case len(v) > 2 && (v[0] == '+' || v[0] == '-'):
+		n, err := strconv.Atoi(v[1 : len(v)-1])
+		if err != nil || n < 0 {
+			return time.Time{}, false
+		}
+		if v[0] == '-' {
+			n = -n
+		}
+		switch v[len(v)-1] {
+		case 'd':
+			day = today.AddDate(0, 0, n)
+		case 'w':
+			day = today.AddDate(0, 0, 7*n)
+		default:
+			return time.Time{}, false
+		}
+	default:
+		return time.Time{}, false
+	}
+	if endOfDay {
+		day = day.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	return day, true
+}
+
+// todoFilterSortKeys compiles a sort expression ("field[:asc|desc],...") into ORDER BY keys, ending
+// in created_at, id so the order is total. Empty and bare preset names use todoSortKeys.
+func todoFilterSortKeys(spec string, positionColumn string) ([]sortKey, error) {
+	switch TodoSort(spec) {
+	case "", SortPosition, SortCreated, SortPriority, SortDue:
+		return todoSortKeys(TodoSort(spec), positionColumn)
+	}
+
+	fields := strings.Split(spec, ",")
+	if len(fields) > MaxSortFields {
+		return nil, fmt.Errorf("%w: sort accepts at most %d fields", ErrInvalidFilter, MaxSortFields)
+	}
+
+	var keys []sortKey
+	used := make(map[string]bool)
+	for _, field := range fields {
+		name, dir, hasDir := strings.Cut(strings.TrimSpace(field), ":")
+		desc, ok := todoSortFields[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown sort field %q", ErrInvalidFilter, name)
+		}
+		if used[name] {
+			return nil, fmt.Errorf("%w: duplicate sort field %q", ErrInvalidFilter, name)
+		}
+		used[name] = true
+		if hasDir {
+			switch dir {
+			case "asc":
+				desc = false
+			case "desc":
+				desc = true
+			default:
+				return nil, fmt.Errorf("%w: sort direction must be asc or desc", ErrInvalidFilter)
+			}
+		}
+
+		switch name {
+		case "position":
+			keys = append(keys, sortKey{positionColumn, desc})
+		case "created":
+			keys = append(keys, sortKey{"t.created_at", desc})
+		case "due":
+			// Undated todos sort last in both directions.
+			keys = append(keys, sortKey{"t.due_at IS NULL", false}, sortKey{"COALESCE(t.due_at, '')", desc})
+		case "priority":
+			keys = append(keys, sortKey{"t.priority", desc})
+		case "title":
+			keys = append(keys, sortKey{"t.title COLLATE NOCASE", desc})
+		case "completed":
+			keys = append(keys, sortKey{"t.completed", desc})
+		}
+	}
+
+	if !used["created"] {
+		keys = append(keys, sortKey{"t.created_at", true})
+	}
+	return append(keys, sortKey{"t.id", true}), nil
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/mail"
+	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -28,9 +35,9 @@ func writeError(w http.ResponseWriter, status int, msg string) {
 	json.NewEncoder(w).Encode(map[string]string{"error": msg})
 }
 
-// handleRegister creates a new user account.
-// POST /api/auth/register → 201 { "token": "..." }
-func handleRegister(db *sql.DB) http.HandlerFunc {
+// handleRegister creates a new user account, logs it in and emails it a verification link.
+// POST /api/auth/register → 201 AuthTokens
+func handleRegister(db *sql.DB, mailer Mailer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Email    string `json:"email"`
@@ -49,7 +56,7 @@ func handleRegister(db *sql.DB) http.HandlerFunc {
 			writeError(w, http.StatusBadRequest, "invalid email format")
 			return
 		}
-		if len(req.Password) < 6 {
+		if len(req.Password) < MinPasswordLength {
 			writeError(w, http.StatusBadRequest, "password must be at least 6 characters")
 			return
 		}
@@ -70,18 +77,23 @@ func handleRegister(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		token, err := generateJWT(user.ID)
+		tokens, err := startSession(db, r, user.ID)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, "failed to generate token")
 			return
 		}
+		// The account works without it (subject to the verification policy), and the user can ask
+		// for another one, so a failure here does not fail the registration.
+		if err := sendVerificationEmail(db, mailer, user); err != nil {
+			slog.Error("failed to send verification email", "user_id", user.ID, "error", err)
+		}
 
-		writeJSON(w, http.StatusCreated, map[string]string{"token": token})
+		writeJSON(w, http.StatusCreated, tokens)
 	}
 }
 
-// handleLogin authenticates a user and returns a JWT token.
-// POST /api/auth/login → 200 { "token": "..." }
+// handleLogin authenticates a user and starts a session.
+// POST /api/auth/login → 200 AuthTokens
 func handleLogin(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
@@ -113,157 +125,225 @@ func handleLogin(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		token, err := generateJWT(user.ID)
+		tokens, err := startSession(db, r, user.ID)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, "failed to generate token")
 			return
 		}
 
-		writeJSON(w, http.StatusOK, map[string]string{"token": token})
+		writeJSON(w, http.StatusOK, tokens)
 	}
 }
 
-// handleListTodos returns all todos for the authenticated user as a JSON array, with lists per todo.
-// GET /api/todos → 200 []Todo (each with lists)
-// GET /api/todos?list_id=123 → 200 []Todo (filtered by list)
-func handleListTodos(db *sql.DB) http.HandlerFunc {
+// handleRefresh exchanges a refresh token for a new access token and refresh token. Reusing a refresh
+// token revokes its session, logging out both the thief and the legitimate client.
+// POST /api/auth/refresh { "refresh_token": "..." } → 200 AuthTokens
+func handleRefresh(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserIDFromContext(r)
-		var todos []Todo
-		var err error
-		if listIDStr := r.URL.Query().Get("list_id"); listIDStr != "" {
-			listID, parseErr := strconv.ParseInt(listIDStr, 10, 64)
-			if parseErr != nil {
-				writeError(w, http.StatusBadRequest, "invalid list_id")
-				return
-			}
-			todos, err = ListTodosByList(db, listID, userID)
-			if err != nil {
-				if errors.Is(err, ErrListNotFound) {
-					writeError(w, http.StatusNotFound, "list not found")
-					return
-				}
-				writeError(w, http.StatusInternalServerError, "failed to fetch todos")
-				return
+		refreshToken, ok := decodeRefreshToken(w, r)
+		if !ok {
+			return
+		}
+
+		newToken, err := generateOpaqueToken()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to generate token")
+			return
+		}
+		session, err := RotateSession(db, hashToken(refreshToken), hashToken(newToken), clientIP(r), time.Now())
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrRefreshTokenReused):
+				slog.Warn("refresh token reused, session revoked")
+				writeError(w, http.StatusUnauthorized, "refresh token reuse detected, session revoked")
+			case errors.Is(err, ErrInvalidRefreshToken):
+				writeError(w, http.StatusUnauthorized, "invalid or expired refresh token")
+			default:
+				writeError(w, http.StatusInternalServerError, "failed to refresh session")
 			}
-			writeJSON(w, http.StatusOK, todos)
 			return
 		}
-		todos, err = GetAllTodos(db, userID)
+
+		token, err := generateJWT(session.UserID, session.ID)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, "failed to fetch todos")
+			writeError(w, http.StatusInternalServerError, "failed to generate token")
 			return
 		}
-		for i := range todos {
-			lists, err := ListTodoLists(db, todos[i].ID, userID)
-			if err != nil {
-				todos[i].Lists = nil
-			} else {
-				todos[i].Lists = lists
+		writeJSON(w, http.StatusOK, AuthTokens{token, newToken, int(AccessTokenTTL.Seconds())})
+	}
+}
+
+// handleLogout ends the session of a refresh token; it can no longer be refreshed.
+// POST /api/auth/logout { "refresh_token": "..." } → 204
+func handleLogout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		refreshToken, ok := decodeRefreshToken(w, r)
+		if !ok {
+			return
+		}
+
+		if err := RevokeSessionByRefreshToken(db, hashToken(refreshToken), time.Now()); err != nil {
+			if errors.Is(err, ErrInvalidRefreshToken) {
+				writeError(w, http.StatusUnauthorized, "invalid or expired refresh token")
+				return
 			}
+			writeError(w, http.StatusInternalServerError, "failed to log out")
+			return
 		}
-		writeJSON(w, http.StatusOK, todos)
+
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-// handleCreateTodo creates a new todo from the request body for the authenticated user.
-// POST /api/todos → 201 Todo
-func handleCreateTodo(db *sql.DB) http.HandlerFunc {
+// handleChangePassword changes the authenticated user's password after checking the current one,
+// and logs out their other sessions.
+// POST /api/auth/password { "current_password": "...", "new_password": "..." } → 204
+func handleChangePassword(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserIDFromContext(r)
 		var req struct {
-			Title string `json:"title"`
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeError(w, http.StatusBadRequest, "invalid JSON body")
 			return
 		}
+		if req.CurrentPassword == "" || req.NewPassword == "" {
+			writeError(w, http.StatusBadRequest, "current_password and new_password are required")
+			return
+		}
+		if len(req.NewPassword) < MinPasswordLength {
+			writeError(w, http.StatusBadRequest, "password must be at least 6 characters")
+			return
+		}
 
-		todo, err := CreateTodo(db, req.Title, userID)
+		userID := getUserIDFromContext(r)
+		user, err := GetUserByID(db, userID)
 		if err != nil {
-			if errors.Is(err, ErrEmptyTitle) {
-				writeError(w, http.StatusBadRequest, "title cannot be empty")
-				return
-			}
-			if errors.Is(err, ErrTitleTooLong) {
-				writeError(w, http.StatusBadRequest, "title exceeds maximum length of 255 characters")
+			if errors.Is(err, ErrUserNotFound) {
+				writeError(w, http.StatusNotFound, "user not found")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "failed to create todo")
+			writeError(w, http.StatusInternalServerError, "failed to change password")
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)); err != nil {
+			writeError(w, http.StatusForbidden, "current password is incorrect")
 			return
 		}
 
-		writeJSON(w, http.StatusCreated, todo)
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to process password")
+			return
+		}
+		if err := ChangePassword(db, userID, string(hash), getSessionIDFromContext(r), time.Now()); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to change password")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-// handleUpdateTodo updates the completed status of a todo for the authenticated user.
-// PATCH /api/todos/{id} → 204
-func handleUpdateTodo(db *sql.DB) http.HandlerFunc {
+// handleRequestPasswordReset emails a single-use reset link to the address, if it is registered. The
+// lookup and the email happen after the response, on resets' workers, and the response is the same
+// either way and takes as long, so that it does not reveal which addresses have accounts. Each client
+// IP may ask limiter's number of times per window.
+// POST /api/auth/password/reset { "email": "..." } → 202
+func handleRequestPasswordReset(resets *resetQueue, limiter *rateLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserIDFromContext(r)
-		idStr := r.PathValue("id")
-		id, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid todo ID")
+		if ok, retryAfter := limiter.Allow(clientIP(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+			writeError(w, http.StatusTooManyRequests, "too many password reset requests, try again later")
 			return
 		}
 
 		var req struct {
-			Completed bool `json:"completed"`
+			Email string `json:"email"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeError(w, http.StatusBadRequest, "invalid JSON body")
 			return
 		}
-
-		if err := UpdateTodoStatus(db, id, req.Completed, userID); err != nil {
-			if errors.Is(err, ErrNotFound) {
-				writeError(w, http.StatusNotFound, "todo not found")
-				return
-			}
-			writeError(w, http.StatusInternalServerError, "failed to update todo")
+		if req.Email == "" {
+			writeError(w, http.StatusBadRequest, "email is required")
 			return
 		}
 
-		w.WriteHeader(http.StatusNoContent)
+		if !resets.Enqueue(req.Email) {
+			slog.Warn("password reset dropped, queue full or closed")
+		}
+		w.WriteHeader(http.StatusAccepted)
 	}
 }
 
-// handleUpdateTodoTitle updates only the title of a todo for the authenticated user.
-// PATCH /api/todos/{id}/title → 204
-func handleUpdateTodoTitle(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserIDFromContext(r)
-		idStr := r.PathValue("id")
-		id, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid todo ID")
-			return
+// requestPasswordReset creates a reset token for the account with the given email, if there is one
+// and it was not sent a link too recently, and emails the link. It runs on a resetQueue worker after
+// the response has been sent, so failures are only logged.
+func requestPasswordReset(db *sql.DB, mailer Mailer, email string) {
+	user, err := GetUserByEmail(db, email)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			slog.Error("failed to look up user for password reset", "error", err)
 		}
+		return
+	}
+
+	token, err := generateOpaqueToken()
+	if err != nil {
+		slog.Error("failed to generate password reset token", "error", err)
+		return
+	}
+	if err := CreatePasswordReset(db, user.ID, hashToken(token), time.Now()); err != nil {
+		if !errors.Is(err, ErrResetTooSoon) {
+			slog.Error("failed to create password reset", "error", err)
+		}
+		return
+	}
+
+	sendMail(mailer, Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Someone asked to reset the password of your account.\n\n" +
+			"Open this link within 1 hour to choose a new one:\n" +
+			getAppURL() + "/reset-password?token=" + token + "\n\n" +
+			"If it was not you, ignore this email; your password has not changed.\n",
+	})
+}
 
+// handleConfirmPasswordReset sets a new password with a reset token and logs out all sessions.
+// POST /api/auth/password/reset/confirm { "token": "...", "new_password": "..." } → 204
+func handleConfirmPasswordReset(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
-			Title string `json:"title"`
+			Token       string `json:"token"`
+			NewPassword string `json:"new_password"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeError(w, http.StatusBadRequest, "invalid JSON body")
 			return
 		}
+		if req.Token == "" || req.NewPassword == "" {
+			writeError(w, http.StatusBadRequest, "token and new_password are required")
+			return
+		}
+		if len(req.NewPassword) < MinPasswordLength {
+			writeError(w, http.StatusBadRequest, "password must be at least 6 characters")
+			return
+		}
 
-		if err := UpdateTodoTitle(db, id, req.Title, userID); err != nil {
-			if errors.Is(err, ErrEmptyTitle) {
-				writeError(w, http.StatusBadRequest, "title cannot be empty")
-				return
-			}
-			if errors.Is(err, ErrTitleTooLong) {
-				writeError(w, http.StatusBadRequest, "title exceeds maximum length of 255 characters")
-				return
-			}
-			if errors.Is(err, ErrNotFound) {
-				writeError(w, http.StatusNotFound, "todo not found")
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to process password")
+			return
+		}
+		if err := ResetPassword(db, hashToken(req.Token), string(hash), time.Now()); err != nil {
+			if errors.Is(err, ErrInvalidResetToken) {
+				writeError(w, http.StatusBadRequest, "invalid or expired reset token")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "failed to update todo title")
+			writeError(w, http.StatusInternalServerError, "failed to reset password")
 			return
 		}
 
@@ -271,24 +351,34 @@ func handleUpdateTodoTitle(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// handleDeleteTodo soft-deletes a todo for the authenticated user.
-// DELETE /api/todos/{id} → 204
-func handleDeleteTodo(db *sql.DB) http.HandlerFunc {
+// handleVerifyEmail marks an email address as verified with the token of the link emailed to it.
+// It needs no login, so the link works on any device.
+// POST /api/auth/verify { "token": "..." } → 204
+func handleVerifyEmail(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserIDFromContext(r)
-		idStr := r.PathValue("id")
-		id, err := strconv.ParseInt(idStr, 10, 64)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid todo ID")
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if req.Token == "" {
+			writeError(w, http.StatusBadRequest, "token is required")
 			return
 		}
 
-		if err := DeleteTodo(db, id, userID); err != nil {
-			if errors.Is(err, ErrNotFound) {
-				writeError(w, http.StatusNotFound, "todo not found")
+		userID, email, err := validateVerificationToken(req.Token)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid or expired verification token")
+			return
+		}
+		if err := MarkEmailVerified(db, userID, email, time.Now()); err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				writeError(w, http.StatusBadRequest, "invalid or expired verification token")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "failed to delete todo")
+			writeError(w, http.StatusInternalServerError, "failed to verify email")
 			return
 		}
 
@@ -296,256 +386,718 @@ func handleDeleteTodo(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// --- List Handlers ---
-
-// handleListTodosByList returns all todos for a specific list for the authenticated user.
-// GET /api/lists/{id}/todos → 200 []Todo (each with lists populated)
-func handleListTodosByList(db *sql.DB) http.HandlerFunc {
+// handleResendVerification emails the authenticated user a new verification link, at most once per
+// VerificationResendInterval.
+// POST /api/auth/verify/resend → 202
+func handleResendVerification(db *sql.DB, mailer Mailer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserIDFromContext(r)
-		idStr := r.PathValue("id")
-		listID, err := strconv.ParseInt(idStr, 10, 64)
+		user, err := GetUserByID(db, getUserIDFromContext(r))
 		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid list ID")
+			if errors.Is(err, ErrUserNotFound) {
+				writeError(w, http.StatusNotFound, "user not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to send verification email")
 			return
 		}
 
-		todos, err := ListTodosByList(db, listID, userID)
-		if err != nil {
-			if errors.Is(err, ErrListNotFound) {
-				writeError(w, http.StatusNotFound, "list not found")
-				return
+		if err := sendVerificationEmail(db, mailer, user); err != nil {
+			switch {
+			case errors.Is(err, ErrEmailAlreadyVerified):
+				writeError(w, http.StatusConflict, "email already verified")
+			case errors.Is(err, ErrVerificationTooSoon):
+				w.Header().Set("Retry-After", strconv.Itoa(int(VerificationResendInterval.Seconds())))
+				writeError(w, http.StatusTooManyRequests, "a verification email was sent recently, try again later")
+			default:
+				writeError(w, http.StatusInternalServerError, "failed to send verification email")
 			}
-			writeError(w, http.StatusInternalServerError, "failed to fetch todos")
 			return
 		}
 
-		writeJSON(w, http.StatusOK, todos)
+		w.WriteHeader(http.StatusAccepted)
 	}
 }
 
-// handleListLists returns all lists for the authenticated user.
-// GET /api/lists → 200 []List
-func handleListLists(db *sql.DB) http.HandlerFunc {
+// sendVerificationEmail emails the user a link to verify their address, subject to
+// ReserveVerificationEmail's rate limit.
+func sendVerificationEmail(db *sql.DB, mailer Mailer, user User) error {
+	if err := ReserveVerificationEmail(db, user.ID, time.Now()); err != nil {
+		return err
+	}
+	token, err := generateVerificationToken(user.ID, user.Email)
+	if err != nil {
+		return err
+	}
+
+	go sendMail(mailer, Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: "Welcome! Confirm that this is your email address by opening this link within 48 hours:\n" +
+			getAppURL() + "/verify-email?token=" + token + "\n\n" +
+			"If you did not create an account, ignore this email.\n",
+	})
+	return nil
+}
+
+// sendMail sends msg with mailer, logging failures; handlers run it in a goroutine so that slow
+// mail servers do not hold up (or time) the response.
+func sendMail(mailer Mailer, msg Message) {
+	if err := mailer.Send(msg); err != nil {
+		slog.Error("failed to send email", "to", msg.To, "subject", msg.Subject, "error", err)
+	}
+}
+
+// handleListSessions returns the authenticated user's active sessions, most recently used first,
+// with the current one flagged.
+// GET /api/auth/sessions → 200 []Session
+func handleListSessions(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserIDFromContext(r)
-		lists, err := ListLists(db, userID)
+		sessions, err := ListSessions(db, getUserIDFromContext(r), time.Now())
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, "failed to fetch lists")
+			writeError(w, http.StatusInternalServerError, "failed to list sessions")
 			return
 		}
-		writeJSON(w, http.StatusOK, lists)
+		current := getSessionIDFromContext(r)
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current
+		}
+		writeJSON(w, http.StatusOK, sessions)
 	}
 }
 
-// handleCreateList creates a new list for the authenticated user.
-// POST /api/lists → 201 List
-func handleCreateList(db *sql.DB) http.HandlerFunc {
+// handleRevokeSession logs out one of the authenticated user's sessions, e.g. a lost device.
+// DELETE /api/auth/sessions/{id} → 204
+func handleRevokeSession(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserIDFromContext(r)
-		var req struct {
-			Name  string `json:"name"`
-			Color string `json:"color"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			writeError(w, http.StatusBadRequest, "invalid JSON body")
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid session ID")
 			return
 		}
 
-		list, err := CreateList(db, req.Name, req.Color, userID)
-		if err != nil {
-			if errors.Is(err, ErrEmptyListName) {
-				writeError(w, http.StatusBadRequest, "list name cannot be empty")
-				return
-			}
-			if errors.Is(err, ErrListNameTooLong) {
-				writeError(w, http.StatusBadRequest, "list name exceeds maximum length of 50 characters")
-				return
-			}
-			if errors.Is(err, ErrDuplicateList) {
-				writeError(w, http.StatusConflict, "list with this name already exists")
-				return
-			}
-			if errors.Is(err, ErrInvalidColor) {
-				writeError(w, http.StatusBadRequest, "color must be a valid pastel hex from the palette")
+		if err := RevokeSession(db, getUserIDFromContext(r), id, time.Now()); err != nil {
+			if errors.Is(err, ErrSessionNotFound) {
+				writeError(w, http.StatusNotFound, "session not found")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "failed to create list")
+			writeError(w, http.StatusInternalServerError, "failed to revoke session")
 			return
 		}
 
-		writeJSON(w, http.StatusCreated, list)
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-// handleUpdateList updates the name and/or color of a list for the authenticated user.
-// PATCH /api/lists/{id} → 204
-func handleUpdateList(db *sql.DB) http.HandlerFunc {
+// handleRevokeAllSessions logs the authenticated user out everywhere, including the current session.
+// DELETE /api/auth/sessions → 204
+func handleRevokeAllSessions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := RevokeAllSessions(db, getUserIDFromContext(r), time.Now()); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to revoke sessions")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// startSession creates a session for the user logging in with r and returns its first access and
+// refresh tokens.
+func startSession(db *sql.DB, r *http.Request, userID int64) (AuthTokens, error) {
+	refreshToken, err := generateOpaqueToken()
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	session, err := CreateSession(db, userID, hashToken(refreshToken), r.UserAgent(), clientIP(r), time.Now())
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	token, err := generateJWT(userID, session.ID)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	return AuthTokens{token, refreshToken, int(AccessTokenTTL.Seconds())}, nil
+}
+
+// decodeRefreshToken reads the refresh_token of a refresh or logout body, writing a 400 if it is missing.
+func decodeRefreshToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return "", false
+	}
+	if req.RefreshToken == "" {
+		writeError(w, http.StatusBadRequest, "refresh_token is required")
+		return "", false
+	}
+	return req.RefreshToken, true
+}
+
+// handleGetMe returns the authenticated user's profile.
+// GET /api/me → 200 User
+func handleGetMe(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := getUserIDFromContext(r)
-		idStr := r.PathValue("id")
-		id, err := strconv.ParseInt(idStr, 10, 64)
+		user, err := GetUserByID(db, userID)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid list ID")
+			if errors.Is(err, ErrUserNotFound) {
+				writeError(w, http.StatusNotFound, "user not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to fetch user")
 			return
 		}
+		writeJSON(w, http.StatusOK, user)
+	}
+}
 
+// handleUpdateMe updates the authenticated user's settings (currently the timezone).
+// PATCH /api/me → 200 User
+func handleUpdateMe(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
 		var req struct {
-			Name  string `json:"name"`
-			Color string `json:"color"`
+			Timezone string `json:"timezone"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeError(w, http.StatusBadRequest, "invalid JSON body")
 			return
 		}
 
-		existing, err := GetListByID(db, id, userID)
-		if err != nil {
-			if errors.Is(err, ErrListNotFound) {
-				writeError(w, http.StatusNotFound, "list not found")
+		if err := UpdateUserTimezone(db, userID, req.Timezone); err != nil {
+			if errors.Is(err, ErrInvalidTimezone) {
+				writeError(w, http.StatusBadRequest, "timezone must be a valid IANA name")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "failed to fetch list")
+			if errors.Is(err, ErrUserNotFound) {
+				writeError(w, http.StatusNotFound, "user not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to update user")
 			return
 		}
-		name := req.Name
-		if name == "" {
-			name = existing.Name
-		}
-		color := req.Color
-		if color == "" {
-			color = existing.Color
+
+		user, err := GetUserByID(db, userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to fetch user")
+			return
 		}
+		writeJSON(w, http.StatusOK, user)
+	}
+}
 
-		if err := UpdateList(db, id, name, color, userID); err != nil {
-			if errors.Is(err, ErrEmptyListName) {
-				writeError(w, http.StatusBadRequest, "list name cannot be empty")
+// parsePage reads the limit and cursor query parameters of a paginated endpoint,
+// writing a 400 and returning false when limit is invalid.
+func parsePage(w http.ResponseWriter, r *http.Request) (Page, bool) {
+	page := Page{Cursor: r.URL.Query().Get("cursor")}
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 200")
+			return page, false
+		}
+		page.Limit = limit
+	}
+	return page, true
+}
+
+// writePageError maps pagination errors to a 400, returning false for any other error.
+func writePageError(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, ErrInvalidCursor) {
+		writeError(w, http.StatusBadRequest, "invalid cursor")
+		return true
+	}
+	if errors.Is(err, ErrInvalidLimit) {
+		writeError(w, http.StatusBadRequest, "limit must be between 1 and 200")
+		return true
+	}
+	return false
+}
+
+// setNextLink points a Link rel="next" header at the following page, if there is one.
+func setNextLink(w http.ResponseWriter, r *http.Request, next string) {
+	if next == "" {
+		return
+	}
+	query := r.URL.Query()
+	query.Set("cursor", next)
+	w.Header().Set("Link", "<"+r.URL.Path+"?"+query.Encode()+`>; rel="next"`)
+}
+
+// etag formats a list version as a strong entity tag.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// todoETag is the strong entity tag of a todo as served with its lists: the todo's version, followed
+// by the sum of the embedded lists' versions when it has any ("3.7"). Adding or removing a list bumps
+// the todo's version and list versions only grow, so the tag changes whenever a list is renamed or
+// recolored too.
+func todoETag(todo Todo) string {
+	if len(todo.Lists) == 0 {
+		return etag(todo.Version)
+	}
+	var lists int64
+	for _, l := range todo.Lists {
+		lists += l.Version
+	}
+	return `"` + strconv.FormatInt(todo.Version, 10) + "." + strconv.FormatInt(lists, 10) + `"`
+}
+
+// ifMatchVersion reads the If-Match header of a conditional write: the version it names, or 0 when
+// it is absent or "*". The list part of a todo tag is ignored, since list changes do not conflict
+// with writes to the todo. A weak, malformed or multi-valued header can never match a single
+// version, so it writes a 412 and returns false.
+func ifMatchVersion(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return 0, true
+	}
+	if len(value) > 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		tag, lists, found := strings.Cut(value[1:len(value)-1], ".")
+		if _, err := strconv.ParseUint(lists, 10, 64); found && err != nil {
+			tag = ""
+		}
+		if version, err := strconv.ParseInt(tag, 10, 64); err == nil && version > 0 {
+			return version, true
+		}
+	}
+	writeError(w, http.StatusPreconditionFailed, "If-Match must be a single ETag")
+	return 0, false
+}
+
+// notModified sets the ETag of a GET response and, when If-None-Match lists it (or is "*"),
+// writes a 304 and returns true. Comparison is weak, as RFC 9110 requires for If-None-Match.
+func notModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	w.Header().Set("ETag", tag)
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == tag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// handleListTodos returns the authenticated user's todos as a JSON array, with lists per todo.
+// GET /api/todos → 200 []Todo (each with lists, in manual order)
+// GET /api/todos?completed=false&list_id=1,2&title=milk&sort=due:asc,priority:desc → 200 []Todo (filters: see ParseTodoFilter)
+// GET /api/todos?due=overdue|today|upcoming → 200 []Todo (by due date, in the user's timezone)
+// GET /api/todos?limit=50&cursor=... → 200 []Todo (one page; Link: <...>; rel="next" while more remain)
+func handleListTodos(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		query := r.URL.Query()
+		var todos []Todo
+		var next string
+		var err error
+		page, ok := parsePage(w, r)
+		if !ok {
+			return
+		}
+
+		loc, err := GetUserLocation(db, userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to fetch todos")
+			return
+		}
+
+		if due := query.Get("due"); due != "" {
+			sort := TodoSort(query.Get("sort"))
+			query.Del("sort")
+			if HasTodoFilter(query) {
+				writeError(w, http.StatusBadRequest, "due cannot be combined with other filters")
 				return
 			}
-			if errors.Is(err, ErrListNameTooLong) {
-				writeError(w, http.StatusBadRequest, "list name exceeds maximum length of 50 characters")
+			if page != (Page{}) {
+				writeError(w, http.StatusBadRequest, "due cannot be combined with limit or cursor")
 				return
 			}
-			if errors.Is(err, ErrDuplicateList) {
-				writeError(w, http.StatusConflict, "list with this name already exists")
+			todos, err = GetTodosDue(db, userID, due, sort, loc, time.Now())
+			if err != nil {
+				if errors.Is(err, ErrInvalidDue) {
+					writeError(w, http.StatusBadRequest, "due must be overdue, today or upcoming")
+					return
+				}
+				if errors.Is(err, ErrInvalidSort) {
+					writeError(w, http.StatusBadRequest, "sort must be position, created, priority or due")
+					return
+				}
+				writeError(w, http.StatusInternalServerError, "failed to fetch todos")
 				return
 			}
-			if errors.Is(err, ErrListNotFound) {
-				writeError(w, http.StatusNotFound, "list not found")
+		} else {
+			filter, err := ParseTodoFilter(query, loc, time.Now())
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "failed to update list")
+			todos, next, err = QueryTodos(db, filter, userID, page)
+			if err != nil {
+				if errors.Is(err, ErrListNotFound) {
+					writeError(w, http.StatusNotFound, "list not found")
+					return
+				}
+				if writePageError(w, err) {
+					return
+				}
+				writeError(w, http.StatusInternalServerError, "failed to fetch todos")
+				return
+			}
+		}
+
+		if err := attachTodoLists(db, todos, userID); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to fetch todos")
 			return
 		}
+		setNextLink(w, r, next)
+		writeJSON(w, http.StatusOK, todos)
+	}
+}
 
-		w.WriteHeader(http.StatusNoContent)
+// parseScheduleRequest parses optional due_at/start_at request values in the user's timezone.
+// Empty or absent values yield nil. Returns ErrInvalidDate for unparseable values.
+func parseScheduleRequest(db *sql.DB, userID int64, dueAt, startAt *string) (due, start *time.Time, err error) {
+	hasDue := dueAt != nil && *dueAt != ""
+	hasStart := startAt != nil && *startAt != ""
+	if !hasDue && !hasStart {
+		return nil, nil, nil
+	}
+
+	loc, err := GetUserLocation(db, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hasDue {
+		t, err := ParseTodoTime(*dueAt, loc, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		due = &t
+	}
+	if hasStart {
+		t, err := ParseTodoTime(*startAt, loc, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		start = &t
 	}
+	return due, start, nil
 }
 
-// handleDeleteList deletes a list for the authenticated user.
-// DELETE /api/lists/{id} → 204
-func handleDeleteList(db *sql.DB) http.HandlerFunc {
+// handleCreateTodo creates a new todo from the request body for the authenticated user.
+// POST /api/todos → 201 Todo
+func handleCreateTodo(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := getUserIDFromContext(r)
-		idStr := r.PathValue("id")
-		id, err := strconv.ParseInt(idStr, 10, 64)
+		var req struct {
+			Title      string  `json:"title"`
+			DueAt      *string `json:"due_at"`
+			StartAt    *string `json:"start_at"`
+			Priority   string  `json:"priority"`
+			Notes      string  `json:"notes"`
+			Recurrence string  `json:"recurrence"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		dueAt, startAt, err := parseScheduleRequest(db, userID, req.DueAt, req.StartAt)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid list ID")
+			if errors.Is(err, ErrInvalidDate) {
+				writeError(w, http.StatusBadRequest, "due_at and start_at must be RFC 3339 or YYYY-MM-DD")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to create todo")
 			return
 		}
 
-		if err := DeleteList(db, id, userID); err != nil {
-			if errors.Is(err, ErrListNotFound) {
-				writeError(w, http.StatusNotFound, "list not found")
+		details := TodoDetails{
+			DueAt:      dueAt,
+			StartAt:    startAt,
+			Priority:   req.Priority,
+			Notes:      req.Notes,
+			Recurrence: req.Recurrence,
+		}
+		todo, err := CreateTodoWithDetails(db, req.Title, details, userID)
+		if err != nil {
+			if errors.Is(err, ErrEmptyTitle) {
+				writeError(w, http.StatusBadRequest, "title cannot be empty")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "failed to delete list")
+			if errors.Is(err, ErrTitleTooLong) {
+				writeError(w, http.StatusBadRequest, "title exceeds maximum length of 255 characters")
+				return
+			}
+			if errors.Is(err, ErrStartAfterDue) {
+				writeError(w, http.StatusBadRequest, "start_at must not be after due_at")
+				return
+			}
+			if errors.Is(err, ErrInvalidPriority) {
+				writeError(w, http.StatusBadRequest, "priority must be none, low, medium, high or urgent")
+				return
+			}
+			if errors.Is(err, ErrNotesTooLong) {
+				writeError(w, http.StatusBadRequest, "notes exceed maximum length of 65536 bytes")
+				return
+			}
+			if errors.Is(err, ErrInvalidRecurrence) {
+				writeError(w, http.StatusBadRequest, "recurrence must be a supported RRULE")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to create todo")
 			return
 		}
 
-		w.WriteHeader(http.StatusNoContent)
+		writeJSON(w, http.StatusCreated, todo)
 	}
 }
 
-// handleAddListToTodo associates a list with a todo for the authenticated user.
-// POST /api/todos/{id}/lists/{listId} → 204
-func handleAddListToTodo(db *sql.DB) http.HandlerFunc {
+// handleBulkTodos applies one action to many todos of the authenticated user in a single transaction.
+// Todos that cannot be changed are reported in their result without affecting the others.
+// POST /api/todos/bulk { "action": "add_to_list", "ids": [1, 2, 3], "list_id": 4 } → 200 { "results": []BulkResult }
+func handleBulkTodos(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := getUserIDFromContext(r)
-		todoIDStr := r.PathValue("id")
-		listIDStr := r.PathValue("listId")
-		todoID, err := strconv.ParseInt(todoIDStr, 10, 64)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid todo ID")
+		var req struct {
+			Action BulkAction `json:"action"`
+			IDs    []int64    `json:"ids"`
+			ListID int64      `json:"list_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
 			return
 		}
-		listID, err := strconv.ParseInt(listIDStr, 10, 64)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid list ID")
+		if req.Action.isListAction() && req.ListID == 0 {
+			writeError(w, http.StatusBadRequest, "list_id is required for list actions")
 			return
 		}
 
-		if err := AddListToTodo(db, todoID, listID, userID); err != nil {
-			if errors.Is(err, ErrNotFound) {
-				writeError(w, http.StatusNotFound, "todo not found")
+		errs, err := BulkUpdateTodos(db, req.Action, req.IDs, req.ListID, userID)
+		if err != nil {
+			if errors.Is(err, ErrInvalidBulkAction) || errors.Is(err, ErrInvalidBulkSize) {
+				writeError(w, http.StatusBadRequest, err.Error())
 				return
 			}
 			if errors.Is(err, ErrListNotFound) {
 				writeError(w, http.StatusNotFound, "list not found")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "failed to add list to todo")
+			writeError(w, http.StatusInternalServerError, "failed to update todos")
 			return
 		}
 
-		w.WriteHeader(http.StatusNoContent)
+		notFound := "todo not found"
+		if req.Action == BulkRestore {
+			notFound = "todo not found in trash"
+		}
+		results := make([]BulkResult, len(req.IDs))
+		for i, id := range req.IDs {
+			results[i] = BulkResult{ID: id, Status: http.StatusOK}
+			if errs[i] != nil {
+				results[i].Status = http.StatusNotFound
+				results[i].Error = notFound
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string][]BulkResult{"results": results})
 	}
 }
 
-// handleRemoveListFromTodo removes the association between a list and a todo.
-// DELETE /api/todos/{id}/lists/{listId} → 204
-func handleRemoveListFromTodo(db *sql.DB) http.HandlerFunc {
+// handleGetTodo returns a single todo with its notes and lists for the authenticated user.
+// GET /api/todos/{id} → 200 Todo (with ETag; 304 if If-None-Match matches)
+func handleGetTodo(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := getUserIDFromContext(r)
-		todoIDStr := r.PathValue("id")
-		listIDStr := r.PathValue("listId")
-		todoID, err := strconv.ParseInt(todoIDStr, 10, 64)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
 			writeError(w, http.StatusBadRequest, "invalid todo ID")
 			return
 		}
-		listID, err := strconv.ParseInt(listIDStr, 10, 64)
+
+		todo, err := GetTodoByID(db, id, userID)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid list ID")
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to fetch todo")
 			return
 		}
 
-		if err := RemoveListFromTodo(db, todoID, listID, userID); err != nil {
-			if errors.Is(err, ErrNotFound) {
-				writeError(w, http.StatusNotFound, "todo or list association not found")
+		if notModified(w, r, todoETag(todo)) {
+			return
+		}
+		writeJSON(w, http.StatusOK, todo)
+	}
+}
+
+// todoReadOnlyFields are Todo fields that a merge patch may not change.
+var todoReadOnlyFields = map[string]bool{
+	"id": true, "created_at": true, "user_id": true, "deleted_at": true, "progress": true, "lists": true,
+	"version": true, "updated_at": true,
+}
+
+// parseTodoPatch converts a JSON Merge Patch (RFC 7396) document into a TodoPatch. Absent members are
+// left untouched; null resets nullable fields (due_at, start_at, priority, notes, recurrence).
+// Dates without an offset are read in loc. The returned error is a client-facing message.
+func parseTodoPatch(doc map[string]json.RawMessage, loc *time.Location) (TodoPatch, error) {
+	var patch TodoPatch
+	for field, raw := range doc {
+		isNull := string(raw) == "null"
+		switch field {
+		case "title":
+			var title string
+			if isNull || json.Unmarshal(raw, &title) != nil {
+				return patch, errors.New("title must be a string")
+			}
+			patch.Title = &title
+		case "completed":
+			var completed bool
+			if isNull || json.Unmarshal(raw, &completed) != nil {
+				return patch, errors.New("completed must be a boolean")
+			}
+			patch.Completed = &completed
+		case "due_at", "start_at":
+			var value string
+			if !isNull && json.Unmarshal(raw, &value) != nil {
+				return patch, errors.New(field + " must be a string or null")
+			}
+			var t *time.Time
+			if value != "" {
+				parsed, err := ParseTodoTime(value, loc, field == "due_at")
+				if err != nil {
+					return patch, errors.New("due_at and start_at must be RFC 3339 or YYYY-MM-DD")
+				}
+				t = &parsed
+			}
+			if field == "due_at" {
+				patch.DueAt, patch.ClearDueAt = t, t == nil
+			} else {
+				patch.StartAt, patch.ClearStartAt = t, t == nil
+			}
+		case "priority", "notes", "recurrence":
+			var value string
+			if !isNull && json.Unmarshal(raw, &value) != nil {
+				return patch, errors.New(field + " must be a string or null")
+			}
+			switch field {
+			case "priority":
+				patch.Priority = &value
+			case "notes":
+				patch.Notes = &value
+			default:
+				patch.Recurrence = &value
+			}
+		default:
+			if todoReadOnlyFields[field] {
+				return patch, errors.New(field + " cannot be changed")
+			}
+			return patch, errors.New("unknown field " + strconv.Quote(field))
+		}
+	}
+	return patch, nil
+}
+
+// handleUpdateTodo applies a JSON Merge Patch to a todo for the authenticated user: fields absent from
+// the body are untouched, null clears optional fields, and all changes are applied atomically.
+// An If-Match header makes the update conditional on the todo's ETag (412 if it has changed).
+// PATCH /api/todos/{id} { "title": "...", "completed": true, "due_at": null, ... } → 200 Todo (with ETag)
+func handleUpdateTodo(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+		version, ok := ifMatchVersion(w, r)
+		if !ok {
+			return
+		}
+
+		var doc map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if doc == nil {
+			writeError(w, http.StatusBadRequest, "merge patch must be a JSON object")
+			return
+		}
+
+		loc, err := GetUserLocation(db, userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to update todo")
+			return
+		}
+		patch, err := parseTodoPatch(doc, loc)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		patch.Version = version
+
+		todo, err := PatchTodo(db, id, patch, userID)
+		if err != nil {
+			if errors.Is(err, ErrEmptyTitle) {
+				writeError(w, http.StatusBadRequest, "title cannot be empty")
 				return
 			}
-			if errors.Is(err, ErrListNotFound) {
-				writeError(w, http.StatusNotFound, "list not found")
+			if errors.Is(err, ErrTitleTooLong) {
+				writeError(w, http.StatusBadRequest, "title exceeds maximum length of 255 characters")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "failed to remove list from todo")
+			if errors.Is(err, ErrStartAfterDue) {
+				writeError(w, http.StatusBadRequest, "start_at must not be after due_at")
+				return
+			}
+			if errors.Is(err, ErrInvalidPriority) {
+				writeError(w, http.StatusBadRequest, "priority must be none, low, medium, high or urgent")
+				return
+			}
+			if errors.Is(err, ErrNotesTooLong) {
+				writeError(w, http.StatusBadRequest, "notes exceed maximum length of 65536 bytes")
+				return
+			}
+			if errors.Is(err, ErrInvalidRecurrence) {
+				writeError(w, http.StatusBadRequest, "recurrence must be a supported RRULE")
+				return
+			}
+			if errors.Is(err, ErrVersionMismatch) {
+				writeError(w, http.StatusPreconditionFailed, "todo has been modified")
+				return
+			}
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to update todo")
 			return
 		}
 
-		w.WriteHeader(http.StatusNoContent)
+		w.Header().Set("ETag", todoETag(todo))
+		writeJSON(w, http.StatusOK, todo)
 	}
 }
 
-// handleCreateTodoInList creates a todo and atomically associates it with the given list.
-// POST /api/lists/{id}/todos → 201 Todo
-func handleCreateTodoInList(db *sql.DB) http.HandlerFunc {
+// handleUpdateTodoTitle updates only the title of a todo for the authenticated user.
+// PATCH /api/todos/{id}/title → 204
+func handleUpdateTodoTitle(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := getUserIDFromContext(r)
 		idStr := r.PathValue("id")
-		listID, err := strconv.ParseInt(idStr, 10, 64)
+		id, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid list ID")
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+		version, ok := ifMatchVersion(w, r)
+		if !ok {
 			return
 		}
 
@@ -557,7 +1109,7 @@ func handleCreateTodoInList(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		todo, err := CreateTodoInList(db, req.Title, listID, userID)
+		todo, err := PatchTodo(db, id, TodoPatch{Title: &req.Title, Version: version}, userID)
 		if err != nil {
 			if errors.Is(err, ErrEmptyTitle) {
 				writeError(w, http.StatusBadRequest, "title cannot be empty")
@@ -567,14 +1119,1693 @@ func handleCreateTodoInList(db *sql.DB) http.HandlerFunc {
 				writeError(w, http.StatusBadRequest, "title exceeds maximum length of 255 characters")
 				return
 			}
-			if errors.Is(err, ErrListNotFound) {
-				writeError(w, http.StatusNotFound, "list not found")
+			if errors.Is(err, ErrVersionMismatch) {
+				writeError(w, http.StatusPreconditionFailed, "todo has been modified")
 				return
 			}
-			writeError(w, http.StatusInternalServerError, "failed to create todo in list")
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to update todo title")
 			return
 		}
 
-		writeJSON(w, http.StatusCreated, todo)
+		w.Header().Set("ETag", todoETag(todo))
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
+
+// handleUpdateTodoNotes replaces the Markdown notes of a todo for the authenticated user.
+// PATCH /api/todos/{id}/notes → 204
+func handleUpdateTodoNotes(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+		version, ok := ifMatchVersion(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Notes string `json:"notes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		todo, err := PatchTodo(db, id, TodoPatch{Notes: &req.Notes, Version: version}, userID)
+		if err != nil {
+			if errors.Is(err, ErrNotesTooLong) {
+				writeError(w, http.StatusBadRequest, "notes exceed maximum length of 65536 bytes")
+				return
+			}
+			if errors.Is(err, ErrVersionMismatch) {
+				writeError(w, http.StatusPreconditionFailed, "todo has been modified")
+				return
+			}
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to update todo notes")
+			return
+		}
+
+		w.Header().Set("ETag", todoETag(todo))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleUpdateTodoRecurrence sets or clears (empty value) the RRULE of a todo for the authenticated user.
+// PATCH /api/todos/{id}/recurrence { "recurrence": "FREQ=WEEKLY;BYDAY=MO" } → 204
+func handleUpdateTodoRecurrence(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+		version, ok := ifMatchVersion(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Recurrence string `json:"recurrence"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		todo, err := PatchTodo(db, id, TodoPatch{Recurrence: &req.Recurrence, Version: version}, userID)
+		if err != nil {
+			if errors.Is(err, ErrInvalidRecurrence) {
+				writeError(w, http.StatusBadRequest, "recurrence must be a supported RRULE")
+				return
+			}
+			if errors.Is(err, ErrVersionMismatch) {
+				writeError(w, http.StatusPreconditionFailed, "todo has been modified")
+				return
+			}
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to update todo recurrence")
+			return
+		}
+
+		w.Header().Set("ETag", todoETag(todo))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleUpdateTodoSchedule replaces the due and start dates of a todo for the authenticated user.
+// Absent, null or empty values clear the corresponding date.
+// PATCH /api/todos/{id}/schedule → 204
+func handleUpdateTodoSchedule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+		version, ok := ifMatchVersion(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			DueAt   *string `json:"due_at"`
+			StartAt *string `json:"start_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		dueAt, startAt, err := parseScheduleRequest(db, userID, req.DueAt, req.StartAt)
+		if err != nil {
+			if errors.Is(err, ErrInvalidDate) {
+				writeError(w, http.StatusBadRequest, "due_at and start_at must be RFC 3339 or YYYY-MM-DD")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to update todo schedule")
+			return
+		}
+
+		patch := TodoPatch{DueAt: dueAt, ClearDueAt: dueAt == nil, StartAt: startAt, ClearStartAt: startAt == nil, Version: version}
+		todo, err := PatchTodo(db, id, patch, userID)
+		if err != nil {
+			if errors.Is(err, ErrStartAfterDue) {
+				writeError(w, http.StatusBadRequest, "start_at must not be after due_at")
+				return
+			}
+			if errors.Is(err, ErrVersionMismatch) {
+				writeError(w, http.StatusPreconditionFailed, "todo has been modified")
+				return
+			}
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to update todo schedule")
+			return
+		}
+
+		w.Header().Set("ETag", todoETag(todo))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleUpdateTodoPriority sets the priority of a todo for the authenticated user.
+// PATCH /api/todos/{id}/priority → 204
+func handleUpdateTodoPriority(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+		version, ok := ifMatchVersion(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Priority string `json:"priority"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		todo, err := PatchTodo(db, id, TodoPatch{Priority: &req.Priority, Version: version}, userID)
+		if err != nil {
+			if errors.Is(err, ErrInvalidPriority) {
+				writeError(w, http.StatusBadRequest, "priority must be none, low, medium, high or urgent")
+				return
+			}
+			if errors.Is(err, ErrVersionMismatch) {
+				writeError(w, http.StatusPreconditionFailed, "todo has been modified")
+				return
+			}
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to update todo priority")
+			return
+		}
+
+		w.Header().Set("ETag", todoETag(todo))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleDeleteTodo soft-deletes a todo for the authenticated user, conditionally on If-Match if sent.
+// DELETE /api/todos/{id} → 204
+func handleDeleteTodo(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+		version, ok := ifMatchVersion(w, r)
+		if !ok {
+			return
+		}
+
+		if err := DeleteTodoIfMatch(db, id, version, userID); err != nil {
+			if errors.Is(err, ErrVersionMismatch) {
+				writeError(w, http.StatusPreconditionFailed, "todo has been modified")
+				return
+			}
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to delete todo")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// --- Trash Handlers ---
+
+// handleSearchTodos runs a full-text search over the authenticated user's todos.
+// GET /api/search?q=milk&list_id=1&completed=false → 200 []SearchResult (best matches first, each with a snippet)
+func handleSearchTodos(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		query := r.URL.Query()
+
+		var filter SearchFilter
+		if listIDStr := query.Get("list_id"); listIDStr != "" {
+			listID, err := strconv.ParseInt(listIDStr, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid list_id")
+				return
+			}
+			filter.ListID = &listID
+		}
+		if completedStr := query.Get("completed"); completedStr != "" {
+			completed, err := strconv.ParseBool(completedStr)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "completed must be true or false")
+				return
+			}
+			filter.Completed = &completed
+		}
+
+		results, err := SearchTodos(db, query.Get("q"), filter, userID)
+		if err != nil {
+			if errors.Is(err, ErrEmptyQuery) {
+				writeError(w, http.StatusBadRequest, "q is required")
+				return
+			}
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusNotFound, "list not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to search todos")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+// handleListTrash returns the authenticated user's soft-deleted todos.
+// GET /api/trash → 200 []Todo (each with deleted_at)
+func handleListTrash(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		todos, err := ListTrash(db, userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to fetch trash")
+			return
+		}
+		writeJSON(w, http.StatusOK, todos)
+	}
+}
+
+// handleRestoreTodo moves a soft-deleted todo out of the trash for the authenticated user.
+// POST /api/todos/{id}/restore → 204
+func handleRestoreTodo(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+
+		if err := RestoreTodo(db, id, userID); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found in trash")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to restore todo")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handlePurgeTodo permanently deletes a trashed todo for the authenticated user.
+// DELETE /api/trash/{id} → 204
+func handlePurgeTodo(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+
+		if err := PurgeTodo(db, id, userID); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found in trash")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to purge todo")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// --- List Handlers ---
+
+// handleListTodosByList returns all todos for a specific list for the authenticated user.
+// GET /api/lists/{id}/todos?sort=position|created|priority|due → 200 []Todo (each with lists populated)
+// GET /api/lists/{id}/todos?limit=50&cursor=... → 200 []Todo (one page; Link: <...>; rel="next" while more remain)
+func handleListTodosByList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		listID, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid list ID")
+			return
+		}
+
+		page, ok := parsePage(w, r)
+		if !ok {
+			return
+		}
+
+		sort := TodoSort(r.URL.Query().Get("sort"))
+		todos, next, err := ListTodosByListPage(db, listID, userID, sort, page)
+		if err != nil {
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusNotFound, "list not found")
+				return
+			}
+			if errors.Is(err, ErrInvalidSort) {
+				writeError(w, http.StatusBadRequest, "sort must be position, created, priority or due")
+				return
+			}
+			if writePageError(w, err) {
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to fetch todos")
+			return
+		}
+
+		setNextLink(w, r, next)
+		writeJSON(w, http.StatusOK, todos)
+	}
+}
+
+// moveTodoRequest is the body of the todo reorder endpoints: the todo to move and the todo it should
+// follow (null or omitted moves it to the top).
+type moveTodoRequest struct {
+	TodoID  int64  `json:"todo_id"`
+	AfterID *int64 `json:"after_id"`
+}
+
+// decodeMoveTodoRequest reads a moveTodoRequest, writing a 400 and returning false when it is invalid.
+func decodeMoveTodoRequest(w http.ResponseWriter, r *http.Request) (moveTodoRequest, bool) {
+	var req moveTodoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return req, false
+	}
+	if req.TodoID == 0 {
+		writeError(w, http.StatusBadRequest, "todo_id is required")
+		return req, false
+	}
+	return req, true
+}
+
+// handleReorderTodos moves a todo within the authenticated user's manual order.
+// POST /api/todos/reorder { "todo_id": 3, "after_id": 7 } → 204 (after_id null moves to the top)
+func handleReorderTodos(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		req, ok := decodeMoveTodoRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := MoveTodo(db, req.TodoID, req.AfterID, userID); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			if errors.Is(err, ErrInvalidPosition) {
+				writeError(w, http.StatusBadRequest, "after_id must reference another todo")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to reorder todos")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleReorderListTodos moves a todo within a list's manual order.
+// POST /api/lists/{id}/todos/reorder { "todo_id": 3, "after_id": 7 } → 204 (after_id null moves to the top)
+func handleReorderListTodos(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		listID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid list ID")
+			return
+		}
+		req, ok := decodeMoveTodoRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := MoveTodoInList(db, listID, req.TodoID, req.AfterID, userID); err != nil {
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusNotFound, "list not found")
+				return
+			}
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found in list")
+				return
+			}
+			if errors.Is(err, ErrInvalidPosition) {
+				writeError(w, http.StatusBadRequest, "after_id must reference another todo in the list")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to reorder todos")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleListLists returns all lists for the authenticated user, pinned first and then in manual order.
+// GET /api/lists → 200 []List
+// GET /api/lists?limit=50&cursor=... → 200 []List (one page; Link: <...>; rel="next" while more remain)
+func handleListLists(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		page, ok := parsePage(w, r)
+		if !ok {
+			return
+		}
+		lists, next, err := ListListsPage(db, userID, page)
+		if err != nil {
+			if writePageError(w, err) {
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to fetch lists")
+			return
+		}
+		setNextLink(w, r, next)
+		writeJSON(w, http.StatusOK, lists)
+	}
+}
+
+// handleCreateList creates a new list for the authenticated user.
+// POST /api/lists → 201 List
+func handleCreateList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		var req struct {
+			Name  string `json:"name"`
+			Color string `json:"color"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		list, err := CreateList(db, req.Name, req.Color, userID)
+		if err != nil {
+			if errors.Is(err, ErrEmptyListName) {
+				writeError(w, http.StatusBadRequest, "list name cannot be empty")
+				return
+			}
+			if errors.Is(err, ErrListNameTooLong) {
+				writeError(w, http.StatusBadRequest, "list name exceeds maximum length of 50 characters")
+				return
+			}
+			if errors.Is(err, ErrDuplicateList) {
+				writeError(w, http.StatusConflict, "list with this name already exists")
+				return
+			}
+			if errors.Is(err, ErrInvalidColor) {
+				writeError(w, http.StatusBadRequest, "color must be a valid pastel hex from the palette")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to create list")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, list)
+	}
+}
+
+// handleGetList returns a single list of the authenticated user.
+// GET /api/lists/{id} → 200 List (with ETag; 304 if If-None-Match matches)
+func handleGetList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid list ID")
+			return
+		}
+
+		list, err := GetListByID(db, id, userID)
+		if err != nil {
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusNotFound, "list not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to fetch list")
+			return
+		}
+
+		if notModified(w, r, etag(list.Version)) {
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+// handleUpdateList updates the name, color and/or pinned flag of a list for the authenticated user,
+// conditionally on If-Match if sent (412 if the list has changed).
+// PATCH /api/lists/{id} { "name": "...", "color": "...", "pinned": true } → 204 (with ETag)
+func handleUpdateList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid list ID")
+			return
+		}
+		version, ok := ifMatchVersion(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Name   string `json:"name"`
+			Color  string `json:"color"`
+			Pinned *bool  `json:"pinned"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		existing, err := GetListByID(db, id, userID)
+		if err != nil {
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusNotFound, "list not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to fetch list")
+			return
+		}
+		name := req.Name
+		if name == "" {
+			name = existing.Name
+		}
+		color := req.Color
+		if color == "" {
+			color = existing.Color
+		}
+
+		if err := UpdateListIfMatch(db, id, name, color, req.Pinned, version, userID); err != nil {
+			if errors.Is(err, ErrEmptyListName) {
+				writeError(w, http.StatusBadRequest, "list name cannot be empty")
+				return
+			}
+			if errors.Is(err, ErrListNameTooLong) {
+				writeError(w, http.StatusBadRequest, "list name exceeds maximum length of 50 characters")
+				return
+			}
+			if errors.Is(err, ErrDuplicateList) {
+				writeError(w, http.StatusConflict, "list with this name already exists")
+				return
+			}
+			if errors.Is(err, ErrVersionMismatch) {
+				writeError(w, http.StatusPreconditionFailed, "list has been modified")
+				return
+			}
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusNotFound, "list not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to update list")
+			return
+		}
+
+		updated, err := GetListByID(db, id, userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to fetch list")
+			return
+		}
+		w.Header().Set("ETag", etag(updated.Version))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleReorderLists sets the manual order of the authenticated user's lists from the full list of IDs.
+// PATCH /api/lists/order { "list_ids": [3, 1, 2] } → 204
+func handleReorderLists(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		var req struct {
+			ListIDs []int64 `json:"list_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		if err := ReorderLists(db, req.ListIDs, userID); err != nil {
+			if errors.Is(err, ErrInvalidOrder) {
+				writeError(w, http.StatusBadRequest, "list_ids must list every list exactly once")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to reorder lists")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleDeleteList deletes a list for the authenticated user, conditionally on If-Match if sent.
+// DELETE /api/lists/{id} → 204
+func handleDeleteList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid list ID")
+			return
+		}
+		version, ok := ifMatchVersion(w, r)
+		if !ok {
+			return
+		}
+
+		if err := DeleteListIfMatch(db, id, version, userID); err != nil {
+			if errors.Is(err, ErrVersionMismatch) {
+				writeError(w, http.StatusPreconditionFailed, "list has been modified")
+				return
+			}
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusNotFound, "list not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to delete list")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAddListToTodo associates a list with a todo for the authenticated user.
+// POST /api/todos/{id}/lists/{listId} → 204
+func handleAddListToTodo(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		todoIDStr := r.PathValue("id")
+		listIDStr := r.PathValue("listId")
+		todoID, err := strconv.ParseInt(todoIDStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+		listID, err := strconv.ParseInt(listIDStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid list ID")
+			return
+		}
+
+		if err := AddListToTodo(db, todoID, listID, userID); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusNotFound, "list not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to add list to todo")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleRemoveListFromTodo removes the association between a list and a todo.
+// DELETE /api/todos/{id}/lists/{listId} → 204
+func handleRemoveListFromTodo(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		todoIDStr := r.PathValue("id")
+		listIDStr := r.PathValue("listId")
+		todoID, err := strconv.ParseInt(todoIDStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+		listID, err := strconv.ParseInt(listIDStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid list ID")
+			return
+		}
+
+		if err := RemoveListFromTodo(db, todoID, listID, userID); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo or list association not found")
+				return
+			}
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusNotFound, "list not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to remove list from todo")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleCreateTodoInList creates a todo and atomically associates it with the given list.
+// POST /api/lists/{id}/todos → 201 Todo
+func handleCreateTodoInList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		idStr := r.PathValue("id")
+		listID, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid list ID")
+			return
+		}
+
+		var req struct {
+			Title      string  `json:"title"`
+			DueAt      *string `json:"due_at"`
+			StartAt    *string `json:"start_at"`
+			Priority   string  `json:"priority"`
+			Notes      string  `json:"notes"`
+			Recurrence string  `json:"recurrence"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		dueAt, startAt, err := parseScheduleRequest(db, userID, req.DueAt, req.StartAt)
+		if err != nil {
+			if errors.Is(err, ErrInvalidDate) {
+				writeError(w, http.StatusBadRequest, "due_at and start_at must be RFC 3339 or YYYY-MM-DD")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to create todo in list")
+			return
+		}
+
+		details := TodoDetails{
+			DueAt:      dueAt,
+			StartAt:    startAt,
+			Priority:   req.Priority,
+			Notes:      req.Notes,
+			Recurrence: req.Recurrence,
+		}
+		todo, err := CreateTodoInListWithDetails(db, req.Title, details, listID, userID)
+		if err != nil {
+			if errors.Is(err, ErrEmptyTitle) {
+				writeError(w, http.StatusBadRequest, "title cannot be empty")
+				return
+			}
+			if errors.Is(err, ErrTitleTooLong) {
+				writeError(w, http.StatusBadRequest, "title exceeds maximum length of 255 characters")
+				return
+			}
+			if errors.Is(err, ErrStartAfterDue) {
+				writeError(w, http.StatusBadRequest, "start_at must not be after due_at")
+				return
+			}
+			if errors.Is(err, ErrInvalidPriority) {
+				writeError(w, http.StatusBadRequest, "priority must be none, low, medium, high or urgent")
+				return
+			}
+			if errors.Is(err, ErrNotesTooLong) {
+				writeError(w, http.StatusBadRequest, "notes exceed maximum length of 65536 bytes")
+				return
+			}
+			if errors.Is(err, ErrInvalidRecurrence) {
+				writeError(w, http.StatusBadRequest, "recurrence must be a supported RRULE")
+				return
+			}
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusNotFound, "list not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to create todo in list")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, todo)
+	}
+}
+
+// --- Checklist Item Handlers ---
+
+// parseTodoItemPath parses the {id} and {itemId} path values, writing a 400 on failure.
+func parseTodoItemPath(w http.ResponseWriter, r *http.Request) (todoID, itemID int64, ok bool) {
+	todoID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid todo ID")
+		return 0, 0, false
+	}
+	itemID, err = strconv.ParseInt(r.PathValue("itemId"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid item ID")
+		return 0, 0, false
+	}
+	return todoID, itemID, true
+}
+
+// handleListTodoItems returns the checklist items of a todo for the authenticated user.
+// GET /api/todos/{id}/items → 200 []TodoItem
+func handleListTodoItems(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		todoID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+
+		items, err := ListTodoItems(db, todoID, userID)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to fetch checklist items")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, items)
+	}
+}
+
+// handleCreateTodoItem appends a checklist item to a todo for the authenticated user.
+// POST /api/todos/{id}/items → 201 TodoItem
+func handleCreateTodoItem(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		todoID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+
+		var req struct {
+			Title string `json:"title"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		item, err := CreateTodoItem(db, todoID, req.Title, userID)
+		if err != nil {
+			if errors.Is(err, ErrEmptyTitle) {
+				writeError(w, http.StatusBadRequest, "title cannot be empty")
+				return
+			}
+			if errors.Is(err, ErrTitleTooLong) {
+				writeError(w, http.StatusBadRequest, "title exceeds maximum length of 255 characters")
+				return
+			}
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to create checklist item")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, item)
+	}
+}
+
+// handleUpdateTodoItem updates the title and/or completion of a checklist item.
+// Absent fields are left untouched.
+// PATCH /api/todos/{id}/items/{itemId} → 200 TodoItem
+func handleUpdateTodoItem(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		todoID, itemID, ok := parseTodoItemPath(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Title     *string `json:"title"`
+			Completed *bool   `json:"completed"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		item, err := UpdateTodoItem(db, todoID, itemID, req.Title, req.Completed, userID)
+		if err != nil {
+			if errors.Is(err, ErrEmptyTitle) {
+				writeError(w, http.StatusBadRequest, "title cannot be empty")
+				return
+			}
+			if errors.Is(err, ErrTitleTooLong) {
+				writeError(w, http.StatusBadRequest, "title exceeds maximum length of 255 characters")
+				return
+			}
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			if errors.Is(err, ErrItemNotFound) {
+				writeError(w, http.StatusNotFound, "checklist item not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to update checklist item")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, item)
+	}
+}
+
+// handleDeleteTodoItem removes a checklist item from a todo.
+// DELETE /api/todos/{id}/items/{itemId} → 204
+func handleDeleteTodoItem(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		todoID, itemID, ok := parseTodoItemPath(w, r)
+		if !ok {
+			return
+		}
+
+		if err := DeleteTodoItem(db, todoID, itemID, userID); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			if errors.Is(err, ErrItemNotFound) {
+				writeError(w, http.StatusNotFound, "checklist item not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to delete checklist item")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleReorderTodoItems sets the order of a todo's checklist from the full list of item IDs.
+// POST /api/todos/{id}/items/reorder { "item_ids": [3, 1, 2] } → 204
+func handleReorderTodoItems(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		todoID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid todo ID")
+			return
+		}
+
+		var req struct {
+			ItemIDs []int64 `json:"item_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		if err := ReorderTodoItems(db, todoID, req.ItemIDs, userID); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				writeError(w, http.StatusNotFound, "todo not found")
+				return
+			}
+			if errors.Is(err, ErrInvalidOrder) {
+				writeError(w, http.StatusBadRequest, "item_ids must list every checklist item exactly once")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to reorder checklist items")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// --- Smart List Handlers ---
+
+// writeSmartListSaveError maps smart list validation errors to 4xx responses, falling back to a 500.
+func writeSmartListSaveError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrEmptyListName):
+		writeError(w, http.StatusBadRequest, "smart list name cannot be empty")
+	case errors.Is(err, ErrListNameTooLong):
+		writeError(w, http.StatusBadRequest, "smart list name exceeds maximum length of 50 characters")
+	case errors.Is(err, ErrInvalidFilter):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrListNotFound):
+		writeError(w, http.StatusBadRequest, "filter references a list that does not exist")
+	case errors.Is(err, ErrDuplicateSmartList):
+		writeError(w, http.StatusConflict, "smart list with this name already exists")
+	case errors.Is(err, ErrSmartListNotFound):
+		writeError(w, http.StatusNotFound, "smart list not found")
+	default:
+		writeError(w, http.StatusInternalServerError, fallback)
+	}
+}
+
+// handleListSmartLists returns all smart lists of the authenticated user.
+// GET /api/smart-lists → 200 []SmartList
+func handleListSmartLists(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		smartLists, err := ListSmartLists(db, userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to fetch smart lists")
+			return
+		}
+		writeJSON(w, http.StatusOK, smartLists)
+	}
+}
+
+// handleCreateSmartList saves a filter as a smart list for the authenticated user.
+// POST /api/smart-lists { "name": "This week", "filter": "completed=false&due_to=week_end" } → 201 SmartList
+func handleCreateSmartList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		var req struct {
+			Name   string `json:"name"`
+			Filter string `json:"filter"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		smartList, err := CreateSmartList(db, req.Name, req.Filter, userID)
+		if err != nil {
+			writeSmartListSaveError(w, err, "failed to create smart list")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, smartList)
+	}
+}
+
+// handleGetSmartList returns a single smart list of the authenticated user.
+// GET /api/smart-lists/{id} → 200 SmartList
+func handleGetSmartList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid smart list ID")
+			return
+		}
+
+		smartList, err := GetSmartList(db, id, userID)
+		if err != nil {
+			if errors.Is(err, ErrSmartListNotFound) {
+				writeError(w, http.StatusNotFound, "smart list not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to fetch smart list")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, smartList)
+	}
+}
+
+// handleUpdateSmartList renames a smart list and/or replaces its filter; omitted fields are kept.
+// PATCH /api/smart-lists/{id} { "name": "...", "filter": "..." } → 204
+func handleUpdateSmartList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid smart list ID")
+			return
+		}
+
+		var req struct {
+			Name   string  `json:"name"`
+			Filter *string `json:"filter"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		existing, err := GetSmartList(db, id, userID)
+		if err != nil {
+			writeSmartListSaveError(w, err, "failed to fetch smart list")
+			return
+		}
+		name := req.Name
+		if name == "" {
+			name = existing.Name
+		}
+		filter := existing.Filter
+		if req.Filter != nil {
+			filter = *req.Filter
+		}
+
+		if err := UpdateSmartList(db, id, name, filter, userID); err != nil {
+			writeSmartListSaveError(w, err, "failed to update smart list")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleDeleteSmartList deletes a smart list of the authenticated user; its todos are untouched.
+// DELETE /api/smart-lists/{id} → 204
+func handleDeleteSmartList(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid smart list ID")
+			return
+		}
+
+		if err := DeleteSmartList(db, id, userID); err != nil {
+			if errors.Is(err, ErrSmartListNotFound) {
+				writeError(w, http.StatusNotFound, "smart list not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to delete smart list")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleListSmartListTodos evaluates a smart list's filter and returns the matching todos.
+// GET /api/smart-lists/{id}/todos?limit=50&cursor=... → 200 []Todo (each with lists; paginated like GET /api/todos)
+func handleListSmartListTodos(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid smart list ID")
+			return
+		}
+		page, ok := parsePage(w, r)
+		if !ok {
+			return
+		}
+
+		todos, next, err := QuerySmartListTodos(db, id, userID, page)
+		if err != nil {
+			if errors.Is(err, ErrSmartListNotFound) {
+				writeError(w, http.StatusNotFound, "smart list not found")
+				return
+			}
+			if errors.Is(err, ErrListNotFound) {
+				writeError(w, http.StatusConflict, "smart list filter references a deleted list")
+				return
+			}
+			if writePageError(w, err) {
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to fetch todos")
+			return
+		}
+		if err := attachTodoLists(db, todos, userID); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to fetch todos")
+			return
+		}
+
+		setNextLink(w, r, next)
+		writeJSON(w, http.StatusOK, todos)
+	}
+}
+
+// --- Sync Handlers ---
+
+// handleSync returns the authenticated user's todos, lists and list memberships changed since the
+// change token in ?since=, with tombstones for hard deletes, plus the token for the next call.
+// Without since it returns a full snapshot to seed a local cache.
+// GET /api/sync?since=<token> → 200 SyncChanges
+func handleSync(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+
+		var since *int64
+		if v := r.URL.Query().Get("since"); v != "" {
+			token, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, ErrInvalidSyncToken.Error())
+				return
+			}
+			since = &token
+		}
+
+		changes, err := GetSyncChanges(db, since, userID)
+		if err != nil {
+			if errors.Is(err, ErrInvalidSyncToken) {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to fetch changes")
+			return
+		}
+		writeJSON(w, http.StatusOK, changes)
+	}
+}
+
+// handlePushSync replays a batch of operations the authenticated user's client recorded offline, in
+// order and in one transaction. Each operation gets its own result with the server's state of its
+// todo after the batch; on conflicts (a stale version, or a todo the server has trashed) the server
+// state wins and is reported with status 409.
+// POST /api/sync/push { "operations": [{ "op": "update_todo", "id": 1, "version": 3, "patch": {...} }] }
+// → 200 { "results": []SyncPushResult }
+func handlePushSync(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserIDFromContext(r)
+		var req struct {
+			Operations []struct {
+				Op       SyncOpKind                 `json:"op"`
+				ID       int64                      `json:"id"`
+				ClientID string                     `json:"client_id"`
+				Version  int64                      `json:"version"`
+				Todo     map[string]json.RawMessage `json:"todo"`
+				Patch    map[string]json.RawMessage `json:"patch"`
+				ListID   int64                      `json:"list_id"`
+			} `json:"operations"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+
+		loc, err := GetUserLocation(db, userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to apply operations")
+			return
+		}
+
+		ops := make([]SyncOp, len(req.Operations))
+		for i, o := range req.Operations {
+			op := SyncOp{Kind: o.Op, TodoID: o.ID, ClientID: o.ClientID, Version: o.Version, ListID: o.ListID}
+			var problem string
+			switch o.Op {
+			case SyncCreateTodo:
+				if o.Todo == nil {
+					problem = "todo is required"
+				} else if op.Patch, err = parseTodoPatch(o.Todo, loc); err != nil {
+					problem = err.Error()
+				}
+			case SyncUpdateTodo, SyncDeleteTodo, SyncAddToList, SyncRemoveFromList:
+				switch {
+				case o.ID == 0 && o.ClientID == "":
+					problem = "id or client_id is required"
+				case o.Op == SyncUpdateTodo && o.Patch == nil:
+					problem = "patch is required"
+				case o.Op == SyncUpdateTodo:
+					if op.Patch, err = parseTodoPatch(o.Patch, loc); err != nil {
+						problem = err.Error()
+					}
+				case (o.Op == SyncAddToList || o.Op == SyncRemoveFromList) && o.ListID == 0:
+					problem = "list_id is required for list operations"
+				}
+			}
+			if problem != "" {
+				writeError(w, http.StatusBadRequest, "operations["+strconv.Itoa(i)+"]: "+problem)
+				return
+			}
+			ops[i] = op
+		}
+
+		outcomes, err := PushSyncOps(db, ops, userID)
+		if err != nil {
+			if errors.Is(err, ErrInvalidSyncBatch) || errors.Is(err, ErrInvalidSyncOp) {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to apply operations")
+			return
+		}
+
+		results := make([]SyncPushResult, len(ops))
+		for i, outcome := range outcomes {
+			results[i] = SyncPushResult{ClientID: ops[i].ClientID, ID: outcome.TodoID, Todo: outcome.Todo}
+			results[i].Status, results[i].Error = syncOpStatus(ops[i].Kind, outcome.Err)
+		}
+		writeJSON(w, http.StatusOK, map[string][]SyncPushResult{"results": results})
+	}
+}
+
+// syncOpStatus maps the outcome of a pushed operation to an HTTP status and error message.
+func syncOpStatus(kind SyncOpKind, err error) (int, string) {
+	switch {
+	case err == nil && kind == SyncCreateTodo:
+		return http.StatusCreated, ""
+	case err == nil:
+		return http.StatusOK, ""
+	case errors.Is(err, ErrVersionMismatch):
+		return http.StatusConflict, "todo has been modified"
+	case errors.Is(err, ErrTodoInTrash):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, "todo not found"
+	case errors.Is(err, ErrListNotFound):
+		return http.StatusNotFound, "list not found"
+	case errors.Is(err, ErrTitleTooLong):
+		return http.StatusBadRequest, "title exceeds maximum length of 255 characters"
+	case errors.Is(err, ErrStartAfterDue):
+		return http.StatusBadRequest, "start_at must not be after due_at"
+	case errors.Is(err, ErrNotesTooLong):
+		return http.StatusBadRequest, "notes exceed maximum length of 65536 bytes"
+	}
+	return http.StatusBadRequest, err.Error()
+}
+
+// --- Event Handlers ---
+
+// handleCreateStreamTicket issues a ticket opening GET /api/events as the authenticated session, for
+// EventSource clients, which cannot send the Authorization header. A ticket is used up when the
+// stream opens and expires after StreamTicketTTL, so unlike an access token it is worthless once it
+// shows up in a proxy or access log.
+// POST /api/auth/stream-ticket → 201 StreamTicket
+func handleCreateStreamTicket(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ticket, err := generateOpaqueToken()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to create stream ticket")
+			return
+		}
+		if err := CreateStreamTicket(db, getUserIDFromContext(r), getSessionIDFromContext(r), hashToken(ticket), time.Now()); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to create stream ticket")
+			return
+		}
+		writeJSON(w, http.StatusCreated, StreamTicket{ticket, int(StreamTicketTTL.Seconds())})
+	}
+}
+
+// handleEvents streams changes to the authenticated user's todos, lists and list memberships as
+// Server-Sent Events, with a heartbeat comment while idle. Event IDs are sync tokens: a reconnecting
+// client sending Last-Event-ID (or ?last_event_id=, which EventSource clients opening a new stream
+// can set) first gets the events it missed, or a reset event when they cannot be replayed.
+// EventSource clients authenticate with ?ticket= from POST /api/auth/stream-ticket; as a ticket is
+// single-use, they resume with a new EventSource and a fresh ticket. The stream outlives the access
+// token that opened it; its session is checked again at every heartbeat and the stream ends once it
+// is logged out.
+// GET /api/events → 200 text/event-stream
+func handleEvents(db *sql.DB, bus *eventBus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, sessionID := getUserIDFromContext(r), getSessionIDFromContext(r)
+
+		// Subscribe before loading missed events so that nothing committed in between is lost;
+		// events already replayed are skipped by ID.
+		events, unsubscribe, err := bus.Subscribe(userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to subscribe to events")
+			return
+		}
+		defer unsubscribe()
+
+		var lastID int64
+		var missed []Event
+		reset := false
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("last_event_id")
+		}
+		if lastEventID != "" {
+			if lastID, err = strconv.ParseInt(lastEventID, 10, 64); err != nil {
+				reset = true
+			} else if missed, err = GetChangeEvents(db, lastID, userID, MaxReplayEvents+1); errors.Is(err, ErrInvalidSyncToken) || len(missed) > MaxReplayEvents {
+				reset = true
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, "failed to fetch events")
+				return
+			}
+			if reset {
+				missed, lastID = nil, 0
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "retry: "+strconv.FormatInt(eventRetry.Milliseconds(), 10)+"\n\n")
+		if reset {
+			writeEvent(w, Event{Type: EventReset, Data: struct{}{}})
+		}
+		for _, e := range missed {
+			writeEvent(w, e)
+			lastID = e.ID
+		}
+
+		rc := http.NewResponseController(w)
+		heartbeat := time.NewTicker(eventHeartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				// A database error leaves the stream open; the next heartbeat checks again.
+				if err := TouchSession(db, userID, sessionID, time.Now()); errors.Is(err, ErrSessionNotFound) {
+					return
+				}
+				if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				if e.ID <= lastID {
+					continue
+				}
+				if err := writeEvent(w, e); err != nil {
+					return
+				}
+				lastID = e.ID
+			}
+		}
+	}
+}
+
+// --- WebSocket Handlers ---
+
+// handleWebSocket upgrades to a WebSocket over which the authenticated user sends SocketCommands,
+// run one at a time against api (the REST routes, without authentication), and receives every change
+// to their data as events, including those made from their other connections. Before its access
+// token expires the client sends a fresh one for the same session in an auth command; meanwhile
+// commands get 401. The session is checked again before each command and on every ping: the
+// connection is closed with 1008 once the session is logged out, or when no fresh token has arrived
+// wsAuthGracePeriod after the last one expired. A connection that falls too far behind on events is
+// closed with 1013 so that the client reconnects and resyncs.
+// GET /api/ws → 101 Switching Protocols
+func handleWebSocket(db *sql.DB, bus *eventBus, api http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, sessionID := getUserIDFromContext(r), getSessionIDFromContext(r)
+		expiresAt, err := accessTokenExpiry(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "invalid or expired token")
+			return
+		}
+		// expiresAt is renewed by auth commands on the reading goroutine and checked on the pinging one.
+		var expiresMu sync.Mutex
+		tokenExpiry := func() time.Time {
+			expiresMu.Lock()
+			defer expiresMu.Unlock()
+			return expiresAt
+		}
+
+		events, unsubscribe, err := bus.Subscribe(userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to subscribe to events")
+			return
+		}
+		defer unsubscribe()
+
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		done := make(chan struct{})
+		var closeOnce sync.Once
+		closeWith := func(code int, reason string) {
+			closeOnce.Do(func() {
+				ws.writeClose(code, reason)
+				close(done)
+				ws.Close()
+			})
+		}
+		defer closeWith(wsCloseNormal, "")
+
+		go func() {
+			ping := time.NewTicker(wsPingInterval)
+			defer ping.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ping.C:
+					// A database error leaves the connection open; the next check decides.
+					if err := TouchSession(db, userID, sessionID, time.Now()); errors.Is(err, ErrSessionNotFound) {
+						closeWith(wsClosePolicyViolation, "session ended")
+						return
+					}
+					if time.Now().After(tokenExpiry().Add(wsAuthGracePeriod)) {
+						closeWith(wsClosePolicyViolation, "token expired")
+						return
+					}
+					if err := ws.writeFrame(wsOpPing, nil); err != nil {
+						closeWith(wsCloseGoingAway, "")
+						return
+					}
+				case e, ok := <-events:
+					if !ok {
+						closeWith(wsCloseTryAgainLater, "event stream ended, reconnect and resync")
+						return
+					}
+					msg, _ := json.Marshal(SocketMessage{Type: "event", Event: e.Type, EventID: e.ID, Data: e.Data})
+					if err := ws.writeFrame(wsOpText, msg); err != nil {
+						closeWith(wsCloseGoingAway, "")
+						return
+					}
+				}
+			}
+		}()
+
+		for {
+			opcode, data, err := ws.readMessage()
+			if err != nil {
+				var closeErr *wsCloseError
+				if errors.As(err, &closeErr) {
+					closeWith(closeErr.code, closeErr.reason)
+				}
+				return
+			}
+			if opcode != wsOpText {
+				closeWith(wsCloseUnsupportedData, "only text messages are supported")
+				return
+			}
+
+			var cmd SocketCommand
+			var resp SocketMessage
+			sessionErr := TouchSession(db, userID, sessionID, time.Now())
+			ended := false
+			switch {
+			case json.Unmarshal(data, &cmd) != nil:
+				resp = socketError(cmd.ID, http.StatusBadRequest, "invalid JSON message")
+			case errors.Is(sessionErr, ErrSessionNotFound):
+				resp, ended = socketError(cmd.ID, http.StatusUnauthorized, "session ended"), true
+			case sessionErr != nil:
+				resp = socketError(cmd.ID, http.StatusInternalServerError, "failed to check session")
+			case cmd.Type == "auth":
+				tokenUserID, tokenSessionID, err := validateJWT(cmd.Token)
+				expiry, expiryErr := accessTokenExpiry(cmd.Token)
+				if err != nil || expiryErr != nil || tokenUserID != userID || tokenSessionID != sessionID {
+					resp = socketError(cmd.ID, http.StatusUnauthorized, "token must be a valid access token for this session")
+					break
+				}
+				expiresMu.Lock()
+				expiresAt = expiry
+				expiresMu.Unlock()
+				resp = SocketMessage{Type: "response", ID: cmd.ID, Status: http.StatusNoContent}
+			case time.Now().After(tokenExpiry()):
+				resp = socketError(cmd.ID, http.StatusUnauthorized, "token expired, send an auth command with a fresh one")
+			default:
+				resp = runSocketCommand(r.Context(), api, cmd, userID, sessionID)
+			}
+
+			msg, _ := json.Marshal(resp)
+			if err := ws.writeFrame(wsOpText, msg); err != nil {
+				return
+			}
+			if ended {
+				closeWith(wsClosePolicyViolation, "session ended")
+				return
+			}
+		}
+	}
+}
+
+// runSocketCommand runs cmd through api as the given user and returns its response.
+func runSocketCommand(ctx context.Context, api http.Handler, cmd SocketCommand, userID, sessionID int64) (resp SocketMessage) {
+	switch cmd.Method {
+	case http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete:
+	default:
+		return socketError(cmd.ID, http.StatusBadRequest, "method must be GET, POST, PATCH or DELETE")
+	}
+	req, err := http.NewRequestWithContext(ctx, cmd.Method, cmd.Path, bytes.NewReader(cmd.Body))
+	if err != nil || !strings.HasPrefix(req.URL.Path, "/api/") || req.URL.Host != "" {
+		return socketError(cmd.ID, http.StatusBadRequest, "path must be an /api/ path")
+	}
+	if path.Clean(req.URL.Path) == "/api/events" {
+		return socketError(cmd.ID, http.StatusBadRequest, "events are already pushed over the WebSocket")
+	}
+	for name, value := range cmd.Headers {
+		req.Header.Set(name, value)
+	}
+	if len(cmd.Body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	ctx = context.WithValue(req.Context(), userIDKey, userID)
+	req = req.WithContext(context.WithValue(ctx, sessionIDKey, sessionID))
+
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("websocket command panicked", "method", cmd.Method, "path", cmd.Path, "panic", p)
+			resp = socketError(cmd.ID, http.StatusInternalServerError, "internal server error")
+		}
+	}()
+	rec := newCommandResponseWriter()
+	api.ServeHTTP(rec, req)
+
+	resp = SocketMessage{Type: "response", ID: cmd.ID, Status: rec.status, Headers: make(map[string]string)}
+	for name := range rec.header {
+		resp.Headers[name] = rec.header.Get(name)
+	}
+	if body := bytes.TrimSpace(rec.body.Bytes()); json.Valid(body) {
+		resp.Body = body
+	}
+	return resp
+}
+
+// socketError builds the response to a command that failed with status and msg.
+func socketError(id string, status int, msg string) SocketMessage {
+	body, _ := json.Marshal(map[string]string{"error": msg})
+	return SocketMessage{Type: "response", ID: id, Status: status, Body: body}
+}
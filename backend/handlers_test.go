@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"database/sql"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -22,18 +32,21 @@ func TestHandleRegister_Success(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/api/auth/register", bytes.NewBufferString(body))
 	w := httptest.NewRecorder()
 
-	handleRegister(db)(w, req)
+	handleRegister(db, newTestMailer())(w, req)
 
 	if w.Code != http.StatusCreated {
 		t.Fatalf("expected status 201, got %d", w.Code)
 	}
 
-	var resp map[string]string
+	var resp AuthTokens
 	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
-	if resp["token"] == "" {
-		t.Error("expected non-empty token")
+	if resp.Token == "" || resp.RefreshToken == "" {
+		t.Error("expected non-empty access and refresh tokens")
+	}
+	if resp.ExpiresIn != int(AccessTokenTTL.Seconds()) {
+		t.Errorf("expected expires_in %d, got %d", int(AccessTokenTTL.Seconds()), resp.ExpiresIn)
 	}
 }
 
@@ -47,7 +60,7 @@ func TestHandleRegister_DuplicateEmail(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/api/auth/register", bytes.NewBufferString(body))
 	w := httptest.NewRecorder()
 
-	handleRegister(db)(w, req)
+	handleRegister(db, newTestMailer())(w, req)
 
 	if w.Code != http.StatusConflict {
 		t.Fatalf("expected status 409, got %d", w.Code)
@@ -67,7 +80,7 @@ func TestHandleRegister_EmptyEmail(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/api/auth/register", bytes.NewBufferString(body))
 	w := httptest.NewRecorder()
 
-	handleRegister(db)(w, req)
+	handleRegister(db, newTestMailer())(w, req)
 
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("expected status 400, got %d", w.Code)
@@ -81,7 +94,7 @@ func TestHandleRegister_InvalidEmail(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/api/auth/register", bytes.NewBufferString(body))
 	w := httptest.NewRecorder()
 
-	handleRegister(db)(w, req)
+	handleRegister(db, newTestMailer())(w, req)
 
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("expected status 400, got %d", w.Code)
@@ -101,7 +114,7 @@ func TestHandleRegister_ShortPassword(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/api/auth/register", bytes.NewBufferString(body))
 	w := httptest.NewRecorder()
 
-	handleRegister(db)(w, req)
+	handleRegister(db, newTestMailer())(w, req)
 
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("expected status 400, got %d", w.Code)
@@ -130,12 +143,15 @@ func TestHandleLogin_Success(t *testing.T) {
 		t.Fatalf("expected status 200, got %d", w.Code)
 	}
 
-	var resp map[string]string
+	var resp AuthTokens
 	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
-	if resp["token"] == "" {
-		t.Error("expected non-empty token")
+	if resp.Token == "" || resp.RefreshToken == "" {
+		t.Error("expected non-empty access and refresh tokens")
+	}
+	if resp.ExpiresIn != int(AccessTokenTTL.Seconds()) {
+		t.Errorf("expected expires_in %d, got %d", int(AccessTokenTTL.Seconds()), resp.ExpiresIn)
 	}
 }
 
@@ -190,10 +206,493 @@ func TestHandleLogin_EmptyFields(t *testing.T) {
 	}
 }
 
+func TestHandleRefreshAndLogout(t *testing.T) {
+	db := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret123"), bcrypt.DefaultCost)
+	CreateUser(db, "login@example.com", string(hash))
+
+	w := httptest.NewRecorder()
+	handleLogin(db)(w, httptest.NewRequest(http.MethodPost, "/api/auth/login",
+		bytes.NewBufferString(`{"email":"login@example.com","password":"secret123"}`)))
+	var login AuthTokens
+	json.NewDecoder(w.Body).Decode(&login)
+
+	refresh := func(token string) (int, AuthTokens) {
+		w := httptest.NewRecorder()
+		handleRefresh(db)(w, httptest.NewRequest(http.MethodPost, "/api/auth/refresh",
+			bytes.NewBufferString(`{"refresh_token":"`+token+`"}`)))
+		var tokens AuthTokens
+		json.NewDecoder(w.Body).Decode(&tokens)
+		return w.Code, tokens
+	}
+
+	code, refreshed := refresh(login.RefreshToken)
+	if code != http.StatusOK || refreshed.RefreshToken == "" || refreshed.RefreshToken == login.RefreshToken {
+		t.Fatalf("expected a rotated refresh token, got %d %+v", code, refreshed)
+	}
+	if _, _, err := validateJWT(refreshed.Token); err != nil {
+		t.Errorf("expected a valid access token, got %v", err)
+	}
+
+	// Reusing the first token revokes the session for everyone holding its tokens.
+	if code, _ := refresh(login.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a reused refresh token, got %d", code)
+	}
+	if code, _ := refresh(refreshed.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after reuse revoked the session, got %d", code)
+	}
+
+	w = httptest.NewRecorder()
+	handleLogin(db)(w, httptest.NewRequest(http.MethodPost, "/api/auth/login",
+		bytes.NewBufferString(`{"email":"login@example.com","password":"secret123"}`)))
+	json.NewDecoder(w.Body).Decode(&login)
+
+	logout := func(body string) int {
+		w := httptest.NewRecorder()
+		handleLogout(db)(w, httptest.NewRequest(http.MethodPost, "/api/auth/logout", bytes.NewBufferString(body)))
+		return w.Code
+	}
+	if code := logout(`{}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without refresh_token, got %d", code)
+	}
+	if code := logout(`{"refresh_token":"` + login.RefreshToken + `"}`); code != http.StatusNoContent {
+		t.Fatalf("expected 204 on logout, got %d", code)
+	}
+	if code, _ := refresh(login.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 refreshing a logged-out session, got %d", code)
+	}
+	if code := logout(`{"refresh_token":"` + login.RefreshToken + `"}`); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 logging out twice, got %d", code)
+	}
+}
+
+func TestHandleSessions(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	laptop := createTestToken(t, db, user.ID)
+	phone := createTestToken(t, db, user.ID)
+	foreign := createTestToken(t, db, other.ID)
+
+	protected := http.NewServeMux()
+	protected.HandleFunc("GET /api/auth/sessions", handleListSessions(db))
+	protected.HandleFunc("DELETE /api/auth/sessions", handleRevokeAllSessions(db))
+	protected.HandleFunc("DELETE /api/auth/sessions/{id}", handleRevokeSession(db))
+	api := jwtMiddleware(db, protected)
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodGet, "/api/auth/sessions", laptop)
+	var sessions []Session
+	json.NewDecoder(w.Body).Decode(&sessions)
+	if w.Code != http.StatusOK || len(sessions) != 2 {
+		t.Fatalf("expected the user's 2 sessions, got %d %+v", w.Code, sessions)
+	}
+	_, laptopID, _ := validateJWT(laptop)
+	_, phoneID, _ := validateJWT(phone)
+	for _, s := range sessions {
+		if s.Current != (s.ID == laptopID) || s.UserAgent != "test" || s.IP != "127.0.0.1" || s.LastUsedAt == "" {
+			t.Errorf("unexpected session %+v", s)
+		}
+	}
+
+	_, foreignID, _ := validateJWT(foreign)
+	if w := do(http.MethodDelete, "/api/auth/sessions/"+strconv.FormatInt(foreignID, 10), laptop); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 revoking another user's session, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/auth/sessions/abc", laptop); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid session ID, got %d", w.Code)
+	}
+
+	// Revoking a session makes its access token stop working right away.
+	if w := do(http.MethodDelete, "/api/auth/sessions/"+strconv.FormatInt(phoneID, 10), laptop); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 revoking the phone session, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/auth/sessions", phone); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the revoked session, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/api/auth/sessions/"+strconv.FormatInt(phoneID, 10), laptop); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 revoking it twice, got %d", w.Code)
+	}
+
+	if w := do(http.MethodDelete, "/api/auth/sessions", laptop); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 logging out everywhere, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/auth/sessions", laptop); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after logging out everywhere, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/api/auth/sessions", foreign); w.Code != http.StatusOK {
+		t.Errorf("expected another user's session to be unaffected, got %d", w.Code)
+	}
+}
+
+// testMailer records the messages sent through it.
+type testMailer struct {
+	sent chan Message
+}
+
+func newTestMailer() *testMailer {
+	return &testMailer{sent: make(chan Message, 10)}
+}
+
+func (m *testMailer) Send(msg Message) error {
+	select {
+	case m.sent <- msg:
+	default:
+	}
+	return nil
+}
+
+// next returns the next message sent, failing the test if none arrives.
+func (m *testMailer) next(t *testing.T) Message {
+	t.Helper()
+	select {
+	case msg := <-m.sent:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected an email to be sent")
+		return Message{}
+	}
+}
+
+func TestHandleChangePassword(t *testing.T) {
+	db := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret123"), bcrypt.DefaultCost)
+	user, _ := CreateUser(db, "user@test.com", string(hash))
+	current := createTestToken(t, db, user.ID)
+	other := createTestToken(t, db, user.ID)
+
+	protected := http.NewServeMux()
+	protected.HandleFunc("POST /api/auth/password", handleChangePassword(db))
+	protected.HandleFunc("GET /api/me", handleGetMe(db))
+	api := jwtMiddleware(db, protected)
+
+	do := func(method, path, token, body string) int {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"new_password":"newpass1"}`, http.StatusBadRequest},
+		{`{"current_password":"secret123","new_password":"abc"}`, http.StatusBadRequest},
+		{`{"current_password":"wrong","new_password":"newpass1"}`, http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		if code := do(http.MethodPost, "/api/auth/password", current, tc.body); code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.body, tc.status, code)
+		}
+	}
+
+	if code := do(http.MethodPost, "/api/auth/password", current, `{"current_password":"secret123","new_password":"newpass1"}`); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if code := do(http.MethodGet, "/api/me", current, ""); code != http.StatusOK {
+		t.Errorf("expected the current session to stay logged in, got %d", code)
+	}
+	if code := do(http.MethodGet, "/api/me", other, ""); code != http.StatusUnauthorized {
+		t.Errorf("expected other sessions to be logged out, got %d", code)
+	}
+	got, _ := GetUserByID(db, user.ID)
+	if bcrypt.CompareHashAndPassword([]byte(got.PasswordHash), []byte("newpass1")) != nil {
+		t.Error("expected the new password to be stored")
+	}
+}
+
+func TestHandlePasswordReset(t *testing.T) {
+	db := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret123"), bcrypt.DefaultCost)
+	user, _ := CreateUser(db, "user@test.com", string(hash))
+	session := createTestToken(t, db, user.ID)
+	mailer := newTestMailer()
+	resets := newResetQueue(db, mailer, 1, 10)
+	defer resets.Close()
+	limiter := newRateLimiter(PasswordResetIPLimit, PasswordResetIPWindow)
+
+	request := func(body string) int {
+		w := httptest.NewRecorder()
+		handleRequestPasswordReset(resets, limiter)(w, httptest.NewRequest(http.MethodPost, "/api/auth/password/reset", bytes.NewBufferString(body)))
+		return w.Code
+	}
+	confirm := func(body string) int {
+		w := httptest.NewRecorder()
+		handleConfirmPasswordReset(db)(w, httptest.NewRequest(http.MethodPost, "/api/auth/password/reset/confirm", bytes.NewBufferString(body)))
+		return w.Code
+	}
+
+	if code := request(`{}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without email, got %d", code)
+	}
+	// Unknown addresses get the same answer, and no email.
+	if code := request(`{"email":"nobody@test.com"}`); code != http.StatusAccepted {
+		t.Errorf("expected 202 for an unknown email, got %d", code)
+	}
+	if code := request(`{"email":"user@test.com"}`); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", code)
+	}
+	msg := mailer.next(t)
+	if msg.To != "user@test.com" {
+		t.Errorf("expected the email to go to the user, got %q", msg.To)
+	}
+	_, link, ok := strings.Cut(msg.Body, "/reset-password?token=")
+	if !ok {
+		t.Fatalf("expected a reset link in %q", msg.Body)
+	}
+	token, _, _ := strings.Cut(link, "\n")
+
+	// A second request right away is accepted but sends nothing.
+	if code := request(`{"email":"user@test.com"}`); code != http.StatusAccepted {
+		t.Errorf("expected 202, got %d", code)
+	}
+	select {
+	case msg := <-mailer.sent:
+		t.Errorf("expected no email for a repeated request, got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if code := confirm(`{"token":"` + token + `","new_password":"abc"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a short password, got %d", code)
+	}
+	if code := confirm(`{"token":"bogus","new_password":"newpass1"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown token, got %d", code)
+	}
+	if code := confirm(`{"token":"` + token + `","new_password":"newpass1"}`); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if code := confirm(`{"token":"` + token + `","new_password":"newpass2"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 reusing the token, got %d", code)
+	}
+
+	got, _ := GetUserByID(db, user.ID)
+	if bcrypt.CompareHashAndPassword([]byte(got.PasswordHash), []byte("newpass1")) != nil {
+		t.Error("expected the new password to be stored")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+	req.Header.Set("Authorization", "Bearer "+session)
+	w := httptest.NewRecorder()
+	jwtMiddleware(db, handleGetMe(db)).ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected existing sessions to be logged out, got %d", w.Code)
+	}
+}
+
+func TestHandlePasswordReset_RespondsBeforeLookup(t *testing.T) {
+	db := setupTestDB(t)
+	createTestUser(t, db, "user@test.com", "hash")
+	// With the database gone, any lookup made before responding would fail the request.
+	db.Close()
+	resets := newResetQueue(db, newTestMailer(), 1, 10)
+	defer resets.Close()
+	handler := handleRequestPasswordReset(resets, newRateLimiter(PasswordResetIPLimit, PasswordResetIPWindow))
+
+	for _, email := range []string{"user@test.com", "nobody@test.com"} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/api/auth/password/reset", bytes.NewBufferString(`{"email":"`+email+`"}`)))
+		if w.Code != http.StatusAccepted {
+			t.Errorf("%s: expected 202 without waiting for the lookup, got %d", email, w.Code)
+		}
+	}
+}
+
+func TestHandlePasswordReset_LimitsRequestsPerIP(t *testing.T) {
+	db := setupTestDB(t)
+	resets := newResetQueue(db, newTestMailer(), 1, 10)
+	defer resets.Close()
+	handler := handleRequestPasswordReset(resets, newRateLimiter(2, time.Hour))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/password/reset", bytes.NewBufferString(`{"email":"nobody@test.com"}`))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	for i := range 2 {
+		if w := request("10.0.0.1:1000"); w.Code != http.StatusAccepted {
+			t.Fatalf("request %d: expected 202, got %d", i, w.Code)
+		}
+	}
+	w := request("10.0.0.1:2000")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("expected 429 with Retry-After past the limit, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := request("10.0.0.2:1000"); w.Code != http.StatusAccepted {
+		t.Errorf("expected another IP to be allowed, got %d", w.Code)
+	}
+}
+
+func TestResetQueue(t *testing.T) {
+	db := setupTestDB(t)
+	createTestUser(t, db, "user@test.com", "hash")
+	mailer := newTestMailer()
+
+	// Without workers nothing is taken off the queue, so it fills up.
+	full := newResetQueue(db, mailer, 0, 1)
+	if !full.Enqueue("nobody@test.com") || full.Enqueue("nobody@test.com") {
+		t.Error("expected the second request to be dropped once the queue is full")
+	}
+	full.Close()
+
+	resets := newResetQueue(db, mailer, 1, 10)
+	if !resets.Enqueue("user@test.com") {
+		t.Fatal("expected the request to be queued")
+	}
+	resets.Close()
+	select {
+	case msg := <-mailer.sent:
+		if msg.To != "user@test.com" {
+			t.Errorf("expected the reset email to go to the user, got %q", msg.To)
+		}
+	default:
+		t.Error("expected Close to wait for the queued request")
+	}
+	if resets.Enqueue("user@test.com") {
+		t.Error("expected a closed queue to refuse requests")
+	}
+	resets.Close()
+}
+
+func TestHandleEmailVerification(t *testing.T) {
+	db := setupTestDB(t)
+	mailer := newTestMailer()
+
+	w := httptest.NewRecorder()
+	handleRegister(db, mailer)(w, httptest.NewRequest(http.MethodPost, "/api/auth/register",
+		bytes.NewBufferString(`{"email":"new@example.com","password":"secret123"}`)))
+	var tokens AuthTokens
+	json.NewDecoder(w.Body).Decode(&tokens)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+
+	msg := mailer.next(t)
+	_, link, ok := strings.Cut(msg.Body, "/verify-email?token=")
+	if msg.To != "new@example.com" || !ok {
+		t.Fatalf("expected a verification link sent to the new user, got %+v", msg)
+	}
+	token, _, _ := strings.Cut(link, "\n")
+
+	protected := http.NewServeMux()
+	protected.HandleFunc("GET /api/me", handleGetMe(db))
+	protected.HandleFunc("POST /api/auth/verify/resend", handleResendVerification(db, mailer))
+	api := jwtMiddleware(db, protected)
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.Token)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+	verify := func(token string) int {
+		w := httptest.NewRecorder()
+		handleVerifyEmail(db)(w, httptest.NewRequest(http.MethodPost, "/api/auth/verify", bytes.NewBufferString(`{"token":"`+token+`"}`)))
+		return w.Code
+	}
+
+	// Resending right after registration is rate limited.
+	w = do(http.MethodPost, "/api/auth/verify/resend")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+	db.Exec("UPDATE users SET verification_sent_at = '2000-01-01 00:00:00'")
+	if w := do(http.MethodPost, "/api/auth/verify/resend"); w.Code != http.StatusAccepted {
+		t.Errorf("expected 202 once the interval has passed, got %d", w.Code)
+	}
+	mailer.next(t)
+
+	if code := verify("bogus"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid token, got %d", code)
+	}
+	if code := verify(tokens.Token); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an access token, got %d", code)
+	}
+	if code := verify(token); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if code := verify(token); code != http.StatusNoContent {
+		t.Errorf("expected verifying again to succeed, got %d", code)
+	}
+
+	var me User
+	json.NewDecoder(do(http.MethodGet, "/api/me").Body).Decode(&me)
+	if me.EmailVerifiedAt == nil {
+		t.Error("expected email_verified_at to be set")
+	}
+	if w := do(http.MethodPost, "/api/auth/verify/resend"); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 once verified, got %d", w.Code)
+	}
+}
+
+func TestVerificationMiddleware(t *testing.T) {
+	db := setupTestDB(t)
+	unverified := createTestUser(t, db, "new@test.com", "hash")
+	verified := createTestUser(t, db, "old@test.com", "hash")
+	MarkEmailVerified(db, verified.ID, verified.Email, time.Now())
+
+	tests := []struct {
+		policy VerificationPolicy
+		userID int64
+		method string
+		path   string
+		status int
+	}{
+		{VerificationOptional, unverified.ID, http.MethodPost, "/api/todos", http.StatusOK},
+		{VerificationReadOnly, unverified.ID, http.MethodGet, "/api/todos", http.StatusOK},
+		{VerificationReadOnly, unverified.ID, http.MethodPost, "/api/todos", http.StatusForbidden},
+		{VerificationReadOnly, unverified.ID, http.MethodPatch, "/api/me", http.StatusOK},
+		{VerificationRequired, unverified.ID, http.MethodGet, "/api/todos", http.StatusForbidden},
+		{VerificationRequired, unverified.ID, http.MethodGet, "/api/me", http.StatusOK},
+		{VerificationRequired, unverified.ID, http.MethodPost, "/api/auth/verify/resend", http.StatusOK},
+		{VerificationRequired, verified.ID, http.MethodPost, "/api/todos", http.StatusOK},
+	}
+	for _, tc := range tests {
+		handler := verificationMiddleware(db, tc.policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, injectUserID(httptest.NewRequest(tc.method, tc.path, nil), tc.userID))
+		if w.Code != tc.status {
+			t.Errorf("%s %s %s (user %d): expected status %d, got %d", tc.policy, tc.method, tc.path, tc.userID, tc.status, w.Code)
+		}
+	}
+}
+
+func TestLogMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer := &logMailer{dir: dir, from: "app@test.com"}
+
+	if err := mailer.Send(Message{To: "user@test.com", Subject: "Hi\r\nBcc: evil@test.com", Body: "line 1\nline 2"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected 1 email file, got %d", len(files))
+	}
+	data, _ := os.ReadFile(dir + "/" + files[0].Name())
+	content := string(data)
+	for _, want := range []string{"From: app@test.com\r\n", "To: user@test.com\r\n", "Subject: HiBcc: evil@test.com\r\n", "\r\n\r\nline 1\r\nline 2"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected %q in the email, got %q", want, content)
+		}
+	}
+}
+
 // --- JWT Tests ---
 
 func TestGenerateAndValidateJWT(t *testing.T) {
-	token, err := generateJWT(42)
+	token, err := generateJWT(42, 7)
 	if err != nil {
 		t.Fatalf("generateJWT failed: %v", err)
 	}
@@ -201,24 +700,24 @@ func TestGenerateAndValidateJWT(t *testing.T) {
 		t.Fatal("expected non-empty token")
 	}
 
-	userID, err := validateJWT(token)
+	userID, sessionID, err := validateJWT(token)
 	if err != nil {
 		t.Fatalf("validateJWT failed: %v", err)
 	}
-	if userID != 42 {
-		t.Errorf("expected userID 42, got %d", userID)
+	if userID != 42 || sessionID != 7 {
+		t.Errorf("expected userID 42 and sessionID 7, got %d and %d", userID, sessionID)
 	}
 }
 
 func TestValidateJWT_InvalidToken(t *testing.T) {
-	_, err := validateJWT("invalid.token.string")
+	_, _, err := validateJWT("invalid.token.string")
 	if err == nil {
 		t.Error("expected error for invalid token, got nil")
 	}
 }
 
 func TestValidateJWT_EmptyToken(t *testing.T) {
-	_, err := validateJWT("")
+	_, _, err := validateJWT("")
 	if err == nil {
 		t.Error("expected error for empty token, got nil")
 	}
@@ -226,13 +725,33 @@ func TestValidateJWT_EmptyToken(t *testing.T) {
 
 // --- JWT Middleware Tests ---
 
+// createTestToken starts a session for the user and returns an access token for it.
+func createTestToken(t testing.TB, db *sql.DB, userID int64) string {
+	t.Helper()
+	refreshToken, _ := generateOpaqueToken()
+	session, err := CreateSession(db, userID, hashToken(refreshToken), "test", "127.0.0.1", time.Now())
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	token, err := generateJWT(userID, session.ID)
+	if err != nil {
+		t.Fatalf("generateJWT failed: %v", err)
+	}
+	return token
+}
+
 func TestJWTMiddleware_ValidToken(t *testing.T) {
-	token, _ := generateJWT(1)
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	token := createTestToken(t, db, user.ID)
 
-	handler := jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := jwtMiddleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		uid := getUserIDFromContext(r)
-		if uid != 1 {
-			t.Errorf("expected userID 1 in context, got %d", uid)
+		if uid != user.ID {
+			t.Errorf("expected userID %d in context, got %d", user.ID, uid)
+		}
+		if getSessionIDFromContext(r) == 0 {
+			t.Error("expected a session ID in context")
 		}
 		w.WriteHeader(http.StatusOK)
 	}))
@@ -248,8 +767,30 @@ func TestJWTMiddleware_ValidToken(t *testing.T) {
 	}
 }
 
+func TestJWTMiddleware_RevokedSession(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	token := createTestToken(t, db, user.ID)
+	RevokeAllSessions(db, user.ID, time.Now())
+
+	handler := jwtMiddleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called for a logged-out session")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/todos", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+}
+
 func TestJWTMiddleware_MissingHeader(t *testing.T) {
-	handler := jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	db := setupTestDB(t)
+	handler := jwtMiddleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t.Error("handler should not be called without authorization")
 	}))
 
@@ -264,7 +805,8 @@ func TestJWTMiddleware_MissingHeader(t *testing.T) {
 }
 
 func TestJWTMiddleware_InvalidFormat(t *testing.T) {
-	handler := jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	db := setupTestDB(t)
+	handler := jwtMiddleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t.Error("handler should not be called with invalid authorization")
 	}))
 
@@ -280,7 +822,8 @@ func TestJWTMiddleware_InvalidFormat(t *testing.T) {
 }
 
 func TestJWTMiddleware_InvalidToken(t *testing.T) {
-	handler := jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	db := setupTestDB(t)
+	handler := jwtMiddleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t.Error("handler should not be called with invalid token")
 	}))
 
@@ -450,8 +993,13 @@ func TestHandleUpdateTodo_Success(t *testing.T) {
 
 	handleUpdateTodo(db)(w, req)
 
-	if w.Code != http.StatusNoContent {
-		t.Fatalf("expected status 204, got %d", w.Code)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var updated Todo
+	json.NewDecoder(w.Body).Decode(&updated)
+	if !updated.Completed || updated.Title != "Test task" {
+		t.Errorf("expected the completed todo in the response, got %+v", updated)
 	}
 }
 
@@ -719,8 +1267,8 @@ func TestCORSMiddleware(t *testing.T) {
 		}
 
 		headers := w.Header().Get("Access-Control-Allow-Headers")
-		if headers != "Content-Type, Authorization" {
-			t.Errorf("expected Access-Control-Allow-Headers 'Content-Type, Authorization', got '%s'", headers)
+		if headers != "Content-Type, Authorization, If-Match, If-None-Match, Idempotency-Key" {
+			t.Errorf("expected Access-Control-Allow-Headers 'Content-Type, Authorization, If-Match, If-None-Match, Idempotency-Key', got '%s'", headers)
 		}
 
 		if w.Code != http.StatusOK {
@@ -751,7 +1299,7 @@ func TestAPIFullAuthAndCRUDFlow(t *testing.T) {
 	db := setupTestDB(t)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /api/auth/register", handleRegister(db))
+	mux.HandleFunc("POST /api/auth/register", handleRegister(db, newTestMailer()))
 	mux.HandleFunc("POST /api/auth/login", handleLogin(db))
 
 	protected := http.NewServeMux()
@@ -760,8 +1308,8 @@ func TestAPIFullAuthAndCRUDFlow(t *testing.T) {
 	protected.HandleFunc("PATCH /api/todos/{id}", handleUpdateTodo(db))
 	protected.HandleFunc("PATCH /api/todos/{id}/title", handleUpdateTodoTitle(db))
 	protected.HandleFunc("DELETE /api/todos/{id}", handleDeleteTodo(db))
-	mux.Handle("/api/todos", jwtMiddleware(protected))
-	mux.Handle("/api/todos/", jwtMiddleware(protected))
+	mux.Handle("/api/todos", jwtMiddleware(db, protected))
+	mux.Handle("/api/todos/", jwtMiddleware(db, protected))
 
 	srv := httptest.NewServer(corsMiddleware(mux))
 	defer srv.Close()
@@ -1219,13 +1767,10 @@ func TestAPIListsFullFlow(t *testing.T) {
 	db := setupTestDB(t)
 	user := createTestUser(t, db, "user@test.com", "hash")
 
-	token, err := generateJWT(user.ID)
-	if err != nil {
-		t.Fatalf("generateJWT: %v", err)
-	}
+	token := createTestToken(t, db, user.ID)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /api/auth/register", handleRegister(db))
+	mux.HandleFunc("POST /api/auth/register", handleRegister(db, newTestMailer()))
 	mux.HandleFunc("POST /api/auth/login", handleLogin(db))
 	protected := http.NewServeMux()
 	protected.HandleFunc("GET /api/todos", handleListTodos(db))
@@ -1241,10 +1786,10 @@ func TestAPIListsFullFlow(t *testing.T) {
 	protected.HandleFunc("PATCH /api/lists/{id}", handleUpdateList(db))
 	protected.HandleFunc("DELETE /api/lists/{id}", handleDeleteList(db))
 	protected.HandleFunc("POST /api/lists/{id}/todos", handleCreateTodoInList(db))
-	mux.Handle("/api/todos", jwtMiddleware(protected))
-	mux.Handle("/api/todos/", jwtMiddleware(protected))
-	mux.Handle("/api/lists", jwtMiddleware(protected))
-	mux.Handle("/api/lists/", jwtMiddleware(protected))
+	mux.Handle("/api/todos", jwtMiddleware(db, protected))
+	mux.Handle("/api/todos/", jwtMiddleware(db, protected))
+	mux.Handle("/api/lists", jwtMiddleware(db, protected))
+	mux.Handle("/api/lists/", jwtMiddleware(db, protected))
 
 	srv := httptest.NewServer(corsMiddleware(mux))
 	defer srv.Close()
@@ -1501,3 +2046,1905 @@ func TestHandleCreateTodoInList_EmptyTitle(t *testing.T) {
 	}
 }
 
+// --- Due/Start Date Handler Tests ---
+
+func TestHandleCreateTodo_WithDueDate(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	if err := UpdateUserTimezone(db, user.ID, "America/Sao_Paulo"); err != nil {
+		t.Fatalf("UpdateUserTimezone failed: %v", err)
+	}
+
+	body := `{"title":"Pay rent","due_at":"2026-03-10","start_at":"2026-03-01T09:00"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBufferString(body))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleCreateTodo(db)(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var todo Todo
+	if err := json.NewDecoder(w.Body).Decode(&todo); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if todo.DueAt == nil || *todo.DueAt != "2026-03-11 02:59:59" {
+		t.Errorf("expected due_at at end of day in user timezone, got %v", todo.DueAt)
+	}
+	if todo.StartAt == nil || *todo.StartAt != "2026-03-01 12:00:00" {
+		t.Errorf("expected start_at '2026-03-01 12:00:00', got %v", todo.StartAt)
+	}
+}
+
+func TestHandleCreateTodo_InvalidDueDate(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	for _, body := range []string{
+		`{"title":"Task","due_at":"tomorrow"}`,
+		`{"title":"Task","due_at":"2026-03-01","start_at":"2026-03-05"}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBufferString(body))
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+
+		handleCreateTodo(db)(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("body %s: expected status 400, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestHandleListTodos_DueFilter(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	past := time.Now().Add(-48 * time.Hour)
+	CreateTodoWithDetails(db, "Late", TodoDetails{DueAt: &past}, user.ID)
+	CreateTodo(db, "Undated", user.ID)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/todos?due=overdue", nil)
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleListTodos(db)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var todos []Todo
+	if err := json.NewDecoder(w.Body).Decode(&todos); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(todos) != 1 || todos[0].Title != "Late" {
+		t.Errorf("expected only 'Late', got %v", todos)
+	}
+
+	for _, query := range []string{"?due=someday", "?due=today&list_id=1"} {
+		req = httptest.NewRequest(http.MethodGet, "/api/todos"+query, nil)
+		req = injectUserID(req, user.ID)
+		w = httptest.NewRecorder()
+
+		handleListTodos(db)(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestHandleUpdateTodoSchedule_Success(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Task", user.ID)
+
+	body := `{"due_at":"2026-03-10T18:00:00Z"}`
+	req := httptest.NewRequest(http.MethodPatch, "/api/todos/"+strconv.FormatInt(todo.ID, 10)+"/schedule", bytes.NewBufferString(body))
+	req.SetPathValue("id", strconv.FormatInt(todo.ID, 10))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleUpdateTodoSchedule(db)(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+	got, _ := getTodo(db, todo.ID)
+	if got.DueAt == nil || *got.DueAt != "2026-03-10 18:00:00" {
+		t.Errorf("expected due_at to be set, got %v", got.DueAt)
+	}
+}
+
+func TestHandleUpdateMe_Timezone(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/me", bytes.NewBufferString(`{"timezone":"Asia/Tokyo"}`))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleUpdateMe(db)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var got User
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if got.Timezone != "Asia/Tokyo" {
+		t.Errorf("expected timezone 'Asia/Tokyo', got '%s'", got.Timezone)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/api/me", bytes.NewBufferString(`{"timezone":"Nowhere/Special"}`))
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+
+	handleUpdateMe(db)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+}
+
+// --- Priority Handler Tests ---
+
+func TestHandleCreateTodo_InvalidPriority(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	body := `{"title":"Task","priority":"asap"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBufferString(body))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleCreateTodo(db)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", w.Code)
+	}
+}
+
+func TestHandleUpdateTodoPriority_Success(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Task", user.ID)
+
+	body := `{"priority":"medium"}`
+	req := httptest.NewRequest(http.MethodPatch, "/api/todos/"+strconv.FormatInt(todo.ID, 10)+"/priority", bytes.NewBufferString(body))
+	req.SetPathValue("id", strconv.FormatInt(todo.ID, 10))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleUpdateTodoPriority(db)(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+	got, _ := getTodo(db, todo.ID)
+	if got.Priority != "medium" {
+		t.Errorf("expected priority 'medium', got '%s'", got.Priority)
+	}
+}
+
+func TestHandleListTodosByList_SortByPriority(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "work", "#F8BBD9", user.ID)
+	CreateTodoInListWithDetails(db, "minor", TodoDetails{Priority: "low"}, list.ID, user.ID)
+	CreateTodoInListWithDetails(db, "major", TodoDetails{Priority: "urgent"}, list.ID, user.ID)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/lists/"+strconv.FormatInt(list.ID, 10)+"/todos?sort=priority", nil)
+	req.SetPathValue("id", strconv.FormatInt(list.ID, 10))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleListTodosByList(db)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var todos []Todo
+	if err := json.NewDecoder(w.Body).Decode(&todos); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if len(todos) != 2 || todos[0].Title != "major" {
+		t.Errorf("expected 'major' first, got %v", todos)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/lists/"+strconv.FormatInt(list.ID, 10)+"/todos?sort=color", nil)
+	req.SetPathValue("id", strconv.FormatInt(list.ID, 10))
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+
+	handleListTodosByList(db)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for invalid sort, got %d", w.Code)
+	}
+}
+
+// --- Notes Handler Tests ---
+
+func TestHandleGetTodo_Success(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodoWithDetails(db, "Task", TodoDetails{Notes: "line one\n\nline two"}, user.ID)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/todos/"+strconv.FormatInt(todo.ID, 10), nil)
+	req.SetPathValue("id", strconv.FormatInt(todo.ID, 10))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleGetTodo(db)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var got Todo
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if got.Notes == nil || *got.Notes != "line one\n\nline two" {
+		t.Errorf("expected notes to be returned, got %v", got.Notes)
+	}
+}
+
+func TestHandleGetTodo_NotFound(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/todos/999", nil)
+	req.SetPathValue("id", "999")
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleGetTodo(db)(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", w.Code)
+	}
+}
+
+func TestHandleUpdateTodoNotes_Sanitizes(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Task", user.ID)
+
+	body := `{"notes":"<iframe src=\"evil\"></iframe>[a](javascript:void(0))"}`
+	req := httptest.NewRequest(http.MethodPatch, "/api/todos/"+strconv.FormatInt(todo.ID, 10)+"/notes", bytes.NewBufferString(body))
+	req.SetPathValue("id", strconv.FormatInt(todo.ID, 10))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleUpdateTodoNotes(db)(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+	got, _ := GetTodoByID(db, todo.ID, user.ID)
+	if *got.Notes != "[a](#)" {
+		t.Errorf("expected sanitized notes '[a](#)', got %q", *got.Notes)
+	}
+}
+
+// --- Checklist Item Handler Tests ---
+
+func TestHandleTodoItems_Flow(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Launch", user.ID)
+	todoIDStr := strconv.FormatInt(todo.ID, 10)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/todos/"+todoIDStr+"/items", bytes.NewBufferString(`{"title":"Write tests"}`))
+	req.SetPathValue("id", todoIDStr)
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+	handleCreateTodoItem(db)(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: expected status 201, got %d", w.Code)
+	}
+	var item TodoItem
+	if err := json.NewDecoder(w.Body).Decode(&item); err != nil {
+		t.Fatalf("failed to decode item: %v", err)
+	}
+	itemIDStr := strconv.FormatInt(item.ID, 10)
+
+	req = httptest.NewRequest(http.MethodPatch, "/api/todos/"+todoIDStr+"/items/"+itemIDStr, bytes.NewBufferString(`{"completed":true}`))
+	req.SetPathValue("id", todoIDStr)
+	req.SetPathValue("itemId", itemIDStr)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleUpdateTodoItem(db)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: expected status 200, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/todos", nil)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleListTodos(db)(w, req)
+	var todos []Todo
+	if err := json.NewDecoder(w.Body).Decode(&todos); err != nil {
+		t.Fatalf("failed to decode todos: %v", err)
+	}
+	if todos[0].Progress != (Progress{Done: 1, Total: 1}) {
+		t.Errorf("expected progress 1/1, got %+v", todos[0].Progress)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/todos/"+todoIDStr+"/items/"+itemIDStr, nil)
+	req.SetPathValue("id", todoIDStr)
+	req.SetPathValue("itemId", itemIDStr)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleDeleteTodoItem(db)(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: expected status 204, got %d", w.Code)
+	}
+}
+
+func TestHandleUpdateTodoItem_NotFound(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Launch", user.ID)
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/todos/1/items/999", bytes.NewBufferString(`{"completed":true}`))
+	req.SetPathValue("id", strconv.FormatInt(todo.ID, 10))
+	req.SetPathValue("itemId", "999")
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleUpdateTodoItem(db)(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", w.Code)
+	}
+	var errResp map[string]string
+	json.NewDecoder(w.Body).Decode(&errResp)
+	if errResp["error"] != "checklist item not found" {
+		t.Errorf("expected error 'checklist item not found', got '%s'", errResp["error"])
+	}
+}
+
+func TestHandleReorderTodoItems_InvalidOrder(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Launch", user.ID)
+	CreateTodoItem(db, todo.ID, "one", user.ID)
+	CreateTodoItem(db, todo.ID, "two", user.ID)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/todos/1/items/reorder", bytes.NewBufferString(`{"item_ids":[1]}`))
+	req.SetPathValue("id", strconv.FormatInt(todo.ID, 10))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleReorderTodoItems(db)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", w.Code)
+	}
+}
+
+// --- Recurrence Handler Tests ---
+
+func TestHandleCreateTodo_WithRecurrence(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	body := `{"title":"Standup","recurrence":"FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBufferString(body))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleCreateTodo(db)(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", w.Code)
+	}
+	var todo Todo
+	json.NewDecoder(w.Body).Decode(&todo)
+	if todo.Recurrence == nil || *todo.Recurrence != "FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR" {
+		t.Errorf("expected recurrence to be stored, got %v", todo.Recurrence)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/todos", bytes.NewBufferString(`{"title":"Bad","recurrence":"every day"}`))
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+
+	handleCreateTodo(db)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for invalid recurrence, got %d", w.Code)
+	}
+}
+
+func TestHandleUpdateTodo_CompletingRecurringTodo(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodoWithDetails(db, "Daily review", TodoDetails{Recurrence: "daily"}, user.ID)
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/todos/"+strconv.FormatInt(todo.ID, 10), bytes.NewBufferString(`{"completed":true}`))
+	req.SetPathValue("id", strconv.FormatInt(todo.ID, 10))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+
+	handleUpdateTodo(db)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	todos, _ := GetAllTodos(db, user.ID)
+	if len(todos) != 2 {
+		t.Fatalf("expected a new occurrence, got %d todos", len(todos))
+	}
+	for _, td := range todos {
+		if td.ID != todo.ID && td.DueAt == nil {
+			t.Error("expected the undated series to be scheduled for the next day")
+		}
+	}
+}
+
+// --- Trash Handler Tests ---
+
+func TestHandleTrash_Flow(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Oops", user.ID)
+	DeleteTodo(db, todo.ID, user.ID)
+	idStr := strconv.FormatInt(todo.ID, 10)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/trash", nil)
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+	handleListTrash(db)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: expected status 200, got %d", w.Code)
+	}
+	var trash []Todo
+	json.NewDecoder(w.Body).Decode(&trash)
+	if len(trash) != 1 || trash[0].DeletedAt == nil {
+		t.Fatalf("expected 1 trashed todo with deleted_at, got %+v", trash)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/todos/"+idStr+"/restore", nil)
+	req.SetPathValue("id", idStr)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleRestoreTodo(db)(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("restore: expected status 204, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/trash/"+idStr, nil)
+	req.SetPathValue("id", idStr)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handlePurgeTodo(db)(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("purge of restored todo: expected status 404, got %d", w.Code)
+	}
+}
+
+func TestGetTrashRetention(t *testing.T) {
+	t.Setenv("TRASH_RETENTION_DAYS", "7")
+	if got := getTrashRetention(); got != 7*24*time.Hour {
+		t.Errorf("expected 7 days, got %s", got)
+	}
+	t.Setenv("TRASH_RETENTION_DAYS", "soon")
+	if got := getTrashRetention(); got != DefaultTrashRetention {
+		t.Errorf("expected default retention, got %s", got)
+	}
+}
+
+// --- Manual Ordering Handler Tests ---
+
+func TestHandleReorderListTodos(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	a, _ := CreateTodoInList(db, "A", list.ID, user.ID)
+	CreateTodoInList(db, "B", list.ID, user.ID)
+	listIDStr := strconv.FormatInt(list.ID, 10)
+
+	body := `{"todo_id": ` + strconv.FormatInt(a.ID, 10) + `, "after_id": null}`
+	req := httptest.NewRequest(http.MethodPost, "/api/lists/"+listIDStr+"/todos/reorder", strings.NewReader(body))
+	req.SetPathValue("id", listIDStr)
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+	handleReorderListTodos(db)(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/lists/"+listIDStr+"/todos", nil)
+	req.SetPathValue("id", listIDStr)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleListTodosByList(db)(w, req)
+	var todos []Todo
+	json.NewDecoder(w.Body).Decode(&todos)
+	if len(todos) != 2 || todos[0].ID != a.ID {
+		t.Errorf("expected A first after reorder, got %+v", todos)
+	}
+
+	body = `{"todo_id": ` + strconv.FormatInt(a.ID, 10) + `, "after_id": ` + strconv.FormatInt(a.ID, 10) + `}`
+	req = httptest.NewRequest(http.MethodPost, "/api/lists/"+listIDStr+"/todos/reorder", strings.NewReader(body))
+	req.SetPathValue("id", listIDStr)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleReorderListTodos(db)(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+}
+
+func TestHandleReorderTodos_Validation(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`not json`, http.StatusBadRequest},
+		{`{"after_id": 1}`, http.StatusBadRequest},
+		{`{"todo_id": 9999}`, http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/todos/reorder", strings.NewReader(tc.body))
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handleReorderTodos(db)(w, req)
+		if w.Code != tc.want {
+			t.Errorf("body %s: expected status %d, got %d", tc.body, tc.want, w.Code)
+		}
+	}
+}
+
+func TestHandleReorderLists(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	a, _ := CreateList(db, "A", "", user.ID)
+	b, _ := CreateList(db, "B", "", user.ID)
+
+	body := `{"list_ids": [` + strconv.FormatInt(a.ID, 10) + `, ` + strconv.FormatInt(b.ID, 10) + `]}`
+	req := httptest.NewRequest(http.MethodPatch, "/api/lists/order", strings.NewReader(body))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+	handleReorderLists(db)(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", w.Code, w.Body.String())
+	}
+
+	idStr := strconv.FormatInt(b.ID, 10)
+	req = httptest.NewRequest(http.MethodPatch, "/api/lists/"+idStr, strings.NewReader(`{"pinned": true}`))
+	req.SetPathValue("id", idStr)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleUpdateList(db)(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("pin: expected status 204, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/lists", nil)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleListLists(db)(w, req)
+	var lists []List
+	json.NewDecoder(w.Body).Decode(&lists)
+	if len(lists) != 2 || lists[0].ID != b.ID || !lists[0].Pinned || lists[1].ID != a.ID {
+		t.Errorf("expected pinned B then A, got %+v", lists)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/api/lists/order", strings.NewReader(`{"list_ids": [1]}`))
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleReorderLists(db)(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a partial order, got %d", w.Code)
+	}
+}
+
+// --- Search Handler Tests ---
+
+func TestHandleSearchTodos(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	CreateTodo(db, "Buy milk", user.ID)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"q=milk", http.StatusOK},
+		{"q=", http.StatusBadRequest},
+		{"q=milk&completed=maybe", http.StatusBadRequest},
+		{"q=milk&list_id=abc", http.StatusBadRequest},
+		{"q=milk&list_id=9999", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/search?"+tc.query, nil)
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handleSearchTodos(db)(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: expected status %d, got %d", tc.query, tc.want, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/search?q=milk", nil)
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+	handleSearchTodos(db)(w, req)
+	var results []SearchResult
+	json.NewDecoder(w.Body).Decode(&results)
+	if len(results) != 1 || results[0].Title != "Buy milk" || results[0].Snippet != "Buy <mark>milk</mark>" {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
+
+// --- Pagination Handler Tests ---
+
+func TestHandleListTodos_Pagination(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	for i := 0; i < 5; i++ {
+		CreateTodo(db, "Todo "+strconv.Itoa(i), user.ID)
+	}
+
+	url := "/api/todos?limit=2"
+	var seen []int64
+	for pages := 0; url != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handleListTodos(db)(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var todos []Todo
+		json.NewDecoder(w.Body).Decode(&todos)
+		for _, td := range todos {
+			seen = append(seen, td.ID)
+		}
+
+		url = ""
+		if link := w.Header().Get("Link"); link != "" {
+			if !strings.HasPrefix(link, "</api/todos?") || !strings.HasSuffix(link, `>; rel="next"`) {
+				t.Fatalf("unexpected Link header %q", link)
+			}
+			url = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	if len(seen) != 5 {
+		t.Errorf("expected 5 todos across pages, got %d", len(seen))
+	}
+
+	for _, query := range []string{"limit=0", "limit=201", "limit=x", "cursor=bogus", "due=today&limit=2"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/todos?"+query, nil)
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handleListTodos(db)(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestHandleListLists_Pagination(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	CreateList(db, "A", "", user.ID)
+	CreateList(db, "B", "", user.ID)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/lists?limit=1", nil)
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+	handleListLists(db)(w, req)
+	var lists []List
+	json.NewDecoder(w.Body).Decode(&lists)
+	if w.Code != http.StatusOK || len(lists) != 1 || w.Header().Get("Link") == "" {
+		t.Errorf("expected one list and a next link, got %d lists, status %d, Link %q", len(lists), w.Code, w.Header().Get("Link"))
+	}
+}
+
+// --- Filter Handler Tests ---
+
+func TestHandleListTodos_Filters(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	CreateTodoInList(db, "Write report", list.ID, user.ID)
+	done, _ := CreateTodo(db, "Send report", user.ID)
+	UpdateTodoStatus(db, done.ID, true, user.ID)
+	CreateTodo(db, "Buy milk", user.ID)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/todos?completed=false&title=report&sort=title:asc", nil)
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+	handleListTodos(db)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var todos []Todo
+	json.NewDecoder(w.Body).Decode(&todos)
+	if len(todos) != 1 || todos[0].Title != "Write report" || len(todos[0].Lists) != 1 {
+		t.Errorf("expected only the open report with its list, got %+v", todos)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+		msg   string
+	}{
+		{"sort=color:asc", http.StatusBadRequest, `invalid filter: unknown sort field "color"`},
+		{"completed=maybe", http.StatusBadRequest, "invalid filter: completed must be true or false"},
+		{"due=today&completed=false", http.StatusBadRequest, "due cannot be combined with other filters"},
+		{"list_id=9999", http.StatusNotFound, "list not found"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/todos?"+tc.query, nil)
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handleListTodos(db)(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: expected status %d, got %d", tc.query, tc.want, w.Code)
+			continue
+		}
+		var body map[string]string
+		json.NewDecoder(w.Body).Decode(&body)
+		if body["error"] != tc.msg {
+			t.Errorf("%s: expected error %q, got %q", tc.query, tc.msg, body["error"])
+		}
+	}
+}
+
+// --- Smart List Handler Tests ---
+
+func TestHandleSmartLists_Flow(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	CreateTodo(db, "Buy milk", user.ID)
+	done, _ := CreateTodo(db, "Buy bread", user.ID)
+	UpdateTodoStatus(db, done.ID, true, user.ID)
+
+	body := `{"name":"Open","filter":"completed=false"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/smart-lists", strings.NewReader(body))
+	req = injectUserID(req, user.ID)
+	w := httptest.NewRecorder()
+	handleCreateSmartList(db)(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var sl SmartList
+	json.NewDecoder(w.Body).Decode(&sl)
+	id := strconv.FormatInt(sl.ID, 10)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/smart-lists/"+id+"/todos", nil)
+	req.SetPathValue("id", id)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleListSmartListTodos(db)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var todos []Todo
+	json.NewDecoder(w.Body).Decode(&todos)
+	if len(todos) != 1 || todos[0].Title != "Buy milk" {
+		t.Errorf("expected only the open todo, got %+v", todos)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/api/smart-lists/"+id, strings.NewReader(`{"filter":"completed=true"}`))
+	req.SetPathValue("id", id)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleUpdateSmartList(db)(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if got, _ := GetSmartList(db, sl.ID, user.ID); got.Name != "Open" || got.Filter != "completed=true" {
+		t.Errorf("expected name kept and filter replaced, got %+v", got)
+	}
+
+	tests := []struct {
+		body string
+		want int
+		msg  string
+	}{
+		{`{"name":"Bad","filter":"sort=color"}`, http.StatusBadRequest, `invalid filter: unknown sort field "color"`},
+		{`{"name":"Missing","filter":"list_id=9999"}`, http.StatusBadRequest, "filter references a list that does not exist"},
+		{`{"name":"Open"}`, http.StatusConflict, "smart list with this name already exists"},
+		{`{"name":" "}`, http.StatusBadRequest, "smart list name cannot be empty"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/smart-lists", strings.NewReader(tc.body))
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handleCreateSmartList(db)(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: expected status %d, got %d", tc.body, tc.want, w.Code)
+			continue
+		}
+		var resp map[string]string
+		json.NewDecoder(w.Body).Decode(&resp)
+		if resp["error"] != tc.msg {
+			t.Errorf("%s: expected error %q, got %q", tc.body, tc.msg, resp["error"])
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/smart-lists/"+id, nil)
+	req.SetPathValue("id", id)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleDeleteSmartList(db)(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/smart-lists/"+id, nil)
+	req.SetPathValue("id", id)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleGetSmartList(db)(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 after delete, got %d", w.Code)
+	}
+}
+
+// --- Merge Patch Handler Tests ---
+
+func TestHandleUpdateTodo_MergePatch(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodoWithDetails(db, "Original", TodoDetails{Priority: "low", Notes: "notes"}, user.ID)
+	id := strconv.FormatInt(todo.ID, 10)
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/todos/"+id, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		req.SetPathValue("id", id)
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handleUpdateTodo(db)(w, req)
+		return w
+	}
+
+	w := patch(`{"title":"Renamed","due_at":"2030-01-10","priority":null}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var updated Todo
+	json.NewDecoder(w.Body).Decode(&updated)
+	if updated.Title != "Renamed" || updated.DueAt == nil || updated.Priority != "none" || updated.Completed {
+		t.Errorf("unexpected todo after patch: %+v", updated)
+	}
+	if updated.Notes == nil || *updated.Notes != "notes" {
+		t.Errorf("expected notes untouched, got %v", updated.Notes)
+	}
+
+	w = patch(`{"due_at":null}`)
+	var cleared Todo
+	json.NewDecoder(w.Body).Decode(&cleared)
+	if w.Code != http.StatusOK || cleared.DueAt != nil {
+		t.Errorf("expected null to clear due_at, got %d %+v", w.Code, cleared)
+	}
+
+	tests := []struct {
+		body string
+		want int
+		msg  string
+	}{
+		{`[]`, http.StatusBadRequest, "invalid JSON body"},
+		{`null`, http.StatusBadRequest, "merge patch must be a JSON object"},
+		{`{"completed":"yes"}`, http.StatusBadRequest, "completed must be a boolean"},
+		{`{"title":null}`, http.StatusBadRequest, "title must be a string"},
+		{`{"title":" "}`, http.StatusBadRequest, "title cannot be empty"},
+		{`{"due_at":"soon"}`, http.StatusBadRequest, "due_at and start_at must be RFC 3339 or YYYY-MM-DD"},
+		{`{"start_at":"2030-02-01","due_at":"2030-01-01"}`, http.StatusBadRequest, "start_at must not be after due_at"},
+		{`{"id":5}`, http.StatusBadRequest, "id cannot be changed"},
+		{`{"version":9}`, http.StatusBadRequest, "version cannot be changed"},
+		{`{"updated_at":"2030-01-01T00:00:00Z"}`, http.StatusBadRequest, "updated_at cannot be changed"},
+		{`{"colour":"red"}`, http.StatusBadRequest, `unknown field "colour"`},
+	}
+	for _, tc := range tests {
+		w := patch(tc.body)
+		if w.Code != tc.want {
+			t.Errorf("%s: expected status %d, got %d", tc.body, tc.want, w.Code)
+			continue
+		}
+		var body map[string]string
+		json.NewDecoder(w.Body).Decode(&body)
+		if body["error"] != tc.msg {
+			t.Errorf("%s: expected error %q, got %q", tc.body, tc.msg, body["error"])
+		}
+	}
+
+	if got, _ := GetTodoByID(db, todo.ID, user.ID); got.Title != "Renamed" || got.StartAt != nil {
+		t.Errorf("expected rejected patches to change nothing, got %+v", got)
+	}
+}
+
+// --- ETag Handler Tests ---
+
+func TestHandleTodo_ETags(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "Task", user.ID)
+	id := strconv.FormatInt(todo.ID, 10)
+
+	do := func(handler http.HandlerFunc, method, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/todos/"+id, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		req.SetPathValue("id", id)
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := do(handleGetTodo(db), http.MethodGet, "", nil)
+	tag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || tag != `"1"` {
+		t.Fatalf("expected 200 with ETag \"1\", got %d %q", w.Code, tag)
+	}
+	if w := do(handleGetTodo(db), http.MethodGet, "", map[string]string{"If-None-Match": tag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected an empty 304 for a matching If-None-Match, got %d", w.Code)
+	}
+
+	w = do(handleUpdateTodo(db), http.MethodPatch, `{"title":"Tab A"}`, map[string]string{"If-Match": tag})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	newTag := w.Header().Get("ETag")
+	if newTag == tag || newTag == "" {
+		t.Errorf("expected a new ETag after the update, got %q", newTag)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+		ifMatch string
+	}{
+		{"stale merge patch", handleUpdateTodo(db), http.MethodPatch, `{"title":"Tab B"}`, tag},
+		{"stale title", handleUpdateTodoTitle(db), http.MethodPatch, `{"title":"Tab B"}`, tag},
+		{"stale delete", handleDeleteTodo(db), http.MethodDelete, "", tag},
+		{"weak tag", handleUpdateTodo(db), http.MethodPatch, `{"title":"Tab B"}`, "W/" + newTag},
+		{"several tags", handleUpdateTodo(db), http.MethodPatch, `{"title":"Tab B"}`, newTag + ", " + tag},
+	}
+	for _, tc := range tests {
+		w := do(tc.handler, tc.method, tc.body, map[string]string{"If-Match": tc.ifMatch})
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s: expected status 412, got %d", tc.name, w.Code)
+		}
+	}
+	if got, _ := GetTodoByID(db, todo.ID, user.ID); got.Title != "Tab A" {
+		t.Errorf("expected failed preconditions to change nothing, got title %q", got.Title)
+	}
+
+	if w := do(handleGetTodo(db), http.MethodGet, "", map[string]string{"If-None-Match": tag}); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for a stale If-None-Match, got %d", w.Code)
+	}
+	if w := do(handleDeleteTodo(db), http.MethodDelete, "", map[string]string{"If-Match": newTag}); w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204 deleting with the current ETag, got %d", w.Code)
+	}
+}
+
+func TestHandleTodo_ETagCoversLists(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	todo, _ := CreateTodoInList(db, "Task", list.ID, user.ID)
+	id := strconv.FormatInt(todo.ID, 10)
+
+	get := func(header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/todos/"+id, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		req.SetPathValue("id", id)
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handleGetTodo(db)(w, req)
+		return w
+	}
+
+	tag := get(nil).Header().Get("ETag")
+	if err := UpdateList(db, list.ID, "Office", "#ff0000", user.ID); err != nil {
+		t.Fatalf("UpdateList failed: %v", err)
+	}
+	w := get(map[string]string{"If-None-Match": tag})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 after the embedded list was renamed, got %d", w.Code)
+	}
+	var got Todo
+	json.NewDecoder(w.Body).Decode(&got)
+	if len(got.Lists) != 1 || got.Lists[0].Name != "Office" {
+		t.Errorf("expected the renamed list, got %+v", got.Lists)
+	}
+	newTag := w.Header().Get("ETag")
+	if newTag == tag {
+		t.Errorf("expected a new ETag after the list was renamed, got %q", newTag)
+	}
+
+	// The list part of the tag does not guard writes to the todo itself.
+	req := httptest.NewRequest(http.MethodPatch, "/api/todos/"+id, strings.NewReader(`{"completed":true}`))
+	req.Header.Set("If-Match", tag)
+	req.SetPathValue("id", id)
+	req = injectUserID(req, user.ID)
+	w = httptest.NewRecorder()
+	handleUpdateTodo(db)(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 with the todo's current version, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleList_ETags(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	id := strconv.FormatInt(list.ID, 10)
+
+	do := func(handler http.HandlerFunc, method, body, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/lists/"+id, strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		req.SetPathValue("id", id)
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := do(handleGetList(db), http.MethodGet, "", "")
+	tag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || tag == "" {
+		t.Fatalf("expected 200 with an ETag, got %d %q", w.Code, tag)
+	}
+
+	w = do(handleUpdateList(db), http.MethodPatch, `{"name":"Office","pinned":true}`, tag)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", w.Code, w.Body.String())
+	}
+	newTag := w.Header().Get("ETag")
+
+	if w := do(handleUpdateList(db), http.MethodPatch, `{"name":"Home"}`, tag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412 for a stale If-Match, got %d", w.Code)
+	}
+	if w := do(handleDeleteList(db), http.MethodDelete, "", tag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412 deleting with a stale If-Match, got %d", w.Code)
+	}
+	if w := do(handleDeleteList(db), http.MethodDelete, "", newTag); w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204 deleting with the current ETag, got %d", w.Code)
+	}
+}
+
+// --- Bulk Handler Tests ---
+
+func TestHandleBulkTodos(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	list, _ := CreateList(db, "Work", "", user.ID)
+	a, _ := CreateTodo(db, "A", user.ID)
+	foreign, _ := CreateTodo(db, "Foreign", other.ID)
+
+	bulk := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/todos/bulk", strings.NewReader(body))
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handleBulkTodos(db)(w, req)
+		return w
+	}
+
+	body := fmt.Sprintf(`{"action":"add_to_list","ids":[%d,%d],"list_id":%d}`, a.ID, foreign.ID, list.ID)
+	w := bulk(body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Results []BulkResult `json:"results"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	want := []BulkResult{{ID: a.ID, Status: http.StatusOK}, {ID: foreign.ID, Status: http.StatusNotFound, Error: "todo not found"}}
+	if len(resp.Results) != 2 || resp.Results[0] != want[0] || resp.Results[1] != want[1] {
+		t.Errorf("expected %+v, got %+v", want, resp.Results)
+	}
+	if lists, _ := ListTodoLists(db, a.ID, user.ID); len(lists) != 1 {
+		t.Errorf("expected todo A added to the list, got %d lists", len(lists))
+	}
+
+	tests := []struct {
+		body string
+		want int
+		msg  string
+	}{
+		{`{"action":"archive","ids":[1]}`, http.StatusBadRequest, ErrInvalidBulkAction.Error()},
+		{`{"action":"delete","ids":[]}`, http.StatusBadRequest, ErrInvalidBulkSize.Error()},
+		{`{"action":"move_to_list","ids":[1]}`, http.StatusBadRequest, "list_id is required for list actions"},
+		{`{"action":"move_to_list","ids":[1],"list_id":9999}`, http.StatusNotFound, "list not found"},
+	}
+	for _, tc := range tests {
+		w := bulk(tc.body)
+		if w.Code != tc.want {
+			t.Errorf("%s: expected status %d, got %d", tc.body, tc.want, w.Code)
+			continue
+		}
+		var errResp map[string]string
+		json.NewDecoder(w.Body).Decode(&errResp)
+		if errResp["error"] != tc.msg {
+			t.Errorf("%s: expected error %q, got %q", tc.body, tc.msg, errResp["error"])
+		}
+	}
+}
+
+// --- Idempotency Middleware Tests ---
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/todos", handleCreateTodo(db))
+	failures := 0
+	mux.HandleFunc("POST /api/fail", func(w http.ResponseWriter, r *http.Request) {
+		failures++
+		writeError(w, http.StatusInternalServerError, "boom")
+	})
+	handler := idempotencyMiddleware(db, mux)
+
+	post := func(path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	first := post("/api/todos", "create-1", `{"title":"Buy milk"}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", first.Code, first.Body.String())
+	}
+	retry := post("/api/todos", "create-1", `{"title":"Buy milk"}`)
+	if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Errorf("expected the first response replayed, got %d: %s", retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || retry.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected replay headers %v", retry.Header())
+	}
+	if todos, _ := GetAllTodos(db, user.ID); len(todos) != 1 {
+		t.Errorf("expected 1 todo after a retry, got %d", len(todos))
+	}
+
+	if w := post("/api/todos", "create-1", `{"title":"Buy bread"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a reused key, got %d", w.Code)
+	}
+	if w := post("/api/todos", strings.Repeat("k", 256), `{"title":"Buy milk"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an overlong key, got %d", w.Code)
+	}
+
+	// Without a key every request runs.
+	post("/api/todos", "", `{"title":"Buy milk"}`)
+	if todos, _ := GetAllTodos(db, user.ID); len(todos) != 2 {
+		t.Errorf("expected 2 todos, got %d", len(todos))
+	}
+
+	// Server errors are not saved, so a retry runs again.
+	post("/api/fail", "fail-1", "")
+	if w := post("/api/fail", "fail-1", ""); w.Header().Get("Idempotent-Replayed") != "" || failures != 2 {
+		t.Errorf("expected a retry after a 5xx to run again, got %d runs", failures)
+	}
+}
+
+func TestIdempotencyMiddleware_SkipsRequestsWithoutUser(t *testing.T) {
+	db := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret123"), bcrypt.DefaultCost)
+	CreateUser(db, "user@test.com", string(hash))
+	handler := idempotencyMiddleware(db, handleLogin(db))
+
+	var tokens []string
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(`{"email":"user@test.com","password":"secret123"}`))
+		req.Header.Set("Idempotency-Key", "login-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var resp AuthTokens
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("expected the login to run, got %d (replayed %q)", w.Code, w.Header().Get("Idempotent-Replayed"))
+		}
+		tokens = append(tokens, resp.RefreshToken)
+	}
+	if tokens[0] == tokens[1] {
+		t.Error("expected each login to issue its own refresh token")
+	}
+	var saved int
+	db.QueryRow("SELECT COUNT(*) FROM idempotency_keys").Scan(&saved)
+	if saved != 0 {
+		t.Errorf("expected no stored responses, got %d", saved)
+	}
+}
+
+// --- Sync Handler Tests ---
+
+func TestHandleSync(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "A", user.ID)
+
+	sync := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/sync"+query, nil)
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handleSync(db)(w, req)
+		return w
+	}
+
+	w := sync("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var full SyncChanges
+	json.NewDecoder(w.Body).Decode(&full)
+	if len(full.Todos) != 1 || full.Token == "" {
+		t.Fatalf("expected a snapshot with 1 todo and a token, got %+v", full)
+	}
+
+	DeleteTodo(db, todo.ID, user.ID)
+	PurgeTodo(db, todo.ID, user.ID)
+	w = sync("?since=" + full.Token)
+	var delta SyncChanges
+	json.NewDecoder(w.Body).Decode(&delta)
+	if w.Code != http.StatusOK || len(delta.Todos) != 0 || len(delta.Deleted.Todos) != 1 {
+		t.Errorf("expected a tombstone for the purged todo, got %d: %+v", w.Code, delta)
+	}
+
+	for _, query := range []string{"?since=abc", "?since=-1", "?since=99999"} {
+		if w := sync(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestHandlePushSync(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	todo, _ := CreateTodo(db, "A", user.ID)
+	UpdateTodoTitle(db, todo.ID, "A2", user.ID)
+
+	push := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/sync/push", strings.NewReader(body))
+		req = injectUserID(req, user.ID)
+		w := httptest.NewRecorder()
+		handlePushSync(db)(w, req)
+		return w
+	}
+
+	body := fmt.Sprintf(`{"operations":[
+		{"op":"create_todo","client_id":"c1","todo":{"title":"Offline","due_at":"2030-01-02"}},
+		{"op":"update_todo","id":%d,"version":%d,"patch":{"title":"Mine"}},
+		{"op":"delete_todo","id":%d}
+	]}`, todo.ID, todo.Version, todo.ID)
+	w := push(body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Results []SyncPushResult `json:"results"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Results) != 3 {
+		t.Fatalf("expected 3 results, got %+v", resp.Results)
+	}
+	if r := resp.Results[0]; r.Status != http.StatusCreated || r.ClientID != "c1" || r.Todo == nil || r.Todo.DueAt == nil {
+		t.Errorf("expected the created todo, got %+v", r)
+	}
+	if r := resp.Results[1]; r.Status != http.StatusConflict || r.Error != "todo has been modified" || r.Todo == nil || r.Todo.DeletedAt == nil {
+		t.Errorf("expected a conflict reporting the final server state, got %+v", r)
+	}
+	if r := resp.Results[2]; r.Status != http.StatusOK {
+		t.Errorf("expected the delete to apply, got %+v", r)
+	}
+
+	tests := []struct {
+		body string
+		msg  string
+	}{
+		{`{"operations":[]}`, ErrInvalidSyncBatch.Error()},
+		{`{"operations":[{"op":"archive","id":1}]}`, ErrInvalidSyncOp.Error()},
+		{`{"operations":[{"op":"create_todo"}]}`, "operations[0]: todo is required"},
+		{`{"operations":[{"op":"update_todo","patch":{}}]}`, "operations[0]: id or client_id is required"},
+		{`{"operations":[{"op":"update_todo","id":1,"patch":{"completed":"yes"}}]}`, "operations[0]: completed must be a boolean"},
+		{`{"operations":[{"op":"add_to_list","id":1}]}`, "operations[0]: list_id is required for list operations"},
+	}
+	for _, tc := range tests {
+		w := push(tc.body)
+		var errResp map[string]string
+		json.NewDecoder(w.Body).Decode(&errResp)
+		if w.Code != http.StatusBadRequest || errResp["error"] != tc.msg {
+			t.Errorf("%s: expected 400 %q, got %d %q", tc.body, tc.msg, w.Code, errResp["error"])
+		}
+	}
+}
+
+// --- Event Stream Handler Tests ---
+
+// readEvent reads the next event (or comment) block of an SSE stream as field → value.
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	t.Helper()
+	block := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return block
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		block[field] = value
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	token := createTestToken(t, db, user.ID)
+	bus := newEventBus(db)
+	defer bus.Close()
+
+	protected := http.NewServeMux()
+	protected.HandleFunc("GET /api/events", handleEvents(db, bus))
+	srv := httptest.NewServer(streamTicketMiddleware(db, protected))
+	defer srv.Close()
+
+	connect := func(lastEventID string) (*bufio.Reader, func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/events", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("expected a 200 event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		r := bufio.NewReader(resp.Body)
+		if block := readEvent(t, r); block["retry"] == "" {
+			t.Fatalf("expected a retry hint first, got %v", block)
+		}
+		return r, func() { cancel(); resp.Body.Close() }
+	}
+
+	stream, disconnect := connect("")
+	todo, _ := CreateTodo(db, "A", user.ID)
+	bus.Notify()
+	block := readEvent(t, stream)
+	var data Todo
+	json.Unmarshal([]byte(block["data"]), &data)
+	if block["event"] != EventTodoChanged || data.ID != todo.ID || block["id"] == "" {
+		t.Fatalf("expected a todo.changed event for the new todo, got %v", block)
+	}
+	lastID := block["id"]
+	disconnect()
+
+	// Changes made while disconnected are replayed after Last-Event-ID.
+	UpdateTodoTitle(db, todo.ID, "A2", user.ID)
+	stream, disconnect = connect(lastID)
+	block = readEvent(t, stream)
+	json.Unmarshal([]byte(block["data"]), &data)
+	if block["event"] != EventTodoChanged || data.Title != "A2" {
+		t.Errorf("expected the missed rename to be replayed, got %v", block)
+	}
+	disconnect()
+
+	stream, disconnect = connect("99999")
+	if block := readEvent(t, stream); block["event"] != EventReset {
+		t.Errorf("expected a reset event for an unknown Last-Event-ID, got %v", block)
+	}
+	disconnect()
+
+	defer func(interval time.Duration) { eventHeartbeatInterval = interval }(eventHeartbeatInterval)
+	eventHeartbeatInterval = 10 * time.Millisecond
+	stream, disconnect = connect("")
+	if line, _ := stream.ReadString('\n'); line != ": heartbeat\n" {
+		t.Errorf("expected a heartbeat comment, got %q", line)
+	}
+	disconnect()
+
+	for _, query := range []string{"", "?access_token=" + token} {
+		resp, _ := http.Get(srv.URL + "/api/events" + query)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401 without a header or ticket, got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestHandleEvents_OpensWithStreamTicket(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	token := createTestToken(t, db, user.ID)
+	bus := newEventBus(db)
+	defer bus.Close()
+
+	protected := http.NewServeMux()
+	protected.HandleFunc("POST /api/auth/stream-ticket", handleCreateStreamTicket(db))
+	protected.HandleFunc("GET /api/events", handleEvents(db, bus))
+	srv := httptest.NewServer(streamTicketMiddleware(db, idempotencyMiddleware(db, protected)))
+	defer srv.Close()
+
+	// Tickets are never stored for replay, even when the client sends an Idempotency-Key.
+	newTicket := func() string {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/auth/stream-ticket", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Idempotency-Key", "ticket")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to create a ticket: %v", err)
+		}
+		defer resp.Body.Close()
+		var ticket StreamTicket
+		json.NewDecoder(resp.Body).Decode(&ticket)
+		if resp.StatusCode != http.StatusCreated || ticket.Ticket == "" || ticket.ExpiresIn != int(StreamTicketTTL.Seconds()) {
+			t.Fatalf("expected a ticket, got %d %+v", resp.StatusCode, ticket)
+		}
+		return ticket.Ticket
+	}
+
+	todo, _ := CreateTodo(db, "A", user.ID)
+	ticket := newTicket()
+	resp, err := http.Get(srv.URL + "/api/events?ticket=" + ticket)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the ticket to open the stream, got %d", resp.StatusCode)
+	}
+
+	// A ticket is single-use: reconnecting with it fails, and the client resumes with a fresh one.
+	for _, bad := range []string{ticket, "garbage"} {
+		resp, _ := http.Get(srv.URL + "/api/events?ticket=" + bad)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401 for a used or unknown ticket, got %d", bad, resp.StatusCode)
+		}
+	}
+
+	UpdateTodoTitle(db, todo.ID, "A2", user.ID)
+	full, _ := GetSyncChanges(db, nil, user.ID)
+	since, _ := strconv.ParseInt(full.Token, 10, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/events?ticket="+newTicket()+"&last_event_id="+strconv.FormatInt(since-1, 10), nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	defer resp.Body.Close()
+	stream := bufio.NewReader(resp.Body)
+	readEvent(t, stream)
+	block := readEvent(t, stream)
+	var data Todo
+	json.Unmarshal([]byte(block["data"]), &data)
+	if block["event"] != EventTodoChanged || data.Title != "A2" {
+		t.Errorf("expected the missed rename to be replayed after last_event_id, got %v", block)
+	}
+
+	_, sessionID, _ := validateJWT(token)
+	orphan, _ := generateOpaqueToken()
+	CreateStreamTicket(db, user.ID, sessionID, hashToken(orphan), time.Now())
+	RevokeAllSessions(db, user.ID, time.Now())
+	resp, _ = http.Get(srv.URL + "/api/events?ticket=" + orphan)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a ticket of a logged out session, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandleEvents_EndsWhenSessionIsRevoked(t *testing.T) {
+	defer func(interval time.Duration) { eventHeartbeatInterval = interval }(eventHeartbeatInterval)
+	eventHeartbeatInterval = 10 * time.Millisecond
+
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	token := createTestToken(t, db, user.ID)
+	short := createShortLivedToken(t, token, 2*time.Second)
+	_, sessionID, _ := validateJWT(token)
+	bus := newEventBus(db)
+	defer bus.Close()
+
+	srv := httptest.NewServer(streamTicketMiddleware(db, handleEvents(db, bus)))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/events", nil)
+	req.Header.Set("Authorization", "Bearer "+short)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+	stream := bufio.NewReader(resp.Body)
+	readEvent(t, stream)
+
+	// The stream outlives the token that opened it.
+	expired := time.Now().Truncate(time.Second).Add(2100 * time.Millisecond)
+	for time.Now().Before(expired) {
+		if line, err := stream.ReadString('\n'); err != nil || (line != ": heartbeat\n" && line != "\n") {
+			t.Fatalf("expected heartbeats while the session is valid, got %q %v", line, err)
+		}
+	}
+
+	if err := RevokeSession(db, user.ID, sessionID, time.Now()); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, stream)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the stream to end cleanly, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the stream to end once the session was revoked")
+	}
+}
+
+// --- WebSocket Handler Tests ---
+
+// wsTestClient is a minimal WebSocket client speaking raw frames.
+type wsTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWebSocket opens a WebSocket to path on srv, checking the handshake.
+func dialWebSocket(t *testing.T, srv *httptest.Server, path string) *wsTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", path)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("failed to read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got %d", resp.StatusCode)
+	}
+	// The example key and accept value of RFC 6455, section 1.3.
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %q", accept)
+	}
+	return &wsTestClient{t: t, conn: conn, br: br}
+}
+
+// newWebSocketTestServer serves h until the test ends, then waits for its handlers once the
+// connections dialed by the test are closed, so that none outlives the test or a global it restores
+// with an earlier t.Cleanup.
+func newWebSocketTestServer(t *testing.T, h http.Handler) *httptest.Server {
+	var handlers sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		handlers.Wait()
+	})
+	return srv
+}
+
+// writeFrame sends one final frame, masked like every client frame must be unless masked is false.
+func (c *wsTestClient) writeFrame(opcode byte, payload []byte, masked bool) {
+	frame := []byte{0x80 | opcode}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	body := append([]byte(nil), payload...)
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i := range body {
+			body[i] ^= mask[i%4]
+		}
+	}
+	if _, err := c.conn.Write(append(frame, body...)); err != nil {
+		c.t.Fatalf("failed to write frame: %v", err)
+	}
+}
+
+// readFrame reads one unmasked server frame.
+func (c *wsTestClient) readFrame() (byte, []byte) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		c.t.Fatalf("failed to read frame: %v", err)
+	}
+	length := int(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatalf("failed to read payload: %v", err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+// send runs a command and returns its response, collecting any events received meanwhile.
+func (c *wsTestClient) send(cmd string) (SocketMessage, []SocketMessage) {
+	c.t.Helper()
+	c.writeFrame(wsOpText, []byte(cmd), true)
+	var events []SocketMessage
+	for {
+		opcode, payload := c.readFrame()
+		if opcode != wsOpText {
+			c.t.Fatalf("expected a text message, got opcode %d", opcode)
+		}
+		var msg SocketMessage
+		json.Unmarshal(payload, &msg)
+		if msg.Type == "response" {
+			return msg, events
+		}
+		events = append(events, msg)
+	}
+}
+
+// closeCode reads frames until a close frame and returns its code.
+func (c *wsTestClient) closeCode() int {
+	c.t.Helper()
+	for {
+		opcode, payload := c.readFrame()
+		if opcode == wsOpClose {
+			return int(binary.BigEndian.Uint16(payload))
+		}
+	}
+}
+
+func TestHandleWebSocket(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	other := createTestUser(t, db, "other@test.com", "hash")
+	token := createTestToken(t, db, user.ID)
+	otherToken := createTestToken(t, db, other.ID)
+	bus := newEventBus(db)
+	defer bus.Close()
+
+	protected := http.NewServeMux()
+	protected.HandleFunc("GET /api/todos", handleListTodos(db))
+	protected.HandleFunc("POST /api/todos", handleCreateTodo(db))
+	protected.HandleFunc("GET /api/events", handleEvents(db, bus))
+	srv := newWebSocketTestServer(t, queryTokenMiddleware(jwtMiddleware(db, handleWebSocket(db, bus, publishMiddleware(bus, idempotencyMiddleware(db, protected))))))
+
+	laptop := dialWebSocket(t, srv, "/api/ws?access_token="+token)
+	phone := dialWebSocket(t, srv, "/api/ws?access_token="+token)
+	stranger := dialWebSocket(t, srv, "/api/ws?access_token="+otherToken)
+
+	resp, events := phone.send(`{"id":"1","method":"POST","path":"/api/todos","body":{"title":"From phone"}}`)
+	var created Todo
+	json.Unmarshal(resp.Body, &created)
+	if resp.ID != "1" || resp.Status != http.StatusCreated || created.Title != "From phone" || resp.Headers["Content-Type"] != "application/json" {
+		t.Fatalf("expected the created todo, got %+v", resp)
+	}
+
+	// Every session of the user hears about the change, including the one that made it.
+	if len(events) == 0 {
+		_, payload := phone.readFrame()
+		var msg SocketMessage
+		json.Unmarshal(payload, &msg)
+		events = append(events, msg)
+	}
+	_, payload := laptop.readFrame()
+	var pushed SocketMessage
+	json.Unmarshal(payload, &pushed)
+	for _, msg := range []SocketMessage{events[0], pushed} {
+		if msg.Type != "event" || msg.Event != EventTodoChanged || msg.EventID == 0 {
+			t.Errorf("expected a todo.changed event, got %+v", msg)
+		}
+	}
+
+	// The other user's session gets only its own responses.
+	resp, events = stranger.send(`{"id":"s","method":"GET","path":"/api/todos"}`)
+	if resp.Status != http.StatusOK || string(resp.Body) != "[]" || len(events) != 0 {
+		t.Errorf("expected an empty list and no events for another user, got %+v %+v", resp, events)
+	}
+
+	tests := []struct {
+		cmd    string
+		status int
+	}{
+		{`not json`, http.StatusBadRequest},
+		{`{"id":"2","method":"PUT","path":"/api/todos"}`, http.StatusBadRequest},
+		{`{"id":"3","method":"GET","path":"/api/events"}`, http.StatusBadRequest},
+		{`{"id":"4","method":"GET","path":"http://elsewhere/api/todos"}`, http.StatusBadRequest},
+		{`{"id":"5","method":"POST","path":"/api/todos","body":{"title":""}}`, http.StatusBadRequest},
+		{`{"id":"6","method":"GET","path":"/api/nowhere"}`, http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if resp, _ := stranger.send(tc.cmd); resp.Status != tc.status {
+			t.Errorf("%s: expected status %d, got %+v", tc.cmd, tc.status, resp)
+		}
+	}
+
+	stranger.writeFrame(wsOpPing, []byte("hi"), true)
+	if opcode, payload := stranger.readFrame(); opcode != wsOpPong || string(payload) != "hi" {
+		t.Errorf("expected a pong echoing the ping, got %d %q", opcode, payload)
+	}
+
+	stranger.writeFrame(wsOpText, []byte(`{}`), false)
+	if code := stranger.closeCode(); code != wsCloseProtocolError {
+		t.Errorf("expected close code 1002 for an unmasked frame, got %d", code)
+	}
+	phone.writeFrame(wsOpBinary, []byte{1}, true)
+	if code := phone.closeCode(); code != wsCloseUnsupportedData {
+		t.Errorf("expected close code 1003 for a binary message, got %d", code)
+	}
+	laptop.writeFrame(wsOpText, bytes.Repeat([]byte("a"), wsMaxMessageSize+1), true)
+	if code := laptop.closeCode(); code != wsCloseTooBig {
+		t.Errorf("expected close code 1009 for an oversized message, got %d", code)
+	}
+
+	plain, _ := http.Get(srv.URL + "/api/ws?access_token=" + token)
+	plain.Body.Close()
+	if plain.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a request without upgrade, got %d", plain.StatusCode)
+	}
+}
+
+func TestHandleWebSocket_ClosesWhenSessionIsRevoked(t *testing.T) {
+	interval := wsPingInterval
+	t.Cleanup(func() { wsPingInterval = interval })
+	wsPingInterval = 50 * time.Millisecond
+
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	token := createTestToken(t, db, user.ID)
+	_, sessionID, _ := validateJWT(token)
+	bus := newEventBus(db)
+	defer bus.Close()
+
+	srv := newWebSocketTestServer(t, queryTokenMiddleware(jwtMiddleware(db, handleWebSocket(db, bus, http.NotFoundHandler()))))
+
+	client := dialWebSocket(t, srv, "/api/ws?access_token="+token)
+	if opcode, _ := client.readFrame(); opcode != wsOpPing {
+		t.Fatalf("expected a ping while the session is valid, got opcode %d", opcode)
+	}
+	client.writeFrame(wsOpPong, nil, true)
+	if err := RevokeSession(db, user.ID, sessionID, time.Now()); err != nil {
+		t.Fatalf("RevokeSession failed: %v", err)
+	}
+	if code := client.closeCode(); code != wsClosePolicyViolation {
+		t.Errorf("expected close code 1008 once the session is revoked, got %d", code)
+	}
+}
+
+// createShortLivedToken returns an access token for the session of token that expires in ttl,
+// rounded down to the second.
+func createShortLivedToken(t *testing.T, token string, ttl time.Duration) string {
+	t.Helper()
+	userID, sessionID, _ := validateJWT(token)
+	claims := jwt.MapClaims{"user_id": userID, "sid": sessionID, "exp": time.Now().Add(ttl).Unix()}
+	short, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(getJWTSecret())
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return short
+}
+
+func TestHandleWebSocket_RenewsTokenInBand(t *testing.T) {
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	token := createTestToken(t, db, user.ID)
+	otherSession := createTestToken(t, db, user.ID)
+	short := createShortLivedToken(t, token, 2*time.Second)
+	bus := newEventBus(db)
+	defer bus.Close()
+
+	protected := http.NewServeMux()
+	protected.HandleFunc("GET /api/todos", handleListTodos(db))
+	srv := newWebSocketTestServer(t, queryTokenMiddleware(jwtMiddleware(db, handleWebSocket(db, bus, protected))))
+
+	renewed := dialWebSocket(t, srv, "/api/ws?access_token="+short)
+	late := dialWebSocket(t, srv, "/api/ws?access_token="+short)
+
+	for _, cmd := range []string{
+		`{"id":"a1","type":"auth","token":"` + otherSession + `"}`,
+		`{"id":"a2","type":"auth","token":"garbage"}`,
+	} {
+		if resp, _ := renewed.send(cmd); resp.Status != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401 for a token of another session, got %+v", cmd, resp)
+		}
+	}
+	if resp, _ := renewed.send(`{"id":"a3","type":"auth","token":"` + token + `"}`); resp.ID != "a3" || resp.Status != http.StatusNoContent {
+		t.Fatalf("expected the fresh token to be accepted, got %+v", resp)
+	}
+
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(2100 * time.Millisecond)))
+	if resp, _ := renewed.send(`{"id":"1","method":"GET","path":"/api/todos"}`); resp.Status != http.StatusOK {
+		t.Errorf("expected commands to keep working with the renewed token, got %+v", resp)
+	}
+
+	// Without a fresh token commands are refused, but the connection stays open for one.
+	if resp, _ := late.send(`{"id":"2","method":"GET","path":"/api/todos"}`); resp.Status != http.StatusUnauthorized {
+		t.Errorf("expected 401 once the token has expired, got %+v", resp)
+	}
+	if resp, _ := late.send(`{"id":"a4","type":"auth","token":"` + token + `"}`); resp.Status != http.StatusNoContent {
+		t.Fatalf("expected the fresh token to be accepted after expiry, got %+v", resp)
+	}
+	if resp, _ := late.send(`{"id":"3","method":"GET","path":"/api/todos"}`); resp.Status != http.StatusOK {
+		t.Errorf("expected commands to work again after renewal, got %+v", resp)
+	}
+}
+
+func TestHandleWebSocket_ClosesWhenTokenIsNotRenewed(t *testing.T) {
+	interval, grace := wsPingInterval, wsAuthGracePeriod
+	t.Cleanup(func() { wsPingInterval, wsAuthGracePeriod = interval, grace })
+	wsPingInterval, wsAuthGracePeriod = 50*time.Millisecond, 0
+
+	db := setupTestDB(t)
+	user := createTestUser(t, db, "user@test.com", "hash")
+	short := createShortLivedToken(t, createTestToken(t, db, user.ID), 2*time.Second)
+	bus := newEventBus(db)
+	defer bus.Close()
+
+	srv := newWebSocketTestServer(t, queryTokenMiddleware(jwtMiddleware(db, handleWebSocket(db, bus, http.NotFoundHandler()))))
+
+	client := dialWebSocket(t, srv, "/api/ws?access_token="+short)
+	for {
+		opcode, payload := client.readFrame()
+		if opcode == wsOpPing {
+			client.writeFrame(wsOpPong, nil, true)
+			continue
+		}
+		if opcode != wsOpClose || int(binary.BigEndian.Uint16(payload)) != wsClosePolicyViolation {
+			t.Errorf("expected close code 1008 once the grace period is over, got opcode %d %q", opcode, payload)
+		}
+		return
+	}
+}
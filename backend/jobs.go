@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultTrashRetention is how long soft-deleted todos stay restorable when TRASH_RETENTION_DAYS is unset.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// trashPurgeInterval is how often the purge job runs.
+const trashPurgeInterval = time.Hour
+
+// getTrashRetention reads TRASH_RETENTION_DAYS; invalid or non-positive values fall back to the default.
+func getTrashRetention() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		return DefaultTrashRetention
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// startTrashPurger permanently removes trash older than retention once at startup and then
+// every interval, until ctx is cancelled.
+func startTrashPurger(ctx context.Context, db *sql.DB, retention, interval time.Duration) {
+	runPeriodically(ctx, interval, func() {
+		n, err := PurgeTrash(db, time.Now().Add(-retention))
+		if err != nil {
+			slog.Error("trash purge failed", "error", err)
+			return
+		}
+		if n > 0 {
+			slog.Info("trash purged", "todos", n)
+		}
+	})
+}
+
+// startIdempotencyKeyPurger deletes idempotency keys older than ttl once at startup and then
+// every interval, until ctx is cancelled.
+func startIdempotencyKeyPurger(ctx context.Context, db *sql.DB, ttl, interval time.Duration) {
+	runPeriodically(ctx, interval, func() {
+		n, err := PurgeIdempotencyKeys(db, time.Now().Add(-ttl))
+		if err != nil {
+			slog.Error("idempotency key purge failed", "error", err)
+			return
+		}
+		if n > 0 {
+			slog.Info("idempotency keys purged", "keys", n)
+		}
+	})
+}
+
+// startSessionPurger deletes expired sessions, password reset tokens and stream tickets once at startup
+// and then every interval, until ctx is cancelled.
+func startSessionPurger(ctx context.Context, db *sql.DB, interval time.Duration) {
+	runPeriodically(ctx, interval, func() {
+		now := time.Now()
+		n, err := PurgeSessions(db, now)
+		if err != nil {
+			slog.Error("session purge failed", "error", err)
+			return
+		}
+		resets, err := PurgePasswordResets(db, now)
+		if err != nil {
+			slog.Error("password reset purge failed", "error", err)
+			return
+		}
+		tickets, err := PurgeStreamTickets(db, now)
+		if err != nil {
+			slog.Error("stream ticket purge failed", "error", err)
+			return
+		}
+		if n > 0 || resets > 0 || tickets > 0 {
+			slog.Info("sessions purged", "sessions", n, "password_resets", resets, "stream_tickets", tickets)
+		}
+	})
+}
+
+// runPeriodically calls job in a goroutine once right away and then every interval, until ctx is cancelled.
+func runPeriodically(ctx context.Context, interval time.Duration, job func()) {
+	go func() {
+		job()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				job()
+			}
+		}
+	}()
+}
+
+// Password reset requests wait in a queue of passwordResetQueueSize for one of passwordResetWorkers;
+// requests arriving while it is full are dropped.
+const (
+	passwordResetWorkers   = 2
+	passwordResetQueueSize = 100
+)
+
+// resetQueue runs password reset requests (see requestPasswordReset) after their response has been
+// sent, on a fixed number of workers, so that unauthenticated requests cannot start unbounded work.
+type resetQueue struct {
+	db       *sql.DB
+	mailer   Mailer
+	emails   chan string
+	mu       sync.Mutex
+	closed   bool
+	finished sync.WaitGroup
+}
+
+// newResetQueue starts workers that run the reset requests queued, up to size at a time. Close must
+// be called before db is closed.
+func newResetQueue(db *sql.DB, mailer Mailer, workers, size int) *resetQueue {
+	q := &resetQueue{db: db, mailer: mailer, emails: make(chan string, size)}
+	for range workers {
+		q.finished.Add(1)
+		go func() {
+			defer q.finished.Done()
+			for email := range q.emails {
+				requestPasswordReset(q.db, q.mailer, email)
+			}
+		}()
+	}
+	return q
+}
+
+// Enqueue queues a reset request for email. It never blocks: it returns false, and the request is
+// dropped, if the queue is full or closed.
+func (q *resetQueue) Enqueue(email string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.emails <- email:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting requests and waits for the queued ones to finish. Closing twice is a no-op.
+func (q *resetQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.emails)
+	}
+	q.mu.Unlock()
+	q.finished.Wait()
+}
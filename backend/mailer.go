@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails such as password reset links.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// newMailerFromEnv returns an SMTP mailer when SMTP_HOST is set and a logMailer otherwise, writing
+// to MAIL_DIR if set, for local development.
+func newMailerFromEnv() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return &logMailer{dir: os.Getenv("MAIL_DIR"), from: from}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return &smtpMailer{
+		addr:     net.JoinHostPort(host, port),
+		host:     host,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     from,
+	}
+}
+
+// smtpMailer sends through an SMTP server, with STARTTLS when the server offers it and PLAIN
+// authentication when a username is configured.
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, formatMessage(m.from, msg, time.Now()))
+}
+
+// logMailer logs emails instead of sending them and, if dir is set, also writes each one to a .eml
+// file there.
+type logMailer struct {
+	dir  string
+	from string
+}
+
+func (m *logMailer) Send(msg Message) error {
+	slog.Info("email", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	if m.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := filepath.Join(m.dir, fmt.Sprintf("%d.eml", now.UnixNano()))
+	return os.WriteFile(name, formatMessage(m.from, msg, now), 0o644)
+}
+
+// formatMessage renders msg as an RFC 5322 message from the given sender. Line breaks in header
+// values are removed so that they cannot inject headers.
+func formatMessage(from string, msg Message, now time.Time) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", header.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", header.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", header.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// getAppURL reads APP_URL, the frontend address used in links sent by email.
+func getAppURL() string {
+	if url := os.Getenv("APP_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://localhost:5173"
+}
@@ -20,32 +20,106 @@ func main() {
 	}
 	defer db.Close()
 
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	startTrashPurger(jobsCtx, db, getTrashRetention(), trashPurgeInterval)
+	startIdempotencyKeyPurger(jobsCtx, db, IdempotencyKeyTTL, trashPurgeInterval)
+	startSessionPurger(jobsCtx, db, trashPurgeInterval)
+
+	bus := newEventBus(db)
+	defer bus.Close()
+
+	mailer := newMailerFromEnv()
+	verificationPolicy := getVerificationPolicy()
+
+	// Deferred after db.Close, so it runs first: queued resets finish before the database closes.
+	resets := newResetQueue(db, mailer, passwordResetWorkers, passwordResetQueueSize)
+	defer resets.Close()
+
 	mux := http.NewServeMux()
 
 	// Auth routes (public)
-	mux.HandleFunc("POST /api/auth/register", handleRegister(db))
+	mux.HandleFunc("POST /api/auth/register", handleRegister(db, mailer))
 	mux.HandleFunc("POST /api/auth/login", handleLogin(db))
+	mux.HandleFunc("POST /api/auth/refresh", handleRefresh(db))
+	mux.HandleFunc("POST /api/auth/logout", handleLogout(db))
+	mux.HandleFunc("POST /api/auth/password/reset", handleRequestPasswordReset(resets, newRateLimiter(PasswordResetIPLimit, PasswordResetIPWindow)))
+	mux.HandleFunc("POST /api/auth/password/reset/confirm", handleConfirmPasswordReset(db))
+	mux.HandleFunc("POST /api/auth/verify", handleVerifyEmail(db))
 
-	// Todo and list routes (protected by JWT middleware)
+	// Session, user, todo, search, list, sync and event routes (protected by JWT middleware)
 	protected := http.NewServeMux()
+	protected.HandleFunc("POST /api/auth/password", handleChangePassword(db))
+	protected.HandleFunc("POST /api/auth/verify/resend", handleResendVerification(db, mailer))
+	protected.HandleFunc("POST /api/auth/stream-ticket", handleCreateStreamTicket(db))
+	protected.HandleFunc("GET /api/auth/sessions", handleListSessions(db))
+	protected.HandleFunc("DELETE /api/auth/sessions", handleRevokeAllSessions(db))
+	protected.HandleFunc("DELETE /api/auth/sessions/{id}", handleRevokeSession(db))
+	protected.HandleFunc("GET /api/me", handleGetMe(db))
+	protected.HandleFunc("PATCH /api/me", handleUpdateMe(db))
 	protected.HandleFunc("GET /api/todos", handleListTodos(db))
 	protected.HandleFunc("POST /api/todos", handleCreateTodo(db))
+	protected.HandleFunc("POST /api/todos/reorder", handleReorderTodos(db))
+	protected.HandleFunc("POST /api/todos/bulk", handleBulkTodos(db))
+	protected.HandleFunc("GET /api/todos/{id}", handleGetTodo(db))
 	protected.HandleFunc("PATCH /api/todos/{id}", handleUpdateTodo(db))
 	protected.HandleFunc("PATCH /api/todos/{id}/title", handleUpdateTodoTitle(db))
+	protected.HandleFunc("PATCH /api/todos/{id}/schedule", handleUpdateTodoSchedule(db))
+	protected.HandleFunc("PATCH /api/todos/{id}/priority", handleUpdateTodoPriority(db))
+	protected.HandleFunc("PATCH /api/todos/{id}/notes", handleUpdateTodoNotes(db))
+	protected.HandleFunc("PATCH /api/todos/{id}/recurrence", handleUpdateTodoRecurrence(db))
 	protected.HandleFunc("DELETE /api/todos/{id}", handleDeleteTodo(db))
 	protected.HandleFunc("POST /api/todos/{id}/lists/{listId}", handleAddListToTodo(db))
 	protected.HandleFunc("DELETE /api/todos/{id}/lists/{listId}", handleRemoveListFromTodo(db))
+	protected.HandleFunc("GET /api/todos/{id}/items", handleListTodoItems(db))
+	protected.HandleFunc("POST /api/todos/{id}/items", handleCreateTodoItem(db))
+	protected.HandleFunc("POST /api/todos/{id}/items/reorder", handleReorderTodoItems(db))
+	protected.HandleFunc("PATCH /api/todos/{id}/items/{itemId}", handleUpdateTodoItem(db))
+	protected.HandleFunc("DELETE /api/todos/{id}/items/{itemId}", handleDeleteTodoItem(db))
+	protected.HandleFunc("POST /api/todos/{id}/restore", handleRestoreTodo(db))
+	protected.HandleFunc("GET /api/search", handleSearchTodos(db))
+	protected.HandleFunc("GET /api/smart-lists", handleListSmartLists(db))
+	protected.HandleFunc("POST /api/smart-lists", handleCreateSmartList(db))
+	protected.HandleFunc("GET /api/smart-lists/{id}", handleGetSmartList(db))
+	protected.HandleFunc("PATCH /api/smart-lists/{id}", handleUpdateSmartList(db))
+	protected.HandleFunc("DELETE /api/smart-lists/{id}", handleDeleteSmartList(db))
+	protected.HandleFunc("GET /api/smart-lists/{id}/todos", handleListSmartListTodos(db))
+	protected.HandleFunc("GET /api/trash", handleListTrash(db))
+	protected.HandleFunc("DELETE /api/trash/{id}", handlePurgeTodo(db))
 	protected.HandleFunc("GET /api/lists", handleListLists(db))
 	protected.HandleFunc("POST /api/lists", handleCreateList(db))
+	protected.HandleFunc("PATCH /api/lists/order", handleReorderLists(db))
+	protected.HandleFunc("GET /api/lists/{id}", handleGetList(db))
 	protected.HandleFunc("PATCH /api/lists/{id}", handleUpdateList(db))
 	protected.HandleFunc("DELETE /api/lists/{id}", handleDeleteList(db))
 	protected.HandleFunc("GET /api/lists/{id}/todos", handleListTodosByList(db))
 	protected.HandleFunc("POST /api/lists/{id}/todos", handleCreateTodoInList(db))
+	protected.HandleFunc("POST /api/lists/{id}/todos/reorder", handleReorderListTodos(db))
+	protected.HandleFunc("GET /api/sync", handleSync(db))
+	protected.HandleFunc("POST /api/sync/push", handlePushSync(db))
+	protected.HandleFunc("GET /api/events", handleEvents(db, bus))
 
-	mux.Handle("/api/todos", jwtMiddleware(protected))
-	mux.Handle("/api/todos/", jwtMiddleware(protected))
-	mux.Handle("/api/lists", jwtMiddleware(protected))
-	mux.Handle("/api/lists/", jwtMiddleware(protected))
+	commands := publishMiddleware(bus, verificationMiddleware(db, verificationPolicy, idempotencyMiddleware(db, protected)))
+	api := jwtMiddleware(db, commands)
+	mux.Handle("POST /api/auth/password", api)
+	mux.Handle("POST /api/auth/verify/resend", api)
+	mux.Handle("POST /api/auth/stream-ticket", api)
+	mux.Handle("/api/auth/sessions", api)
+	mux.Handle("/api/auth/sessions/", api)
+	mux.Handle("/api/me", api)
+	mux.Handle("/api/todos", api)
+	mux.Handle("/api/todos/", api)
+	mux.Handle("/api/search", api)
+	mux.Handle("/api/smart-lists", api)
+	mux.Handle("/api/smart-lists/", api)
+	mux.Handle("/api/trash", api)
+	mux.Handle("/api/trash/", api)
+	mux.Handle("/api/lists", api)
+	mux.Handle("/api/lists/", api)
+	mux.Handle("/api/sync", api)
+	mux.Handle("/api/sync/", api)
+	mux.Handle("/api/events", streamTicketMiddleware(db, commands))
+	mux.Handle("GET /api/ws", queryTokenMiddleware(jwtMiddleware(db, verificationMiddleware(db, verificationPolicy, handleWebSocket(db, bus, commands)))))
 
 	handler := loggingMiddleware(corsMiddleware(mux))
 
@@ -53,6 +127,8 @@ func main() {
 		Addr:    ":8080",
 		Handler: handler,
 	}
+	// Event streams and WebSockets never end on their own; closing the bus ends them on shutdown.
+	srv.RegisterOnShutdown(bus.Close)
 
 	go func() {
 		slog.Info("server starting", "port", 8080)
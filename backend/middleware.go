@@ -1,17 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 type contextKey string
 
-const userIDKey contextKey = "user_id"
+const (
+	userIDKey    contextKey = "user_id"
+	sessionIDKey contextKey = "session_id"
+)
 
 // corsMiddleware adds CORS headers to allow requests from the configured origin.
 func corsMiddleware(next http.Handler) http.Handler {
@@ -22,7 +33,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match, If-None-Match, Idempotency-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "Link, ETag, Idempotent-Replayed")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -31,9 +43,9 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// jwtMiddleware validates the JWT token from the Authorization header
-// and injects the user_id into the request context.
-func jwtMiddleware(next http.Handler) http.Handler {
+// jwtMiddleware validates the JWT token from the Authorization header, checks that its session
+// has not been logged out, and injects the user_id and session_id into the request context.
+func jwtMiddleware(db *sql.DB, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -47,23 +59,199 @@ func jwtMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		userID, err := validateJWT(parts[1])
+		userID, sessionID, err := authenticateToken(db, parts[1])
 		if err != nil {
-			writeError(w, http.StatusUnauthorized, "invalid or expired token")
+			if errors.Is(err, ErrInvalidToken) {
+				writeError(w, http.StatusUnauthorized, "invalid or expired token")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to check session")
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		ctx = context.WithValue(ctx, sessionIDKey, sessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// authenticateToken validates an access token and checks its session with TouchSession, returning
+// the user and session IDs. Returns ErrInvalidToken if the token is invalid or its session has ended.
+func authenticateToken(db *sql.DB, token string) (int64, int64, error) {
+	userID, sessionID, err := validateJWT(token)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := TouchSession(db, userID, sessionID, time.Now()); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return 0, 0, ErrInvalidToken
+		}
+		return 0, 0, err
+	}
+	return userID, sessionID, nil
+}
+
+// VerificationPolicy is what accounts whose email is not verified yet may do, set with EMAIL_VERIFICATION.
+type VerificationPolicy string
+
+const (
+	// VerificationOptional lets unverified accounts do everything (the default).
+	VerificationOptional VerificationPolicy = "optional"
+	// VerificationReadOnly lets unverified accounts read their data but not change it.
+	VerificationReadOnly VerificationPolicy = "read_only"
+	// VerificationRequired keeps unverified accounts to the account routes until they verify.
+	VerificationRequired VerificationPolicy = "required"
+)
+
+// getVerificationPolicy reads EMAIL_VERIFICATION; unknown values fall back to VerificationOptional.
+func getVerificationPolicy() VerificationPolicy {
+	switch policy := VerificationPolicy(os.Getenv("EMAIL_VERIFICATION")); policy {
+	case VerificationReadOnly, VerificationRequired:
+		return policy
+	default:
+		return VerificationOptional
+	}
+}
+
+// verificationMiddleware enforces policy on users whose email is not verified, answering 403 to
+// the requests it does not allow. The account routes (/api/me and /api/auth/...) are always
+// allowed, so that such users can resend the verification email or fix their account.
+// Must run inside jwtMiddleware.
+func verificationMiddleware(db *sql.DB, policy VerificationPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accountRoute := r.URL.Path == "/api/me" || strings.HasPrefix(r.URL.Path, "/api/auth/")
+		if policy == VerificationOptional || accountRoute || (policy == VerificationReadOnly && r.Method == http.MethodGet) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := GetUserByID(db, getUserIDFromContext(r))
+		if err != nil {
+			if errors.Is(err, ErrUserNotFound) {
+				writeError(w, http.StatusUnauthorized, "invalid or expired token")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to check email verification")
+			return
+		}
+		if user.EmailVerifiedAt == nil {
+			writeError(w, http.StatusForbidden, "email address not verified")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// queryTokenMiddleware lets clients that cannot set headers, such as browser WebSockets, pass their
+// JWT in the access_token query parameter; it is moved to the Authorization header for jwtMiddleware.
+func queryTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamTicketMiddleware authenticates requests carrying a ?ticket= from POST /api/auth/stream-ticket,
+// using it up, and injects its user_id and session_id into the request context like jwtMiddleware,
+// which handles requests without a ticket.
+func streamTicketMiddleware(db *sql.DB, next http.Handler) http.Handler {
+	withJWT := jwtMiddleware(db, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ticket := r.URL.Query().Get("ticket")
+		if ticket == "" {
+			withJWT.ServeHTTP(w, r)
+			return
+		}
+
+		userID, sessionID, err := RedeemStreamTicket(db, hashToken(ticket), time.Now())
+		if err == nil {
+			err = TouchSession(db, userID, sessionID, time.Now())
+		}
+		if err != nil {
+			if errors.Is(err, ErrInvalidStreamTicket) || errors.Is(err, ErrSessionNotFound) {
+				writeError(w, http.StatusUnauthorized, "invalid or expired stream ticket")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to check stream ticket")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		ctx = context.WithValue(ctx, sessionIDKey, sessionID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// rateLimiter allows each key, such as a client IP, at most limit requests per fixed window.
+// Finished windows are dropped as it goes, so it only holds the keys seen in about one window.
+type rateLimiter struct {
+	limit     int
+	window    time.Duration
+	mu        sync.Mutex
+	hits      map[string]rateWindow
+	lastPrune time.Time
+}
+
+// rateWindow counts the requests of one key since start.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// newRateLimiter returns a limiter allowing limit requests per key every window.
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: make(map[string]rateWindow)}
+}
+
+// Allow records a request for key at now and reports whether it is within the limit. When it is
+// not, it also returns how long until the key's window ends.
+func (l *rateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) >= l.window {
+		for k, w := range l.hits {
+			if now.Sub(w.start) >= l.window {
+				delete(l.hits, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	w, ok := l.hits[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = rateWindow{start: now}
+	}
+	if w.count >= l.limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+	w.count++
+	l.hits[key] = w
+	return true, 0
+}
+
 // getUserIDFromContext extracts the user ID from the request context.
 func getUserIDFromContext(r *http.Request) int64 {
 	userID, _ := r.Context().Value(userIDKey).(int64)
 	return userID
 }
 
+// getSessionIDFromContext extracts the session ID from the request context.
+func getSessionIDFromContext(r *http.Request) int64 {
+	sessionID, _ := r.Context().Value(sessionIDKey).(int64)
+	return sessionID
+}
+
+// clientIP returns the address of the client that sent r, without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // responseRecorder wraps http.ResponseWriter to capture the status code.
 type responseRecorder struct {
 	http.ResponseWriter
@@ -75,6 +263,11 @@ func (rr *responseRecorder) WriteHeader(code int) {
 	rr.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer (e.g. to flush event streams).
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
 // loggingMiddleware logs each request with method, path, status code and duration.
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -89,3 +282,113 @@ func loggingMiddleware(next http.Handler) http.Handler {
 		)
 	})
 }
+
+// Limits applied to POST requests sent with an Idempotency-Key.
+const (
+	maxIdempotencyKeyLength = 255
+	maxIdempotentBodySize   = 1 << 20
+)
+
+// replayedHeaders are the response headers saved and replayed with an idempotent response.
+var replayedHeaders = []string{"Content-Type", "Location", "ETag", "Link"}
+
+// idempotencyRecorder passes a response through while keeping a copy of its status and body.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (ir *idempotencyRecorder) WriteHeader(code int) {
+	ir.statusCode = code
+	ir.ResponseWriter.WriteHeader(code)
+}
+
+func (ir *idempotencyRecorder) Write(b []byte) (int, error) {
+	ir.body.Write(b)
+	return ir.ResponseWriter.Write(b)
+}
+
+// idempotencyMiddleware makes authenticated POST requests carrying an Idempotency-Key header safe to
+// retry: the first response (unless a 5xx) is saved per user and key and replayed, with an
+// Idempotent-Replayed header, for up to IdempotencyKeyTTL. Reusing a key for a different method,
+// path or body is rejected with 422; a retry racing the original request gets 409.
+// Must run inside jwtMiddleware; requests without a user pass straight through. The public auth
+// routes are deliberately not wrapped, and stream tickets pass through: their responses carry
+// credentials, which must not be stored or replayed, and they create nothing a retry could duplicate.
+func idempotencyMiddleware(db *sql.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" || getUserIDFromContext(r) == 0 || r.URL.Path == "/api/auth/stream-ticket" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256([]byte(r.Method + " " + r.URL.RequestURI() + "\n" + string(body)))
+		userID := getUserIDFromContext(r)
+
+		saved, err := ReserveIdempotencyKey(db, userID, key, hex.EncodeToString(sum[:]), time.Now())
+		if err != nil {
+			if errors.Is(err, ErrIdempotencyKeyReused) {
+				writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+				return
+			}
+			if errors.Is(err, ErrIdempotencyKeyInProgress) {
+				writeError(w, http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "failed to check idempotency key")
+			return
+		}
+		if saved != nil {
+			for name, value := range saved.Headers {
+				w.Header().Set(name, value)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(saved.Status)
+			w.Write(saved.Body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if rec.statusCode >= http.StatusInternalServerError {
+			// Server errors are not final: let a retry run the request again.
+			if err := ReleaseIdempotencyKey(db, userID, key); err != nil {
+				slog.Error("failed to release idempotency key", "error", err)
+			}
+			return
+		}
+		resp := IdempotentResponse{Status: rec.statusCode, Headers: make(map[string]string), Body: rec.body.Bytes()}
+		for _, name := range replayedHeaders {
+			if value := w.Header().Get(name); value != "" {
+				resp.Headers[name] = value
+			}
+		}
+		if err := SaveIdempotentResponse(db, userID, key, resp); err != nil {
+			slog.Error("failed to save idempotent response", "error", err)
+		}
+	})
+}
+
+// publishMiddleware notifies the event bus after every request that may have changed data, so that
+// the bus publishes the committed changes once the handler is done with the database.
+func publishMiddleware(bus *eventBus, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			bus.Notify()
+		}
+	})
+}
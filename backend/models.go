@@ -1,30 +1,182 @@
 package main
 
+import "encoding/json"
+
 // Todo represents a task in the to-do list.
 // Lists is the thematic list association; populated when returning from GET /api/todos.
+// DueAt and StartAt are optional UTC timestamps in the same layout as CreatedAt.
+// Priority is one of PriorityLevels. Notes is sanitized Markdown, only populated by GET /api/todos/{id}.
+// Recurrence is a canonical RRULE; completing the todo spawns the next occurrence.
+// Version increases on every change and is served as the todo's ETag.
 type Todo struct {
-	ID        int64   `json:"id"`
-	Title     string  `json:"title"`
-	Completed bool    `json:"completed"`
-	CreatedAt string  `json:"created_at"`
-	UserID    int64   `json:"user_id,omitempty"`
-	DeletedAt *string `json:"deleted_at,omitempty"`
-	Lists     []List  `json:"lists,omitempty"`
+	ID         int64    `json:"id"`
+	Title      string   `json:"title"`
+	Completed  bool     `json:"completed"`
+	CreatedAt  string   `json:"created_at"`
+	UserID     int64    `json:"user_id,omitempty"`
+	DeletedAt  *string  `json:"deleted_at,omitempty"`
+	DueAt      *string  `json:"due_at,omitempty"`
+	StartAt    *string  `json:"start_at,omitempty"`
+	Priority   string   `json:"priority"`
+	Notes      *string  `json:"notes,omitempty"`
+	Recurrence *string  `json:"recurrence,omitempty"`
+	Version    int64    `json:"version"`
+	UpdatedAt  string   `json:"updated_at"`
+	Progress   Progress `json:"progress"`
+	Lists      []List   `json:"lists,omitempty"`
+}
+
+// Progress summarizes a todo's checklist: Done of Total items completed.
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// TodoItem is a checklist entry inside a todo, ordered by Position.
+type TodoItem struct {
+	ID        int64  `json:"id"`
+	TodoID    int64  `json:"todo_id"`
+	Title     string `json:"title"`
+	Completed bool   `json:"completed"`
+	Position  int    `json:"position"`
+	CreatedAt string `json:"created_at"`
 }
 
 // List represents a thematic list that can be associated with todos.
+// Version increases on every change and is served as the list's ETag.
 type List struct {
 	ID        int64  `json:"id"`
 	Name      string `json:"name"`
 	Color     string `json:"color"`
 	CreatedAt string `json:"created_at"`
 	UserID    int64  `json:"user_id,omitempty"`
+	Position  int    `json:"position"`
+	Pinned    bool   `json:"pinned"`
+	Version   int64  `json:"version"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// SmartList is a saved todo filter whose contents are computed on read.
+// Filter uses the GET /api/todos query syntax, e.g. "completed=false&due_to=week_end".
+type SmartList struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Filter    string `json:"filter"`
+	CreatedAt string `json:"created_at"`
+	UserID    int64  `json:"user_id,omitempty"`
 }
 
-// User represents a registered user.
+// User represents a registered user. EmailVerifiedAt is null until the user follows the link
+// emailed on registration.
 type User struct {
-	ID           int64  `json:"id"`
-	Email        string `json:"email"`
-	PasswordHash string `json:"-"`
-	CreatedAt    string `json:"created_at"`
+	ID              int64   `json:"id"`
+	Email           string  `json:"email"`
+	PasswordHash    string  `json:"-"`
+	CreatedAt       string  `json:"created_at"`
+	Timezone        string  `json:"timezone"`
+	EmailVerifiedAt *string `json:"email_verified_at"`
+}
+
+// Session is a login of a user, kept alive by rotating its refresh token. Times are UTC in the
+// CreatedAt layout; RevokedAt is set once it is logged out or its refresh token is reused.
+// UserAgent is the one that logged in and IP the last one to refresh. Current marks, in
+// GET /api/auth/sessions, the session of the request.
+type Session struct {
+	ID         int64   `json:"id"`
+	UserID     int64   `json:"user_id,omitempty"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt string  `json:"last_used_at"`
+	ExpiresAt  string  `json:"expires_at"`
+	RevokedAt  *string `json:"revoked_at,omitempty"`
+	UserAgent  string  `json:"user_agent"`
+	IP         string  `json:"ip"`
+	Current    bool    `json:"current"`
+}
+
+// AuthTokens is returned by register, login and refresh: an access token valid for ExpiresIn seconds
+// and the refresh token that renews it. Each refresh token can be used once.
+type AuthTokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// StreamTicket is returned by POST /api/auth/stream-ticket: a single-use ticket that opens one event
+// stream within ExpiresIn seconds.
+type StreamTicket struct {
+	Ticket    string `json:"ticket"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// SearchResult is a todo matched by full-text search, with an HTML snippet of the best-matching text.
+type SearchResult struct {
+	Todo
+	Snippet string `json:"snippet"`
+}
+
+// BulkResult is the outcome of a bulk action for one todo: Status is the HTTP status the matching
+// single-todo request would have returned, with Error set when it failed.
+type BulkResult struct {
+	ID     int64  `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SyncChanges is the response of GET /api/sync: what changed since the client's change token, and
+// the token to send next time. Deleted holds tombstones of hard-deleted rows.
+type SyncChanges struct {
+	Token     string         `json:"token"`
+	Todos     []Todo         `json:"todos"`
+	Lists     []List         `json:"lists"`
+	TodoLists []TodoListLink `json:"todo_lists"`
+	Deleted   SyncTombstones `json:"deleted"`
+}
+
+// SyncTombstones identifies rows deleted since a change token.
+type SyncTombstones struct {
+	Todos     []int64        `json:"todos"`
+	Lists     []int64        `json:"lists"`
+	TodoLists []TodoListLink `json:"todo_lists"`
+}
+
+// TodoListLink is a todo's membership in a list.
+type TodoListLink struct {
+	TodoID int64 `json:"todo_id"`
+	ListID int64 `json:"list_id"`
+}
+
+// SyncPushResult is the outcome of one operation of POST /api/sync/push: its status and error, and the
+// server's state of the todo it targeted after the whole batch (absent if the todo no longer exists).
+type SyncPushResult struct {
+	ClientID string `json:"client_id,omitempty"`
+	ID       int64  `json:"id,omitempty"`
+	Status   int    `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Todo     *Todo  `json:"todo,omitempty"`
+}
+
+// SocketCommand is a message sent to /api/ws: a REST request to run as the connected user, answered
+// by a SocketMessage of type "response" carrying the same ID. A command of Type "auth" instead
+// replaces the connection's access token with Token, a fresh one for the same session.
+type SocketCommand struct {
+	ID      string            `json:"id"`
+	Type    string            `json:"type,omitempty"`
+	Token   string            `json:"token,omitempty"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// SocketMessage is a message sent by /api/ws: the response to a SocketCommand (Type "response"),
+// or a change to the user's data (Type "event", as served by GET /api/events).
+type SocketMessage struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+	Event   string            `json:"event,omitempty"`
+	EventID int64             `json:"event_id,omitempty"`
+	Data    any               `json:"data,omitempty"`
 }
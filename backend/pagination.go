@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Page size bounds for cursor pagination.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+var (
+	ErrInvalidLimit  = errors.New("limit must be between 1 and 200")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Page requests one page of a keyset-paginated query. A zero Limit returns every row (no pagination);
+// Cursor is the next cursor returned with the previous page, empty for the first page.
+type Page struct {
+	Limit  int
+	Cursor string
+}
+
+// sortKey is one ORDER BY term. Expressions must never be NULL so keyset comparisons stay total;
+// nullable columns are split into an IS NULL key plus a COALESCE key.
+type sortKey struct {
+	expr string
+	desc bool
+}
+
+// orderByClause renders keys as an ORDER BY expression list.
+func orderByClause(keys []sortKey) string {
+	terms := make([]string, len(keys))
+	for i, k := range keys {
+		dir := " ASC"
+		if k.desc {
+			dir = " DESC"
+		}
+		terms[i] = k.expr + dir
+	}
+	return strings.Join(terms, ", ")
+}
+
+// keyExprs renders keys as a SELECT list, so each row carries the values its cursor is built from.
+func keyExprs(keys []sortKey) string {
+	exprs := make([]string, len(keys))
+	for i, k := range keys {
+		exprs[i] = k.expr
+	}
+	return strings.Join(exprs, ", ")
+}
+
+// keysetCondition returns a WHERE condition selecting the rows that sort strictly after values
+// under keys: (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ..., with < for descending keys. Key expressions
+// are parenthesized since comparison operators bind tighter than IS.
+func keysetCondition(keys []sortKey, values []any) (string, []any) {
+	var clauses []string
+	var args []any
+	for i, k := range keys {
+		var terms []string
+		for j := 0; j < i; j++ {
+			terms = append(terms, "("+keys[j].expr+") = ?")
+			args = append(args, values[j])
+		}
+		op := " > ?"
+		if k.desc {
+			op = " < ?"
+		}
+		terms = append(terms, "("+k.expr+")"+op)
+		args = append(args, values[i])
+		clauses = append(clauses, "("+strings.Join(terms, " AND ")+")")
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// cursorPayload is the decoded form of an opaque cursor: the ordering it was issued for and the
+// sort key values of the last row of the page.
+type cursorPayload struct {
+	Order  string `json:"o"`
+	Values []any  `json:"v"`
+}
+
+// encodeCursor builds the opaque cursor continuing after a row with the given key values.
+func encodeCursor(order string, values []any) string {
+	for i, v := range values {
+		// Drivers may return TEXT as []byte; keep cursors readable as JSON strings.
+		if b, ok := v.([]byte); ok {
+			values[i] = string(b)
+		}
+	}
+	data, _ := json.Marshal(cursorPayload{Order: order, Values: values})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns the key values stored in cursor. Returns ErrInvalidCursor if it is malformed,
+// was issued for another ordering, or does not hold one value per key.
+func decodeCursor(cursor string, order string, keys int) ([]any, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	var payload cursorPayload
+	if err := dec.Decode(&payload); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if payload.Order != order || len(payload.Values) != keys {
+		return nil, ErrInvalidCursor
+	}
+
+	for i, v := range payload.Values {
+		switch v := v.(type) {
+		case json.Number:
+			n, err := v.Int64()
+			if err != nil {
+				return nil, ErrInvalidCursor
+			}
+			payload.Values[i] = n
+		case string, bool:
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+	return payload.Values, nil
+}
+
+// paginate applies page to a query ordered by keys. It returns the extra WHERE condition (empty on
+// the first page), its arguments, and the LIMIT to use (one more than the page size, so callers can
+// tell whether a next page exists; 0 when not paginating).
+func paginate(keys []sortKey, order string, page Page) (string, []any, int, error) {
+	if page.Limit == 0 && page.Cursor == "" {
+		return "", nil, 0, nil
+	}
+	limit := page.Limit
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	if limit < 0 || limit > MaxPageSize {
+		return "", nil, 0, ErrInvalidLimit
+	}
+	if page.Cursor == "" {
+		return "", nil, limit + 1, nil
+	}
+
+	values, err := decodeCursor(page.Cursor, order, len(keys))
+	if err != nil {
+		return "", nil, 0, err
+	}
+	cond, args := keysetCondition(keys, values)
+	return cond, args, limit + 1, nil
+}
+
+// nextCursor trims a fetched page of limit+1 rows down to the page size and returns the cursor for the
+// following page, or "" when this is the last one. keyValues holds each row's sort key values.
+func nextCursor(order string, limit int, keyValues [][]any) (int, string) {
+	if limit == 0 || len(keyValues) < limit {
+		return len(keyValues), ""
+	}
+	size := limit - 1
+	return size, encodeCursor(order, keyValues[size-1])
+}
@@ -0,0 +1,172 @@
+package main
+
+import "strings"
+
+// rankDigits is the base-62 alphabet of position ranks, in ascending byte order so that SQLite's
+// default BINARY collation sorts ranks correctly.
+const rankDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// A rank is an integer part followed by an optional fraction. The integer's head character encodes
+// its length ('a'..'z' for 2..27 characters counting upwards, 'Z'..'A' for 2..27 counting downwards),
+// so prepending or appending only increments or decrements the integer and ranks stay short even
+// when every new todo goes to the top. The fraction gives room between two adjacent integers.
+
+// rankBetween returns a rank that sorts strictly between lower and upper, where an empty lower
+// means "before everything" and an empty upper "after everything". Ranks are fractional: there is
+// always room between two of them, so moving an item only rewrites that item's rank.
+// lower and upper must be ranks produced by rankBetween, with lower sorting before upper.
+func rankBetween(lower, upper string) string {
+	switch {
+	case lower == "" && upper == "":
+		return "a" + rankDigits[:1]
+	case lower == "":
+		integer := rankInteger(upper)
+		if integer < upper {
+			return integer
+		}
+		if prev, ok := rankDecrement(integer); ok {
+			return prev
+		}
+		return integer + rankMidpoint("", upper[len(integer):])
+	case upper == "":
+		integer := rankInteger(lower)
+		if next, ok := rankIncrement(integer); ok {
+			return next
+		}
+		return integer + rankMidpoint(lower[len(integer):], "")
+	}
+
+	lowerInt, upperInt := rankInteger(lower), rankInteger(upper)
+	if lowerInt == upperInt {
+		return lowerInt + rankMidpoint(lower[len(lowerInt):], upper[len(upperInt):])
+	}
+	if next, ok := rankIncrement(lowerInt); ok && next < upper {
+		return next
+	}
+	return lowerInt + rankMidpoint(lower[len(lowerInt):], "")
+}
+
+// rankMidpoint returns a fraction strictly between the fractions lower and upper ("" upper means
+// unbounded). Fractions never end in '0', which keeps a midpoint always available.
+func rankMidpoint(lower, upper string) string {
+	if upper != "" {
+		// Keep the common prefix (lower is padded with '0') and recurse on the remainder.
+		n := 0
+		for n < len(upper) && rankDigitAt(lower, n) == upper[n] {
+			n++
+		}
+		if n > 0 {
+			rest := ""
+			if n < len(lower) {
+				rest = lower[n:]
+			}
+			return upper[:n] + rankMidpoint(rest, upper[n:])
+		}
+	}
+
+	lo := 0
+	if lower != "" {
+		lo = strings.IndexByte(rankDigits, lower[0])
+	}
+	hi := len(rankDigits)
+	if upper != "" {
+		hi = strings.IndexByte(rankDigits, upper[0])
+	}
+
+	if hi-lo > 1 {
+		return string(rankDigits[(lo+hi+1)/2])
+	}
+	// Adjacent first digits: a longer upper can be cut to its first digit, which is still above lower.
+	if len(upper) > 1 {
+		return upper[:1]
+	}
+	rest := ""
+	if len(lower) > 1 {
+		rest = lower[1:]
+	}
+	return string(rankDigits[lo]) + rankMidpoint(rest, "")
+}
+
+// rankDigitAt returns the digit of rank at i, treating missing trailing digits as '0'.
+func rankDigitAt(rank string, i int) byte {
+	if i < len(rank) {
+		return rank[i]
+	}
+	return rankDigits[0]
+}
+
+// rankIntegerLength returns the length of the integer part announced by a rank's head character.
+func rankIntegerLength(head byte) int {
+	switch {
+	case head >= 'a' && head <= 'z':
+		return int(head-'a') + 2
+	case head >= 'A' && head <= 'Z':
+		return int('Z'-head) + 2
+	default:
+		return 1
+	}
+}
+
+// rankInteger returns the integer part of a rank.
+func rankInteger(rank string) string {
+	return rank[:min(rankIntegerLength(rank[0]), len(rank))]
+}
+
+// rankIncrement returns the integer following integer, growing it by a digit when a head boundary
+// is crossed. It returns false once the largest integer is reached.
+func rankIncrement(integer string) (string, bool) {
+	head, digits := integer[0], []byte(integer[1:])
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := strings.IndexByte(rankDigits, digits[i]) + 1
+		if d < len(rankDigits) {
+			digits[i] = rankDigits[d]
+			return string(head) + string(digits), true
+		}
+		digits[i] = rankDigits[0]
+	}
+
+	// Carry out of the head.
+	switch head {
+	case 'Z':
+		return "a" + rankDigits[:1], true
+	case 'z':
+		return "", false
+	}
+	head++
+	if head > 'a' {
+		digits = append(digits, rankDigits[0])
+	} else {
+		digits = digits[:len(digits)-1]
+	}
+	return string(head) + string(digits), true
+}
+
+// rankDecrement returns the integer preceding integer, growing it by a digit when a head boundary
+// is crossed. It returns false once the smallest integer is reached.
+func rankDecrement(integer string) (string, bool) {
+	last := rankDigits[len(rankDigits)-1]
+	head, digits := integer[0], []byte(integer[1:])
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := strings.IndexByte(rankDigits, digits[i]) - 1
+		if d >= 0 {
+			digits[i] = rankDigits[d]
+			return string(head) + string(digits), true
+		}
+		digits[i] = last
+	}
+
+	// Borrow from the head.
+	switch head {
+	case 'a':
+		return "Z" + string(last), true
+	case 'A':
+		return "", false
+	}
+	head--
+	if head < 'Z' {
+		digits = append(digits, last)
+	} else {
+		digits = digits[:len(digits)-1]
+	}
+	return string(head) + string(digits), true
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidRecurrence = errors.New("recurrence must be a supported RRULE")
+)
+
+// Recurrence frequencies supported by ParseRecurrence.
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+)
+
+// maxRecurrenceSearchDays bounds the day-by-day search for the next occurrence.
+const maxRecurrenceSearchDays = 3660
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// recurrenceShorthands maps the preset names accepted by the API to full rules.
+var recurrenceShorthands = map[string]string{
+	"daily":   "FREQ=DAILY",
+	"weekly":  "FREQ=WEEKLY",
+	"monthly": "FREQ=MONTHLY",
+	"yearly":  "FREQ=YEARLY",
+}
+
+// WeekdayRule is a BYDAY entry. Ordinal is 0 for "every", or the nth (negative: from the end)
+// weekday of the month for MONTHLY rules.
+type WeekdayRule struct {
+	Ordinal int
+	Weekday time.Weekday
+}
+
+// Recurrence is the supported subset of an iCalendar RRULE (RFC 5545):
+// FREQ, INTERVAL, BYDAY (WEEKLY/MONTHLY), BYMONTHDAY (MONTHLY), COUNT and UNTIL.
+type Recurrence struct {
+	Freq       string
+	Interval   int
+	ByDay      []WeekdayRule
+	ByMonthDay []int
+	Count      int
+	Until      *time.Time
+}
+
+// ParseRecurrence parses an RRULE such as "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE" (an optional
+// "RRULE:" prefix is accepted) or one of the shorthands daily, weekly, monthly and yearly.
+// Returns ErrInvalidRecurrence for malformed or unsupported rules.
+func ParseRecurrence(rule string) (Recurrence, error) {
+	s := strings.TrimSpace(rule)
+	if full, ok := recurrenceShorthands[strings.ToLower(s)]; ok {
+		s = full
+	}
+	s = strings.TrimPrefix(strings.ToUpper(s), "RRULE:")
+
+	r := Recurrence{Interval: 1}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" || seen[key] {
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+		seen[key] = true
+
+		switch key {
+		case "FREQ":
+			switch value {
+			case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+				r.Freq = value
+			default:
+				return Recurrence{}, ErrInvalidRecurrence
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 1000 {
+				return Recurrence{}, ErrInvalidRecurrence
+			}
+			r.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return Recurrence{}, ErrInvalidRecurrence
+			}
+			r.Count = n
+		case "UNTIL":
+			until, err := parseRRuleUntil(value)
+			if err != nil {
+				return Recurrence{}, err
+			}
+			r.Until = &until
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				wr, err := parseWeekdayRule(day)
+				if err != nil {
+					return Recurrence{}, err
+				}
+				r.ByDay = append(r.ByDay, wr)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(day)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return Recurrence{}, ErrInvalidRecurrence
+				}
+				r.ByMonthDay = append(r.ByMonthDay, n)
+			}
+		default:
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+	}
+
+	if r.Freq == "" || (r.Count > 0 && r.Until != nil) {
+		return Recurrence{}, ErrInvalidRecurrence
+	}
+	if len(r.ByDay) > 0 && r.Freq != FreqWeekly && r.Freq != FreqMonthly {
+		return Recurrence{}, ErrInvalidRecurrence
+	}
+	if len(r.ByMonthDay) > 0 && r.Freq != FreqMonthly {
+		return Recurrence{}, ErrInvalidRecurrence
+	}
+	for _, wr := range r.ByDay {
+		if wr.Ordinal != 0 && r.Freq != FreqMonthly {
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+	}
+
+	return r, nil
+}
+
+// parseRRuleUntil accepts the RFC 5545 forms 20261231T235959Z and 20261231 (end of that UTC day).
+func parseRRuleUntil(value string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("20060102", value)
+	if err != nil {
+		return time.Time{}, ErrInvalidRecurrence
+	}
+	return t.AddDate(0, 0, 1).Add(-time.Second), nil
+}
+
+// parseWeekdayRule parses a BYDAY entry such as "MO", "2TU" or "-1FR".
+func parseWeekdayRule(value string) (WeekdayRule, error) {
+	if len(value) < 2 {
+		return WeekdayRule{}, ErrInvalidRecurrence
+	}
+	weekday, ok := rruleWeekdays[value[len(value)-2:]]
+	if !ok {
+		return WeekdayRule{}, ErrInvalidRecurrence
+	}
+	wr := WeekdayRule{Weekday: weekday}
+	if prefix := value[:len(value)-2]; prefix != "" {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return WeekdayRule{}, ErrInvalidRecurrence
+		}
+		wr.Ordinal = n
+	}
+	return wr, nil
+}
+
+// String formats the rule in canonical RRULE form (without the "RRULE:" prefix).
+func (r Recurrence) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, wr := range r.ByDay {
+			days[i] = wr.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		days := make([]string, len(r.ByMonthDay))
+		for i, d := range r.ByMonthDay {
+			days[i] = strconv.Itoa(d)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.Until != nil {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// String formats a BYDAY entry, e.g. "MO" or "-1FR".
+func (wr WeekdayRule) String() string {
+	for code, weekday := range rruleWeekdays {
+		if weekday == wr.Weekday {
+			if wr.Ordinal != 0 {
+				return strconv.Itoa(wr.Ordinal) + code
+			}
+			return code
+		}
+	}
+	return ""
+}
+
+// Next returns the first occurrence strictly after the given one, keeping its wall-clock time in loc.
+// The second result is false when the series has ended (COUNT exhausted or past UNTIL).
+// The period containing after is treated as the rule's first period, so INTERVAL is counted from it.
+func (r Recurrence) Next(after time.Time, loc *time.Location) (time.Time, bool) {
+	if r.Count == 1 {
+		return time.Time{}, false
+	}
+
+	local := after.In(loc)
+	var next time.Time
+	var found bool
+	switch {
+	case r.Freq == FreqDaily:
+		next, found = local.AddDate(0, 0, r.Interval), true
+	case r.Freq == FreqYearly:
+		next, found = r.nextYearly(local)
+	default:
+		next, found = r.nextByDay(local, loc)
+	}
+
+	if !found || (r.Until != nil && next.After(*r.Until)) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// Successor returns the rule to carry on the next occurrence (COUNT decremented).
+func (r Recurrence) Successor() Recurrence {
+	if r.Count > 1 {
+		r.Count--
+	}
+	return r
+}
+
+// nextYearly advances whole years, skipping years where the date does not exist (Feb 29).
+func (r Recurrence) nextYearly(local time.Time) (time.Time, bool) {
+	for years := r.Interval; years <= 400; years += r.Interval {
+		candidate := time.Date(local.Year()+years, local.Month(), local.Day(),
+			local.Hour(), local.Minute(), local.Second(), 0, local.Location())
+		if candidate.Day() == local.Day() {
+			return candidate, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// nextByDay scans forward day by day for WEEKLY and MONTHLY rules.
+// Without BYDAY/BYMONTHDAY the weekday or day of month of local is used.
+func (r Recurrence) nextByDay(local time.Time, loc *time.Location) (time.Time, bool) {
+	byDay := r.ByDay
+	byMonthDay := r.ByMonthDay
+	if len(byDay) == 0 && len(byMonthDay) == 0 {
+		if r.Freq == FreqWeekly {
+			byDay = []WeekdayRule{{Weekday: local.Weekday()}}
+		} else {
+			byMonthDay = []int{local.Day()}
+		}
+	}
+
+	startDay := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	for offset := 1; offset <= maxRecurrenceSearchDays*r.Interval; offset++ {
+		day := startDay.AddDate(0, 0, offset)
+		if r.periodsBetween(startDay, day)%r.Interval != 0 {
+			continue
+		}
+		if !matchesByDay(day, byDay) || !matchesByMonthDay(day, byMonthDay) {
+			continue
+		}
+		return time.Date(day.Year(), day.Month(), day.Day(),
+			local.Hour(), local.Minute(), local.Second(), 0, loc), true
+	}
+	return time.Time{}, false
+}
+
+// periodsBetween counts whole weeks (Monday-based) or calendar months from a to b.
+func (r Recurrence) periodsBetween(a, b time.Time) int {
+	if r.Freq == FreqWeekly {
+		return int(weekStart(b).Sub(weekStart(a)).Hours() / (24 * 7))
+	}
+	return (b.Year()-a.Year())*12 + int(b.Month()) - int(a.Month())
+}
+
+// weekStart returns the Monday of the week containing day (a UTC midnight).
+func weekStart(day time.Time) time.Time {
+	offset := (int(day.Weekday()) + 6) % 7
+	return day.AddDate(0, 0, -offset)
+}
+
+// matchesByDay reports whether day satisfies any BYDAY entry; an empty list matches every day.
+func matchesByDay(day time.Time, rules []WeekdayRule) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	daysInMonth := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, wr := range rules {
+		if wr.Weekday != day.Weekday() {
+			continue
+		}
+		switch {
+		case wr.Ordinal == 0:
+			return true
+		case wr.Ordinal > 0 && (day.Day()-1)/7+1 == wr.Ordinal:
+			return true
+		case wr.Ordinal < 0 && (daysInMonth-day.Day())/7+1 == -wr.Ordinal:
+			return true
+		}
+	}
+	return false
+}
+
+// matchesByMonthDay reports whether day satisfies any BYMONTHDAY entry (negative counts from
+// the end of the month); an empty list matches every day.
+func matchesByMonthDay(day time.Time, monthDays []int) bool {
+	if len(monthDays) == 0 {
+		return true
+	}
+	daysInMonth := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, d := range monthDays {
+		if d > 0 && d == day.Day() {
+			return true
+		}
+		if d < 0 && daysInMonth+d+1 == day.Day() {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeRecurrence validates a rule and returns its canonical form; empty means no recurrence.
+func normalizeRecurrence(rule string) (*string, error) {
+	if strings.TrimSpace(rule) == "" {
+		return nil, nil
+	}
+	r, err := ParseRecurrence(rule)
+	if err != nil {
+		return nil, err
+	}
+	s := r.String()
+	return &s, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	// htmlTagPattern matches raw HTML tags and comments; Markdown autolinks such as
+	// <https://example.com> do not match because the scheme is followed by ':'.
+	htmlTagPattern = regexp.MustCompile(`(?s)<!--.*?-->|</?[a-zA-Z][a-zA-Z0-9-]*(\s[^>]*)?/?>`)
+
+	// unsafeAutolinkPattern matches autolinks with script-capable schemes.
+	unsafeAutolinkPattern = regexp.MustCompile(`(?i)<\s*(javascript|vbscript|data):[^>]*>`)
+
+	// safeAutolinkPattern matches the autolinks kept as they are; every other '<' is escaped.
+	safeAutolinkPattern = regexp.MustCompile(`(?i)<(https?|mailto|tel):[^\s<>]*>`)
+
+	// urlSchemePattern matches a URL scheme, as opposed to a relative path containing ':'.
+	urlSchemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*$`)
+)
+
+// safeLinkSchemes are the URL schemes allowed in link destinations.
+var safeLinkSchemes = map[string]bool{"http": true, "https": true, "mailto": true, "tel": true}
+
+// sanitizeNotes makes user-supplied Markdown safe to render: it normalizes line endings,
+// drops control characters, strips raw HTML, neutralizes links whose scheme is not http, https,
+// mailto or tel, and escapes any '<' left over, so no HTML survives (not even inside code, where
+// it shows as &lt;). Plain Markdown syntax is preserved.
+func sanitizeNotes(notes string) string {
+	s := strings.ReplaceAll(notes, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\n' && r != '\t' {
+			return -1
+		}
+		if r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+	// Strip until nothing changes, so that removing one tag cannot join the pieces of another
+	// (as in <scr<script>ipt>).
+	for {
+		stripped := htmlTagPattern.ReplaceAllString(s, "")
+		stripped = unsafeAutolinkPattern.ReplaceAllString(stripped, "")
+		if stripped == s {
+			break
+		}
+		s = stripped
+	}
+	s = neutralizeLinkDestinations(s)
+	s = escapeAngleBrackets(s)
+	return strings.TrimSpace(s)
+}
+
+// neutralizeLinkDestinations replaces the destination of every inline link or image ("](dest)")
+// and link reference definition ("]: dest") that is not a safe URL with "#".
+func neutralizeLinkDestinations(s string) string {
+	var b strings.Builder
+	last := 0
+	for i := 0; i+1 < len(s); i++ {
+		if s[i] != ']' || (s[i+1] != '(' && s[i+1] != ':') {
+			continue
+		}
+		inline := s[i+1] == '('
+		start, end := linkDestination(s, i+2, inline)
+		if isSafeLinkDestination(s[start:end]) {
+			continue
+		}
+		if inline {
+			// The whitespace before the destination goes too: "]( data:...)" becomes "](#)".
+			start = i + 2
+		}
+		b.WriteString(s[last:start])
+		b.WriteString("#")
+		last = end
+		i = end - 1
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// linkDestination returns the bounds of the link destination following position i, after spaces
+// and at most one line break: either <...> or a run of non-space characters which, for inline links,
+// ends at an unbalanced ')'.
+func linkDestination(s string, i int, inline bool) (int, int) {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	if i < len(s) && s[i] == '\n' {
+		i++
+	}
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	start := i
+	if i < len(s) && s[i] == '<' {
+		if end := strings.IndexAny(s[i+1:], ">\n"); end >= 0 && s[i+1+end] == '>' {
+			return start, i + end + 2
+		}
+	}
+
+	depth := 0
+	for ; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			return start, i
+		case c == '\\' && i+1 < len(s):
+			i++
+		case c == '(' && inline:
+			depth++
+		case c == ')' && inline:
+			if depth == 0 {
+				return start, i
+			}
+			depth--
+		}
+	}
+	return start, i
+}
+
+// isSafeLinkDestination reports whether a link destination is relative or uses a safe scheme.
+// It decodes entities and drops backslashes, whitespace and control characters first, as renderers
+// and browsers would, so that "java&#115;cript:" or "java\tscript:" are caught.
+func isSafeLinkDestination(dest string) bool {
+	u := strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+	u = strings.Map(func(r rune) rune {
+		if r <= 0x20 || r == 0x7f || r == '\\' {
+			return -1
+		}
+		return r
+	}, html.UnescapeString(u))
+	scheme, _, ok := strings.Cut(u, ":")
+	if !ok || !urlSchemePattern.MatchString(scheme) {
+		return true
+	}
+	return safeLinkSchemes[strings.ToLower(scheme)]
+}
+
+// escapeAngleBrackets escapes every '<' outside safe autolinks as &lt;.
+func escapeAngleBrackets(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range safeAutolinkPattern.FindAllStringIndex(s, -1) {
+		b.WriteString(strings.ReplaceAll(s[last:m[0]], "<", "&lt;"))
+		b.WriteString(s[m[0]:m[1]])
+		last = m[1]
+	}
+	b.WriteString(strings.ReplaceAll(s[last:], "<", "&lt;"))
+	return b.String()
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// websocketGUID is appended to the client key to compute Sec-WebSocket-Accept (RFC 6455, 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// WebSocket close codes.
+const (
+	wsCloseNormal          = 1000
+	wsCloseGoingAway       = 1001
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseInvalidPayload  = 1007
+	wsClosePolicyViolation = 1008
+	wsCloseTooBig          = 1009
+	wsCloseTryAgainLater   = 1013
+)
+
+// Connection limits: messages larger than wsMaxMessageSize are refused and a peer that does not
+// take a frame within wsWriteTimeout is dropped.
+const (
+	wsMaxMessageSize = 1 << 20
+	wsWriteTimeout   = 10 * time.Second
+)
+
+// wsPingInterval is how often a connection is pinged (and its session and token checked again). A
+// peer silent for two intervals, which it would not be if it answered the pings, is dropped.
+var wsPingInterval = 30 * time.Second
+
+// wsAuthGracePeriod is how long a connection stays open after its access token expires, waiting
+// for the client to send a fresh one with an auth command.
+var wsAuthGracePeriod = time.Minute
+
+// errWebSocketClosed is returned by readMessage once the peer has closed the connection.
+var errWebSocketClosed = errors.New("websocket closed")
+
+// wsCloseError is a protocol violation by the peer; the connection is closed with its code.
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return "websocket: " + e.reason
+}
+
+// wsConn is the server side of a WebSocket connection. readMessage must be called from a single
+// goroutine; writes may come from several.
+type wsConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// upgradeWebSocket completes the opening handshake of a WebSocket request and takes over its
+// connection. On failure it has already written the HTTP error response.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		writeError(w, http.StatusBadRequest, "expected a WebSocket upgrade request")
+		return nil, errors.New("not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, http.StatusUpgradeRequired, "unsupported WebSocket version")
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		writeError(w, http.StatusBadRequest, "invalid Sec-WebSocket-Key")
+		return nil, errors.New("invalid websocket key")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "WebSocket not supported")
+		return nil, err
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: rw.Reader}, nil
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value answering key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether the comma-separated header name contains token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text or binary message, reassembling fragments. Pings are answered
+// and pongs skipped along the way. It returns errWebSocketClosed once the peer closes (after
+// echoing its close frame) and a *wsCloseError when the peer breaks the protocol.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		fin, op, payload, err := c.readFrame(wsMaxMessageSize - len(message))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.writeClose(code, "")
+			return 0, nil, errWebSocketClosed
+		case wsOpText, wsOpBinary:
+			if opcode != 0 {
+				return 0, nil, &wsCloseError{wsCloseProtocolError, "new message inside a fragmented one"}
+			}
+			opcode = op
+		case wsOpContinuation:
+			if opcode == 0 {
+				return 0, nil, &wsCloseError{wsCloseProtocolError, "continuation without a message"}
+			}
+		default:
+			return 0, nil, &wsCloseError{wsCloseProtocolError, "unknown opcode"}
+		}
+
+		message = append(message, payload...)
+		if fin {
+			if opcode == wsOpText && !utf8.Valid(message) {
+				return 0, nil, &wsCloseError{wsCloseInvalidPayload, "text message is not valid UTF-8"}
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads and unmasks one frame whose payload may hold at most limit bytes.
+func (c *wsConn) readFrame(limit int) (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op := head[0]&0x80 != 0, head[0]&0x0F
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "reserved bits set"}
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "client frames must be masked"}
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (!fin || length > 125) {
+		return false, 0, nil, &wsCloseError{wsCloseProtocolError, "invalid control frame"}
+	}
+	if length > uint64(limit) {
+		return false, 0, nil, &wsCloseError{wsCloseTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame sends payload as a single unmasked frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	var frame bytes.Buffer
+	frame.WriteByte(0x80 | opcode)
+	switch n := len(payload); {
+	case n < 126:
+		frame.WriteByte(byte(n))
+	case n <= 0xFFFF:
+		frame.WriteByte(126)
+		binary.Write(&frame, binary.BigEndian, uint16(n))
+	default:
+		frame.WriteByte(127)
+		binary.Write(&frame, binary.BigEndian, uint64(n))
+	}
+	frame.Write(payload)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return errWebSocketClosed
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(frame.Bytes())
+	return err
+}
+
+// writeClose sends a close frame; nothing can be written after it.
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	err := c.writeFrame(wsOpClose, append(payload, reason...))
+	c.writeMu.Lock()
+	c.closed = true
+	c.writeMu.Unlock()
+	return err
+}
+
+// Close closes the underlying connection.
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// commandResponseWriter records the response of a command run over a WebSocket.
+type commandResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newCommandResponseWriter() *commandResponseWriter {
+	return &commandResponseWriter{header: make(http.Header), status: http.StatusOK}
+}
+
+func (cw *commandResponseWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *commandResponseWriter) WriteHeader(code int) {
+	cw.status = code
+}
+
+func (cw *commandResponseWriter) Write(b []byte) (int, error) {
+	return cw.body.Write(b)
+}
@@ -33,6 +33,7 @@ vi.mock("../../services/api.ts", () => ({
 vi.mock("../../services/auth.ts", () => ({
   registerUser: vi.fn(),
   loginUser: vi.fn(),
+  logoutUser: vi.fn(),
 }));
 
 import {
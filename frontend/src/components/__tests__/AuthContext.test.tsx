@@ -10,7 +10,7 @@ function TestComponent() {
     <div>
       <span data-testid="token">{token ?? "null"}</span>
       <span data-testid="auth">{isAuthenticated ? "yes" : "no"}</span>
-      <button onClick={() => login("test-token")}>Login</button>
+      <button onClick={() => login("test-token", "refresh-token")}>Login</button>
       <button onClick={logout}>Logout</button>
     </div>
   );
@@ -59,6 +59,7 @@ describe("AuthContext", () => {
     expect(screen.getByTestId("token").textContent).toBe("test-token");
     expect(screen.getByTestId("auth").textContent).toBe("yes");
     expect(localStorage.getItem("token")).toBe("test-token");
+    expect(localStorage.getItem("refreshToken")).toBe("refresh-token");
   });
 
   it("logout removes token from state and localStorage", async () => {
@@ -9,6 +9,7 @@ import { LoginPage } from "../../pages/LoginPage.tsx";
 vi.mock("../../services/auth.ts", () => ({
   loginUser: vi.fn(),
   registerUser: vi.fn(),
+  logoutUser: vi.fn(),
 }));
 
 import { loginUser } from "../../services/auth.ts";
@@ -62,7 +63,11 @@ describe("LoginPage", () => {
 
   it("calls loginUser on valid form submission", async () => {
     const user = userEvent.setup();
-    vi.mocked(loginUser).mockResolvedValue({ token: "jwt-token" });
+    vi.mocked(loginUser).mockResolvedValue({
+      token: "jwt-token",
+      refresh_token: "refresh-token",
+      expires_in: 900,
+    });
     renderLoginPage();
 
     await user.type(screen.getByLabelText("Email"), "test@test.com");
@@ -72,6 +77,8 @@ describe("LoginPage", () => {
     await waitFor(() => {
       expect(loginUser).toHaveBeenCalledWith("test@test.com", "password123");
     });
+    expect(localStorage.getItem("token")).toBe("jwt-token");
+    expect(localStorage.getItem("refreshToken")).toBe("refresh-token");
   });
 
   it("shows error on invalid credentials", async () => {
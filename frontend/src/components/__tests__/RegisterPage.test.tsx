@@ -9,6 +9,7 @@ import { RegisterPage } from "../../pages/RegisterPage.tsx";
 vi.mock("../../services/auth.ts", () => ({
   registerUser: vi.fn(),
   loginUser: vi.fn(),
+  logoutUser: vi.fn(),
 }));
 
 import { registerUser } from "../../services/auth.ts";
@@ -83,7 +84,11 @@ describe("RegisterPage", () => {
 
   it("calls registerUser on valid form submission", async () => {
     const user = userEvent.setup();
-    vi.mocked(registerUser).mockResolvedValue({ token: "jwt-token" });
+    vi.mocked(registerUser).mockResolvedValue({
+      token: "jwt-token",
+      refresh_token: "refresh-token",
+      expires_in: 900,
+    });
     renderRegisterPage();
 
     await user.type(screen.getByLabelText("Email"), "test@test.com");
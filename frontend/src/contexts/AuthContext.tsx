@@ -1,6 +1,7 @@
 import { createContext, useContext, useState, useCallback } from "react";
 import type { ReactNode } from "react";
 import type { AuthContextType } from "../types/auth.ts";
+import { logoutUser } from "../services/auth.ts";
 
 const AuthContext = createContext<AuthContextType | null>(null);
 
@@ -9,13 +10,22 @@ export function AuthProvider({ children }: { children: ReactNode }) {
     return localStorage.getItem("token");
   });
 
-  const login = useCallback((newToken: string) => {
+  const login = useCallback((newToken: string, refreshToken?: string) => {
     localStorage.setItem("token", newToken);
+    if (refreshToken) {
+      localStorage.setItem("refreshToken", refreshToken);
+    }
     setToken(newToken);
   }, []);
 
   const logout = useCallback(() => {
+    // End the session on the server too; the local logout does not wait for it.
+    const refreshToken = localStorage.getItem("refreshToken");
+    if (refreshToken) {
+      logoutUser(refreshToken).catch(() => {});
+    }
     localStorage.removeItem("token");
+    localStorage.removeItem("refreshToken");
     setToken(null);
   }, []);
 
@@ -26,8 +26,8 @@ export function LoginPage() {
 
     setLoading(true);
     try {
-      const { token } = await loginUser(email, password);
-      login(token);
+      const { token, refresh_token } = await loginUser(email, password);
+      login(token, refresh_token);
       navigate("/", { replace: true });
     } catch (err) {
       setError(err instanceof Error ? err.message : "Login failed");
@@ -31,8 +31,8 @@ export function RegisterPage() {
 
     setLoading(true);
     try {
-      const { token } = await registerUser(email, password);
-      login(token);
+      const { token, refresh_token } = await registerUser(email, password);
+      login(token, refresh_token);
       navigate("/", { replace: true });
     } catch (err) {
       setError(err instanceof Error ? err.message : "Registration failed");
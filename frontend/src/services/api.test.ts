@@ -110,6 +110,45 @@ describe("fetchTodos", () => {
     expect(localStorage.getItem("token")).toBeNull();
     expect(window.location.href).toBe("/login");
   });
+
+  it("refreshes the token and retries the request on 401", async () => {
+    localStorage.setItem("token", "expired-token");
+    localStorage.setItem("refreshToken", "refresh-token");
+    mockFetch
+      .mockResolvedValueOnce(jsonResponse({ error: "invalid or expired token" }, 401))
+      .mockResolvedValueOnce(
+        jsonResponse({ token: "new-token", refresh_token: "new-refresh-token", expires_in: 900 })
+      )
+      .mockResolvedValueOnce(jsonResponse([]));
+
+    const result = await fetchTodos();
+
+    expect(result).toEqual([]);
+    expect(mockFetch).toHaveBeenNthCalledWith(2, "http://localhost:8080/api/auth/refresh", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ refresh_token: "refresh-token" }),
+    });
+    expect(mockFetch).toHaveBeenLastCalledWith("http://localhost:8080/api/todos", {
+      headers: { "Content-Type": "application/json", Authorization: "Bearer new-token" },
+    });
+    expect(localStorage.getItem("token")).toBe("new-token");
+    expect(localStorage.getItem("refreshToken")).toBe("new-refresh-token");
+  });
+
+  it("redirects to login when the refresh fails", async () => {
+    localStorage.setItem("token", "expired-token");
+    localStorage.setItem("refreshToken", "revoked-token");
+    mockFetch
+      .mockResolvedValueOnce(jsonResponse({ error: "invalid or expired token" }, 401))
+      .mockResolvedValueOnce(jsonResponse({ error: "invalid or expired refresh token" }, 401));
+
+    await expect(fetchTodos()).rejects.toThrow("Session expired");
+    expect(mockFetch).toHaveBeenCalledTimes(2);
+    expect(localStorage.getItem("token")).toBeNull();
+    expect(localStorage.getItem("refreshToken")).toBeNull();
+    expect(window.location.href).toBe("/login");
+  });
 });
 
 // --- createTodo ---
@@ -1,5 +1,6 @@
 import type { List } from "../types/list";
 import type { Todo } from "../types/todo";
+import { refreshSession } from "./auth.ts";
 
 const API_BASE_URL = import.meta.env.VITE_API_URL || "http://localhost:8080/api";
 
@@ -16,10 +17,47 @@ function authHeaders(): Record<string, string> {
   return headers;
 }
 
+let refreshing: Promise<boolean> | null = null;
+
+// Exchanges the stored refresh token for a new token pair. Concurrent callers share one
+// request, since a refresh token can only be used once.
+function refreshAccessToken(): Promise<boolean> {
+  const refreshToken = localStorage.getItem("refreshToken");
+  if (!refreshToken) {
+    return Promise.resolve(false);
+  }
+  refreshing ??= refreshSession(refreshToken)
+    .then(({ token, refresh_token }) => {
+      localStorage.setItem("token", token);
+      localStorage.setItem("refreshToken", refresh_token);
+      return true;
+    })
+    .catch(() => false)
+    .finally(() => {
+      refreshing = null;
+    });
+  return refreshing;
+}
+
+// Sends an authenticated request. When the access token has expired, it is refreshed once and
+// the request retried.
+async function authFetch(url: string, init: RequestInit = {}): Promise<Response> {
+  const response = await fetch(url, { ...init, headers: authHeaders() });
+  if (response.status !== 401 || !(await refreshAccessToken())) {
+    return response;
+  }
+  return fetch(url, { ...init, headers: authHeaders() });
+}
+
+function clearSession(): void {
+  localStorage.removeItem("token");
+  localStorage.removeItem("refreshToken");
+  window.location.href = "/login";
+}
+
 async function handleResponse<T>(response: Response): Promise<T> {
   if (response.status === 401) {
-    localStorage.removeItem("token");
-    window.location.href = "/login";
+    clearSession();
     throw new Error("Session expired");
   }
   if (!response.ok) {
@@ -31,8 +69,7 @@ async function handleResponse<T>(response: Response): Promise<T> {
 
 async function handleVoidResponse(response: Response): Promise<void> {
   if (response.status === 401) {
-    localStorage.removeItem("token");
-    window.location.href = "/login";
+    clearSession();
     throw new Error("Session expired");
   }
   if (!response.ok) {
@@ -42,43 +79,37 @@ async function handleVoidResponse(response: Response): Promise<void> {
 }
 
 export async function fetchTodos(): Promise<Todo[]> {
-  const response = await fetch(`${API_BASE_URL}/todos`, {
-    headers: authHeaders(),
-  });
+  const response = await authFetch(`${API_BASE_URL}/todos`);
   return handleResponse<Todo[]>(response);
 }
 
 export async function createTodo(title: string): Promise<Todo> {
-  const response = await fetch(`${API_BASE_URL}/todos`, {
+  const response = await authFetch(`${API_BASE_URL}/todos`, {
     method: "POST",
-    headers: authHeaders(),
     body: JSON.stringify({ title }),
   });
   return handleResponse<Todo>(response);
 }
 
 export async function updateTodo(id: number, completed: boolean): Promise<void> {
-  const response = await fetch(`${API_BASE_URL}/todos/${id}`, {
+  const response = await authFetch(`${API_BASE_URL}/todos/${id}`, {
     method: "PATCH",
-    headers: authHeaders(),
     body: JSON.stringify({ completed }),
   });
   return handleVoidResponse(response);
 }
 
 export async function updateTodoTitle(id: number, title: string): Promise<void> {
-  const response = await fetch(`${API_BASE_URL}/todos/${id}/title`, {
+  const response = await authFetch(`${API_BASE_URL}/todos/${id}/title`, {
     method: "PATCH",
-    headers: authHeaders(),
     body: JSON.stringify({ title }),
   });
   return handleVoidResponse(response);
 }
 
 export async function deleteTodo(id: number): Promise<void> {
-  const response = await fetch(`${API_BASE_URL}/todos/${id}`, {
+  const response = await authFetch(`${API_BASE_URL}/todos/${id}`, {
     method: "DELETE",
-    headers: authHeaders(),
   });
   return handleVoidResponse(response);
 }
@@ -86,26 +117,20 @@ export async function deleteTodo(id: number): Promise<void> {
 // --- Lists ---
 
 export async function fetchLists(): Promise<List[]> {
-  const response = await fetch(`${API_BASE_URL}/lists`, {
-    headers: authHeaders(),
-  });
+  const response = await authFetch(`${API_BASE_URL}/lists`);
   return handleResponse<List[]>(response);
 }
 
 export async function fetchTodosByList(listId: number): Promise<Todo[]> {
-  const response = await fetch(
-    `${API_BASE_URL}/todos?list_id=${encodeURIComponent(listId)}`,
-    {
-      headers: authHeaders(),
-    }
+  const response = await authFetch(
+    `${API_BASE_URL}/todos?list_id=${encodeURIComponent(listId)}`
   );
   return handleResponse<Todo[]>(response);
 }
 
 export async function createList(name: string, color: string): Promise<List> {
-  const response = await fetch(`${API_BASE_URL}/lists`, {
+  const response = await authFetch(`${API_BASE_URL}/lists`, {
     method: "POST",
-    headers: authHeaders(),
     body: JSON.stringify({ name, color }),
   });
   return handleResponse<List>(response);
@@ -116,18 +141,16 @@ export async function updateList(
   name: string,
   color: string
 ): Promise<void> {
-  const response = await fetch(`${API_BASE_URL}/lists/${id}`, {
+  const response = await authFetch(`${API_BASE_URL}/lists/${id}`, {
     method: "PATCH",
-    headers: authHeaders(),
     body: JSON.stringify({ name, color }),
   });
   return handleVoidResponse(response);
 }
 
 export async function deleteList(id: number): Promise<void> {
-  const response = await fetch(`${API_BASE_URL}/lists/${id}`, {
+  const response = await authFetch(`${API_BASE_URL}/lists/${id}`, {
     method: "DELETE",
-    headers: authHeaders(),
   });
   return handleVoidResponse(response);
 }
@@ -136,9 +159,8 @@ export async function createTodoInList(
   listId: number,
   title: string
 ): Promise<Todo> {
-  const response = await fetch(`${API_BASE_URL}/lists/${listId}/todos`, {
+  const response = await authFetch(`${API_BASE_URL}/lists/${listId}/todos`, {
     method: "POST",
-    headers: authHeaders(),
     body: JSON.stringify({ title }),
   });
   return handleResponse<Todo>(response);
@@ -148,11 +170,10 @@ export async function addListToTodo(
   todoId: number,
   listId: number
 ): Promise<void> {
-  const response = await fetch(
+  const response = await authFetch(
     `${API_BASE_URL}/todos/${todoId}/lists/${listId}`,
     {
       method: "POST",
-      headers: authHeaders(),
     }
   );
   return handleVoidResponse(response);
@@ -162,11 +183,10 @@ export async function removeListFromTodo(
   todoId: number,
   listId: number
 ): Promise<void> {
-  const response = await fetch(
+  const response = await authFetch(
     `${API_BASE_URL}/todos/${todoId}/lists/${listId}`,
     {
       method: "DELETE",
-      headers: authHeaders(),
     }
   );
   return handleVoidResponse(response);
@@ -1,5 +1,7 @@
 import { describe, it, expect, vi, beforeEach } from "vitest";
-import { registerUser, loginUser } from "./auth.ts";
+import { registerUser, loginUser, refreshSession, logoutUser } from "./auth.ts";
+
+const tokens = { token: "jwt-token", refresh_token: "refresh-token", expires_in: 900 };
 
 const mockFetch = vi.fn();
 globalThis.fetch = mockFetch;
@@ -18,11 +20,11 @@ beforeEach(() => {
 
 describe("registerUser", () => {
   it("sends POST to register endpoint and returns token", async () => {
-    mockFetch.mockResolvedValueOnce(jsonResponse({ token: "jwt-token" }, 201));
+    mockFetch.mockResolvedValueOnce(jsonResponse(tokens, 201));
 
     const result = await registerUser("user@test.com", "password123");
 
-    expect(result).toEqual({ token: "jwt-token" });
+    expect(result).toEqual(tokens);
     expect(mockFetch).toHaveBeenCalledWith(
       "http://localhost:8080/api/auth/register",
       {
@@ -56,11 +58,11 @@ describe("registerUser", () => {
 
 describe("loginUser", () => {
   it("sends POST to login endpoint and returns token", async () => {
-    mockFetch.mockResolvedValueOnce(jsonResponse({ token: "jwt-token" }, 200));
+    mockFetch.mockResolvedValueOnce(jsonResponse(tokens, 200));
 
     const result = await loginUser("user@test.com", "password123");
 
-    expect(result).toEqual({ token: "jwt-token" });
+    expect(result).toEqual(tokens);
     expect(mockFetch).toHaveBeenCalledWith(
       "http://localhost:8080/api/auth/login",
       {
@@ -81,3 +83,48 @@ describe("loginUser", () => {
     );
   });
 });
+
+describe("refreshSession", () => {
+  it("sends POST to refresh endpoint and returns the new tokens", async () => {
+    mockFetch.mockResolvedValueOnce(jsonResponse(tokens, 200));
+
+    const result = await refreshSession("old-refresh-token");
+
+    expect(result).toEqual(tokens);
+    expect(mockFetch).toHaveBeenCalledWith(
+      "http://localhost:8080/api/auth/refresh",
+      {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ refresh_token: "old-refresh-token" }),
+      }
+    );
+  });
+
+  it("throws error on 401 unauthorized", async () => {
+    mockFetch.mockResolvedValueOnce(
+      jsonResponse({ error: "invalid or expired refresh token" }, 401)
+    );
+
+    await expect(refreshSession("stale")).rejects.toThrow(
+      "invalid or expired refresh token"
+    );
+  });
+});
+
+describe("logoutUser", () => {
+  it("sends POST to logout endpoint with the refresh token", async () => {
+    mockFetch.mockResolvedValueOnce({ ok: true, status: 204 } as Response);
+
+    await logoutUser("refresh-token");
+
+    expect(mockFetch).toHaveBeenCalledWith(
+      "http://localhost:8080/api/auth/logout",
+      {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ refresh_token: "refresh-token" }),
+      }
+    );
+  });
+});
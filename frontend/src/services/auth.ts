@@ -31,3 +31,31 @@ export async function loginUser(email: string, password: string): Promise<AuthRe
 
   return response.json() as Promise<AuthResponse>;
 }
+
+export async function refreshSession(refreshToken: string): Promise<AuthResponse> {
+  const response = await fetch(`${API_BASE_URL}/auth/refresh`, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ refresh_token: refreshToken }),
+  });
+
+  if (!response.ok) {
+    const body = await response.json().catch(() => ({ error: "Unknown error" }));
+    throw new Error(body.error || "Unknown error");
+  }
+
+  return response.json() as Promise<AuthResponse>;
+}
+
+export async function logoutUser(refreshToken: string): Promise<void> {
+  const response = await fetch(`${API_BASE_URL}/auth/logout`, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ refresh_token: refreshToken }),
+  });
+
+  if (!response.ok) {
+    const body = await response.json().catch(() => ({ error: "Unknown error" }));
+    throw new Error(body.error || "Unknown error");
+  }
+}
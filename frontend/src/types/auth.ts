@@ -1,10 +1,22 @@
 export interface AuthResponse {
   token: string;
+  refresh_token: string;
+  expires_in: number;
+}
+
+export interface Session {
+  id: number;
+  created_at: string;
+  last_used_at: string;
+  expires_at: string;
+  user_agent: string;
+  ip: string;
+  current: boolean;
 }
 
 export interface AuthContextType {
   token: string | null;
   isAuthenticated: boolean;
-  login: (token: string) => void;
+  login: (token: string, refreshToken?: string) => void;
   logout: () => void;
 }
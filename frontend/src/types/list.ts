@@ -3,6 +3,17 @@ export interface List {
   name: string;
   color: string;
   created_at: string;
+  position?: number;
+  pinned?: boolean;
+  version?: number;
+  updated_at?: string;
+}
+
+export interface SmartList {
+  id: number;
+  name: string;
+  filter: string;
+  created_at: string;
 }
 
 export const PASTEL_COLORS = [
@@ -5,5 +5,81 @@ export interface Todo {
   title: string;
   completed: boolean;
   created_at: string;
+  due_at?: string;
+  start_at?: string;
+  priority?: "none" | "low" | "medium" | "high" | "urgent";
+  notes?: string;
+  progress?: { done: number; total: number };
+  recurrence?: string;
+  version?: number;
+  updated_at?: string;
+  deleted_at?: string;
   lists?: List[];
 }
+
+export interface SearchResult extends Todo {
+  snippet: string;
+}
+
+export interface BulkResult {
+  id: number;
+  status: number;
+  error?: string;
+}
+
+export interface TodoListLink {
+  todo_id: number;
+  list_id: number;
+}
+
+export interface SyncChanges {
+  token: string;
+  todos: Todo[];
+  lists: List[];
+  todo_lists: TodoListLink[];
+  deleted: {
+    todos: number[];
+    lists: number[];
+    todo_lists: TodoListLink[];
+  };
+}
+
+export interface SyncPushResult {
+  client_id?: string;
+  id?: number;
+  status: number;
+  error?: string;
+  todo?: Todo;
+}
+
+export type ChangeEventType =
+  | "todo.changed"
+  | "todo.deleted"
+  | "list.changed"
+  | "list.deleted"
+  | "todo_list.added"
+  | "todo_list.removed"
+  | "reset";
+
+export interface SocketCommand {
+  id: string;
+  method: "GET" | "POST" | "PATCH" | "DELETE";
+  path: string;
+  headers?: Record<string, string>;
+  body?: unknown;
+}
+
+export type SocketMessage =
+  | {
+      type: "response";
+      id: string;
+      status: number;
+      headers?: Record<string, string>;
+      body?: unknown;
+    }
+  | {
+      type: "event";
+      event: ChangeEventType;
+      event_id?: number;
+      data: unknown;
+    };